@@ -0,0 +1,161 @@
+// Package adminapi describes chatmaild's admin API, and has a client for it.
+//
+// chatmaild serves the API as HTTP+JSON on its admin socket, which is a unix
+// socket that only root and chatmaild's own user may use. Every path starts
+// with the API version, so that clients written against one version keep
+// working when the next one comes along. openapi.json describes the API in
+// full; chatmaild also serves it at /v1/openapi.json.
+package adminapi
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version is the version of the API that this package speaks, and the first
+// element of every path.
+const Version = "v1"
+
+// OpenAPI is the OpenAPI 3 description of the API.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Account describes an account, or a blocked address that has none. Times
+// that aren't known are left out.
+type Account struct {
+	Address      string     `json:"address"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastLogin    *time.Time `json:"last_login,omitempty"`
+	MailboxBytes int64      `json:"mailbox_bytes"`
+	Blocked      bool       `json:"blocked"`
+}
+
+type AccountList struct {
+	Accounts []Account `json:"accounts"`
+}
+
+// AccountRequest creates an account. Unlike a first login, it may use
+// reserved usernames, such as those of OperatorMailbox and the passthrough
+// addresses.
+type AccountRequest struct {
+	Password string `json:"password"`
+}
+
+type ExpireRequest struct {
+	// Addresses to remove old mail from. Empty means every account.
+	Addresses []string `json:"addresses,omitempty"`
+	// Days is how old the mail that's removed has to be. Zero means
+	// DeleteMailsAfterDays from the configuration.
+	Days int `json:"days,omitempty"`
+}
+
+type ExpireResult struct {
+	// Expired is how many messages were removed.
+	Expired int `json:"expired"`
+}
+
+// Quotas are the limits that apply to every account, and how close each
+// account is to its mailbox limit.
+type Quotas struct {
+	MaxMailboxBytes    int64        `json:"max_mailbox_bytes"`
+	MaxMessageBytes    int64        `json:"max_message_bytes"`
+	MaxEmailsPerMinute int          `json:"max_emails_per_minute"`
+	Usage              []QuotaUsage `json:"usage"`
+}
+
+type QuotaUsage struct {
+	Address      string  `json:"address"`
+	MailboxBytes int64   `json:"mailbox_bytes"`
+	Percent      float64 `json:"percent"`
+}
+
+// PolicyStats counts what the milter and the SASL server have done since
+// chatmaild started.
+type PolicyStats struct {
+	// Decisions counts messages by what the milter decided and why.
+	Decisions map[string]uint64 `json:"decisions"`
+	// Unenforced counts the rejections that monitor-only mode let through.
+	Unenforced  map[string]uint64 `json:"unenforced"`
+	RateLimited uint64            `json:"rate_limited"`
+	Logins      map[string]uint64 `json:"logins"`
+	// Lockouts counts the networks and accounts that have been locked out
+	// after too many failed logins, by scope.
+	Lockouts           map[string]uint64 `json:"lockouts"`
+	AccountsCreated    uint64            `json:"accounts_created"`
+	MonitorOnly        bool              `json:"monitor_only"`
+	MonitorOnlyDomains []string          `json:"monitor_only_domains"`
+}
+
+// Invite is an invite token, which InviteOnly servers need for creating an
+// account.
+type Invite struct {
+	Token   string     `json:"token"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	MaxUses int        `json:"max_uses"`
+	Uses    int        `json:"uses"`
+	Note    string     `json:"note,omitempty"`
+}
+
+type InviteList struct {
+	Invites []Invite `json:"invites"`
+}
+
+type InviteRequest struct {
+	// ExpiresInSeconds of zero makes an invite that never expires.
+	ExpiresInSeconds int64  `json:"expires_in_seconds,omitempty"`
+	MaxUses          int    `json:"max_uses"`
+	Note             string `json:"note,omitempty"`
+}
+
+// Lockout is a network or account that can't log in for now, because
+// there were too many failed logins from or for it.
+type Lockout struct {
+	// Key is the account's address, or the IP address of the network: an
+	// IPv4 address, or the start of an IPv6 /64.
+	Key   string    `json:"key"`
+	Scope string    `json:"scope"`
+	Until time.Time `json:"until"`
+	// Lockouts in a row; each one makes a network's next lockout longer.
+	// For accounts, the lockouts in the last LoginMaxLockoutSeconds.
+	Lockouts int `json:"lockouts"`
+}
+
+type LockoutList struct {
+	Lockouts []Lockout `json:"lockouts"`
+}
+
+// ReloadResult says which settings changed when the configuration was
+// reloaded. The ones that only take effect on a restart keep their old
+// values until then.
+type ReloadResult struct {
+	Changed      []string `json:"changed"`
+	NeedsRestart []string `json:"needs_restart"`
+}
+
+// Error is what the API returns when a request fails.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// SocketPath finds the path of the admin socket in a listen address like
+// AdminListenAddress.
+func SocketPath(listen_uri string) (string, error) {
+	scheme, rest, found := strings.Cut(listen_uri, "://")
+	if !found || scheme != "unix" {
+		return "", fmt.Errorf("can't connect to admin socket %q: only unix:// addresses are supported", listen_uri)
+	}
+	path, _, _ := strings.Cut(rest, "?")
+	if path == "" {
+		return "", fmt.Errorf("admin socket %q has no path", listen_uri)
+	}
+	return path, nil
+}
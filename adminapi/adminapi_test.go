@@ -0,0 +1,135 @@
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type openapi_schema struct {
+	Properties map[string]json.RawMessage `json:"properties"`
+	Required   []string                   `json:"required"`
+}
+
+func load_openapi(t *testing.T) map[string]openapi_schema {
+	t.Helper()
+	var doc struct {
+		Components struct {
+			Schemas map[string]openapi_schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		t.Fatalf("openapi.json isn't valid JSON: %v", err)
+	}
+	return doc.Components.Schemas
+}
+
+// TestOpenAPIMatchesTypes checks that every type in the API has a schema with
+// the same fields, which are required unless they can be left out.
+func TestOpenAPIMatchesTypes(t *testing.T) {
+	schemas := load_openapi(t)
+	for _, v := range []any{
+		Account{}, AccountList{}, AccountRequest{}, ExpireRequest{}, ExpireResult{}, Quotas{}, QuotaUsage{},
+		PolicyStats{}, Invite{}, InviteList{}, InviteRequest{}, Lockout{}, LockoutList{}, ReloadResult{}, Error{},
+	} {
+		typ := reflect.TypeOf(v)
+		schema, found := schemas[typ.Name()]
+		if !found {
+			t.Errorf("openapi.json has no schema for %s", typ.Name())
+			continue
+		}
+		var fields, required []string
+		for i := range typ.NumField() {
+			name, options, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			fields = append(fields, name)
+			if options != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		var properties []string
+		for name := range schema.Properties {
+			properties = append(properties, name)
+		}
+		slices.Sort(fields)
+		slices.Sort(properties)
+		if !slices.Equal(fields, properties) {
+			t.Errorf("openapi.json schema for %s has properties %v; want %v", typ.Name(), properties, fields)
+		}
+		slices.Sort(required)
+		slices.Sort(schema.Required)
+		if !slices.Equal(required, schema.Required) {
+			t.Errorf("openapi.json schema for %s requires %v; want %v", typ.Name(), schema.Required, required)
+		}
+	}
+}
+
+func TestOpenAPIReferences(t *testing.T) {
+	var doc map[string]any
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range regexp.MustCompile(`"\$ref": "#/([^"]+)"`).FindAllSubmatch(OpenAPI, -1) {
+		var node any = doc
+		for _, part := range strings.Split(string(ref[1]), "/") {
+			m, ok := node.(map[string]any)
+			if !ok {
+				node = nil
+				break
+			}
+			node = m[part]
+		}
+		if node == nil {
+			t.Errorf("openapi.json refers to #/%s, which doesn't exist", ref[1])
+		}
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	for _, tc := range []struct {
+		uri  string
+		want string
+	}{
+		{"unix:///run/chatmail/admin.sock?mode=0600", "/run/chatmail/admin.sock"},
+		{"unix:///tmp/admin.sock", "/tmp/admin.sock"},
+		{"systemd://admin", ""},
+		{"tcp://127.0.0.1:1234", ""},
+		{"unix://", ""},
+	} {
+		got, err := SocketPath(tc.uri)
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("SocketPath(%q) = %q, %v; want %q", tc.uri, got, err, tc.want)
+		}
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/accounts/nobody@chat.example":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(Error{Message: "account does not exist"})
+		default:
+			http.Error(w, "teapot", http.StatusTeapot)
+		}
+	}))
+	defer server.Close()
+	client := NewHTTPClient(server.URL, server.Client())
+
+	_, err := client.Account(context.Background(), "nobody@chat.example")
+	if !IsNotFound(err) || err.Error() != "account does not exist" {
+		t.Fatalf("Account() of a missing account = %v; want the API's not found error", err)
+	}
+	_, err = client.Quotas(context.Background())
+	if IsNotFound(err) || err == nil || !strings.Contains(err.Error(), "418") {
+		t.Fatalf("Quotas() from a teapot = %v; want an error with the HTTP status", err)
+	}
+}
@@ -0,0 +1,181 @@
+package adminapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client calls chatmaild's admin API.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// NewClient makes a client that connects to the admin socket at path.
+func NewClient(path string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	// The host is ignored, since every request goes to the socket.
+	return NewHTTPClient("http://chatmaild", &http.Client{Transport: transport, Timeout: 10 * time.Minute})
+}
+
+// NewHTTPClient makes a client that sends requests to base through hc, for
+// when the API is reached some other way, like through a proxy.
+func NewHTTPClient(base string, hc *http.Client) *Client {
+	return &Client{base: base, http: hc}
+}
+
+// IsNotFound reports whether err is the API saying that what it was asked
+// about doesn't exist.
+func IsNotFound(err error) bool {
+	var api_err *Error
+	return errors.As(err, &api_err) && api_err.StatusCode == http.StatusNotFound
+}
+
+// do sends in (if there is one) as JSON, and decodes the response into out
+// (if there is one).
+func (c *Client) do(ctx context.Context, method string, path string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+"/"+Version+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		api_err := &Error{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(api_err); err != nil || api_err.Message == "" {
+			api_err.Message = fmt.Sprintf("%s %s: %s", method, path, resp.Status)
+		}
+		return api_err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+	}
+	return nil
+}
+
+func account_path(address string) string {
+	return "/accounts/" + url.PathEscape(address)
+}
+
+// Accounts describes every account and blocked address.
+func (c *Client) Accounts(ctx context.Context) ([]Account, error) {
+	var list AccountList
+	err := c.do(ctx, http.MethodGet, "/accounts", nil, &list)
+	return list.Accounts, err
+}
+
+// Account describes one account.
+func (c *Client) Account(ctx context.Context, address string) (Account, error) {
+	var account Account
+	err := c.do(ctx, http.MethodGet, account_path(address), nil, &account)
+	return account, err
+}
+
+// CreateAccount makes an account for address with password.
+func (c *Client) CreateAccount(ctx context.Context, address string, password string) (Account, error) {
+	var account Account
+	err := c.do(ctx, http.MethodPut, account_path(address), AccountRequest{Password: password}, &account)
+	return account, err
+}
+
+// DeleteAccount removes an account along with all of its mail. A blocked
+// address stays blocked.
+func (c *Client) DeleteAccount(ctx context.Context, address string) error {
+	return c.do(ctx, http.MethodDelete, account_path(address), nil, nil)
+}
+
+// Block stops address from logging in, or from being created if there's no
+// account for it yet.
+func (c *Client) Block(ctx context.Context, address string) error {
+	return c.do(ctx, http.MethodPut, account_path(address)+"/blocked", nil, nil)
+}
+
+// Unblock undoes Block.
+func (c *Client) Unblock(ctx context.Context, address string) error {
+	return c.do(ctx, http.MethodDelete, account_path(address)+"/blocked", nil, nil)
+}
+
+// Expire removes old mail, and returns how many messages it removed.
+func (c *Client) Expire(ctx context.Context, req ExpireRequest) (int, error) {
+	var result ExpireResult
+	err := c.do(ctx, http.MethodPost, "/expire", req, &result)
+	return result.Expired, err
+}
+
+func (c *Client) Quotas(ctx context.Context) (Quotas, error) {
+	var quotas Quotas
+	err := c.do(ctx, http.MethodGet, "/quotas", nil, &quotas)
+	return quotas, err
+}
+
+func (c *Client) Stats(ctx context.Context) (PolicyStats, error) {
+	var stats PolicyStats
+	err := c.do(ctx, http.MethodGet, "/stats", nil, &stats)
+	return stats, err
+}
+
+func (c *Client) Invites(ctx context.Context) ([]Invite, error) {
+	var list InviteList
+	err := c.do(ctx, http.MethodGet, "/invites", nil, &list)
+	return list.Invites, err
+}
+
+func (c *Client) CreateInvite(ctx context.Context, req InviteRequest) (Invite, error) {
+	var invite Invite
+	err := c.do(ctx, http.MethodPost, "/invites", req, &invite)
+	return invite, err
+}
+
+func (c *Client) RevokeInvite(ctx context.Context, token string) error {
+	return c.do(ctx, http.MethodDelete, "/invites/"+url.PathEscape(token), nil, nil)
+}
+
+// Lockouts lists the networks and accounts that can't log in for now.
+func (c *Client) Lockouts(ctx context.Context) ([]Lockout, error) {
+	var list LockoutList
+	err := c.do(ctx, http.MethodGet, "/lockouts", nil, &list)
+	return list.Lockouts, err
+}
+
+// ClearLockout lets the account or the network of the IP address in key
+// log in again, and forgets its failed logins.
+func (c *Client) ClearLockout(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/lockouts/"+url.PathEscape(key), nil, nil)
+}
+
+// ReloadConfig makes chatmaild read its configuration again.
+func (c *Client) ReloadConfig(ctx context.Context) (ReloadResult, error) {
+	var result ReloadResult
+	err := c.do(ctx, http.MethodPost, "/config/reload", nil, &result)
+	return result, err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Chatmail servers always offer implicit TLS and STARTTLS on the standard
+// ports. Port 443 isn't offered: nothing serves IMAP or SMTP on it yet, and
+// the clients that use autoconfig wouldn't send the ALPN protocol that it
+// will need to tell them apart from HTTPS.
+const (
+	imap_tls_port      = 993
+	imap_starttls_port = 143
+	smtp_tls_port      = 465
+	smtp_starttls_port = 587
+)
+
+const auth_method = "password-cleartext"
+
+type mail_server struct {
+	Protocol   string
+	Hostname   string
+	Port       int
+	SocketType string
+}
+
+func incoming_servers(cm_config config.ChatmailConfig) []mail_server {
+	host := cm_config.MailFullyQualifiedDomainName
+	return []mail_server{
+		{"imap", host, imap_tls_port, "SSL"},
+		{"imap", host, imap_starttls_port, "STARTTLS"},
+	}
+}
+
+func outgoing_servers(cm_config config.ChatmailConfig) []mail_server {
+	host := cm_config.MailFullyQualifiedDomainName
+	return []mail_server{
+		{"smtp", host, smtp_tls_port, "SSL"},
+		{"smtp", host, smtp_starttls_port, "STARTTLS"},
+	}
+}
+
+// MARK: Thunderbird autoconfig
+
+type tb_client_config struct {
+	XMLName       xml.Name          `xml:"clientConfig"`
+	Version       string            `xml:"version,attr"`
+	EmailProvider tb_email_provider `xml:"emailProvider"`
+}
+
+type tb_email_provider struct {
+	ID               string      `xml:"id,attr"`
+	Domain           string      `xml:"domain"`
+	DisplayName      string      `xml:"displayName"`
+	DisplayShortName string      `xml:"displayShortName"`
+	IncomingServers  []tb_server `xml:"incomingServer"`
+	OutgoingServers  []tb_server `xml:"outgoingServer"`
+}
+
+type tb_server struct {
+	Type           string `xml:"type,attr"`
+	Hostname       string `xml:"hostname"`
+	Port           int    `xml:"port"`
+	SocketType     string `xml:"socketType"`
+	Authentication string `xml:"authentication"`
+	Username       string `xml:"username"`
+}
+
+func make_tb_servers(servers []mail_server) []tb_server {
+	result := make([]tb_server, 0, len(servers))
+	for _, s := range servers {
+		result = append(result, tb_server{
+			Type:           s.Protocol,
+			Hostname:       s.Hostname,
+			Port:           s.Port,
+			SocketType:     s.SocketType,
+			Authentication: auth_method,
+			Username:       "%EMAILADDRESS%",
+		})
+	}
+	return result
+}
+
+func make_autoconfig(cm_config config.ChatmailConfig) tb_client_config {
+	fqdn := cm_config.MailFullyQualifiedDomainName
+	return tb_client_config{
+		Version: "1.1",
+		EmailProvider: tb_email_provider{
+			ID:               fqdn,
+			Domain:           fqdn,
+			DisplayName:      fqdn + " chatmail",
+			DisplayShortName: fqdn,
+			IncomingServers:  make_tb_servers(incoming_servers(cm_config)),
+			OutgoingServers:  make_tb_servers(outgoing_servers(cm_config)),
+		},
+	}
+}
+
+func autoconfig_handler(cm_config config.ChatmailConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		write_xml(w, make_autoconfig(cm_config))
+	}
+}
+
+// MARK: Microsoft autodiscover
+
+const (
+	ad_response_ns = "http://schemas.microsoft.com/exchange/autodiscover/responseschema/2006"
+	ad_outlook_ns  = "http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a"
+)
+
+type ad_request struct {
+	XMLName      xml.Name `xml:"Autodiscover"`
+	EMailAddress string   `xml:"Request>EMailAddress"`
+}
+
+type ad_autodiscover struct {
+	XMLName  xml.Name    `xml:"Autodiscover"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Response ad_response `xml:"Response"`
+}
+
+type ad_response struct {
+	Xmlns   string     `xml:"xmlns,attr"`
+	Account ad_account `xml:"Account"`
+}
+
+type ad_account struct {
+	AccountType string        `xml:"AccountType"`
+	Action      string        `xml:"Action"`
+	Protocols   []ad_protocol `xml:"Protocol"`
+}
+
+type ad_protocol struct {
+	Type           string `xml:"Type"`
+	Server         string `xml:"Server"`
+	Port           int    `xml:"Port"`
+	LoginName      string `xml:"LoginName,omitempty"`
+	DomainRequired string `xml:"DomainRequired"`
+	SPA            string `xml:"SPA"`
+	SSL            string `xml:"SSL"`
+	Encryption     string `xml:"Encryption,omitempty"`
+	AuthRequired   string `xml:"AuthRequired"`
+}
+
+func on_off(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func make_autodiscover(cm_config config.ChatmailConfig, email string) ad_autodiscover {
+	servers := append(incoming_servers(cm_config), outgoing_servers(cm_config)...)
+	protocols := make([]ad_protocol, 0, len(servers))
+	for _, s := range servers {
+		p := ad_protocol{
+			Type:           strings.ToUpper(s.Protocol),
+			Server:         s.Hostname,
+			Port:           s.Port,
+			LoginName:      email,
+			DomainRequired: on_off(false),
+			SPA:            on_off(false),
+			SSL:            on_off(true),
+			AuthRequired:   on_off(true),
+		}
+		if s.SocketType == "STARTTLS" {
+			p.Encryption = "TLS"
+		}
+		protocols = append(protocols, p)
+	}
+	return ad_autodiscover{
+		Xmlns: ad_response_ns,
+		Response: ad_response{
+			Xmlns: ad_outlook_ns,
+			Account: ad_account{
+				AccountType: "email",
+				Action:      "settings",
+				Protocols:   protocols,
+			},
+		},
+	}
+}
+
+func autodiscover_handler(cm_config config.ChatmailConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Outlook POSTs the address it's configuring, but a bare GET is
+		// also answered so that the endpoint can be checked in a browser.
+		var ad_req ad_request
+		if req.Method == http.MethodPost {
+			body, err := io.ReadAll(io.LimitReader(req.Body, 64*1024))
+			if err != nil {
+				http.Error(w, "failed to read request", http.StatusBadRequest)
+				return
+			}
+			// A malformed request still gets the generic settings.
+			_ = xml.Unmarshal(body, &ad_req)
+		}
+		write_xml(w, make_autodiscover(cm_config, ad_req.EMailAddress))
+	}
+}
+
+func write_xml(w http.ResponseWriter, v any) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("failed to render XML: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	w.Write(out)
+	io.WriteString(w, "\n")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update_golden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func check_golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update_golden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("output for %s does not match golden file:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func serve(h http.HandlerFunc, method string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestAutoconfigGolden(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	rec := serve(autoconfig_handler(cfg), http.MethodGet, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("autoconfig status = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/xml") {
+		t.Fatalf("autoconfig Content-Type = %q; want application/xml", ct)
+	}
+	check_golden(t, "config-v1.1.xml", rec.Body.Bytes())
+}
+
+func TestAutodiscoverGolden(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	rec := serve(autodiscover_handler(cfg), http.MethodGet, "")
+	check_golden(t, "autodiscover.xml", rec.Body.Bytes())
+
+	request := `<?xml version="1.0" encoding="utf-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/requestschema/2006">
+  <Request>
+    <EMailAddress>ac_1234@chat.example</EMailAddress>
+    <AcceptableResponseSchema>http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a</AcceptableResponseSchema>
+  </Request>
+</Autodiscover>`
+	rec = serve(autodiscover_handler(cfg), http.MethodPost, request)
+	check_golden(t, "autodiscover-with-address.xml", rec.Body.Bytes())
+
+	rec = serve(autodiscover_handler(cfg), http.MethodPost, "not xml")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("autodiscover with garbage request status = %d; want %d", rec.Code, http.StatusOK)
+	}
+}
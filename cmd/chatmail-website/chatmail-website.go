@@ -1,7 +1,12 @@
 package main
 
 import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/invite"
+
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 )
@@ -16,7 +21,28 @@ func main() {
 	if len(port_str) < 1 {
 		port_str = "80"
 	}
-	http.HandleFunc("/", index)
+	var default_config_file = os.Getenv("CM_WEB_CONFIG")
+	if len(default_config_file) < 1 {
+		default_config_file = "chatmail.json"
+	}
+	config_file := flag.String("config", default_config_file, "path to the chatmail server configuration file, or \"\" to configure chatmail only with CHATMAIL_* environment variables and flags")
+	overrides := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	cm_config, _, err := config.DefaultLoader(*config_file, overrides).Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// CM_WEB_ROOT is the website built by cmdeploy.
+	if web_root := os.Getenv("CM_WEB_ROOT"); web_root != "" {
+		http.Handle("/", http.FileServer(http.Dir(web_root)))
+	} else {
+		http.HandleFunc("/", index)
+	}
+	http.HandleFunc("/new", new_account_handler(cm_config, invite.NewStore(cm_config.InviteTokensFile)))
+	http.HandleFunc("/.well-known/autoconfig/mail/config-v1.1.xml", autoconfig_handler(cm_config))
+	http.HandleFunc("/mail/config-v1.1.xml", autoconfig_handler(cm_config))
+	http.HandleFunc("/autodiscover/autodiscover.xml", autodiscover_handler(cm_config))
+	http.HandleFunc("/Autodiscover/Autodiscover.xml", autodiscover_handler(cm_config))
 	var listen_spec = fmt.Sprintf(":%s", port_str)
 	http.ListenAndServe(listen_spec, nil)
 }
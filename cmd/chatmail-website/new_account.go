@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/invite"
+	"github.com/s0ph0s-dog/gochatmail/internal/usernames"
+
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	username_charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	password_charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+type new_account_response struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func random_string(charset string, length int) (string, error) {
+	limit := big.NewInt(int64(len(charset)))
+	var result strings.Builder
+	for i := 0; i < length; i++ {
+		choice, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		result.WriteByte(charset[choice.Int64()])
+	}
+	return result.String(), nil
+}
+
+// make_credentials invents an address and password for a new account. The
+// account itself is only created by chatmaild when the client first logs in.
+func make_credentials(cm_config config.ChatmailConfig, token string) (new_account_response, error) {
+	user, err := random_username(cm_config)
+	if err != nil {
+		return new_account_response{}, err
+	}
+	password, err := random_string(password_charset, cm_config.PasswordMinLength+3)
+	if err != nil {
+		return new_account_response{}, err
+	}
+	if token != "" {
+		password = token + invite.TokenPasswordSeparator + password
+	}
+	return new_account_response{
+		Email:    user + "@" + cm_config.MailFullyQualifiedDomainName,
+		Password: password,
+	}, nil
+}
+
+// random_username picks a username that chatmaild will let the client
+// register, which only takes more than one try if ReservedUsernames has
+// broad patterns.
+func random_username(cm_config config.ChatmailConfig) (string, error) {
+	for range 100 {
+		user, err := random_string(username_charset, cm_config.UsernameMaxLength)
+		if err != nil {
+			return "", err
+		}
+		if usernames.Check(cm_config, user, nil) == nil {
+			return user, nil
+		}
+	}
+	return "", errors.New("every username tried was reserved; check ReservedUsernames")
+}
+
+// new_account_handler serves the DCACCOUNT endpoint that Delta Chat uses to
+// get credentials for a new profile. In invite mode, the token from the
+// invite QR code is checked here and redeemed by chatmaild on first login.
+func new_account_handler(cm_config config.ChatmailConfig, invites *invite.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := ""
+		if cm_config.InviteOnly {
+			token = req.URL.Query().Get("token")
+			if err := invites.Check(token, time.Now()); err != nil {
+				http.Error(w, "a valid invite is required to create an account", http.StatusForbidden)
+				return
+			}
+		}
+		creds, err := make_credentials(cm_config, token)
+		if err != nil {
+			log.Printf("failed to generate credentials: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(creds)
+	}
+}
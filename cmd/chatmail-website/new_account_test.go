@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/invite"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func request_new_account(h http.HandlerFunc, target string) (*httptest.ResponseRecorder, new_account_response) {
+	req := httptest.NewRequest(http.MethodPost, target, nil)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	var creds new_account_response
+	json.Unmarshal(rec.Body.Bytes(), &creds)
+	return rec, creds
+}
+
+func TestNewAccountOpenRegistration(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	invites := invite.NewStore(filepath.Join(t.TempDir(), "invites.json"))
+	rec, creds := request_new_account(new_account_handler(cfg, invites), "/new")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/new status = %d; want %d", rec.Code, http.StatusOK)
+	}
+	localpart, domain, _ := strings.Cut(creds.Email, "@")
+	if len(localpart) != cfg.UsernameMaxLength || domain != "chat.example" {
+		t.Fatalf("/new email = %q; want %d characters @chat.example", creds.Email, cfg.UsernameMaxLength)
+	}
+	if len(creds.Password) < cfg.PasswordMinLength {
+		t.Fatalf("/new password = %q; want at least %d characters", creds.Password, cfg.PasswordMinLength)
+	}
+}
+
+func TestNewAccountInviteOnly(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.InviteOnly = true
+	invites := invite.NewStore(filepath.Join(t.TempDir(), "invites.json"))
+	h := new_account_handler(cfg, invites)
+
+	for _, target := range []string{"/new", "/new?token=bogus"} {
+		rec, _ := request_new_account(h, target)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("%s status = %d; want %d", target, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	tok, err := invites.Create(time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, creds := request_new_account(h, "/new?token="+tok.Token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/new with token status = %d; want %d", rec.Code, http.StatusOK)
+	}
+	token, _, ok := invite.SplitPassword(creds.Password)
+	if !ok || token != tok.Token {
+		t.Fatalf("/new with token password = %q; want %s: prefix", creds.Password, tok.Token)
+	}
+}
+
+func TestNewAccountAvoidsReservedUsernames(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.ReservedUsernames = []string{"[a-y]*"}
+	invites := invite.NewStore(filepath.Join(t.TempDir(), "invites.json"))
+	for range 20 {
+		_, creds := request_new_account(new_account_handler(cfg, invites), "/new")
+		if c := creds.Email[0]; c >= 'a' && c <= 'y' {
+			t.Fatalf("/new email = %q; want it to not match ReservedUsernames", creds.Email)
+		}
+	}
+
+	cfg.ReservedUsernames = []string{"*"}
+	if rec, _ := request_new_account(new_account_handler(cfg, invites), "/new"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("/new with every username reserved status = %d; want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
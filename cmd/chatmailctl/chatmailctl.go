@@ -0,0 +1,277 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/adminapi"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// chatmailctl manages the accounts of a running chatmaild through its admin
+// socket, so it has to run on the server, as root or as chatmaild's user.
+
+const usage = "expected 'list', 'create', 'block', 'unblock', 'delete', 'expire', 'lockouts', or 'unlock' subcommands"
+
+const password_charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func format_size(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value := float64(bytes) / unit
+	for _, suffix := range []string{"KiB", "MiB", "GiB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f TiB", value)
+}
+
+func format_time(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func write_accounts_table(w io.Writer, accounts []adminapi.Account) error {
+	if len(accounts) == 0 {
+		_, err := fmt.Fprintln(w, "There are no accounts.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tCREATED\tLAST LOGIN\tMAILBOX\tBLOCKED")
+	for _, a := range accounts {
+		blocked := ""
+		if a.Blocked {
+			blocked = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.Address, format_time(a.Created), format_time(a.LastLogin), format_size(a.MailboxBytes), blocked)
+	}
+	return tw.Flush()
+}
+
+func write_lockouts_table(w io.Writer, lockouts []adminapi.Lockout) error {
+	if len(lockouts) == 0 {
+		_, err := fmt.Fprintln(w, "Nothing is locked out.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSCOPE\tUNTIL\tLOCKOUTS")
+	for _, l := range lockouts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", l.Key, l.Scope, format_time(&l.Until), l.Lockouts)
+	}
+	return tw.Flush()
+}
+
+func write_json(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// random_password makes a password for an account that the operator
+// creates without giving one.
+func random_password() (string, error) {
+	limit := big.NewInt(int64(len(password_charset)))
+	password := make([]byte, 24)
+	for i := range password {
+		choice, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		password[i] = password_charset[choice.Int64()]
+	}
+	return string(password), nil
+}
+
+// for_each_address calls f on each of addresses, stopping at the first
+// error.
+func for_each_address(addresses []string, f func(string) error) error {
+	for _, addr := range addresses {
+		if err := f(addr); err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+// do_command carries out one subcommand, writing what happened to w in
+// format.
+func do_command(w io.Writer, client *adminapi.Client, format string, command string, args []string) error {
+	ctx := context.Background()
+	switch command {
+	case "list":
+		listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+		listCmd.Parse(args)
+		accounts, err := client.Accounts(ctx)
+		if err != nil {
+			return err
+		}
+		if format == "json" {
+			return write_json(w, adminapi.AccountList{Accounts: accounts})
+		}
+		return write_accounts_table(w, accounts)
+	case "create":
+		createCmd := flag.NewFlagSet("create", flag.ExitOnError)
+		password := createCmd.String("password", "", "the account's password (default: a random one, which is shown)")
+		createCmd.Parse(args)
+		if createCmd.NArg() != 1 {
+			return fmt.Errorf("you have to provide the one address to create")
+		}
+		addr := createCmd.Arg(0)
+		shown := ""
+		if *password == "" {
+			var err error
+			if *password, err = random_password(); err != nil {
+				return err
+			}
+			shown = *password
+		}
+		if _, err := client.CreateAccount(ctx, addr, *password); err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		if shown == "" {
+			return report(w, format, "created", addr)
+		}
+		if format == "json" {
+			return write_json(w, map[string]string{"address": addr, "result": "created", "password": shown})
+		}
+		_, err := fmt.Fprintf(w, "created %s with password %s\n", addr, shown)
+		return err
+	case "block", "unblock":
+		blockCmd := flag.NewFlagSet(command, flag.ExitOnError)
+		blockCmd.Parse(args)
+		if blockCmd.NArg() < 1 {
+			return fmt.Errorf("you have to provide the addresses to %s", command)
+		}
+		f := client.Block
+		if command == "unblock" {
+			f = client.Unblock
+		}
+		return for_each_address(blockCmd.Args(), func(addr string) error {
+			if err := f(ctx, addr); err != nil {
+				return err
+			}
+			return report(w, format, command+"ed", addr)
+		})
+	case "delete":
+		deleteCmd := flag.NewFlagSet("delete", flag.ExitOnError)
+		yes := deleteCmd.Bool("yes", false, "really delete the accounts and all of their mail")
+		deleteCmd.Parse(args)
+		if deleteCmd.NArg() < 1 {
+			return fmt.Errorf("you have to provide the addresses to delete")
+		}
+		if !*yes {
+			return fmt.Errorf("deleting accounts removes all of their mail and can't be undone; pass -yes to go ahead")
+		}
+		return for_each_address(deleteCmd.Args(), func(addr string) error {
+			if err := client.DeleteAccount(ctx, addr); err != nil {
+				return err
+			}
+			return report(w, format, "deleted", addr)
+		})
+	case "lockouts":
+		lockoutsCmd := flag.NewFlagSet("lockouts", flag.ExitOnError)
+		lockoutsCmd.Parse(args)
+		lockouts, err := client.Lockouts(ctx)
+		if err != nil {
+			return err
+		}
+		if format == "json" {
+			return write_json(w, adminapi.LockoutList{Lockouts: lockouts})
+		}
+		return write_lockouts_table(w, lockouts)
+	case "unlock":
+		unlockCmd := flag.NewFlagSet("unlock", flag.ExitOnError)
+		unlockCmd.Parse(args)
+		if unlockCmd.NArg() < 1 {
+			return fmt.Errorf("you have to provide the addresses or IP addresses to unlock")
+		}
+		return for_each_address(unlockCmd.Args(), func(key string) error {
+			if err := client.ClearLockout(ctx, key); err != nil {
+				return err
+			}
+			return report(w, format, "unlocked", key)
+		})
+	case "expire":
+		expireCmd := flag.NewFlagSet("expire", flag.ExitOnError)
+		days := expireCmd.Int("days", 0, "remove mail older than this many days (default: DeleteMailsAfterDays from the configuration)")
+		expireCmd.Parse(args)
+		if *days < 0 {
+			return fmt.Errorf("-days can't be negative")
+		}
+		expired, err := client.Expire(ctx, adminapi.ExpireRequest{Addresses: expireCmd.Args(), Days: *days})
+		if err != nil {
+			return err
+		}
+		if format == "json" {
+			return write_json(w, adminapi.ExpireResult{Expired: expired})
+		}
+		_, err = fmt.Fprintf(w, "removed %d messages\n", expired)
+		return err
+	}
+	return errors.New(usage)
+}
+
+// report says that something was done to addr.
+func report(w io.Writer, format string, done string, addr string) error {
+	if format == "json" {
+		return write_json(w, map[string]string{"address": addr, "result": done})
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", done, addr)
+	return err
+}
+
+func main() {
+	config_file := flag.String("config", "/etc/chatmail/chatmail.json", "path to the chatmail server configuration file, which says where the admin socket is")
+	socket := flag.String("socket", "", "path to chatmaild's admin socket (default: from AdminListenAddress in the configuration)")
+	format := flag.String("format", "table", "output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: chatmailctl [flags] list|create|block|unblock|delete|expire|lockouts|unlock [addresses]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *format != "table" && *format != "json" {
+		fmt.Printf("unknown output format %q (expected table or json)\n", *format)
+		os.Exit(1)
+	}
+	if flag.NArg() < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	path := *socket
+	if path == "" {
+		cm_config, _, err := config.DefaultLoader(*config_file, nil).Load()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if cm_config.AdminListenAddress == "" {
+			fmt.Println("the admin socket is turned off; set AdminListenAddress in the configuration")
+			os.Exit(1)
+		}
+		if path, err = adminapi.SocketPath(cm_config.AdminListenAddress); err != nil {
+			fmt.Printf("%v; use -socket\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := do_command(os.Stdout, adminapi.NewClient(path), *format, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
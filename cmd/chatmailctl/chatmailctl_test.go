@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/adminapi"
+
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake_admin_api answers requests with the JSON in responses, by method and
+// path, and records the requests it got.
+func fake_admin_api(t *testing.T, responses map[string]any) (*adminapi.Client, *[]string) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.Method + " " + r.URL.Path
+		if body, _ := io.ReadAll(r.Body); len(body) > 0 {
+			request += " " + strings.TrimSpace(string(body))
+		}
+		requests = append(requests, request)
+		resp, found := responses[r.Method+" "+r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return adminapi.NewHTTPClient(server.URL, server.Client()), &requests
+}
+
+func TestFormatSize(t *testing.T) {
+	for _, tc := range []struct {
+		bytes int64
+		want  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{100 << 20, "100.0 MiB"},
+		{3 << 40, "3.0 TiB"},
+	} {
+		if got := format_size(tc.bytes); got != tc.want {
+			t.Errorf("format_size(%d) = %q; want %q", tc.bytes, got, tc.want)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	client, _ := fake_admin_api(t, map[string]any{"GET /v1/accounts": adminapi.AccountList{Accounts: []adminapi.Account{
+		{Address: "ac_1@chat.example", Created: &created, LastLogin: &created, MailboxBytes: 2048},
+		{Address: "ac_2@chat.example", Blocked: true},
+	}}})
+
+	var out bytes.Buffer
+	if err := do_command(&out, client, "table", "list", nil); err != nil {
+		t.Fatalf("do_command(list) = %v; want nil", err)
+	}
+	want := "" +
+		"ADDRESS            CREATED              LAST LOGIN           MAILBOX  BLOCKED\n" +
+		"ac_1@chat.example  2024-03-01 12:00:00  2024-03-01 12:00:00  2.0 KiB  \n" +
+		"ac_2@chat.example  -                    -                    0 B      yes\n"
+	if out.String() != want {
+		t.Fatalf("do_command(list) wrote\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := do_command(&out, client, "json", "list", nil); err != nil {
+		t.Fatalf("do_command(list) as JSON = %v; want nil", err)
+	}
+	var list adminapi.AccountList
+	if err := json.Unmarshal(out.Bytes(), &list); err != nil || len(list.Accounts) != 2 || !list.Accounts[0].Created.Equal(created) || list.Accounts[1].Created != nil {
+		t.Fatalf("do_command(list) as JSON wrote %s (%v); want both accounts", out.String(), err)
+	}
+}
+
+func TestLockouts(t *testing.T) {
+	until := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	client, _ := fake_admin_api(t, map[string]any{"GET /v1/lockouts": adminapi.LockoutList{Lockouts: []adminapi.Lockout{
+		{Key: "192.0.2.7", Scope: "ip", Until: until, Lockouts: 3},
+	}}})
+	var out bytes.Buffer
+	if err := do_command(&out, client, "table", "lockouts", nil); err != nil {
+		t.Fatalf("do_command(lockouts) = %v; want nil", err)
+	}
+	want := "" +
+		"KEY        SCOPE  UNTIL                LOCKOUTS\n" +
+		"192.0.2.7  ip     2024-03-01 12:00:00  3\n"
+	if out.String() != want {
+		t.Fatalf("do_command(lockouts) wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestMutatingCommands(t *testing.T) {
+	client, requests := fake_admin_api(t, map[string]any{
+		"PUT /v1/accounts/postmaster@chat.example": adminapi.Account{Address: "postmaster@chat.example"},
+		"PUT /v1/accounts/abuse@chat.example":      adminapi.Account{Address: "abuse@chat.example"},
+		"POST /v1/expire":                          adminapi.ExpireResult{Expired: 3},
+	})
+	var out bytes.Buffer
+	if err := do_command(&out, client, "table", "delete", []string{"ac_1@chat.example"}); err == nil || !strings.Contains(err.Error(), "-yes") {
+		t.Fatalf("do_command(delete) without -yes = %v; want it to ask for -yes", err)
+	}
+	if err := do_command(&out, client, "table", "block", nil); err == nil {
+		t.Fatal("do_command(block) without addresses succeeded")
+	}
+	if len(*requests) != 0 {
+		t.Fatalf("commands that should have been refused sent %+v", *requests)
+	}
+
+	for _, args := range [][]string{
+		{"create", "-password", "correct horse battery", "postmaster@chat.example"},
+		{"block", "ac_1@chat.example"},
+		{"unblock", "ac_1@chat.example"},
+		{"delete", "-yes", "ac_1@chat.example", "ac_2@chat.example"},
+		{"expire", "-days", "7"},
+		{"unlock", "192.0.2.7", "ac_1@chat.example"},
+	} {
+		if err := do_command(&out, client, "table", args[0], args[1:]); err != nil {
+			t.Fatalf("do_command(%v) = %v; want nil", args, err)
+		}
+	}
+	want := "created postmaster@chat.example\nblocked ac_1@chat.example\nunblocked ac_1@chat.example\ndeleted ac_1@chat.example\ndeleted ac_2@chat.example\nremoved 3 messages\nunlocked 192.0.2.7\nunlocked ac_1@chat.example\n"
+	if out.String() != want {
+		t.Fatalf("commands wrote %q; want %q", out.String(), want)
+	}
+	want_requests := []string{
+		`PUT /v1/accounts/postmaster@chat.example {"password":"correct horse battery"}`,
+		"PUT /v1/accounts/ac_1@chat.example/blocked",
+		"DELETE /v1/accounts/ac_1@chat.example/blocked",
+		"DELETE /v1/accounts/ac_1@chat.example",
+		"DELETE /v1/accounts/ac_2@chat.example",
+		`POST /v1/expire {"days":7}`,
+		"DELETE /v1/lockouts/192.0.2.7",
+		"DELETE /v1/lockouts/ac_1@chat.example",
+	}
+	if !slices.Equal(*requests, want_requests) {
+		t.Fatalf("commands sent %q; want %q", *requests, want_requests)
+	}
+
+	out.Reset()
+	if err := do_command(&out, client, "json", "create", []string{"abuse@chat.example"}); err != nil {
+		t.Fatalf("do_command(create) = %v; want nil", err)
+	}
+	var created map[string]string
+	if err := json.Unmarshal(out.Bytes(), &created); err != nil || len(created["password"]) < 20 || !strings.Contains((*requests)[len(*requests)-1], created["password"]) {
+		t.Fatalf("do_command(create) without -password wrote %s (%v); want the random password that it sent", out.String(), err)
+	}
+
+	if err := do_command(&out, client, "table", "frobnicate", nil); err == nil {
+		t.Fatal("do_command() with an unknown command succeeded")
+	}
+}
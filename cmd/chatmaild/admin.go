@@ -0,0 +1,444 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/adminapi"
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/invite"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// max_admin_request_size is the most that the admin API reads of a request
+// body.
+const max_admin_request_size = 1 << 20
+
+// admin_server serves the admin API (see the adminapi package) on the admin
+// socket. Besides the socket's permissions, it only answers root and the
+// user that chatmaild runs as.
+type admin_server struct {
+	server   *http.Server
+	listener net.Listener
+	live     *live_config
+	accounts accounts.Store
+	invites  *invite.Store
+	metrics  *chatmaild_metrics
+	guard    *login_guard
+	now      func() time.Time
+	// allowed_uids are the users that may use the API.
+	allowed_uids []int
+}
+
+// admin_route is one operation of the admin API. The pattern is in the
+// format of http.ServeMux, and every one of them is in adminapi.OpenAPI.
+type admin_route struct {
+	pattern string
+	handle  func(as *admin_server, r *http.Request) (int, any, error)
+}
+
+var admin_routes = []admin_route{
+	{"GET /accounts", (*admin_server).list_accounts},
+	{"GET /accounts/{address}", (*admin_server).get_account},
+	{"PUT /accounts/{address}", (*admin_server).create_account},
+	{"DELETE /accounts/{address}", (*admin_server).delete_account},
+	{"PUT /accounts/{address}/blocked", (*admin_server).block_account},
+	{"DELETE /accounts/{address}/blocked", (*admin_server).unblock_account},
+	{"POST /expire", (*admin_server).expire},
+	{"GET /quotas", (*admin_server).quotas},
+	{"GET /stats", (*admin_server).stats},
+	{"GET /invites", (*admin_server).list_invites},
+	{"POST /invites", (*admin_server).create_invite},
+	{"DELETE /invites/{token}", (*admin_server).revoke_invite},
+	{"GET /lockouts", (*admin_server).list_lockouts},
+	{"DELETE /lockouts/{key}", (*admin_server).clear_lockout},
+	{"POST /config/reload", (*admin_server).reload_config},
+	{"GET /openapi.json", (*admin_server).openapi},
+}
+
+// peer_key is the context key for the result of peer_uid on a connection.
+type peer_key struct{}
+
+type peer struct {
+	uid int
+	err error
+}
+
+func new_admin_server(listen_uri string, live *live_config, store accounts.Store, m *chatmaild_metrics, guard *login_guard) (*admin_server, error) {
+	ln, err := make_listener(listen_uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up listener for admin socket: %q", err)
+	}
+	if _, ok := ln.(*net.UnixListener); !ok {
+		ln.Close()
+		return nil, fmt.Errorf("admin socket %s isn't a unix socket", listen_uri)
+	}
+	cm_config := live.get()
+	as := &admin_server{
+		listener:     ln,
+		live:         live,
+		accounts:     store,
+		invites:      invite.NewStore(cm_config.InviteTokensFile),
+		metrics:      m,
+		guard:        guard,
+		now:          time.Now,
+		allowed_uids: []int{0, os.Getuid()},
+	}
+	mux := http.NewServeMux()
+	for _, route := range admin_routes {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		mux.Handle(method+" /"+adminapi.Version+path, as.handler(route))
+	}
+	as.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			uid, err := peer_uid(c.(*net.UnixConn))
+			return context.WithValue(ctx, peer_key{}, peer{uid, err})
+		},
+	}
+	slog.Info("listening for admin connections", "address", listen_uri)
+	return as, nil
+}
+
+func (as *admin_server) serve() error {
+	err := as.server.Serve(as.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (as *admin_server) stop() error {
+	return as.server.Close()
+}
+
+func write_admin_json(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to answer admin request", "err", err)
+	}
+}
+
+// admin_error_status picks the HTTP status for an error from a handler.
+func admin_error_status(err error) int {
+	var api_err *adminapi.Error
+	switch {
+	case errors.As(err, &api_err):
+		return api_err.StatusCode
+	case errors.Is(err, accounts.ErrNotFound), errors.Is(err, invite.ErrUnknownToken):
+		return http.StatusNotFound
+	case errors.Is(err, accounts.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, accounts.ErrInvalidAddr):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func bad_request(format string, args ...any) error {
+	return &adminapi.Error{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// handler checks who's asking before handing the request to route, and
+// turns what it returns into a response.
+func (as *admin_server) handler(route admin_route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := r.Context().Value(peer_key{}).(peer)
+		if p.err != nil {
+			slog.Warn("refusing admin request", "err", p.err)
+			write_admin_json(w, http.StatusForbidden, adminapi.Error{Message: p.err.Error()})
+			return
+		}
+		if !slices.Contains(as.allowed_uids, p.uid) {
+			slog.Warn("refusing admin request", "uid", p.uid)
+			write_admin_json(w, http.StatusForbidden, adminapi.Error{Message: fmt.Sprintf("user %d may not use the admin API", p.uid)})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max_admin_request_size)
+		status, body, err := route.handle(as, r)
+		if err != nil {
+			status = admin_error_status(err)
+			body = adminapi.Error{Message: err.Error()}
+		}
+		level := slog.LevelInfo
+		if r.Method == http.MethodGet {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "admin request", "uid", p.uid, "method", r.Method, "path", r.URL.Path, "status", status)
+		if body == nil {
+			w.WriteHeader(status)
+			return
+		}
+		write_admin_json(w, status, body)
+	})
+}
+
+func read_admin_json(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return bad_request("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func time_or_nil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func api_account(info accounts.Info) adminapi.Account {
+	return adminapi.Account{
+		Address:      info.Address,
+		Created:      time_or_nil(info.Created),
+		LastLogin:    time_or_nil(info.LastLogin),
+		MailboxBytes: info.MailboxBytes,
+		Blocked:      info.Blocked,
+	}
+}
+
+// path_address is the account address in the path of r.
+func path_address(r *http.Request) string {
+	return accounts.CanonicalAddress(r.PathValue("address"))
+}
+
+func (as *admin_server) list_accounts(r *http.Request) (int, any, error) {
+	result := adminapi.AccountList{Accounts: []adminapi.Account{}}
+	err := as.accounts.Each(func(info accounts.Info) error {
+		result.Accounts = append(result.Accounts, api_account(info))
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, result, nil
+}
+
+func (as *admin_server) get_account(r *http.Request) (int, any, error) {
+	info, err := as.accounts.Info(path_address(r))
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, api_account(info), nil
+}
+
+// create_account makes an account for the operator. It skips the username
+// checks of a first login, since reserved usernames are exactly the ones
+// that only the operator should have.
+func (as *admin_server) create_account(r *http.Request) (int, any, error) {
+	var req adminapi.AccountRequest
+	if err := read_admin_json(r, &req); err != nil {
+		return 0, nil, err
+	}
+	cm_config := as.live.get()
+	address := path_address(r)
+	if _, domain, _ := strings.Cut(address, "@"); !strings.EqualFold(domain, cm_config.MailFullyQualifiedDomainName) {
+		return 0, nil, bad_request("%s is not an address on %s", address, cm_config.MailFullyQualifiedDomainName)
+	}
+	if len(req.Password) < cm_config.PasswordMinLength {
+		return 0, nil, bad_request("the password has to be at least %d characters long", cm_config.PasswordMinLength)
+	}
+	if err := as.accounts.Create(address, req.Password); err != nil {
+		return 0, nil, err
+	}
+	as.metrics.accounts_created.Inc()
+	info, err := as.accounts.Info(address)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, api_account(info), nil
+}
+
+func (as *admin_server) delete_account(r *http.Request) (int, any, error) {
+	return http.StatusNoContent, nil, as.accounts.Delete(path_address(r))
+}
+
+func (as *admin_server) block_account(r *http.Request) (int, any, error) {
+	return http.StatusNoContent, nil, as.accounts.Block(path_address(r))
+}
+
+func (as *admin_server) unblock_account(r *http.Request) (int, any, error) {
+	return http.StatusNoContent, nil, as.accounts.Unblock(path_address(r))
+}
+
+// expire removes old mail from the requested accounts, or from every
+// account if there are none.
+func (as *admin_server) expire(r *http.Request) (int, any, error) {
+	var req adminapi.ExpireRequest
+	if err := read_admin_json(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.Days < 0 {
+		return 0, nil, bad_request("can't expire mail from the future (%d days)", req.Days)
+	}
+	if req.Days == 0 {
+		req.Days = as.live.get().DeleteMailsAfterDays
+	}
+	if len(req.Addresses) == 0 {
+		err := as.accounts.Each(func(info accounts.Info) error {
+			req.Addresses = append(req.Addresses, info.Address)
+			return nil
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	cutoff := as.now().AddDate(0, 0, -req.Days)
+	var result adminapi.ExpireResult
+	for _, addr := range req.Addresses {
+		addr = accounts.CanonicalAddress(addr)
+		removed, err := as.accounts.ExpireMail(addr, cutoff)
+		result.Expired += removed
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+	return http.StatusOK, result, nil
+}
+
+func (as *admin_server) quotas(r *http.Request) (int, any, error) {
+	cm_config := as.live.get()
+	result := adminapi.Quotas{
+		MaxMailboxBytes:    int64(cm_config.MaxMailboxSizeMB) << 20,
+		MaxMessageBytes:    int64(cm_config.MaxMessageSizeB),
+		MaxEmailsPerMinute: cm_config.MaxEmailsPerMinutePerUser,
+		Usage:              []adminapi.QuotaUsage{},
+	}
+	err := as.accounts.Each(func(info accounts.Info) error {
+		// Blocked addresses without an account have never logged in.
+		if info.LastLogin.IsZero() {
+			return nil
+		}
+		result.Usage = append(result.Usage, adminapi.QuotaUsage{
+			Address:      info.Address,
+			MailboxBytes: info.MailboxBytes,
+			Percent:      100 * float64(info.MailboxBytes) / float64(result.MaxMailboxBytes),
+		})
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, result, nil
+}
+
+func (as *admin_server) stats(r *http.Request) (int, any, error) {
+	cm_config := as.live.get()
+	m := as.metrics
+	result := adminapi.PolicyStats{
+		Decisions:          make(map[string]uint64),
+		Unenforced:         make(map[string]uint64),
+		RateLimited:        m.milter_rate_limits.Value(),
+		Logins:             make(map[string]uint64),
+		Lockouts:           make(map[string]uint64),
+		AccountsCreated:    m.accounts_created.Value(),
+		MonitorOnly:        cm_config.MilterMonitorOnly,
+		MonitorOnlyDomains: cm_config.MilterMonitorOnlyDomains,
+	}
+	for _, d := range milter_decisions {
+		result.Decisions[d] = m.milter_decisions.With(d).Value()
+	}
+	for _, d := range rejected_decisions() {
+		result.Unenforced[d] = m.milter_unenforced.With(d).Value()
+	}
+	for _, login_result := range login_results {
+		result.Logins[login_result] = m.sasl_logins.With(login_result).Value()
+	}
+	for _, scope := range lockout_scopes {
+		result.Lockouts[scope] = m.sasl_lockouts.With(scope).Value()
+	}
+	return http.StatusOK, result, nil
+}
+
+func api_invite(t invite.Token) adminapi.Invite {
+	return adminapi.Invite{
+		Token:   t.Token,
+		Created: t.Created,
+		Expires: time_or_nil(t.Expires),
+		MaxUses: t.MaxUses,
+		Uses:    t.Uses,
+		Note:    t.Note,
+	}
+}
+
+func (as *admin_server) list_invites(r *http.Request) (int, any, error) {
+	tokens, err := as.invites.List()
+	if err != nil {
+		return 0, nil, err
+	}
+	result := adminapi.InviteList{Invites: []adminapi.Invite{}}
+	for _, t := range tokens {
+		result.Invites = append(result.Invites, api_invite(t))
+	}
+	return http.StatusOK, result, nil
+}
+
+func (as *admin_server) create_invite(r *http.Request) (int, any, error) {
+	var req adminapi.InviteRequest
+	if err := read_admin_json(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.MaxUses < 1 {
+		return 0, nil, bad_request("an invite has to allow at least one use")
+	}
+	if req.ExpiresInSeconds < 0 {
+		return 0, nil, bad_request("expires_in_seconds can't be negative")
+	}
+	t, err := as.invites.Create(time.Duration(req.ExpiresInSeconds)*time.Second, req.MaxUses, req.Note)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, api_invite(t), nil
+}
+
+func (as *admin_server) revoke_invite(r *http.Request) (int, any, error) {
+	return http.StatusNoContent, nil, as.invites.Revoke(r.PathValue("token"))
+}
+
+func (as *admin_server) list_lockouts(r *http.Request) (int, any, error) {
+	result := adminapi.LockoutList{Lockouts: []adminapi.Lockout{}}
+	for _, l := range as.guard.locked_out(as.now()) {
+		result.Lockouts = append(result.Lockouts, adminapi.Lockout{Key: l.key, Scope: l.scope, Until: l.until, Lockouts: l.lockouts})
+	}
+	return http.StatusOK, result, nil
+}
+
+// clear_lockout lets a network or account log in again straight away, and
+// forgets its failures.
+func (as *admin_server) clear_lockout(r *http.Request) (int, any, error) {
+	key := r.PathValue("key")
+	if !as.guard.clear(key) {
+		return 0, nil, &adminapi.Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("there are no failed logins from or for %s", key)}
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+func (as *admin_server) reload_config(r *http.Request) (int, any, error) {
+	changed, needs_restart, err := as.live.reload()
+	if err != nil {
+		return 0, nil, err
+	}
+	slog.Info("reloaded configuration", "changed", changed, "needs_restart", needs_restart)
+	result := adminapi.ReloadResult{Changed: changed, NeedsRestart: needs_restart}
+	if result.Changed == nil {
+		result.Changed = []string{}
+	}
+	if result.NeedsRestart == nil {
+		result.NeedsRestart = []string{}
+	}
+	return http.StatusOK, result, nil
+}
+
+func (as *admin_server) openapi(r *http.Request) (int, any, error) {
+	return http.StatusOK, json.RawMessage(adminapi.OpenAPI), nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/adminapi"
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start_test_admin_server serves the admin API on a socket in a temporary
+// directory. Reloading the configuration gives back reloaded.
+func start_test_admin_server(t *testing.T, reloaded func() (config.ChatmailConfig, error)) (*admin_server, *adminapi.Client) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only checked on Linux")
+	}
+	cfg := config.NewChatmailConfig(default_domain())
+	dir := t.TempDir()
+	cfg.MailboxesDirectory = filepath.Join(dir, "mail")
+	cfg.InviteTokensFile = filepath.Join(dir, "invites.json")
+	socket := filepath.Join(dir, "admin.sock")
+	store := accounts.NewFileStore(cfg.MailboxesDirectory)
+	as, err := new_admin_server("unix://"+socket+"?mode=0600", new_live_config(cfg, reloaded), store, new_chatmaild_metrics(store), new_login_guard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go as.serve()
+	t.Cleanup(func() { as.stop() })
+	return as, adminapi.NewClient(socket)
+}
+
+func TestAdminAccounts(t *testing.T) {
+	as, client := start_test_admin_server(t, nil)
+	ctx := context.Background()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	as.now = func() time.Time { return now }
+	user, password := make_login()
+	if err := as.accounts.Create(user, password); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.accounts.RecordLogin(user, now); err != nil {
+		t.Fatal(err)
+	}
+	message := filepath.Join(as.live.get().MailboxesDirectory, user, "cur", "1.eml")
+	if err := os.MkdirAll(filepath.Dir(message), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(message, []byte("Subject: hi\r\n\r\nhi\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := now.AddDate(0, 0, -as.live.get().DeleteMailsAfterDays-1)
+	if err := os.Chtimes(message, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := client.Accounts(ctx)
+	if err != nil || len(list) != 1 || list[0].Address != user || list[0].LastLogin == nil || !list[0].LastLogin.Equal(now) || list[0].Blocked {
+		t.Fatalf("Accounts() = %+v, %v; want %s, last logged in at %v", list, err, user, now)
+	}
+	if account, err := client.Account(ctx, user); err != nil || !same_json(account, list[0]) {
+		t.Fatalf("Account() = %+v, %v; want %+v", account, err, list[0])
+	}
+	if err := client.Block(ctx, user); err != nil {
+		t.Fatalf("Block() = %v; want nil", err)
+	}
+	if account, err := client.Account(ctx, user); err != nil || !account.Blocked {
+		t.Fatalf("Account() after Block() = %+v, %v; want it blocked", account, err)
+	}
+	if err := client.Unblock(ctx, strings.ToUpper(user)); err != nil {
+		t.Fatalf("Unblock() in capitals = %v; want nil", err)
+	}
+	if blocked, err := as.accounts.IsBlocked(user); err != nil || blocked {
+		t.Fatalf("IsBlocked() after Unblock() in capitals = %t, %v; want false, nil", blocked, err)
+	}
+
+	quotas, err := client.Quotas(ctx)
+	if err != nil || quotas.MaxMailboxBytes != 100<<20 || len(quotas.Usage) != 1 || quotas.Usage[0].Percent <= 0 {
+		t.Fatalf("Quotas() = %+v, %v; want a 100 MiB limit, and some use by %s", quotas, err, user)
+	}
+
+	if expired, err := client.Expire(ctx, adminapi.ExpireRequest{}); err != nil || expired != 1 {
+		t.Fatalf("Expire() = %d, %v; want 1, nil", expired, err)
+	}
+	if _, err := os.Stat(message); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expire() left %s behind: %v", message, err)
+	}
+	if _, err := client.Expire(ctx, adminapi.ExpireRequest{Days: -1}); err == nil {
+		t.Fatal("Expire() with negative days succeeded")
+	}
+
+	if err := client.DeleteAccount(ctx, user); err != nil {
+		t.Fatalf("DeleteAccount() = %v; want nil", err)
+	}
+	if list, err := client.Accounts(ctx); err != nil || len(list) != 0 {
+		t.Fatalf("Accounts() after DeleteAccount() = %+v, %v; want nothing", list, err)
+	}
+	if err := client.DeleteAccount(ctx, user); !adminapi.IsNotFound(err) {
+		t.Fatalf("DeleteAccount() of a deleted account = %v; want not found", err)
+	}
+	if _, err := client.Account(ctx, user); !adminapi.IsNotFound(err) {
+		t.Fatalf("Account() of a deleted account = %v; want not found", err)
+	}
+}
+
+// same_json compares a and b as the API would send them.
+func same_json(a any, b any) bool {
+	a_json, a_err := json.Marshal(a)
+	b_json, b_err := json.Marshal(b)
+	return a_err == nil && b_err == nil && string(a_json) == string(b_json)
+}
+
+func TestAdminInvites(t *testing.T) {
+	_, client := start_test_admin_server(t, nil)
+	ctx := context.Background()
+
+	created, err := client.CreateInvite(ctx, adminapi.InviteRequest{ExpiresInSeconds: 3600, MaxUses: 2, Note: "for the team"})
+	if err != nil || created.Token == "" || created.Expires == nil || created.Expires.Sub(created.Created) != time.Hour || created.MaxUses != 2 {
+		t.Fatalf("CreateInvite() = %+v, %v; want a token good for an hour and two uses", created, err)
+	}
+	if _, err := client.CreateInvite(ctx, adminapi.InviteRequest{MaxUses: 0}); err == nil {
+		t.Fatal("CreateInvite() with no uses succeeded")
+	}
+	invites, err := client.Invites(ctx)
+	if err != nil || len(invites) != 1 || !same_json(invites[0], created) {
+		t.Fatalf("Invites() = %+v, %v; want just %+v", invites, err, created)
+	}
+	if err := client.RevokeInvite(ctx, created.Token); err != nil {
+		t.Fatalf("RevokeInvite() = %v; want nil", err)
+	}
+	if err := client.RevokeInvite(ctx, created.Token); !adminapi.IsNotFound(err) {
+		t.Fatalf("RevokeInvite() of a revoked token = %v; want not found", err)
+	}
+	if invites, err := client.Invites(ctx); err != nil || len(invites) != 0 {
+		t.Fatalf("Invites() after RevokeInvite() = %+v, %v; want nothing", invites, err)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	as, client := start_test_admin_server(t, nil)
+	as.metrics.milter_decisions.With(string(decision_encrypted)).Add(3)
+	as.metrics.milter_unenforced.With(string(decision_unencrypted)).Inc()
+	as.metrics.sasl_logins.With("failure").Inc()
+
+	stats, err := client.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Decisions[string(decision_encrypted)] != 3 || stats.Decisions[string(decision_unencrypted)] != 0 || len(stats.Decisions) != len(milter_decisions) {
+		t.Errorf("Stats() decisions = %v; want 3 encrypted messages, and a count for every decision", stats.Decisions)
+	}
+	if stats.Unenforced[string(decision_unencrypted)] != 1 || stats.Logins["failure"] != 1 || stats.Logins["success"] != 0 {
+		t.Errorf("Stats() = %+v; want one unenforced rejection and one failed login", stats)
+	}
+}
+
+func TestAdminReloadConfig(t *testing.T) {
+	var next config.ChatmailConfig
+	reload_err := errors.New("invalid configuration")
+	as, client := start_test_admin_server(t, func() (config.ChatmailConfig, error) {
+		return next, reload_err
+	})
+	ctx := context.Background()
+	before := as.live.get()
+
+	if _, err := client.ReloadConfig(ctx); err == nil || !strings.Contains(err.Error(), "invalid configuration") {
+		t.Fatalf("ReloadConfig() with a broken configuration = %v; want its error", err)
+	}
+	if !same_json(as.live.get(), before) {
+		t.Fatal("failing to reload changed the configuration")
+	}
+
+	next, reload_err = before, nil
+	next.MilterMonitorOnly = true
+	next.MailboxesDirectory = "/somewhere/else"
+	result, err := client.ReloadConfig(ctx)
+	if err != nil {
+		t.Fatalf("ReloadConfig() = %v; want nil", err)
+	}
+	if !slices.Equal(result.Changed, []string{"MailboxesDirectory", "MilterMonitorOnly"}) || !slices.Equal(result.NeedsRestart, []string{"MailboxesDirectory"}) {
+		t.Fatalf("ReloadConfig() = %+v; want MailboxesDirectory and MilterMonitorOnly changed, and the first needing a restart", result)
+	}
+	after := as.live.get()
+	if !after.MilterMonitorOnly || after.MailboxesDirectory != before.MailboxesDirectory {
+		t.Fatalf("after ReloadConfig(), MilterMonitorOnly = %t and MailboxesDirectory = %q; want true and %q", after.MilterMonitorOnly, after.MailboxesDirectory, before.MailboxesDirectory)
+	}
+	if stats, err := client.Stats(ctx); err != nil || !stats.MonitorOnly {
+		t.Fatalf("Stats() after ReloadConfig() = %+v, %v; want monitor-only", stats, err)
+	}
+}
+
+func TestAdminChecksPeer(t *testing.T) {
+	as, client := start_test_admin_server(t, nil)
+	as.allowed_uids = []int{os.Getuid() + 1}
+	if _, err := client.Accounts(context.Background()); err == nil || !strings.Contains(err.Error(), "may not use the admin API") {
+		t.Fatalf("Accounts() from a user that isn't allowed = %v; want it refused", err)
+	}
+}
+
+// TestAdminRoutesDocumented checks that openapi.json describes exactly the
+// operations that chatmaild serves.
+func TestAdminRoutesDocumented(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(adminapi.OpenAPI, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var documented []string
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if method != "parameters" {
+				documented = append(documented, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	var served []string
+	for _, route := range admin_routes {
+		served = append(served, route.pattern)
+	}
+	slices.Sort(documented)
+	slices.Sort(served)
+	if !slices.Equal(documented, served) {
+		t.Fatalf("openapi.json documents %v; chatmaild serves %v", documented, served)
+	}
+}
+
+func TestAdminCreateAccount(t *testing.T) {
+	as, client := start_test_admin_server(t, nil)
+	ctx := context.Background()
+	postmaster := "postmaster@" + default_domain()
+
+	if _, err := client.CreateAccount(ctx, postmaster, "short"); err == nil || !strings.Contains(err.Error(), "at least") {
+		t.Fatalf("CreateAccount() with a short password = %v; want it refused", err)
+	}
+	if _, err := client.CreateAccount(ctx, "postmaster@other.example", "correct horse battery"); err == nil {
+		t.Fatal("CreateAccount() on another domain succeeded")
+	}
+	account, err := client.CreateAccount(ctx, postmaster, "correct horse battery")
+	if err != nil || account.Address != postmaster || account.Created == nil {
+		t.Fatalf("CreateAccount() of a reserved username = %+v, %v; want it created", account, err)
+	}
+	if err := as.accounts.Verify(postmaster, "correct horse battery"); err != nil {
+		t.Fatalf("Verify() after CreateAccount() = %v; want nil", err)
+	}
+	if _, err := client.CreateAccount(ctx, postmaster, "correct horse battery"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("CreateAccount() of an existing account = %v; want it refused", err)
+	}
+}
+
+func TestAdminLockouts(t *testing.T) {
+	as, client := start_test_admin_server(t, nil)
+	ctx := context.Background()
+	cfg := as.live.get()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	as.now = func() time.Time { return now }
+	for range cfg.LoginFailuresPerIP {
+		as.guard.failed(cfg, "2001:db8:1:2::", "someone@"+default_domain(), now)
+	}
+
+	lockouts, err := client.Lockouts(ctx)
+	want := adminapi.Lockout{Key: "2001:db8:1:2::", Scope: "ip", Until: now.Add(time.Duration(cfg.LoginLockoutSeconds) * time.Second), Lockouts: 1}
+	if err != nil || len(lockouts) != 1 || !same_json(lockouts[0], want) {
+		t.Fatalf("Lockouts() = %+v, %v; want just %+v", lockouts, err, want)
+	}
+	if err := client.ClearLockout(ctx, "2001:db8:1:2:3:4:5:6"); err != nil {
+		t.Fatalf("ClearLockout() of an address in the network = %v; want nil", err)
+	}
+	if lockouts, err := client.Lockouts(ctx); err != nil || len(lockouts) != 0 {
+		t.Fatalf("Lockouts() after ClearLockout() = %+v, %v; want nothing", lockouts, err)
+	}
+	if err := client.ClearLockout(ctx, "someone@"+default_domain()); err != nil {
+		t.Fatalf("ClearLockout() of an account with failures = %v; want nil", err)
+	}
+	if err := client.ClearLockout(ctx, "someone@"+default_domain()); !adminapi.IsNotFound(err) {
+		t.Fatalf("ClearLockout() of an account without failures = %v; want not found", err)
+	}
+}
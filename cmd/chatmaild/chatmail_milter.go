@@ -6,15 +6,19 @@ import (
 
 	"github.com/s0ph0s-dog/gochatmail/internal/config"
 
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/mail"
 	"net/textproto"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-milter"
 )
@@ -24,11 +28,13 @@ type milter_server struct {
 	listener net.Listener
 }
 
-func new_milter_server(listen_uri string) (milter_server, error) {
+func new_milter_server(listen_uri string, live *live_config, m *chatmaild_metrics) (milter_server, error) {
+	limiter := new_send_rate_limiter()
 	server := milter.Server{
 		NewMilter: func() milter.Milter {
-			return &ChatmailMilter{}
+			return new_chatmail_milter(live.get(), m, limiter)
 		},
+		Actions:  milter.OptAddHeader,
 		Protocol: milter.OptNoConnect | milter.OptNoHelo,
 	}
 	ln, err := make_listener(listen_uri)
@@ -36,8 +42,8 @@ func new_milter_server(listen_uri string) (milter_server, error) {
 		return milter_server{}, fmt.Errorf("Failed to set up listener for milter: %q", err)
 	}
 
-	log.Printf("using %s as milter listen socket\n", listen_uri)
-	return milter_server{server, ln}, nil
+	slog.Info("listening for milter connections", "address", listen_uri)
+	return milter_server{server, counting_listener{ln, m.milter_connections}}, nil
 }
 
 func (ms *milter_server) serve() error {
@@ -61,11 +67,82 @@ type ChatmailMilter struct {
 	content_type  string
 	body          io.ReadWriter
 	config        config.ChatmailConfig
+	metrics       *chatmaild_metrics
+	rate_limiter  *send_rate_limiter
+}
+
+func new_chatmail_milter(cm_config config.ChatmailConfig, m *chatmaild_metrics, limiter *send_rate_limiter) *ChatmailMilter {
+	return &ChatmailMilter{
+		body:         new(bytes.Buffer),
+		config:       cm_config,
+		metrics:      m,
+		rate_limiter: limiter,
+	}
+}
+
+// milter_decision is what the milter decided to do with a message, and why.
+// They're used as metric labels, so they must not contain anything about the
+// message itself.
+type milter_decision string
+
+const (
+	decision_passthrough_sender    milter_decision = "accepted_passthrough_sender"
+	decision_encrypted             milter_decision = "accepted_encrypted"
+	decision_securejoin            milter_decision = "accepted_securejoin"
+	decision_passthrough_recipient milter_decision = "accepted_passthrough_recipient"
+	decision_internal              milter_decision = "accepted_internal"
+	decision_forged_from           milter_decision = "rejected_forged_from"
+	decision_unencrypted           milter_decision = "rejected_unencrypted"
+	decision_invalid_recipient     milter_decision = "rejected_invalid_recipient"
+	decision_malformed             milter_decision = "rejected_malformed"
+)
+
+var milter_decisions = []string{
+	string(decision_passthrough_sender),
+	string(decision_encrypted),
+	string(decision_securejoin),
+	string(decision_passthrough_recipient),
+	string(decision_internal),
+	string(decision_forged_from),
+	string(decision_unencrypted),
+	string(decision_invalid_recipient),
+	string(decision_malformed),
+}
+
+// rejected_decisions lists the decisions that reject a message.
+func rejected_decisions() []string {
+	var rejected []string
+	for _, d := range milter_decisions {
+		if !milter_decision(d).accepted() {
+			rejected = append(rejected, d)
+		}
+	}
+	return rejected
+}
+
+func (d milter_decision) accepted() bool {
+	return strings.HasPrefix(string(d), "accepted_")
+}
+
+func (d milter_decision) response() milter.Response {
+	if d.accepted() {
+		return milter.RespAccept
+	}
+	return milter.RespReject
+}
+
+// policy_header marks messages that monitor-only mode let through although
+// they would have been rejected.
+const policy_header = "X-Chatmail-Policy"
+
+func policy_header_value(d milter_decision) string {
+	return "would-reject; reason=" + string(d)
 }
 
 // MARK: milter interface functions
 
 func (cm *ChatmailMilter) Abort(m *milter.Modifier) error {
+	*cm = *new_chatmail_milter(cm.config, cm.metrics, cm.rate_limiter)
 	return nil
 }
 
@@ -79,12 +156,16 @@ func (cm *ChatmailMilter) Helo(name string, m *milter.Modifier) (milter.Response
 
 func (cm *ChatmailMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
 	cm.mailFrom = from
-	return nil, nil
+	if !slices.Contains(cm.config.PassthroughSendersList, from) && !cm.rate_limiter.allow(from, cm.config.MaxEmailsPerMinutePerUser, time.Now()) {
+		cm.metrics.milter_rate_limits.Inc()
+		slog.Info("sender is over the rate limit", "from", from)
+	}
+	return milter.RespContinue, nil
 }
 
 func (cm *ChatmailMilter) RcptTo(rcptTo string, m *milter.Modifier) (milter.Response, error) {
 	cm.rcptTos = append(cm.rcptTos, rcptTo)
-	return nil, nil
+	return milter.RespContinue, nil
 }
 
 func (cm *ChatmailMilter) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
@@ -104,9 +185,29 @@ func (cm *ChatmailMilter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (m
 	return milter.RespContinue, nil
 }
 
+// Body rejects messages that the milter decides against, unless the sender
+// is in monitor-only mode.
 func (cm *ChatmailMilter) Body(m *milter.Modifier) (milter.Response, error) {
-	log.Printf("milter_state: %v", cm)
-	return milter.RespAccept, nil
+	decision, err := cm.Decide()
+	if err != nil {
+		slog.Warn("malformed message", "from", cm.mailFrom, "err", err)
+		decision = decision_malformed
+	}
+	enforced := decision.accepted() || !cm.monitor_only()
+	level := slog.LevelInfo
+	if decision.accepted() {
+		level = slog.LevelDebug
+	}
+	slog.Log(context.Background(), level, "milter decision", "reason", decision, "enforced", enforced, "from", cm.mailFrom, "to", cm.rcptTos)
+	cm.metrics.milter_decisions.With(string(decision)).Inc()
+	if !enforced {
+		cm.metrics.milter_unenforced.With(string(decision)).Inc()
+		if err := m.AddHeader(policy_header, policy_header_value(decision)); err != nil {
+			return nil, err
+		}
+		return milter.RespAccept, nil
+	}
+	return decision.response(), nil
 }
 
 func (cm *ChatmailMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
@@ -114,105 +215,183 @@ func (cm *ChatmailMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Re
 	if err != nil {
 		return nil, err
 	}
-	return nil, nil
+	return milter.RespContinue, nil
 }
 
 // MARK: testable logic functions
 
 func (cm *ChatmailMilter) ValidateEmail() (milter.Response, error) {
+	decision, err := cm.Decide()
+	if err != nil {
+		return nil, err
+	}
+	return decision.response(), nil
+}
+
+// monitor_only reports whether the message's rejection would only be
+// recorded instead of enforced, either for everyone or for the sender's
+// domain.
+func (cm *ChatmailMilter) monitor_only() bool {
+	if cm.config.MilterMonitorOnly {
+		return true
+	}
+	domain := cm.mailFrom[strings.LastIndex(cm.mailFrom, "@")+1:]
+	return slices.ContainsFunc(cm.config.MilterMonitorOnlyDomains, func(d string) bool {
+		return strings.EqualFold(d, domain)
+	})
+}
+
+// Decide works out whether the message may be sent: it has to be from the
+// account that's sending it, and encrypted unless it stays on this server
+// or is exempt.
+func (cm *ChatmailMilter) Decide() (milter_decision, error) {
+	return cm.decide(nil)
+}
+
+// decide is Decide, recording each step in trace.
+func (cm *ChatmailMilter) decide(trace *decision_trace) (milter_decision, error) {
 	if slices.Contains(cm.config.PassthroughSendersList, cm.mailFrom) {
-		return milter.RespAccept, nil
+		trace.add("passthrough sender", true, "%s is in PassthroughSendersList, so nothing else is checked", cm.mailFrom)
+		return decision_passthrough_sender, nil
 	}
-	mail_encrypted, err := IsValidEncryptedMessage(
+	trace.add("passthrough sender", false, "%s is not in PassthroughSendersList", cm.mailFrom)
+	mail_encrypted, err := check_encrypted_message(
 		cm.subject,
 		cm.content_type,
 		cm.body,
+		trace,
 	)
 	if err != nil {
-		return nil, err
+		trace.add("message structure", false, "%v", err)
+		return "", err
 	}
 	mime_from_addr, err := mail.ParseAddress(cm.mimeFrom)
 	if err != nil {
-		return nil, err
+		trace.add("From header", false, "can't parse %q: %v", cm.mimeFrom, err)
+		return "", err
 	}
 	if !strings.EqualFold(mime_from_addr.Address, cm.mailFrom) {
-		return milter.RespReject, nil
+		trace.add("From header", false, "%s doesn't match the envelope sender %s", mime_from_addr.Address, cm.mailFrom)
+		return decision_forged_from, nil
 	}
+	trace.add("From header", true, "%s matches the envelope sender", mime_from_addr.Address)
 	mime_from_parts := strings.Split(mime_from_addr.Address, "@")
 	mime_from_domain := mime_from_parts[len(mime_from_parts)-1]
+	decision := decision_internal
+	if mail_encrypted {
+		decision = decision_encrypted
+	}
 	for _, recipient := range cm.rcptTos {
 		if cm.mailFrom == recipient {
+			trace.add("recipient "+recipient, true, "is the sender")
 			continue
 		}
 		if slices.Contains(cm.config.PassthroughRecipientsList, recipient) {
+			trace.add("recipient "+recipient, true, "is in PassthroughRecipientsList")
+			if decision == decision_internal {
+				decision = decision_passthrough_recipient
+			}
 			continue
 		}
 		res := strings.Split(recipient, "@")
 		if len(res) != 2 {
-			return milter.RespReject, nil
+			trace.add("recipient "+recipient, false, "is not an address")
+			return decision_invalid_recipient, nil
 		}
 		recipient_domain := res[len(res)-1]
 		is_outgoing := recipient_domain != mime_from_domain
-		if is_outgoing && !mail_encrypted {
-			is_securejoin := strings.EqualFold(cm.secureJoinHdr, "vc-request") || strings.EqualFold(cm.secureJoinHdr, "vg-request")
-			if !is_securejoin {
-				return milter.RespReject, nil
+		if !is_outgoing {
+			trace.add("recipient "+recipient, true, "is on the sender's domain")
+			continue
+		}
+		if mail_encrypted {
+			trace.add("recipient "+recipient, true, "is on another domain, and the message is encrypted")
+			continue
+		}
+		is_securejoin := strings.EqualFold(cm.secureJoinHdr, "vc-request") || strings.EqualFold(cm.secureJoinHdr, "vg-request")
+		if !is_securejoin {
+			if cm.secureJoinHdr == "" {
+				trace.add("recipient "+recipient, false, "is on another domain, and the message is neither encrypted nor a Secure-Join request")
+			} else {
+				trace.add("recipient "+recipient, false, "is on another domain, and the message isn't encrypted; Secure-Join: %s is only exempt for vc-request and vg-request", cm.secureJoinHdr)
 			}
+			return decision_unencrypted, nil
 		}
+		trace.add("recipient "+recipient, true, "is on another domain, and the message is exempt from encryption as a Secure-Join %s", cm.secureJoinHdr)
+		decision = decision_securejoin
 	}
-	return milter.RespAccept, nil
+	return decision, nil
 }
 
-func IsEncryptedOpenPGPPayload(payload []byte) bool {
+// openpgp_packets splits payload into OpenPGP packets and returns their
+// types, or false if it isn't a sequence of new-format packets.
+func openpgp_packets(payload []byte) ([]byte, bool) {
+	var types []byte
 	i := 0
 	for i < len(payload) {
 		// Permit only OpenPGP formatted binary data.
 		if payload[i]&0xC0 != 0xC0 {
-			return false
+			return types, false
 		}
-		packet_type_id := payload[i] & 0x3F
+		types = append(types, payload[i]&0x3F)
 		i += 1
+		if i >= len(payload) {
+			return types, false
+		}
 		var body_len int
 		if payload[i] < 192 {
 			body_len = int(payload[i])
 			i += 1
 		} else if payload[i] < 224 {
 			if (i + 1) >= len(payload) {
-				return false
+				return types, false
 			}
 			body_len = ((int(payload[i]) - 192) << 8) + int(payload[i+1]) + 192
 			i += 2
 		} else if payload[i] == 255 {
 			if (i + 4) >= len(payload) {
-				return false
+				return types, false
 			}
 			body_len = (int(payload[i+1]) << 24) | (int(payload[i+2]) << 16) | (int(payload[i+3]) << 8) | int(payload[i+4])
 			i += 5
 		} else {
-			return false
+			return types, false
 		}
 		i += body_len
-		if i == len(payload) {
-			// The last packet in the stream should be
-			// "Symmetrically Encrypted and Integrity Protected Data Packet
-			// (SEIDP)".
-			// This is the only place in this function that is allowed to return
-			// true.
-			return packet_type_id == 18
-		} else if packet_type_id != 1 && packet_type_id != 3 {
+	}
+	return types, i == len(payload)
+}
+
+// encrypted_packet_sequence checks that types is some session keys followed
+// by the encrypted data.
+func encrypted_packet_sequence(types []byte) bool {
+	if len(types) == 0 {
+		return false
+	}
+	for _, packet_type_id := range types[:len(types)-1] {
+		// Public-Key or Symmetric-Key Encrypted Session Key packets.
+		if packet_type_id != 1 && packet_type_id != 3 {
 			return false
 		}
 	}
-	return false
+	// The last packet in the stream should be
+	// "Symmetrically Encrypted and Integrity Protected Data Packet
+	// (SEIDP)".
+	return types[len(types)-1] == 18
 }
 
-func IsValidEncryptedPayload(payload string) bool {
+func IsEncryptedOpenPGPPayload(payload []byte) bool {
+	types, ok := openpgp_packets(payload)
+	return ok && encrypted_packet_sequence(types)
+}
+
+func decode_armored_payload(payload string) ([]byte, bool) {
 	const header = "-----BEGIN PGP MESSAGE-----\r\n\r\n"
 	const footer = "-----END PGP MESSAGE-----\r\n\r\n"
 	hasHeader := strings.HasPrefix(payload, header)
 	hasFooter := strings.HasSuffix(payload, footer)
 	if !(hasHeader && hasFooter) {
-		return false
+		return nil, false
 	}
 	start_idx := len(header)
 	crc24_start := strings.LastIndex(payload, "=")
@@ -226,23 +405,37 @@ func IsValidEncryptedPayload(payload string) bool {
 	b64_decoded := make([]byte, base64.StdEncoding.DecodedLen(len(b64_encoded)))
 	n, err := base64.StdEncoding.Decode(b64_decoded, []byte(b64_encoded))
 	if err != nil {
-		return false
+		return nil, false
 	}
-	b64_decoded = b64_decoded[:n]
-	return IsEncryptedOpenPGPPayload(b64_decoded)
+	return b64_decoded[:n], true
+}
+
+func IsValidEncryptedPayload(payload string) bool {
+	decoded, ok := decode_armored_payload(payload)
+	return ok && IsEncryptedOpenPGPPayload(decoded)
 }
 
 func IsValidEncryptedMessage(subject string, content_type string, body io.Reader) (bool, error) {
+	return check_encrypted_message(subject, content_type, body, nil)
+}
+
+// check_encrypted_message is IsValidEncryptedMessage, recording each step in
+// trace.
+func check_encrypted_message(subject string, content_type string, body io.Reader, trace *decision_trace) (bool, error) {
 	if !slices.Contains(CommonEncryptedSubjects, subject) {
+		trace.add("subject", false, "%q is not one that encrypting clients use, so the message doesn't count as encrypted", subject)
 		return false, nil
 	}
+	trace.add("subject", true, "%q is one that encrypting clients use", subject)
 	mediatype, params, err := mime.ParseMediaType(content_type)
 	if err != nil {
 		return false, err
 	}
 	if mediatype != "multipart/encrypted" {
+		trace.add("MIME structure", false, "Content-Type is %s, not multipart/encrypted", mediatype)
 		return false, nil
 	}
+	trace.add("MIME structure", true, "Content-Type is multipart/encrypted")
 	mpr := multipart.NewReader(body, params["boundary"])
 	// TODO: figure out how to/whether it's necessary to decode non-UTF-8 encodings
 	parts_count := 0
@@ -257,6 +450,7 @@ func IsValidEncryptedMessage(subject string, content_type string, body io.Reader
 		if parts_count == 0 {
 			part_content_type := part.Header.Get("Content-Type")
 			if part_content_type != "application/pgp-encrypted" {
+				trace.add("MIME parts", false, "the first part is %s, not application/pgp-encrypted", part_content_type)
 				return false, nil
 			}
 			part_body, err := io.ReadAll(part)
@@ -264,21 +458,38 @@ func IsValidEncryptedMessage(subject string, content_type string, body io.Reader
 				return false, err
 			}
 			if strings.TrimSpace(string(part_body)) != "Version: 1" {
+				trace.add("MIME parts", false, "the first part says %q, not \"Version: 1\"", strings.TrimSpace(string(part_body)))
 				return false, nil
 			}
+			trace.add("MIME parts", true, "the first part is application/pgp-encrypted, Version: 1")
 		} else if parts_count == 1 {
 			part_content_type := part.Header.Get("Content-Type")
 			if !strings.HasPrefix(part_content_type, "application/octet-stream") {
+				trace.add("MIME parts", false, "the second part is %s, not application/octet-stream", part_content_type)
 				return false, nil
 			}
+			trace.add("MIME parts", true, "the second part is application/octet-stream")
 			part_body, err := io.ReadAll(part)
 			if err != nil {
 				return false, err
 			}
-			if !IsValidEncryptedPayload(string(part_body)) {
+			decoded, ok := decode_armored_payload(string(part_body))
+			if !ok {
+				trace.add("OpenPGP packets", false, "the second part isn't an ASCII-armored PGP message")
+				return false, nil
+			}
+			types, ok := openpgp_packets(decoded)
+			if !ok {
+				trace.add("OpenPGP packets", false, "the PGP message isn't a sequence of new-format packets (read %s)", packet_names(types))
+				return false, nil
+			}
+			if !encrypted_packet_sequence(types) {
+				trace.add("OpenPGP packets", false, "found %s; want session keys followed by one encrypted data packet", packet_names(types))
 				return false, nil
 			}
+			trace.add("OpenPGP packets", true, "found %s", packet_names(types))
 		} else {
+			trace.add("MIME parts", false, "there are more than two parts")
 			return false, nil
 		}
 		parts_count += 1
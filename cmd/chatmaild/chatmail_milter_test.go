@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
 	"github.com/s0ph0s-dog/gochatmail/internal/config"
 
 	"bytes"
@@ -9,8 +10,11 @@ import (
 	"math/big"
 	"net/mail"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/emersion/go-milter"
 )
@@ -57,7 +61,7 @@ func emlctx_default_subject(from_addr string, to_addr string) emlctx {
 	return emlctx{from_addr, to_addr, "..."}
 }
 
-func loademailmsg(filename string, ctx emlctx) *mail.Message {
+func renderemail(filename string, ctx emlctx) []byte {
 	path := filepath.Join("testdata", filename)
 	t, err := template.ParseFiles(path)
 	if err != nil {
@@ -68,7 +72,11 @@ func loademailmsg(filename string, ctx emlctx) *mail.Message {
 	if err != nil {
 		panic(err)
 	}
-	msg, err := mail.ReadMessage(&tmpl)
+	return tmpl.Bytes()
+}
+
+func loademailmsg(filename string, ctx emlctx) *mail.Message {
+	msg, err := mail.ReadMessage(bytes.NewReader(renderemail(filename, ctx)))
 	if err != nil {
 		panic(err)
 	}
@@ -94,6 +102,76 @@ func setenvelope(cm *ChatmailMilter, mailFrom string, rcptTos []string) {
 	cm.rcptTos = rcptTos
 }
 
+// milter_transaction runs a message through the milter listening on socket
+// the way the MTA would, and returns the changes it asked for and the final
+// action.
+func milter_transaction(t *testing.T, socket string, mail_from string, rcpt_to string, filename string, ctx emlctx) ([]milter.ModifyAction, *milter.Action) {
+	t.Helper()
+	// The server side of go-milter only speaks protocol version 2, so
+	// don't ask for actions that need a newer one.
+	client := milter.NewClientWithOptions("unix", socket, milter.ClientOptions{
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		ActionMask:   milter.OptAddHeader,
+	})
+	defer client.Close()
+	session, err := client.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	act, err := session.Mail("<"+mail_from+">", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act.Code != milter.ActContinue {
+		return nil, act
+	}
+	if _, err := session.Rcpt("<"+rcpt_to+">", nil); err != nil {
+		t.Fatal(err)
+	}
+	msg := loademailmsg(filename, ctx)
+	for name, values := range msg.Header {
+		for _, value := range values {
+			if _, err := session.HeaderField(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := session.HeaderEnd(); err != nil {
+		t.Fatal(err)
+	}
+	modify, act, err := session.BodyReadFrom(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return modify, act
+}
+
+// send_through_milter is milter_transaction for when only the final action
+// matters.
+func send_through_milter(t *testing.T, socket string, mail_from string, rcpt_to string, filename string, ctx emlctx) *milter.Action {
+	t.Helper()
+	_, act := milter_transaction(t, socket, mail_from, rcpt_to, filename, ctx)
+	return act
+}
+
+// start_test_milter runs a milter server with cfg on a socket in a temporary
+// directory, for the rest of the test.
+func start_test_milter(t *testing.T, cfg config.ChatmailConfig) (string, *chatmaild_metrics) {
+	t.Helper()
+	m := new_chatmaild_metrics(accounts.NewFileStore(cfg.MailboxesDirectory))
+	socket := filepath.Join(t.TempDir(), "milter.sock")
+	server, err := new_milter_server("unix://"+socket, new_live_config(cfg, nil), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve()
+	t.Cleanup(func() { server.stop() })
+	return socket, m
+}
+
 func test_is_valid_encrypted_message(filename string, ctx emlctx) (bool, error) {
 	msg := loademailmsg(filename, ctx)
 	return IsValidEncryptedMessage(ctx.Subject, msg.Header.Get("Content-Type"), msg.Body)
@@ -281,3 +359,52 @@ func TestMilterArmoredPayload(t *testing.T) {
 		t.Fatal("rejected valid PGP payload")
 	}
 }
+
+func TestMilterMonitorOnly(t *testing.T) {
+	sender, _ := make_account()
+	external := "someone@external.example"
+	plain := emlctx_default_subject(sender, external)
+	want_header := milter.ModifyAction{Code: milter.ActAddHeader, HeaderName: policy_header, HeaderValue: "would-reject; reason=rejected_unencrypted"}
+	tests := []struct {
+		name         string
+		monitor_only bool
+		domains      []string
+		enforced     bool
+	}{
+		{"enforced", false, []string{}, true},
+		{"monitoring another domain", false, []string{"other.example"}, true},
+		{"monitoring the sender's domain", false, []string{strings.ToUpper(default_domain())}, false},
+		{"monitoring everything", true, []string{}, false},
+	}
+	for _, test := range tests {
+		cfg := config.NewChatmailConfig(default_domain())
+		cfg.MailboxesDirectory = t.TempDir()
+		cfg.MilterMonitorOnly = test.monitor_only
+		cfg.MilterMonitorOnlyDomains = test.domains
+		socket, m := start_test_milter(t, cfg)
+
+		modify, act := milter_transaction(t, socket, sender, external, "plain.eml", plain)
+		if test.enforced {
+			if act.Code != milter.ActReject || len(modify) != 0 {
+				t.Errorf("%s: milter result for an unencrypted message = %v, %q; want no changes, %q", test.name, modify, act.Code, milter.ActReject)
+			}
+		} else if act.Code != milter.ActAccept || !reflect.DeepEqual(modify, []milter.ModifyAction{want_header}) {
+			t.Errorf("%s: milter result for an unencrypted message = %v, %q; want %v, %q", test.name, modify, act.Code, want_header, milter.ActAccept)
+		}
+		want_unenforced := uint64(1)
+		if test.enforced {
+			want_unenforced = 0
+		}
+		if got := m.milter_unenforced.With(string(decision_unencrypted)).Value(); got != want_unenforced {
+			t.Errorf("%s: unenforced rejections = %d; want %d", test.name, got, want_unenforced)
+		}
+		if got := m.milter_decisions.With(string(decision_unencrypted)).Value(); got != 1 {
+			t.Errorf("%s: unencrypted decisions = %d; want 1", test.name, got)
+		}
+
+		encrypted := emlctx{sender, external, CommonEncryptedSubjects[0]}
+		if modify, act := milter_transaction(t, socket, sender, external, "encrypted.eml", encrypted); act.Code != milter.ActAccept || len(modify) != 0 {
+			t.Errorf("%s: milter result for an encrypted message = %v, %q; want no changes, %q", test.name, modify, act.Code, milter.ActAccept)
+		}
+	}
+}
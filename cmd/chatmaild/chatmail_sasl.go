@@ -1,9 +1,17 @@
 package main
 
 import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/invite"
+	"github.com/s0ph0s-dog/gochatmail/internal/usernames"
+
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/go-dovecot-sasl"
@@ -14,10 +22,28 @@ type sasl_server struct {
 	listener net.Listener
 }
 
-func new_sasl_server(listen_uri string) (sasl_server, error) {
+func new_sasl_server(listen_uri string, live *live_config, store accounts.Store, m *chatmaild_metrics, guard *login_guard) (sasl_server, error) {
+	auth := new_authenticator(live.get(), store, m, guard)
+	secret, err := load_scram_secret(live.get().LogSaltFile)
+	if err != nil {
+		return sasl_server{}, err
+	}
+	auth.scram_secret = secret
 	server := dovecotsasl.NewServer()
-	server.AddMechanism("PLAIN", dovecotsasl.Mechanism{}, func(*dovecotsasl.AuthReq) sasl.Server {
-		return sasl.NewPlainServer(authenticator)
+	server.AddMechanism("PLAIN", dovecotsasl.Mechanism{Plaintext: true}, func(req *dovecotsasl.AuthReq) sasl.Server {
+		return sasl.NewPlainServer(auth.with_config(live.get()).from(req.RemoteIP).login)
+	})
+	server.AddMechanism("LOGIN", dovecotsasl.Mechanism{Plaintext: true}, func(req *dovecotsasl.AuthReq) sasl.Server {
+		a := auth.with_config(live.get()).from(req.RemoteIP)
+		return sasl.NewLoginServer(func(user, pass string) error {
+			return a.login("", user, pass)
+		})
+	})
+	// SCRAM-SHA-256-PLUS isn't offered: it needs the tls-exporter data of the
+	// client's TLS connection, which the dovecot auth protocol doesn't carry
+	// from the MTA.
+	server.AddMechanism("SCRAM-SHA-256", dovecotsasl.Mechanism{MutualAuth: true}, func(req *dovecotsasl.AuthReq) sasl.Server {
+		return auth.with_config(live.get()).from(req.RemoteIP).scram(nil)
 	})
 
 	ln, err := make_listener(listen_uri)
@@ -25,7 +51,7 @@ func new_sasl_server(listen_uri string) (sasl_server, error) {
 		return sasl_server{}, fmt.Errorf("failed to set up listener for SASL server: %q", err)
 	}
 
-	log.Printf("using %s as SASL server listen socket\n", listen_uri)
+	slog.Info("listening for SASL connections", "address", listen_uri)
 	return sasl_server{server, ln}, nil
 }
 
@@ -37,6 +63,193 @@ func (ss *sasl_server) stop() error {
 	return ss.server.Close()
 }
 
-func authenticator(_, user, pass string) error {
-	return fmt.Errorf("rejecting login from %s", user)
+type authenticator struct {
+	config   config.ChatmailConfig
+	accounts accounts.Store
+	invites  *invite.Store
+	metrics  *chatmaild_metrics
+	guard    *login_guard
+	now      func() time.Time
+	// remote_ip is where the login comes from, if the MTA said.
+	remote_ip net.IP
+	// scram_secret makes up SCRAM salts for users who can't log in.
+	scram_secret []byte
+}
+
+func new_authenticator(cm_config config.ChatmailConfig, store accounts.Store, m *chatmaild_metrics, guard *login_guard) *authenticator {
+	return &authenticator{
+		config:   cm_config,
+		accounts: store,
+		invites:  invite.NewStore(cm_config.InviteTokensFile),
+		metrics:  m,
+		guard:    guard,
+		now:      time.Now,
+	}
+}
+
+// with_config is a copy of a that uses cm_config, sharing everything else.
+func (a *authenticator) with_config(cm_config config.ChatmailConfig) *authenticator {
+	copy := *a
+	copy.config = cm_config
+	return &copy
+}
+
+// from is a copy of a for a login from remote_ip, which may be nil.
+func (a *authenticator) from(remote_ip net.IP) *authenticator {
+	copy := *a
+	copy.remote_ip = remote_ip
+	return &copy
+}
+
+// login is authenticate, unless there have been too many failures from the
+// same network or for the same account, counted in the metrics.
+func (a *authenticator) login(identity, user, pass string) error {
+	user = accounts.CanonicalAddress(user)
+	if err := a.check_lockout(user); err != nil {
+		return err
+	}
+	err := a.authenticate(identity, user, pass)
+	a.count_login(user, err)
+	return err
+}
+
+// check_lockout returns an error if user can't log in from where the login
+// comes from right now.
+func (a *authenticator) check_lockout(user string) error {
+	network := network_key(a.remote_ip)
+	if err := a.guard.check(network, user, a.now()); err != nil {
+		a.metrics.sasl_logins.With("locked_out").Inc()
+		slog.Debug("login refused", "user", user, "network", network, "err", err)
+		return err
+	}
+	return nil
+}
+
+// count_login records the outcome err of a login attempt in the metrics and
+// the login guard.
+func (a *authenticator) count_login(user string, err error) {
+	network := network_key(a.remote_ip)
+	now := a.now()
+	if err == nil {
+		a.metrics.sasl_logins.With("success").Inc()
+		a.guard.succeeded(network, user, now)
+		return
+	}
+	a.metrics.sasl_logins.With("failure").Inc()
+	slog.Debug("login failed", "user", user, "err", err)
+	for _, scope := range a.guard.failed(a.config, network, user, now) {
+		a.metrics.sasl_lockouts.With(scope).Inc()
+		slog.Warn("locking out after too many failed logins", "scope", scope, "user", user, "network", network)
+	}
+}
+
+// is_allowed_localpart checks the length limits that apply to new accounts.
+func (a *authenticator) is_allowed_localpart(localpart string) bool {
+	return len(localpart) >= a.config.UsernameMinLength &&
+		len(localpart) <= a.config.UsernameMaxLength
+}
+
+// authenticate logs in existing accounts, and creates accounts that don't
+// exist yet on their first login.
+func (a *authenticator) authenticate(_, user, pass string) error {
+	user = accounts.CanonicalAddress(user)
+	localpart, domain, found := strings.Cut(user, "@")
+	if !found || !strings.EqualFold(domain, a.config.MailFullyQualifiedDomainName) {
+		return fmt.Errorf("rejecting login from %s: not an address on this server", user)
+	}
+	blocked, err := a.accounts.IsBlocked(user)
+	if err != nil {
+		return fmt.Errorf("rejecting login from %s: %w", user, err)
+	}
+	if blocked {
+		return fmt.Errorf("rejecting login from %s: %w", user, accounts.ErrBlocked)
+	}
+	exists, err := a.accounts.Exists(user)
+	if err != nil {
+		return fmt.Errorf("rejecting login from %s: %w", user, err)
+	}
+	if exists {
+		if err := a.accounts.Verify(user, pass); err != nil {
+			return fmt.Errorf("rejecting login from %s: %w", user, err)
+		}
+		a.record_login(user)
+		a.add_scram_keys(user, pass)
+		return nil
+	}
+
+	if !a.is_allowed_localpart(localpart) {
+		return fmt.Errorf("rejecting account creation for %s: username length out of range", user)
+	}
+	taken := func(localpart string) (bool, error) {
+		return a.accounts.Exists(localpart + "@" + domain)
+	}
+	if err := usernames.Check(a.config, localpart, taken); err != nil {
+		return fmt.Errorf("rejecting account creation for %s: %w", user, err)
+	}
+	// In invite mode the password has to start with a valid token. The whole
+	// string (token included) remains the account's password afterwards, so
+	// clients don't need to be reconfigured after the first login.
+	new_password := pass
+	token := ""
+	if a.config.InviteOnly {
+		var ok bool
+		token, new_password, ok = invite.SplitPassword(pass)
+		if !ok {
+			return fmt.Errorf("rejecting account creation for %s: invite token required", user)
+		}
+	}
+	if len(new_password) < a.config.PasswordMinLength {
+		return fmt.Errorf("rejecting account creation for %s: password too short", user)
+	}
+	// The token is redeemed before the account is created, so that two
+	// logins can't both take its last use, and given back if creating fails.
+	if token != "" {
+		if err := a.invites.Redeem(token, a.now()); err != nil {
+			return fmt.Errorf("rejecting account creation for %s: %w", user, err)
+		}
+	}
+	err = a.accounts.Create(user, pass)
+	if err != nil && token != "" {
+		// The token wasn't used up after all.
+		if err := a.invites.Unredeem(token); err != nil {
+			slog.Warn("failed to give back an invite token", "user", user, "err", err)
+		}
+	}
+	if errors.Is(err, accounts.ErrExists) {
+		// Lost a race with a concurrent first login; check the password like
+		// any other login.
+		if err := a.accounts.Verify(user, pass); err != nil {
+			return err
+		}
+		a.record_login(user)
+		a.add_scram_keys(user, pass)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create account %s: %w", user, err)
+	}
+	a.metrics.accounts_created.Inc()
+	slog.Info("created account", "user", user)
+	a.record_login(user)
+	return nil
+}
+
+// record_login notes when user last logged in, for 'chatmailctl list'.
+// Failing to doesn't stop them from logging in.
+func (a *authenticator) record_login(user string) {
+	if err := a.accounts.RecordLogin(user, a.now()); err != nil {
+		slog.Warn("failed to record login", "user", user, "err", err)
+	}
+}
+
+// add_scram_keys stores SCRAM keys for accounts from before they were
+// stored, now that their password is known. Failing to doesn't stop them
+// from logging in.
+func (a *authenticator) add_scram_keys(user string, pass string) {
+	if _, err := a.accounts.SCRAMKeys(user); !errors.Is(err, accounts.ErrNoSCRAMKeys) {
+		return
+	}
+	if err := a.accounts.SetSCRAMKeys(user, pass); err != nil {
+		slog.Warn("failed to store SCRAM keys", "user", user, "err", err)
+	}
 }
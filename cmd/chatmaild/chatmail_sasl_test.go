@@ -0,0 +1,249 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/usernames"
+
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func make_authenticator(t *testing.T) *authenticator {
+	cfg := config.NewChatmailConfig(default_domain())
+	dir := t.TempDir()
+	cfg.MailboxesDirectory = filepath.Join(dir, "mail")
+	cfg.InviteTokensFile = filepath.Join(dir, "invites.json")
+	store := accounts.NewFileStore(cfg.MailboxesDirectory)
+	a := new_authenticator(cfg, store, new_chatmaild_metrics(store), new_login_guard())
+	a.scram_secret = []byte("test secret")
+	return a
+}
+
+// make_login returns an address and password that fit the default length
+// limits for new accounts.
+func make_login() (string, string) {
+	const alphanumeric = "abcdefghijklmnopqrstuvwxyz0123456789"
+	user := fmt.Sprintf("%s@%s", random_choices(alphanumeric, 9), default_domain())
+	return user, random_choices(alphanumeric, 16)
+}
+
+func TestSaslCreateAccountOnFirstLogin(t *testing.T) {
+	auth := make_authenticator(t)
+	user, password := make_login()
+
+	if err := auth.authenticate("", user, password); err != nil {
+		t.Fatalf("authenticate() for new account = %v; want nil", err)
+	}
+	if err := auth.authenticate("", user, password); err != nil {
+		t.Fatalf("authenticate() for existing account = %v; want nil", err)
+	}
+	if err := auth.authenticate("", user, password+"x"); err == nil {
+		t.Fatal("authenticate() with wrong password succeeded")
+	}
+	if err := auth.authenticate("", "ac_abcdefghij@other.example", password); err == nil {
+		t.Fatal("authenticate() for another domain succeeded")
+	}
+	if err := auth.authenticate("", "x@"+default_domain(), password); err == nil {
+		t.Fatal("authenticate() with too-short username succeeded")
+	}
+	other_user, _ := make_login()
+	if err := auth.authenticate("", other_user, "short"); err == nil {
+		t.Fatal("authenticate() with too-short password succeeded")
+	}
+}
+
+func TestSaslAccountDatabase(t *testing.T) {
+	auth := make_authenticator(t)
+	auth.config.AccountDatabaseFile = filepath.Join(t.TempDir(), "accounts.sqlite")
+	store, err := open_account_store(auth.config)
+	if err != nil {
+		t.Fatalf("open_account_store() = %v; want nil", err)
+	}
+	if _, ok := store.(*accounts.SQLStore); !ok {
+		t.Fatalf("open_account_store() with AccountDatabaseFile = %T; want *accounts.SQLStore", store)
+	}
+	auth.accounts = store
+	user, password := make_login()
+	if err := auth.authenticate("", user, password); err != nil {
+		t.Fatalf("authenticate() for new account = %v; want nil", err)
+	}
+	if exists, err := store.Exists(user); err != nil || !exists {
+		t.Fatalf("Exists() in the database after the first login = %t, %v; want true, nil", exists, err)
+	}
+	if exists, err := accounts.NewFileStore(auth.config.MailboxesDirectory).Exists(user); err != nil || exists {
+		t.Fatalf("Exists() in the mailboxes after the first login = %t, %v; want false, nil", exists, err)
+	}
+	if err := auth.authenticate("", user, password+"x"); err == nil {
+		t.Fatal("authenticate() with wrong password succeeded")
+	}
+}
+
+func TestSaslInviteOnly(t *testing.T) {
+	auth := make_authenticator(t)
+	auth.config.InviteOnly = true
+	user, password := make_login()
+
+	if err := auth.authenticate("", user, password); err == nil {
+		t.Fatal("authenticate() without invite token succeeded in invite mode")
+	}
+	if err := auth.authenticate("", user, "bogus:"+password); err == nil {
+		t.Fatal("authenticate() with unknown invite token succeeded")
+	}
+
+	tok, err := auth.invites.Create(time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full_password := tok.Token + ":" + password
+	if err := auth.authenticate("", user, full_password); err != nil {
+		t.Fatalf("authenticate() with invite token = %v; want nil", err)
+	}
+	// The token-prefixed password stays valid for later logins.
+	if err := auth.authenticate("", user, full_password); err != nil {
+		t.Fatalf("second authenticate() with invite token = %v; want nil", err)
+	}
+
+	other_user, other_password := make_login()
+	if err := auth.authenticate("", other_user, tok.Token+":"+other_password); err == nil {
+		t.Fatal("authenticate() with used-up invite token succeeded")
+	}
+}
+
+func TestSaslBlockedAndLastLogin(t *testing.T) {
+	auth := make_authenticator(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	auth.now = func() time.Time { return now }
+	user, password := make_login()
+
+	if err := auth.authenticate("", user, password); err != nil {
+		t.Fatalf("authenticate() for new account = %v; want nil", err)
+	}
+	info, err := auth.accounts.Info(user)
+	if err != nil || !info.LastLogin.Equal(now) {
+		t.Fatalf("last login after creation = %v, %v; want %v", info.LastLogin, err, now)
+	}
+	now = now.Add(time.Hour)
+	if err := auth.authenticate("", user, password); err != nil {
+		t.Fatalf("authenticate() for existing account = %v; want nil", err)
+	}
+	if info, err := auth.accounts.Info(user); err != nil || !info.LastLogin.Equal(now) {
+		t.Fatalf("last login after second login = %v, %v; want %v", info.LastLogin, err, now)
+	}
+
+	if err := auth.accounts.Block(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.authenticate("", user, password); !errors.Is(err, accounts.ErrBlocked) {
+		t.Fatalf("authenticate() for blocked account = %v; want %v", err, accounts.ErrBlocked)
+	}
+	// Blocked addresses can't be created either.
+	other_user, other_password := make_login()
+	if err := auth.accounts.Block(other_user); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.authenticate("", other_user, other_password); !errors.Is(err, accounts.ErrBlocked) {
+		t.Fatalf("authenticate() for blocked new account = %v; want %v", err, accounts.ErrBlocked)
+	}
+}
+
+func TestSaslReservedUsernames(t *testing.T) {
+	auth := make_authenticator(t)
+	auth.config.UsernameMinLength = 4
+	auth.config.UsernameMaxLength = 12
+	_, password := make_login()
+
+	for _, localpart := range []string{"postmaster", "Abuse", "admin2"} {
+		if err := auth.authenticate("", localpart+"@"+default_domain(), password); !errors.Is(err, usernames.ErrReserved) {
+			t.Errorf("authenticate() creating %s = %v; want %v", localpart, err, usernames.ErrReserved)
+		}
+	}
+	if err := auth.authenticate("", "zoë@"+default_domain(), password); !errors.Is(err, usernames.ErrNotASCII) {
+		t.Errorf("authenticate() creating a Unicode username = %v; want %v", err, usernames.ErrNotASCII)
+	}
+
+	auth.config.AllowUnicodeUsernames = true
+	if err := auth.authenticate("", "paypal@"+default_domain(), password); err != nil {
+		t.Fatalf("authenticate() for new account = %v; want nil", err)
+	}
+	if err := auth.authenticate("", "раураl@"+default_domain(), password); !errors.Is(err, usernames.ErrConfusable) {
+		t.Errorf("authenticate() creating a lookalike of an account = %v; want %v", err, usernames.ErrConfusable)
+	}
+	if err := auth.authenticate("", "zoë@"+default_domain(), password); err != nil {
+		t.Errorf("authenticate() creating a Unicode username = %v; want nil", err)
+	}
+}
+
+func TestSaslAddressCase(t *testing.T) {
+	auth := make_authenticator(t)
+	user, password := make_login()
+
+	// Blocking an address blocks every spelling of it.
+	if err := auth.accounts.Block(accounts.CanonicalAddress(user)); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.login("", strings.ToUpper(user), password); !errors.Is(err, accounts.ErrBlocked) {
+		t.Fatalf("login() for a blocked address in capitals = %v; want %v", err, accounts.ErrBlocked)
+	}
+	if exists, err := auth.accounts.Exists(strings.ToUpper(user)); err != nil || exists {
+		t.Fatalf("Exists() in capitals = %t, %v; want false, nil", exists, err)
+	}
+
+	// Every spelling logs in to the same account.
+	other, other_password := make_login()
+	if err := auth.login("", strings.ToUpper(other), other_password); err != nil {
+		t.Fatalf("login() creating an account in capitals = %v; want nil", err)
+	}
+	if err := auth.login("", other, other_password); err != nil {
+		t.Fatalf("login() in lowercase = %v; want nil", err)
+	}
+	if err := auth.login("", other, "another password"); err == nil {
+		t.Fatal("login() in lowercase with a different password succeeded")
+	}
+	if count, err := auth.accounts.Count(); err != nil || count != 1 {
+		t.Fatalf("Count() = %d, %v; want 1, nil", count, err)
+	}
+	if err := run_scram(auth.scram(nil), new_scram_client(strings.ToUpper(other), other_password)); err != nil {
+		t.Fatalf("SCRAM-SHA-256 login in capitals = %v; want nil", err)
+	}
+}
+
+// failing_store fails to create accounts.
+type failing_store struct {
+	accounts.Store
+}
+
+func (failing_store) Create(string, string) error {
+	return errors.New("disk full")
+}
+
+func TestSaslInviteSurvivesFailedCreation(t *testing.T) {
+	auth := make_authenticator(t)
+	auth.config.InviteOnly = true
+	tok, err := auth.invites.Create(time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, password := make_login()
+	store := auth.accounts
+	auth.accounts = failing_store{store}
+	if err := auth.authenticate("", user, tok.Token+":"+password); err == nil {
+		t.Fatal("authenticate() succeeded without creating the account")
+	}
+	if err := auth.invites.Check(tok.Token, time.Now()); err != nil {
+		t.Fatalf("Check() after failing to create an account = %v; want nil", err)
+	}
+	auth.accounts = store
+	if err := auth.authenticate("", user, tok.Token+":"+password); err != nil {
+		t.Fatalf("authenticate() with the token given back = %v; want nil", err)
+	}
+	// Different spellings of the address are the same account, and don't
+	// need another invite.
+	if err := auth.authenticate("", strings.ToUpper(user), tok.Token+":"+password); err != nil {
+		t.Fatalf("authenticate() in capitals = %v; want nil", err)
+	}
+}
@@ -1,29 +1,116 @@
 package main
 
 import (
-	"fmt"
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/logging"
+
+	"flag"
 	"log"
-	"net"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
 	"syscall"
 )
 
-func make_listener(uri string) (net.Listener, error) {
-	parts := strings.SplitN(uri, "://", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("Invalid listen URI (missing '://' between protocol and details): %s", uri)
+// setup_logging sends all logs, including those from the log package,
+// through a logger that redacts addresses.
+func setup_logging(cm_config config.ChatmailConfig, checkpassword bool) error {
+	var salt []byte
+	var err error
+	if checkpassword {
+		// checkpassword runs as the IMAP server's user, which might not be
+		// allowed to read the salt. Without it, the local parts of addresses
+		// are left out entirely.
+		salt, _ = logging.ReadSalt(cm_config.LogSaltFile)
+	} else if salt, err = logging.LoadSalt(cm_config.LogSaltFile); err != nil {
+		return err
+	}
+	logger, err := logging.New(os.Stderr, cm_config.LogLevel, cm_config.LogFormat, logging.NewRedactor(salt))
+	if err != nil {
+		return err
 	}
-	listenNetwork, listenAddr := parts[0], parts[1]
-	return net.Listen(listenNetwork, listenAddr)
+	slog.SetDefault(logger)
+	return nil
+}
+
+// open_account_store opens the SQLite database in AccountDatabaseFile if
+// there is one, and otherwise keeps accounts in MailboxesDirectory like the
+// upstream chatmail does.
+func open_account_store(cm_config config.ChatmailConfig) (accounts.Store, error) {
+	if cm_config.AccountDatabaseFile == "" {
+		return accounts.NewFileStore(cm_config.MailboxesDirectory), nil
+	}
+	return accounts.OpenSQLStore(cm_config.AccountDatabaseFile, cm_config.MailboxesDirectory)
 }
 
 func main() {
-	milter_listen_addr := "unix:///tmp/mandatory-encryption-milter.sock"
-	sasl_listen_addr := "unix:///tmp/sasl.sock"
+	config_file := flag.String("config", "chatmail.json", "path to the chatmail server configuration file, or \"\" to configure chatmail only with CHATMAIL_* environment variables and flags")
+	seed := flag.String("seed", "", "directory of files to copy next to the configuration file before starting, replacing outdated copies")
+	overrides := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *seed != "" {
+		if err := seed_dir(*seed, filepath.Dir(*config_file)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	loader := config.DefaultLoader(*config_file, overrides)
+	cm_config, _, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "check" {
+		os.Exit(check_main(cm_config, flag.Args()[1:]))
+	}
+
+	if err := setup_logging(cm_config, flag.Arg(0) == "checkpassword"); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "checkpassword" {
+		os.Exit(checkpassword_main(cm_config, flag.Args()[1:]))
+	}
+
+	live := new_live_config(cm_config, func() (config.ChatmailConfig, error) {
+		cm_config, _, err := loader.Load()
+		return cm_config, err
+	})
+	store, err := open_account_store(cm_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics := new_chatmaild_metrics(store)
+	if cm_config.MetricsListenAddress != "" {
+		metrics_server, err := new_metrics_server(cm_config.MetricsListenAddress, metrics)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := metrics_server.serve(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	milter_server, err := new_milter_server(milter_listen_addr)
+	guard := new_login_guard()
+	var admin_server *admin_server
+	if cm_config.AdminListenAddress != "" {
+		admin_server, err = new_admin_server(cm_config.AdminListenAddress, live, store, metrics, guard)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := admin_server.serve(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	milter_server, err := new_milter_server(cm_config.MilterListenAddress, live, metrics)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -35,7 +122,7 @@ func main() {
 		}
 	}()
 
-	sasl_server, err := new_sasl_server(sasl_listen_addr)
+	sasl_server, err := new_sasl_server(cm_config.SASLListenAddress, live, store, metrics, guard)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -59,7 +146,10 @@ func main() {
 		if err := sasl_server.stop(); err != nil {
 			log.Fatal("Failed to close SASL server: ", err)
 		}
+		if admin_server != nil {
+			if err := admin_server.stop(); err != nil {
+				log.Fatal("Failed to close admin socket: ", err)
+			}
+		}
 	}()
-
-	// TODO: SQLite account database?
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// 'chatmaild check' runs a saved message through the same checks as the
+// milter and explains what it decided, so that reports of rejected messages
+// can be reproduced.
+
+// Exit codes for 'chatmaild check'.
+const (
+	check_accepted = 0
+	check_rejected = 1
+	check_error    = 2
+)
+
+// decision_step is one question the milter answered while deciding.
+type decision_step struct {
+	check  string
+	yes    bool
+	detail string
+}
+
+// decision_trace records the steps that led to a milter decision. A nil
+// trace records nothing, which is what the milter itself uses.
+type decision_trace struct {
+	steps []decision_step
+}
+
+func (t *decision_trace) add(check string, yes bool, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, decision_step{check, yes, fmt.Sprintf(format, args...)})
+}
+
+var openpgp_packet_names = map[byte]string{
+	1:  "PKESK",
+	3:  "SKESK",
+	18: "SEIPD",
+}
+
+func packet_names(types []byte) string {
+	if len(types) == 0 {
+		return "no packets"
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		if name, ok := openpgp_packet_names[t]; ok {
+			names[i] = name
+		} else {
+			names[i] = fmt.Sprintf("packet type %d", t)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// address_list collects a repeatable (or comma-separated) address flag.
+type address_list []string
+
+func (l *address_list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *address_list) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		*l = append(*l, strings.TrimSpace(s))
+	}
+	return nil
+}
+
+// header_addresses lists the addresses in the named headers.
+func header_addresses(h mail.Header, names ...string) ([]string, error) {
+	var addresses []string
+	for _, name := range names {
+		list, err := h.AddressList(name)
+		if errors.Is(err, mail.ErrHeaderNotPresent) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s header: %w", name, err)
+		}
+		for _, a := range list {
+			addresses = append(addresses, a.Address)
+		}
+	}
+	return addresses, nil
+}
+
+// do_check explains what the milter would do with the message in r. Without
+// an envelope sender or recipients, they're taken from the headers.
+func do_check(w io.Writer, cm_config config.ChatmailConfig, r io.Reader, from string, to []string) (milter_decision, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	// The MTA passes the message on with CRLF line endings, but saved
+	// messages often have bare LFs.
+	data = bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	from_source := ""
+	if from == "" {
+		addresses, err := header_addresses(msg.Header, "From")
+		if err != nil || len(addresses) != 1 {
+			return "", fmt.Errorf("pass -from, since the From header doesn't have exactly one address")
+		}
+		from, from_source = addresses[0], " (from the From header)"
+	}
+	to_source := ""
+	if len(to) == 0 {
+		to, err = header_addresses(msg.Header, "To", "Cc")
+		if err != nil || len(to) == 0 {
+			return "", fmt.Errorf("pass -to, since there are no addresses in the To and Cc headers")
+		}
+		to_source = " (from the To and Cc headers)"
+	}
+
+	cm := new_chatmail_milter(cm_config, nil, nil)
+	cm.mailFrom = from
+	cm.rcptTos = to
+	for name, values := range msg.Header {
+		for _, value := range values {
+			if _, err := cm.Header(name, value, nil); err != nil {
+				return "", err
+			}
+		}
+	}
+	if _, err := io.Copy(cm.body, msg.Body); err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(w, "envelope from: %s%s\n", from, from_source)
+	fmt.Fprintf(w, "envelope to:   %s%s\n\n", strings.Join(to, ", "), to_source)
+	var trace decision_trace
+	decision, err := cm.decide(&trace)
+	if err != nil {
+		decision = decision_malformed
+	}
+	for _, step := range trace.steps {
+		answer := "[yes]"
+		if !step.yes {
+			answer = "[no]"
+		}
+		fmt.Fprintf(w, "%-5s %s: %s\n", answer, step.check, step.detail)
+	}
+	verdict := "rejected"
+	if decision.accepted() {
+		verdict = "accepted"
+	}
+	fmt.Fprintf(w, "\nverdict: %s (%s)\n", verdict, decision)
+	if !decision.accepted() && cm.monitor_only() {
+		fmt.Fprintf(w, "not enforced in monitor-only mode: the message would be delivered with %s: %s\n", policy_header, policy_header_value(decision))
+	}
+	return decision, nil
+}
+
+func check_main(cm_config config.ChatmailConfig, args []string) int {
+	checkCmd := flag.NewFlagSet("check", flag.ExitOnError)
+	from := checkCmd.String("from", "", "envelope sender (default: the address in the From header)")
+	var to address_list
+	checkCmd.Var(&to, "to", "envelope recipient, may be repeated (default: the addresses in the To and Cc headers)")
+	checkCmd.Usage = func() {
+		fmt.Fprintln(checkCmd.Output(), "usage: chatmaild check [-from address] [-to address] message.eml")
+		checkCmd.PrintDefaults()
+	}
+	checkCmd.Parse(args)
+	if checkCmd.NArg() != 1 {
+		checkCmd.Usage()
+		return check_error
+	}
+
+	f, err := os.Open(checkCmd.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return check_error
+	}
+	defer f.Close()
+	decision, err := do_check(os.Stdout, cm_config, f, *from, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return check_error
+	}
+	if !decision.accepted() {
+		return check_rejected
+	}
+	return check_accepted
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDoCheck(t *testing.T) {
+	cfg := config.NewChatmailConfig(default_domain())
+	sender, _ := make_account()
+	external := "someone@external.example"
+	encrypted := emlctx{sender, external, CommonEncryptedSubjects[0]}
+	plain := emlctx_default_subject(sender, external)
+	tests := []struct {
+		name  string
+		data  []byte
+		from  string
+		to    []string
+		want  milter_decision
+		steps []string
+	}{
+		{
+			name: "encrypted",
+			data: renderemail("encrypted.eml", encrypted),
+			want: decision_encrypted,
+			steps: []string{
+				"[yes] subject: ",
+				"[yes] MIME parts: the second part is application/octet-stream",
+				"[yes] OpenPGP packets: found PKESK, PKESK, SEIPD",
+				"[yes] recipient " + external + ": is on another domain, and the message is encrypted",
+			},
+		},
+		{
+			name: "unencrypted with LF line endings",
+			data: bytes.ReplaceAll(renderemail("plain.eml", plain), []byte("\r\n"), []byte("\n")),
+			to:   []string{"friend@" + default_domain(), external},
+			want: decision_unencrypted,
+			steps: []string{
+				"[no]  subject: ",
+				"[yes] recipient friend@" + default_domain() + ": is on the sender's domain",
+				"[no]  recipient " + external + ": is on another domain, and the message is neither encrypted nor a Secure-Join request",
+			},
+		},
+		{
+			name:  "Secure-Join request",
+			data:  append([]byte("Secure-Join: vc-request\r\n"), renderemail("plain.eml", plain)...),
+			want:  decision_securejoin,
+			steps: []string{"[yes] recipient " + external + ": is on another domain, and the message is exempt from encryption as a Secure-Join vc-request"},
+		},
+		{
+			name:  "forged From",
+			data:  renderemail("encrypted.eml", encrypted),
+			from:  "other@" + default_domain(),
+			want:  decision_forged_from,
+			steps: []string{"[no]  From header: " + sender + " doesn't match the envelope sender other@" + default_domain()},
+		},
+		{
+			name:  "literal data instead of encrypted data",
+			data:  renderemail("literal.eml", encrypted),
+			want:  decision_unencrypted,
+			steps: []string{"[no]  OpenPGP packets: "},
+		},
+		{
+			name:  "passthrough recipient",
+			data:  renderemail("plain.eml", plain),
+			to:    []string{"xstore@testrun.org"},
+			want:  decision_passthrough_recipient,
+			steps: []string{"[yes] recipient xstore@testrun.org: is in PassthroughRecipientsList"},
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		got, err := do_check(&out, cfg, bytes.NewReader(test.data), test.from, test.to)
+		if err != nil || got != test.want {
+			t.Errorf("do_check(%s) = %q, %v; want %q, nil", test.name, got, err, test.want)
+			continue
+		}
+		if !strings.Contains(out.String(), "\nverdict: ") || !strings.HasSuffix(out.String(), "("+string(test.want)+")\n") {
+			t.Errorf("do_check(%s) output doesn't end with the verdict:\n%s", test.name, out.String())
+		}
+		for _, step := range test.steps {
+			if !strings.Contains(out.String(), step) {
+				t.Errorf("do_check(%s) output doesn't contain %q:\n%s", test.name, step, out.String())
+			}
+		}
+	}
+}
+
+func TestDoCheckNeedsEnvelope(t *testing.T) {
+	cfg := config.NewChatmailConfig(default_domain())
+	data := []byte("Subject: hi\r\n\r\nhello\r\n")
+	if _, err := do_check(&bytes.Buffer{}, cfg, bytes.NewReader(data), "", []string{"a@chat.example"}); err == nil || !strings.Contains(err.Error(), "pass -from") {
+		t.Errorf("do_check() without a sender = %v; want an error asking for -from", err)
+	}
+	if _, err := do_check(&bytes.Buffer{}, cfg, bytes.NewReader(data), "a@chat.example", nil); err == nil || !strings.Contains(err.Error(), "pass -to") {
+		t.Errorf("do_check() without recipients = %v; want an error asking for -to", err)
+	}
+}
+
+func TestOpenPGPPacketsTruncated(t *testing.T) {
+	for _, payload := range [][]byte{{0xC1}, {0xC1, 0xC0}, {0xC1, 0xFF, 0, 0}, {0xC1, 5, 0}} {
+		if IsEncryptedOpenPGPPayload(payload) {
+			t.Errorf("IsEncryptedOpenPGPPayload(%x) = true; want false", payload)
+		}
+	}
+}
+
+func TestDoCheckMonitorOnly(t *testing.T) {
+	cfg := config.NewChatmailConfig(default_domain())
+	cfg.MilterMonitorOnly = true
+	sender, _ := make_account()
+	var out bytes.Buffer
+	data := renderemail("plain.eml", emlctx_default_subject(sender, "someone@external.example"))
+	if got, err := do_check(&out, cfg, bytes.NewReader(data), "", nil); err != nil || got != decision_unencrypted {
+		t.Fatalf("do_check() = %q, %v; want %q, nil", got, err, decision_unencrypted)
+	}
+	if want := "not enforced in monitor-only mode: the message would be delivered with X-Chatmail-Policy: would-reject; reason=rejected_unencrypted\n"; !strings.HasSuffix(out.String(), want) {
+		t.Fatalf("do_check() output doesn't end with %q:\n%s", want, out.String())
+	}
+}
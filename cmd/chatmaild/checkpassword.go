@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/go-dovecot-sasl"
+)
+
+// Dovecot can't ask another SASL server about logins, but it can run a
+// checkpassword program (https://cr.yp.to/checkpwd/interface.html).
+// 'chatmaild checkpassword' is that program: it passes the login on to the
+// SASL socket of the running chatmaild, so that IMAP logins create accounts
+// the same way as SMTP logins do.
+
+// Exit codes defined by the checkpassword interface.
+const (
+	checkpassword_ok             = 0
+	checkpassword_rejected       = 1
+	checkpassword_temporary_fail = 111
+)
+
+// checkpassword_fd is where the checkpassword caller writes the credentials.
+const checkpassword_fd = 3
+
+// The interface limits the credentials to 512 bytes.
+const checkpassword_max_request = 512
+
+func read_checkpassword_request(r io.Reader) (string, string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, checkpassword_max_request+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) > checkpassword_max_request {
+		return "", "", errors.New("checkpassword request is too long")
+	}
+	fields := bytes.SplitN(data, []byte{0}, 3)
+	if len(fields) < 3 {
+		return "", "", errors.New("malformed checkpassword request")
+	}
+	return string(fields[0]), string(fields[1]), nil
+}
+
+func dial_uri(uri string) (net.Conn, error) {
+	network, addr, found := strings.Cut(uri, "://")
+	if !found {
+		return nil, fmt.Errorf("Invalid URI (missing '://' between protocol and details): %s", uri)
+	}
+	addr, _, _ = strings.Cut(addr, "?")
+	if network != "unix" && network != "tcp" {
+		return nil, fmt.Errorf("can't connect to chatmaild at %s; use a unix:// or tcp:// address", uri)
+	}
+	return net.Dial(network, addr)
+}
+
+// check_password_via_sasl logs in to the SASL server at sasl_uri, passing on
+// the client's address if it's known. Rejected logins return a
+// dovecotsasl.AuthFail error.
+func check_password_via_sasl(sasl_uri string, user string, pass string, remote_ip net.IP) error {
+	conn, err := dial_uri(sasl_uri)
+	if err != nil {
+		return err
+	}
+	client, err := dovecotsasl.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	var params []string
+	if remote_ip != nil {
+		params = append(params, dovecotsasl.RemoteIP(remote_ip))
+	}
+	return client.Do("imap", sasl.NewPlainClient("", user, pass), params...)
+}
+
+// checkpassword checks the credentials in request, from a client at
+// remote_ip (which may be nil), and returns the user and the exit code for
+// the checkpassword interface.
+func checkpassword(cm_config config.ChatmailConfig, request io.Reader, remote_ip net.IP) (string, int) {
+	user, pass, err := read_checkpassword_request(request)
+	if err != nil {
+		slog.Warn("bad checkpassword request", "err", err)
+		return "", checkpassword_rejected
+	}
+	// Dovecot uses the USER that this returns, so that mail for every
+	// spelling of the address ends up in the same Maildir.
+	user = accounts.CanonicalAddress(user)
+	err = check_password_via_sasl(cm_config.SASLListenAddress, user, pass, remote_ip)
+	var auth_fail dovecotsasl.AuthFail
+	if errors.As(err, &auth_fail) {
+		return user, checkpassword_rejected
+	}
+	if err != nil {
+		slog.Error("failed to check password with chatmaild", "user", user, "err", err)
+		return user, checkpassword_temporary_fail
+	}
+	return user, checkpassword_ok
+}
+
+// checkpassword_main runs the checkpassword program. On success it runs the
+// program named in args, as the interface requires, and doesn't return.
+func checkpassword_main(cm_config config.ChatmailConfig, args []string) int {
+	// Dovecot says where the client is in the environment, like tcpserver.
+	remote_ip := net.ParseIP(os.Getenv("TCPREMOTEIP"))
+	user, code := checkpassword(cm_config, os.NewFile(checkpassword_fd, "checkpassword request"), remote_ip)
+	if code != checkpassword_ok || len(args) == 0 {
+		return code
+	}
+	env := append(os.Environ(), "USER="+user)
+	err := syscall.Exec(args[0], args, env)
+	slog.Error("failed to run program after checking password", "program", args[0], "err", err)
+	return checkpassword_temporary_fail
+}
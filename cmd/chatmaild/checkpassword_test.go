@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCheckpasswordRequest(t *testing.T) {
+	user, pass, err := read_checkpassword_request(strings.NewReader("user@chat.example\x00secret\x001700000000\x00"))
+	if err != nil || user != "user@chat.example" || pass != "secret" {
+		t.Fatalf("read_checkpassword_request() = %q, %q, %v; want %q, %q, nil", user, pass, err, "user@chat.example", "secret")
+	}
+	if _, _, err := read_checkpassword_request(strings.NewReader("user@chat.example")); err == nil {
+		t.Fatal("read_checkpassword_request() accepted a request without a password")
+	}
+	if _, _, err := read_checkpassword_request(strings.NewReader(strings.Repeat("a", 600) + "\x00b\x00\x00")); err == nil {
+		t.Fatal("read_checkpassword_request() accepted an oversized request")
+	}
+}
+
+func TestCheckpasswordViaSasl(t *testing.T) {
+	auth := make_authenticator(t)
+	cfg := auth.config
+	cfg.LoginFailuresPerIP = 2
+	cfg.SASLListenAddress = "unix://" + filepath.Join(t.TempDir(), "sasl.sock")
+	server, err := new_sasl_server(cfg.SASLListenAddress, new_live_config(cfg, nil), auth.accounts, auth.metrics, auth.guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve()
+	defer server.stop()
+
+	user, password := make_login()
+	request := func(pass string) *strings.Reader {
+		return strings.NewReader(user + "\x00" + pass + "\x00\x00")
+	}
+	if got, code := checkpassword(cfg, request(password), nil); code != checkpassword_ok || got != user {
+		t.Fatalf("checkpassword() for a new account = %q, %d; want %q, %d", got, code, user, checkpassword_ok)
+	}
+	if _, code := checkpassword(cfg, request(password), nil); code != checkpassword_ok {
+		t.Fatalf("checkpassword() for an existing account = %d; want %d", code, checkpassword_ok)
+	}
+	// Dovecot is told the address that the account is stored under.
+	upper := strings.NewReader(strings.ToUpper(user) + "\x00" + password + "\x00\x00")
+	if got, code := checkpassword(cfg, upper, nil); code != checkpassword_ok || got != user {
+		t.Fatalf("checkpassword() in capitals = %q, %d; want %q, %d", got, code, user, checkpassword_ok)
+	}
+	if _, code := checkpassword(cfg, request(password+"x"), nil); code != checkpassword_rejected {
+		t.Fatalf("checkpassword() with the wrong password = %d; want %d", code, checkpassword_rejected)
+	}
+
+	// The client's address reaches the SASL server, so that it can lock
+	// out networks that keep failing.
+	attacker := net.ParseIP("192.0.2.1")
+	for range cfg.LoginFailuresPerIP {
+		checkpassword(cfg, request(password+"x"), attacker)
+	}
+	if _, code := checkpassword(cfg, request(password), attacker); code != checkpassword_rejected {
+		t.Fatalf("checkpassword() from a locked out network = %d; want %d", code, checkpassword_rejected)
+	}
+	if _, code := checkpassword(cfg, request(password), net.ParseIP("2001:db8::1")); code != checkpassword_ok {
+		t.Fatalf("checkpassword() from another network = %d; want %d", code, checkpassword_ok)
+	}
+
+	cfg.SASLListenAddress = "unix://" + filepath.Join(t.TempDir(), "missing.sock")
+	if _, code := checkpassword(cfg, request(password), nil); code != checkpassword_temporary_fail {
+		t.Fatalf("checkpassword() without chatmaild running = %d; want %d", code, checkpassword_temporary_fail)
+	}
+}
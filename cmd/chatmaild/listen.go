@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// make_listener opens the socket described by uri, which is one of:
+//
+//	unix:///path/to/socket?mode=0660&group=mail
+//	tcp://host:port
+//	tls://host:port?cert=/path/to/cert.pem&key=/path/to/key.pem
+//	systemd://name
+//
+// where systemd://name is the socket that systemd passed in with the
+// FileDescriptorName= name. Sockets that systemd passed in for a unix:// or
+// tcp:// address are used instead of opening the address again.
+func make_listener(uri string) (net.Listener, error) {
+	scheme, rest, found := strings.Cut(uri, "://")
+	if !found {
+		return nil, fmt.Errorf("Invalid listen URI (missing '://' between protocol and details): %s", uri)
+	}
+	addr, raw_query, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(raw_query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid options in listen URI %s: %w", uri, err)
+	}
+	if err := check_listen_options(scheme, query); err != nil {
+		return nil, fmt.Errorf("Invalid listen URI %s: %w", uri, err)
+	}
+	inherited, err := systemd_sockets()
+	if err != nil {
+		return nil, err
+	}
+
+	switch scheme {
+	case "systemd":
+		if l := find_socket_by_name(inherited, addr); l != nil {
+			return l, nil
+		}
+		return nil, fmt.Errorf("systemd didn't pass in a socket called %q", addr)
+	case "unix":
+		if l := find_socket_by_address(inherited, "unix", addr); l != nil {
+			return l, nil
+		}
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := set_socket_permissions(addr, query.Get("mode"), query.Get("group")); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	case "tls":
+		cert, err := tls.LoadX509KeyPair(query.Get("cert"), query.Get("key"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate for %s: %w", uri, err)
+		}
+		l := find_socket_by_address(inherited, "tcp", addr)
+		if l == nil {
+			l, err = net.Listen("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return tls.NewListener(l, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}), nil
+	default:
+		if l := find_socket_by_address(inherited, scheme, addr); l != nil {
+			return l, nil
+		}
+		return net.Listen(scheme, addr)
+	}
+}
+
+// check_listen_options rejects options that don't apply to scheme, so that
+// typos don't silently leave a socket with the wrong permissions.
+func check_listen_options(scheme string, query url.Values) error {
+	allowed := map[string][]string{
+		"unix": {"mode", "group"},
+		"tls":  {"cert", "key"},
+	}[scheme]
+	for name := range query {
+		known := false
+		for _, a := range allowed {
+			known = known || name == a
+		}
+		if !known {
+			return fmt.Errorf("unknown option %q for %s sockets", name, scheme)
+		}
+	}
+	if scheme == "tls" && (query.Get("cert") == "" || query.Get("key") == "") {
+		return fmt.Errorf("tls sockets need cert and key options")
+	}
+	return nil
+}
+
+func set_socket_permissions(path string, mode string, group string) error {
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0777 {
+			return fmt.Errorf("invalid socket mode %q", mode)
+		}
+		if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return err
+			}
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
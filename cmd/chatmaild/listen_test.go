@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMakeListenerUnixOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sasl.sock")
+	l, err := make_listener(fmt.Sprintf("unix://%s?mode=0660&group=%d", path, os.Getgid()))
+	if err != nil {
+		t.Fatalf("make_listener() = %v; want nil", err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Fatalf("socket mode = %v; want %v", info.Mode().Perm(), os.FileMode(0660))
+	}
+}
+
+func TestMakeListenerErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, uri := range []string{
+		"/run/chatmail/sasl.sock",
+		"unix://" + filepath.Join(dir, "a.sock") + "?mode=0999",
+		"unix://" + filepath.Join(dir, "b.sock") + "?mdoe=0660",
+		"unix://" + filepath.Join(dir, "c.sock") + "?group=no-such-group-here",
+		"tcp://127.0.0.1:0?mode=0660",
+		"tls://127.0.0.1:0?cert=" + filepath.Join(dir, "cert.pem"),
+		"systemd://milter",
+	} {
+		if l, err := make_listener(uri); err == nil {
+			l.Close()
+			t.Fatalf("make_listener(%q) succeeded; want an error", uri)
+		}
+	}
+}
+
+func write_self_signed_cert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{default_domain()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert_file := filepath.Join(dir, "cert.pem")
+	key_file := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key_der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert_file, key_file
+}
+
+func TestMakeListenerTLS(t *testing.T) {
+	cert_file, key_file := write_self_signed_cert(t, t.TempDir())
+	l, err := make_listener(fmt.Sprintf("tls://127.0.0.1:0?cert=%s&key=%s", cert_file, key_file))
+	if err != nil {
+		t.Fatalf("make_listener() = %v; want nil", err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- conn.(*tls.Conn).Handshake()
+	}()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake with the listener failed: %v", err)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("server side of the TLS handshake failed: %v", err)
+	}
+}
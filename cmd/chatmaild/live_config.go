@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"errors"
+	"reflect"
+	"slices"
+	"sync/atomic"
+)
+
+// restart_fields are the settings that chatmaild only reads when it starts:
+// the sockets it listens on, where it keeps things, and how it logs.
+// Reloading keeps their old values until the next restart.
+var restart_fields = []string{
+	"MilterListenAddress",
+	"SASLListenAddress",
+	"MetricsListenAddress",
+	"AdminListenAddress",
+	"MailboxesDirectory",
+	"AccountDatabaseFile",
+	"InviteTokensFile",
+	"LogLevel",
+	"LogFormat",
+	"LogSaltFile",
+}
+
+// live_config is the configuration that chatmaild is running with. Every
+// milter connection and login uses whatever it is when they start, so that
+// reloading it takes effect without a restart.
+type live_config struct {
+	current atomic.Pointer[config.ChatmailConfig]
+	// load reads the configuration again. Without it, reloading fails.
+	load func() (config.ChatmailConfig, error)
+}
+
+func new_live_config(cm_config config.ChatmailConfig, load func() (config.ChatmailConfig, error)) *live_config {
+	live := &live_config{load: load}
+	live.current.Store(&cm_config)
+	return live
+}
+
+func (l *live_config) get() config.ChatmailConfig {
+	return *l.current.Load()
+}
+
+// reload reads the configuration again and starts using it. It returns the
+// fields that changed, and which of those need a restart to take effect.
+func (l *live_config) reload() (changed []string, needs_restart []string, err error) {
+	if l.load == nil {
+		return nil, nil, errors.New("this chatmaild can't reload its configuration")
+	}
+	next, err := l.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	old := l.get()
+	old_v, next_v := reflect.ValueOf(old), reflect.ValueOf(&next).Elem()
+	for _, field := range config.FieldNames() {
+		if reflect.DeepEqual(old_v.FieldByName(field).Interface(), next_v.FieldByName(field).Interface()) {
+			continue
+		}
+		changed = append(changed, field)
+		if slices.Contains(restart_fields, field) {
+			needs_restart = append(needs_restart, field)
+			next_v.FieldByName(field).Set(old_v.FieldByName(field))
+		}
+	}
+	l.current.Store(&next)
+	return changed, needs_restart, nil
+}
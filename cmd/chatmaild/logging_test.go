@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/logging"
+
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-milter"
+)
+
+// locked_buffer collects log output from the milter's goroutines.
+type locked_buffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *locked_buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *locked_buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// capture_logs sends everything logged during the test to a buffer, at the
+// most verbose level.
+func capture_logs(t *testing.T, format string, salt []byte) *locked_buffer {
+	t.Helper()
+	out := &locked_buffer{}
+	logger, err := logging.New(out, "debug", format, logging.NewRedactor(salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return out
+}
+
+func TestLogsDontContainAddresses(t *testing.T) {
+	for _, format := range logging.Formats {
+		t.Run(format, func(t *testing.T) {
+			salt := []byte("0123456789abcdef")
+			logs := capture_logs(t, format, salt)
+
+			dir := t.TempDir()
+			cfg := config.NewChatmailConfig(default_domain())
+			cfg.MailboxesDirectory = filepath.Join(dir, "mail")
+			cfg.InviteTokensFile = filepath.Join(dir, "invites.json")
+			cfg.MaxEmailsPerMinutePerUser = 2
+			store := accounts.NewFileStore(cfg.MailboxesDirectory)
+			m := new_chatmaild_metrics(store)
+			socket := filepath.Join(dir, "milter.sock")
+			server, err := new_milter_server("unix://"+socket, new_live_config(cfg, nil), m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.serve()
+			defer server.stop()
+
+			sender, password := make_login()
+			// Random local parts, so that they can't turn up in the logs
+			// by coincidence.
+			forged, _ := make_login()
+			external, _ := make_login()
+			external = strings.Replace(external, default_domain(), "external.example", 1)
+			encrypted := emlctx{sender, external, CommonEncryptedSubjects[0]}
+			auth := new_authenticator(cfg, store, m, new_login_guard())
+			if err := auth.login("", sender, password); err != nil {
+				t.Fatal(err)
+			}
+			auth.login("", sender, password+"x")
+
+			// Accepted, rejected as forged, and over the rate limit: every
+			// path that logs something about a message.
+			for _, message := range []struct {
+				filename string
+				ctx      emlctx
+				want     milter.ActionCode
+			}{
+				{"encrypted.eml", encrypted, milter.ActAccept},
+				{"plain.eml", emlctx_default_subject(forged, external), milter.ActReject},
+				{"encrypted.eml", encrypted, milter.ActAccept},
+			} {
+				if act := send_through_milter(t, socket, sender, external, message.filename, message.ctx); act.Code != message.want {
+					t.Fatalf("milter action for %s from %s = %q; want %q", message.filename, message.ctx.FromAddr, act.Code, message.want)
+				}
+			}
+
+			out := logs.String()
+			for _, address := range []string{sender, external, forged} {
+				local, _, _ := strings.Cut(address, "@")
+				if strings.Contains(out, local) {
+					t.Errorf("logs contain %q from %s:\n%s", local, address, out)
+				}
+			}
+			// The logs are still useful for following one account around.
+			redacted := logging.NewRedactor(salt).Address(sender)
+			for _, want := range []string{"created account", "login failed", "milter decision", "rate limit"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("logs don't mention %q:\n%s", want, out)
+				}
+			}
+			if strings.Count(out, redacted) < 4 {
+				t.Errorf("logs mention %s fewer than 4 times:\n%s", redacted, out)
+			}
+		})
+	}
+}
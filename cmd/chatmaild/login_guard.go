@@ -0,0 +1,265 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An account's lockout doesn't apply to networks it has logged in from in
+// this long.
+const known_network_lifetime = 30 * 24 * time.Hour
+
+// An account is locked out at most this many times per
+// LoginMaxLockoutSeconds, so that an attacker spread over many networks
+// can't keep it locked out.
+const max_account_lockouts = 3
+
+// How often the login guard forgets about failures that no longer matter.
+const login_guard_sweep_interval = time.Minute
+
+const (
+	lockout_scope_ip      = "ip"
+	lockout_scope_account = "account"
+)
+
+var lockout_scopes = []string{lockout_scope_ip, lockout_scope_account}
+
+var ErrLockedOut = errors.New("too many failed logins")
+
+// locked_out_error says what is locked out, and until when.
+type locked_out_error struct {
+	scope string
+	until time.Time
+}
+
+func (e *locked_out_error) Error() string {
+	return fmt.Sprintf("%v from this %s; try again after %s", ErrLockedOut, e.scope, e.until.Format(time.RFC3339))
+}
+
+func (e *locked_out_error) Unwrap() error {
+	return ErrLockedOut
+}
+
+// login_failures is what the guard knows about one network or account.
+type login_failures struct {
+	// failures since the last lockout.
+	failures int
+	// lockouts in a row, which make the next one longer. For accounts, it's
+	// the lockouts since lockouts_since instead.
+	lockouts       int
+	lockouts_since time.Time
+	last_failure   time.Time
+	locked_until   time.Time
+}
+
+// lockout describes a network or account that's locked out, for the admin
+// API.
+type lockout struct {
+	key      string
+	scope    string
+	until    time.Time
+	lockouts int
+}
+
+// login_guard counts failed logins per network and per account, and locks
+// them out for a while when there are too many. Networks are locked out for
+// twice as long each time, up to LoginMaxLockoutSeconds. Accounts are
+// softer targets, since anyone can fail to log in to someone else's
+// account: they need more failures, are only ever locked out for
+// LoginLockoutSeconds and at most max_account_lockouts times per
+// LoginMaxLockoutSeconds, and their lockouts don't apply to networks that
+// they have logged in from before.
+type login_guard struct {
+	mu       sync.Mutex
+	ips      map[string]*login_failures
+	accounts map[string]*login_failures
+	// known has when each account last logged in from each network.
+	known      map[string]map[string]time.Time
+	last_sweep time.Time
+}
+
+func new_login_guard() *login_guard {
+	return &login_guard{
+		ips:      make(map[string]*login_failures),
+		accounts: make(map[string]*login_failures),
+		known:    make(map[string]map[string]time.Time),
+	}
+}
+
+// network_key is the network that ip is tracked as: the address itself for
+// IPv4, and its /64 for IPv6, since that's what one host usually has. It's
+// "" for logins without an address, which aren't tracked per network.
+func network_key(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+func account_key(user string) string {
+	return strings.ToLower(user)
+}
+
+// sweep forgets failures that are too old to count, and networks that
+// accounts haven't logged in from for too long. It's called with mu held.
+func (g *login_guard) sweep(cm_config config.ChatmailConfig, now time.Time) {
+	if now.Sub(g.last_sweep) < login_guard_sweep_interval {
+		return
+	}
+	g.last_sweep = now
+	forget_after := time.Duration(cm_config.LoginMaxLockoutSeconds) * time.Second
+	for _, m := range []map[string]*login_failures{g.ips, g.accounts} {
+		for key, f := range m {
+			if now.After(f.locked_until) && now.Sub(f.last_failure) >= forget_after {
+				delete(m, key)
+			}
+		}
+	}
+	for account, networks := range g.known {
+		for network, last := range networks {
+			if now.Sub(last) >= known_network_lifetime {
+				delete(networks, network)
+			}
+		}
+		if len(networks) == 0 {
+			delete(g.known, account)
+		}
+	}
+}
+
+// check returns a locked_out_error if logins from network as user aren't
+// allowed at now.
+func (g *login_guard) check(network string, user string, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, found := g.ips[network]; found && network != "" && now.Before(f.locked_until) {
+		return &locked_out_error{lockout_scope_ip, f.locked_until}
+	}
+	account := account_key(user)
+	if f, found := g.accounts[account]; found && now.Before(f.locked_until) {
+		if _, known := g.known[account][network]; !known || network == "" {
+			return &locked_out_error{lockout_scope_account, f.locked_until}
+		}
+	}
+	return nil
+}
+
+// failed records a failed login from network as user at now, and returns
+// the scopes that it locked out.
+func (g *login_guard) failed(cm_config config.ChatmailConfig, network string, user string, now time.Time) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(cm_config, now)
+	lockout := time.Duration(cm_config.LoginLockoutSeconds) * time.Second
+	max_lockout := time.Duration(cm_config.LoginMaxLockoutSeconds) * time.Second
+	var locked []string
+	if network != "" && record_failure(g.ips, network, cm_config.LoginFailuresPerIP, 0, now, max_lockout, func(lockouts int) time.Duration {
+		d := lockout
+		for i := 1; i < lockouts && d < max_lockout; i++ {
+			d *= 2
+		}
+		return min(d, max_lockout)
+	}) {
+		locked = append(locked, lockout_scope_ip)
+	}
+	if record_failure(g.accounts, account_key(user), cm_config.LoginFailuresPerAccount, max_account_lockouts, now, max_lockout, func(int) time.Duration {
+		return lockout
+	}) {
+		locked = append(locked, lockout_scope_account)
+	}
+	return locked
+}
+
+// record_failure counts a failure for key in m, and locks it out for
+// duration(lockouts in a row) when it reaches limit. Failures and lockouts
+// are forgotten after forget_after without any. A limit of 0 never locks
+// anything out. A max_lockouts other than 0 caps the lockouts per
+// forget_after, even if the failures never stop.
+func record_failure(m map[string]*login_failures, key string, limit int, max_lockouts int, now time.Time, forget_after time.Duration, duration func(lockouts int) time.Duration) bool {
+	if limit <= 0 {
+		return false
+	}
+	f, found := m[key]
+	if !found || now.Sub(f.last_failure) >= forget_after {
+		f = &login_failures{}
+		m[key] = f
+	}
+	f.last_failure = now
+	f.failures++
+	if f.failures < limit {
+		return false
+	}
+	f.failures = 0
+	if max_lockouts > 0 {
+		if f.lockouts == 0 || now.Sub(f.lockouts_since) >= forget_after {
+			f.lockouts = 0
+			f.lockouts_since = now
+		}
+		if f.lockouts >= max_lockouts {
+			return false
+		}
+	}
+	f.lockouts++
+	f.locked_until = now.Add(duration(f.lockouts))
+	return true
+}
+
+// succeeded records that user logged in from network at now, which ends
+// any lockout of the account and lets the network in during later ones.
+// Networks aren't forgiven, so that logging in to one account doesn't help
+// with guessing the password of another.
+func (g *login_guard) succeeded(network string, user string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	account := account_key(user)
+	delete(g.accounts, account)
+	if network == "" {
+		return
+	}
+	if g.known[account] == nil {
+		g.known[account] = make(map[string]time.Time)
+	}
+	g.known[account][network] = now
+}
+
+// locked_out lists what's locked out at now, sorted by key.
+func (g *login_guard) locked_out(now time.Time) []lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var list []lockout
+	for i, m := range []map[string]*login_failures{g.ips, g.accounts} {
+		for key, f := range m {
+			if now.Before(f.locked_until) {
+				list = append(list, lockout{key, lockout_scopes[i], f.locked_until, f.lockouts})
+			}
+		}
+	}
+	slices.SortFunc(list, func(a, b lockout) int { return strings.Compare(a.key, b.key) })
+	return list
+}
+
+// clear forgets the failures of an account, or of the network that an IP
+// address is in, and reports whether there were any.
+func (g *login_guard) clear(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := g.accounts
+	if ip := net.ParseIP(key); ip != nil {
+		m, key = g.ips, network_key(ip)
+	} else {
+		key = account_key(key)
+	}
+	_, found := m[key]
+	delete(m, key)
+	return found
+}
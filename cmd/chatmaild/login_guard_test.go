@@ -0,0 +1,225 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func login_guard_config() config.ChatmailConfig {
+	cfg := config.NewChatmailConfig(default_domain())
+	cfg.LoginFailuresPerIP = 3
+	cfg.LoginFailuresPerAccount = 5
+	cfg.LoginLockoutSeconds = 60
+	cfg.LoginMaxLockoutSeconds = 300
+	return cfg
+}
+
+// fail_until_locked fails to log in from network as user until that locks
+// something out, and returns what it locked out.
+func fail_until_locked(t *testing.T, g *login_guard, cfg config.ChatmailConfig, network string, user string, now time.Time) []string {
+	t.Helper()
+	for range 100 {
+		if locked := g.failed(cfg, network, user, now); len(locked) > 0 {
+			return locked
+		}
+	}
+	t.Fatalf("100 failed logins from %q as %s didn't lock anything out", network, user)
+	return nil
+}
+
+func TestNetworkKey(t *testing.T) {
+	for _, tc := range []struct {
+		ip   net.IP
+		want string
+	}{
+		{nil, ""},
+		{net.ParseIP("192.0.2.7"), "192.0.2.7"},
+		{net.ParseIP("::ffff:192.0.2.7"), "192.0.2.7"},
+		{net.ParseIP("2001:db8:1:2:3:4:5:6"), "2001:db8:1:2::"},
+	} {
+		if got := network_key(tc.ip); got != tc.want {
+			t.Errorf("network_key(%v) = %q; want %q", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestLoginGuardBacksOffNetworks(t *testing.T) {
+	cfg := login_guard_config()
+	g := new_login_guard()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	const network = "192.0.2.7"
+
+	// Each user only fails once, so only the network is locked out.
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		var locked []string
+		for j := range cfg.LoginFailuresPerIP {
+			locked = g.failed(cfg, network, string(rune('a'+i*10+j))+"@"+default_domain(), now)
+		}
+		if !slices.Equal(locked, []string{lockout_scope_ip}) {
+			t.Fatalf("lockout %d locked out %v; want the network", i+1, locked)
+		}
+		var locked_err *locked_out_error
+		if err := g.check(network, "someone@"+default_domain(), now); !errors.As(err, &locked_err) || !errors.Is(err, ErrLockedOut) || locked_err.until.Sub(now) != want {
+			t.Fatalf("check() after lockout %d = %v; want it locked out for %v", i+1, err, want)
+		}
+		if err := g.check("192.0.2.8", "someone@"+default_domain(), now); err != nil {
+			t.Fatalf("check() from another network = %v; want nil", err)
+		}
+		now = now.Add(want)
+	}
+	if err := g.check(network, "someone@"+default_domain(), now); err != nil {
+		t.Fatalf("check() after the lockout ended = %v; want nil", err)
+	}
+
+	// Without failures for LoginMaxLockoutSeconds, the backoff starts again.
+	now = now.Add(time.Duration(cfg.LoginMaxLockoutSeconds) * time.Second)
+	fail_until_locked(t, g, cfg, network, "a@"+default_domain(), now)
+	if l := g.locked_out(now); len(l) != 1 || l[0].key != network || l[0].until.Sub(now) != time.Minute || l[0].lockouts != 1 {
+		t.Fatalf("locked_out() after the failures were forgotten = %+v; want %s locked out for a minute", l, network)
+	}
+
+	if !g.clear("192.0.2.7") || g.check(network, "a@"+default_domain(), now) != nil {
+		t.Fatal("clear() didn't let the network in again")
+	}
+	if g.clear("192.0.2.7") {
+		t.Fatal("clear() of a network without failures = true; want false")
+	}
+}
+
+func TestLoginGuardAccountsAreSofter(t *testing.T) {
+	cfg := login_guard_config()
+	g := new_login_guard()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	user := "victim@" + default_domain()
+	g.succeeded("198.51.100.1", user, now)
+
+	// An attacker spread over many networks locks the account out...
+	for i := range cfg.LoginFailuresPerAccount - 1 {
+		if locked := g.failed(cfg, network_key(net.IPv4(203, 0, 113, byte(i))), user, now); len(locked) != 0 {
+			t.Fatalf("failure %d locked out %v; want nothing yet", i+1, locked)
+		}
+	}
+	if locked := g.failed(cfg, "203.0.113.99", user, now); !slices.Equal(locked, []string{lockout_scope_account}) {
+		t.Fatalf("failure %d locked out %v; want the account", cfg.LoginFailuresPerAccount, locked)
+	}
+	if err := g.check("203.0.113.100", user, now); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("check() for a locked out account = %v; want %v", err, ErrLockedOut)
+	}
+	if err := g.check("", user, now); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("check() without an address for a locked out account = %v; want %v", err, ErrLockedOut)
+	}
+	// ...but not from where its owner has logged in before...
+	if err := g.check("198.51.100.1", user, now); err != nil {
+		t.Fatalf("check() from a network the account has logged in from = %v; want nil", err)
+	}
+	// ...and never for longer than LoginLockoutSeconds.
+	for range max_account_lockouts - 1 {
+		now = now.Add(time.Duration(cfg.LoginLockoutSeconds) * time.Second)
+		if err := g.check("203.0.113.100", user, now); err != nil {
+			t.Fatalf("check() after the account's lockout = %v; want nil", err)
+		}
+		fail_until_locked(t, g, cfg, "", user, now)
+	}
+
+	// Logging in ends the account's lockout.
+	g.succeeded("198.51.100.1", user, now)
+	if err := g.check("203.0.113.100", user, now); err != nil {
+		t.Fatalf("check() after the owner logged in = %v; want nil", err)
+	}
+
+	// Known networks are forgotten eventually.
+	now = now.Add(known_network_lifetime)
+	fail_until_locked(t, g, cfg, "", user, now)
+	if err := g.check("198.51.100.1", user, now); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("check() from a network the account logged in from long ago = %v; want %v", err, ErrLockedOut)
+	}
+	if !g.clear("Victim@"+default_domain()) || g.check("203.0.113.100", user, now) != nil {
+		t.Fatal("clear() didn't let the account in again")
+	}
+}
+
+func TestLoginGuardCapsAccountLockouts(t *testing.T) {
+	cfg := login_guard_config()
+	g := new_login_guard()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	user := "victim@" + default_domain()
+	lockout := time.Duration(cfg.LoginLockoutSeconds) * time.Second
+	max_lockout := time.Duration(cfg.LoginMaxLockoutSeconds) * time.Second
+
+	// Each network stays under LoginFailuresPerIP, and the attacker comes
+	// back whenever the account's lockout ends.
+	next := 0
+	attack := func() []string {
+		var locked []string
+		for range cfg.LoginFailuresPerAccount {
+			network := network_key(net.IPv4(203, 0, 113, byte(next/(cfg.LoginFailuresPerIP-1))))
+			next++
+			if err := g.check(network, user, now); err != nil {
+				t.Fatalf("check() during the attack = %v; want nil", err)
+			}
+			locked = append(locked, g.failed(cfg, network, user, now)...)
+		}
+		return locked
+	}
+	for i := range max_account_lockouts {
+		if locked := attack(); !slices.Equal(locked, []string{lockout_scope_account}) {
+			t.Fatalf("attack %d locked out %v; want the account", i+1, locked)
+		}
+		now = now.Add(lockout)
+	}
+	for now.Sub(start) < max_lockout {
+		if locked := attack(); len(locked) != 0 {
+			t.Fatalf("attack after %d lockouts locked out %v; want nothing", max_account_lockouts, locked)
+		}
+		now = now.Add(lockout)
+	}
+	// The next window can lock the account out again.
+	if locked := attack(); !slices.Equal(locked, []string{lockout_scope_account}) {
+		t.Fatalf("attack after LoginMaxLockoutSeconds locked out %v; want the account", locked)
+	}
+}
+
+func TestLoginGuardLimitsCanBeOff(t *testing.T) {
+	cfg := login_guard_config()
+	cfg.LoginFailuresPerIP = 0
+	cfg.LoginFailuresPerAccount = 0
+	g := new_login_guard()
+	now := time.Now()
+	for range 1000 {
+		if locked := g.failed(cfg, "192.0.2.7", "a@"+default_domain(), now); len(locked) != 0 {
+			t.Fatalf("failed() with the limits off locked out %v", locked)
+		}
+	}
+}
+
+func TestSaslLockout(t *testing.T) {
+	auth := make_authenticator(t)
+	auth.config.LoginFailuresPerIP = 2
+	user, password := make_login()
+	if err := auth.login("", user, password); err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := auth.from(net.ParseIP("192.0.2.1"))
+	for range auth.config.LoginFailuresPerIP {
+		if err := attacker.login("", user, password+"x"); errors.Is(err, ErrLockedOut) {
+			t.Fatalf("login() before the limit = %v; want a wrong password", err)
+		}
+	}
+	if err := attacker.login("", user, password); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("login() from a locked out network = %v; want %v", err, ErrLockedOut)
+	}
+	if err := auth.from(net.ParseIP("192.0.2.2")).login("", user, password); err != nil {
+		t.Fatalf("login() from another network = %v; want nil", err)
+	}
+	m := auth.metrics
+	if m.sasl_lockouts.With(lockout_scope_ip).Value() != 1 || m.sasl_logins.With("locked_out").Value() != 1 {
+		t.Fatalf("metrics counted %d network lockouts and %d refused logins; want 1 and 1", m.sasl_lockouts.With(lockout_scope_ip).Value(), m.sasl_logins.With("locked_out").Value())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/metrics"
+
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Walking every mailbox is too slow to do on every scrape.
+const storage_measurement_interval = 5 * time.Minute
+
+// login_results are how SASL logins can turn out.
+var login_results = []string{"success", "failure", "locked_out"}
+
+type chatmaild_metrics struct {
+	registry           *metrics.Registry
+	milter_decisions   *metrics.CounterVec
+	milter_unenforced  *metrics.CounterVec
+	milter_rate_limits *metrics.Counter
+	milter_connections *metrics.Gauge
+	sasl_logins        *metrics.CounterVec
+	sasl_lockouts      *metrics.CounterVec
+	accounts_created   *metrics.Counter
+}
+
+func new_chatmaild_metrics(store accounts.Store) *chatmaild_metrics {
+	r := metrics.NewRegistry()
+	m := &chatmaild_metrics{
+		registry:           r,
+		milter_decisions:   r.CounterVec("chatmail_milter_decisions_total", "Messages checked by the milter, by what was decided and why.", "reason", milter_decisions...),
+		milter_unenforced:  r.CounterVec("chatmail_milter_unenforced_total", "Messages that monitor-only mode let through, by why they would have been rejected.", "reason", rejected_decisions()...),
+		milter_rate_limits: r.Counter("chatmail_milter_rate_limited_total", "Messages from senders who had already sent MaxEmailsPerMinutePerUser that minute."),
+		milter_connections: r.Gauge("chatmail_milter_connections", "Open connections from the MTA to the milter."),
+		sasl_logins:        r.CounterVec("chatmail_sasl_logins_total", "SASL login attempts, by result.", "result", login_results...),
+		sasl_lockouts:      r.CounterVec("chatmail_sasl_lockouts_total", "Networks and accounts locked out after too many failed logins, by which it was.", "scope", lockout_scopes...),
+		accounts_created:   r.Counter("chatmail_accounts_created_total", "Accounts created on their first login."),
+	}
+	r.GaugeFunc("chatmail_accounts", "Accounts that exist.", func() (float64, error) {
+		n, err := store.Count()
+		return float64(n), err
+	})
+	r.GaugeFunc("chatmail_mailbox_storage_bytes", "Disk space used by all mailboxes.", cached_measurement(storage_measurement_interval, time.Now, func() (float64, error) {
+		n, err := store.DiskUsage()
+		return float64(n), err
+	}))
+	return m
+}
+
+// cached_measurement calls measure at most once per interval.
+func cached_measurement(interval time.Duration, now func() time.Time, measure func() (float64, error)) func() (float64, error) {
+	var mu sync.Mutex
+	var value float64
+	var measured time.Time
+	return func() (float64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !measured.IsZero() && now().Sub(measured) < interval {
+			return value, nil
+		}
+		n, err := measure()
+		if err != nil {
+			return 0, err
+		}
+		value, measured = n, now()
+		return value, nil
+	}
+}
+
+// counting_listener keeps track of how many of its connections are open.
+type counting_listener struct {
+	net.Listener
+	open *metrics.Gauge
+}
+
+type counted_conn struct {
+	net.Conn
+	once sync.Once
+	open *metrics.Gauge
+}
+
+func (l counting_listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.open.Inc()
+	return &counted_conn{Conn: conn, open: l.open}, nil
+}
+
+func (c *counted_conn) Close() error {
+	c.once.Do(c.open.Dec)
+	return c.Conn.Close()
+}
+
+type metrics_server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+func new_metrics_server(listen_uri string, m *chatmaild_metrics) (metrics_server, error) {
+	ln, err := make_listener(listen_uri)
+	if err != nil {
+		return metrics_server{}, fmt.Errorf("failed to set up listener for metrics: %q", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.registry.Handler())
+	slog.Info("serving metrics", "address", listen_uri)
+	return metrics_server{&http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}, ln}, nil
+}
+
+func (ms *metrics_server) serve() error {
+	err := ms.server.Serve(ms.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (ms *metrics_server) stop() error {
+	return ms.server.Close()
+}
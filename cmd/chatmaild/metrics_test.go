@@ -0,0 +1,241 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-milter"
+)
+
+var (
+	exposition_help   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	exposition_type   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge|untyped)$`)
+	exposition_sample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"\})? (\S+)$`)
+)
+
+type scraped_sample struct {
+	name        string
+	label       string
+	label_value string
+	value       float64
+}
+
+// parse_exposition reads the Prometheus text format strictly enough to
+// catch anything a scraper would choke on.
+func parse_exposition(r io.Reader) ([]scraped_sample, error) {
+	var samples []scraped_sample
+	typed := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := scanner.Text()
+		if m := exposition_help.FindStringSubmatch(line); m != nil {
+			continue
+		}
+		if m := exposition_type.FindStringSubmatch(line); m != nil {
+			if typed[m[1]] {
+				return nil, fmt.Errorf("line %d: second TYPE for %s", line_number, m[1])
+			}
+			typed[m[1]] = true
+			continue
+		}
+		m := exposition_sample.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: can't parse %q", line_number, line)
+		}
+		if !typed[m[1]] {
+			return nil, fmt.Errorf("line %d: sample for %s before its TYPE", line_number, m[1])
+		}
+		value, err := strconv.ParseFloat(m[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line_number, err)
+		}
+		samples = append(samples, scraped_sample{m[1], m[2], m[3], value})
+	}
+	return samples, scanner.Err()
+}
+
+func scrape(t *testing.T, url string) []scraped_sample {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d; want 200", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "@") {
+		t.Fatalf("metrics mention an address:\n%s", body)
+	}
+	samples, err := parse_exposition(strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("parse_exposition() = %v; metrics were:\n%s", err, body)
+	}
+	return samples
+}
+
+func sample_value(samples []scraped_sample, name string, label_value string) (float64, bool) {
+	for _, s := range samples {
+		if s.name == name && s.label_value == label_value {
+			return s.value, true
+		}
+	}
+	return 0, false
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.NewChatmailConfig(default_domain())
+	cfg.MailboxesDirectory = filepath.Join(dir, "mail")
+	cfg.InviteTokensFile = filepath.Join(dir, "invites.json")
+	cfg.MaxEmailsPerMinutePerUser = 3
+	store := accounts.NewFileStore(cfg.MailboxesDirectory)
+	m := new_chatmaild_metrics(store)
+
+	socket := filepath.Join(dir, "milter.sock")
+	milter_server, err := new_milter_server("unix://"+socket, new_live_config(cfg, nil), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go milter_server.serve()
+	defer milter_server.stop()
+
+	server, err := new_metrics_server("tcp://127.0.0.1:0", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve()
+	defer server.stop()
+	url := "http://" + server.listener.Addr().String() + "/metrics"
+
+	sender, _ := make_account()
+	external := "someone@external.example"
+	encrypted := emlctx{sender, external, CommonEncryptedSubjects[0]}
+	if act := send_through_milter(t, socket, sender, external, "encrypted.eml", encrypted); act.Code != milter.ActAccept {
+		t.Fatalf("milter action for an encrypted message = %q; want %q", act.Code, milter.ActAccept)
+	}
+	if act := send_through_milter(t, socket, sender, external, "plain.eml", emlctx_default_subject(sender, external)); act.Code != milter.ActReject {
+		t.Fatalf("milter action for an unencrypted message = %q; want %q", act.Code, milter.ActReject)
+	}
+	if act := send_through_milter(t, socket, sender, external, "plain.eml", emlctx_default_subject("forged@"+default_domain(), external)); act.Code != milter.ActReject {
+		t.Fatalf("milter action for a forged From = %q; want %q", act.Code, milter.ActReject)
+	}
+	// Rate limit hits are only counted, not acted on.
+	if act := send_through_milter(t, socket, sender, external, "encrypted.eml", encrypted); act.Code != milter.ActAccept {
+		t.Fatalf("milter action over the rate limit = %q; want %q", act.Code, milter.ActAccept)
+	}
+
+	auth := new_authenticator(cfg, store, m, new_login_guard())
+	user, password := make_login()
+	if err := auth.login("", user, password); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.login("", user, password+"x"); err == nil {
+		t.Fatal("login() with the wrong password succeeded")
+	}
+
+	samples := scrape(t, url)
+	for _, s := range samples {
+		if s.name == "chatmail_milter_decisions_total" && !slices.Contains(milter_decisions, s.label_value) {
+			t.Errorf("undeclared reason %q in %s", s.label_value, s.name)
+		}
+	}
+	want := []struct {
+		name        string
+		label_value string
+		value       float64
+	}{
+		{"chatmail_milter_decisions_total", string(decision_encrypted), 2},
+		{"chatmail_milter_decisions_total", string(decision_unencrypted), 1},
+		{"chatmail_milter_decisions_total", string(decision_forged_from), 1},
+		{"chatmail_milter_decisions_total", string(decision_securejoin), 0},
+		{"chatmail_milter_rate_limited_total", "", 1},
+		{"chatmail_sasl_logins_total", "success", 1},
+		{"chatmail_sasl_logins_total", "failure", 1},
+		{"chatmail_accounts_created_total", "", 1},
+		{"chatmail_accounts", "", 1},
+	}
+	for _, w := range want {
+		got, ok := sample_value(samples, w.name, w.label_value)
+		if !ok || got != w.value {
+			t.Errorf("%s{%q} = %v, %t; want %v, true", w.name, w.label_value, got, ok, w.value)
+		}
+	}
+	if got, ok := sample_value(samples, "chatmail_mailbox_storage_bytes", ""); !ok || got <= 0 {
+		t.Errorf("chatmail_mailbox_storage_bytes = %v, %t; want > 0, true", got, ok)
+	}
+
+	// The milter notices closed connections in its own time.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, ok := sample_value(scrape(t, url), "chatmail_milter_connections", "")
+		if ok && got == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("chatmail_milter_connections = %v, %t; want 0, true", got, ok)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendRateLimiter(t *testing.T) {
+	l := new_send_rate_limiter()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		sender string
+		at     time.Duration
+		want   bool
+	}{
+		{"a", 0, true},
+		{"a", 10 * time.Second, true},
+		{"a", 20 * time.Second, false},
+		{"b", 20 * time.Second, true},
+		{"a", 60 * time.Second, true},
+		{"a", 65 * time.Second, false},
+		{"a", 70 * time.Second, true},
+	}
+	for _, s := range steps {
+		if got := l.allow(s.sender, 2, start.Add(s.at)); got != s.want {
+			t.Fatalf("allow(%q) at %v = %t; want %t", s.sender, s.at, got, s.want)
+		}
+	}
+	l.allow("c", 2, start.Add(10*time.Minute))
+	if len(l.sent) != 1 {
+		t.Fatalf("rate limiter remembers %d senders after they went quiet; want 1", len(l.sent))
+	}
+}
+
+func TestCachedMeasurement(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	measure := cached_measurement(time.Minute, func() time.Time { return now }, func() (float64, error) {
+		calls++
+		return float64(calls), nil
+	})
+	for _, step := range []struct {
+		advance time.Duration
+		want    float64
+	}{{0, 1}, {30 * time.Second, 1}, {30 * time.Second, 2}} {
+		now = now.Add(step.advance)
+		if got, err := measure(); err != nil || got != step.want {
+			t.Fatalf("measure() = %v, %v; want %v, nil", got, err, step.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peer_uid returns the user on the other end of conn, as the kernel saw it
+// when they connected.
+func peer_uid(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var cred_err error
+	err = raw.Control(func(fd uintptr) {
+		cred, cred_err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if cred_err != nil {
+		return 0, cred_err
+	}
+	return int(cred.Uid), nil
+}
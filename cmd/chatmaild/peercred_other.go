@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peer_uid is only implemented on Linux. Elsewhere, nobody can use the admin
+// socket rather than everybody.
+func peer_uid(conn *net.UnixConn) (int, error) {
+	return 0, errors.New("checking the peer credentials of unix sockets isn't supported on this system")
+}
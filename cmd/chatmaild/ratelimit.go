@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const rate_limit_window = time.Minute
+
+// send_rate_limiter keeps track of how many messages each sender has sent in
+// the last minute.
+type send_rate_limiter struct {
+	mu         sync.Mutex
+	sent       map[string][]time.Time
+	last_sweep time.Time
+}
+
+func new_send_rate_limiter() *send_rate_limiter {
+	return &send_rate_limiter{sent: make(map[string][]time.Time)}
+}
+
+// recent drops the times that are too old to count any more.
+func recent(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= rate_limit_window {
+		i++
+	}
+	return times[i:]
+}
+
+// allow records a message from sender at now, and reports whether it's
+// within max_per_minute. Messages over the limit aren't recorded.
+func (l *send_rate_limiter) allow(sender string, max_per_minute int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget about senders who've gone quiet, so that the map doesn't grow
+	// forever.
+	if now.Sub(l.last_sweep) >= rate_limit_window {
+		for s, times := range l.sent {
+			if len(recent(times, now)) == 0 {
+				delete(l.sent, s)
+			}
+		}
+		l.last_sweep = now
+	}
+
+	times := recent(l.sent[sender], now)
+	if len(times) >= max_per_minute {
+		l.sent[sender] = times
+		return false
+	}
+	l.sent[sender] = append(times, now)
+	return true
+}
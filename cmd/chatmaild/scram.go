@@ -0,0 +1,330 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/logging"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The only channel binding type that SCRAM-SHA-256-PLUS is offered with;
+// tls-unique doesn't work with TLS 1.3 (RFC 9266).
+const scram_channel_binding = "tls-exporter"
+
+var ErrSCRAMMessage = errors.New("malformed SCRAM message")
+
+type scram_state int
+
+const (
+	scram_waiting_client_first scram_state = iota
+	scram_waiting_client_final
+	scram_waiting_end
+	scram_finished
+)
+
+// scram_server is the server side of SCRAM-SHA-256 (RFC 5802, RFC 7677).
+// The server-final message goes out as one more challenge, since the
+// dovecot auth protocol can't send data along with its OK, so clients
+// answer it with an empty response.
+type scram_server struct {
+	// channel_binding is the tls-exporter data of the client's connection,
+	// or nil if the server doesn't have it, in which case clients can't ask
+	// for channel binding.
+	channel_binding []byte
+	// keys returns the keys that user logs in with. If user can't log in,
+	// it returns made-up keys and why as refused, which the client is only
+	// told after sending its proof, like it would be for a wrong password
+	// (RFC 5802 section 9). Any other error ends the exchange straight away.
+	keys func(user string) (keys accounts.SCRAMKeys, refused error, err error)
+	// finished is told whether user proved that they know the password.
+	finished func(user string, err error)
+	// nonce makes the server's part of the nonce.
+	nonce func() (string, error)
+
+	state        scram_state
+	gs2_header   string
+	client_first string
+	server_first string
+	nonce_value  string
+	user         string
+	user_keys    accounts.SCRAMKeys
+	refused      error
+}
+
+// scram_nonce returns 24 random bytes in base64, which never has commas.
+func scram_nonce() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (s *scram_server) Next(response []byte) ([]byte, bool, error) {
+	switch s.state {
+	case scram_waiting_client_first:
+		if response == nil {
+			// SCRAM starts with the client; ask for its first message.
+			return []byte{}, false, nil
+		}
+		challenge, err := s.client_first_message(string(response))
+		if err != nil {
+			s.state = scram_finished
+			return nil, true, err
+		}
+		s.state = scram_waiting_client_final
+		return []byte(challenge), false, nil
+	case scram_waiting_client_final:
+		challenge, err := s.client_final_message(string(response))
+		s.finished(s.user, err)
+		if err != nil {
+			s.state = scram_finished
+			return nil, true, err
+		}
+		s.state = scram_waiting_end
+		return []byte(challenge), false, nil
+	case scram_waiting_end:
+		s.state = scram_finished
+		if len(response) != 0 {
+			return nil, true, fmt.Errorf("%w: unexpected response after server-final-message", ErrSCRAMMessage)
+		}
+		return nil, true, nil
+	}
+	return nil, true, errors.New("SCRAM exchange already finished")
+}
+
+// client_first_message checks the client-first-message and returns the
+// server-first-message.
+func (s *scram_server) client_first_message(msg string) (string, error) {
+	cbind_flag, rest, found := strings.Cut(msg, ",")
+	if !found {
+		return "", fmt.Errorf("%w: no GS2 header", ErrSCRAMMessage)
+	}
+	authzid, bare, found := strings.Cut(rest, ",")
+	if !found {
+		return "", fmt.Errorf("%w: no GS2 header", ErrSCRAMMessage)
+	}
+	switch {
+	case cbind_flag == "n":
+	case cbind_flag == "y":
+		// The client could have used channel binding, but thought that the
+		// server couldn't. If it can, someone removed -PLUS from the list of
+		// mechanisms along the way.
+		if s.channel_binding != nil {
+			return "", errors.New("SCRAM channel binding was downgraded")
+		}
+	case cbind_flag == "p="+scram_channel_binding:
+		if s.channel_binding == nil {
+			return "", errors.New("SCRAM channel binding isn't available")
+		}
+	default:
+		return "", fmt.Errorf("%w: unsupported channel binding flag %q", ErrSCRAMMessage, cbind_flag)
+	}
+	s.gs2_header = msg[:len(msg)-len(bare)]
+	s.client_first = bare
+
+	attrs := strings.Split(bare, ",")
+	if strings.HasPrefix(attrs[0], "m=") {
+		return "", fmt.Errorf("%w: unsupported mandatory extension", ErrSCRAMMessage)
+	}
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return "", fmt.Errorf("%w: client-first-message needs a username and a nonce", ErrSCRAMMessage)
+	}
+	user, err := decode_saslname(attrs[0][2:])
+	if err != nil || user == "" {
+		return "", fmt.Errorf("%w: invalid username", ErrSCRAMMessage)
+	}
+	if authzid != "" {
+		// Logging in as somebody else isn't supported.
+		identity, err := decode_saslname(strings.TrimPrefix(authzid, "a="))
+		if err != nil || !strings.HasPrefix(authzid, "a=") || identity != user {
+			return "", fmt.Errorf("%w: invalid authorization identity", ErrSCRAMMessage)
+		}
+	}
+	client_nonce := attrs[1][2:]
+	if !is_printable(client_nonce) {
+		return "", fmt.Errorf("%w: invalid nonce", ErrSCRAMMessage)
+	}
+
+	s.user = user
+	if s.user_keys, s.refused, err = s.keys(user); err != nil {
+		return "", err
+	}
+	server_nonce, err := s.nonce()
+	if err != nil {
+		return "", err
+	}
+	s.nonce_value = client_nonce + server_nonce
+	s.server_first = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce_value, base64.StdEncoding.EncodeToString(s.user_keys.Salt), s.user_keys.Iterations)
+	return s.server_first, nil
+}
+
+// client_final_message checks the client's proof and returns the
+// server-final-message.
+func (s *scram_server) client_final_message(msg string) (string, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return "", fmt.Errorf("%w: client-final-message has no proof", ErrSCRAMMessage)
+	}
+	without_proof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("%w: invalid proof", ErrSCRAMMessage)
+	}
+	attrs := strings.Split(without_proof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return "", fmt.Errorf("%w: client-final-message needs channel binding and a nonce", ErrSCRAMMessage)
+	}
+	binding := s.gs2_header
+	if strings.HasPrefix(binding, "p=") {
+		binding += string(s.channel_binding)
+	}
+	if attrs[0][2:] != base64.StdEncoding.EncodeToString([]byte(binding)) {
+		return "", errors.New("SCRAM channel binding doesn't match")
+	}
+	if attrs[1][2:] != s.nonce_value {
+		return "", errors.New("SCRAM nonce doesn't match")
+	}
+
+	auth_message := s.client_first + "," + s.server_first + "," + without_proof
+	client_signature := hmac_sha256(s.user_keys.StoredKey, auth_message)
+	client_key := make([]byte, sha256.Size)
+	for i := range client_key {
+		client_key[i] = proof[i] ^ client_signature[i]
+	}
+	stored_key := sha256.Sum256(client_key)
+	matches := subtle.ConstantTimeCompare(stored_key[:], s.user_keys.StoredKey) == 1
+	if s.refused != nil {
+		return "", s.refused
+	}
+	if !matches {
+		return "", fmt.Errorf("rejecting login from %s: %w", s.user, accounts.ErrBadPassword)
+	}
+	server_signature := hmac_sha256(s.user_keys.ServerKey, auth_message)
+	return "v=" + base64.StdEncoding.EncodeToString(server_signature), nil
+}
+
+// fake_scram_keys makes up keys for a user who can't log in. The salt only
+// depends on secret and user, so that asking again doesn't show that it's
+// made up; nobody knows a password for the stored key.
+func fake_scram_keys(secret []byte, user string) accounts.SCRAMKeys {
+	return accounts.SCRAMKeys{
+		Iterations: accounts.SCRAMIterations,
+		Salt:       hmac_sha256(secret, "salt\x00"+user)[:16],
+		StoredKey:  hmac_sha256(secret, "stored key\x00"+user),
+		ServerKey:  hmac_sha256(secret, "server key\x00"+user),
+	}
+}
+
+// load_scram_secret returns the secret that fake_scram_keys uses. It comes
+// from the log salt if chatmaild can read it, so that made-up salts stay
+// the same across restarts; otherwise it only lasts until the next one.
+func load_scram_secret(log_salt_file string) ([]byte, error) {
+	if salt, err := logging.ReadSalt(log_salt_file); err == nil {
+		return hmac_sha256(salt, "SCRAM-SHA-256 made-up keys"), nil
+	}
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// decode_saslname undoes the escaping of commas and equals signs in SCRAM
+// usernames.
+func decode_saslname(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == ',':
+			return "", ErrSCRAMMessage
+		case name[i] != '=':
+			b.WriteByte(name[i])
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+			i += 2
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+			i += 2
+		default:
+			return "", ErrSCRAMMessage
+		}
+	}
+	return b.String(), nil
+}
+
+// is_printable reports whether nonce is a valid SCRAM nonce: printable ASCII
+// without commas.
+func is_printable(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	for i := 0; i < len(nonce); i++ {
+		if nonce[i] < 0x21 || nonce[i] > 0x7e || nonce[i] == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// scram starts a SCRAM-SHA-256 exchange for a, with the tls-exporter
+// channel_binding data of the client's connection if there is any.
+func (a *authenticator) scram(channel_binding []byte) *scram_server {
+	return &scram_server{
+		channel_binding: channel_binding,
+		nonce:           scram_nonce,
+		keys: func(user string) (accounts.SCRAMKeys, error, error) {
+			user = accounts.CanonicalAddress(user)
+			if err := a.check_lockout(user); err != nil {
+				return accounts.SCRAMKeys{}, nil, err
+			}
+			keys, refused := a.scram_keys(user)
+			if refused != nil {
+				keys = fake_scram_keys(a.scram_secret, user)
+			}
+			return keys, refused, nil
+		},
+		finished: func(user string, err error) {
+			user = accounts.CanonicalAddress(user)
+			a.count_login(user, err)
+			if err == nil {
+				a.record_login(user)
+			}
+		},
+	}
+}
+
+// scram_keys returns the keys that user logs in with, or why they can't.
+// Unlike the other mechanisms, SCRAM can't create accounts, because the
+// server never sees the password.
+func (a *authenticator) scram_keys(user string) (accounts.SCRAMKeys, error) {
+	_, domain, found := strings.Cut(user, "@")
+	if !found || !strings.EqualFold(domain, a.config.MailFullyQualifiedDomainName) {
+		return accounts.SCRAMKeys{}, fmt.Errorf("rejecting login from %s: not an address on this server", user)
+	}
+	blocked, err := a.accounts.IsBlocked(user)
+	if err != nil {
+		return accounts.SCRAMKeys{}, fmt.Errorf("rejecting login from %s: %w", user, err)
+	}
+	if blocked {
+		return accounts.SCRAMKeys{}, fmt.Errorf("rejecting login from %s: %w", user, accounts.ErrBlocked)
+	}
+	keys, err := a.accounts.SCRAMKeys(user)
+	if err != nil {
+		return accounts.SCRAMKeys{}, fmt.Errorf("rejecting login from %s: %w", user, err)
+	}
+	return keys, nil
+}
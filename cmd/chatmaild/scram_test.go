@@ -0,0 +1,425 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/accounts"
+	"github.com/s0ph0s-dog/gochatmail/internal/logging"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/go-dovecot-sasl"
+)
+
+// scram_client is the client side of SCRAM-SHA-256, which checks the
+// server's signature at the end.
+type scram_client struct {
+	user     string
+	password string
+	// cbind_flag is "n", "y" or "p=tls-exporter", with channel_binding.
+	cbind_flag      string
+	channel_binding []byte
+	nonce           string
+
+	client_first     string
+	server_signature []byte
+	state            int
+}
+
+func new_scram_client(user string, password string) *scram_client {
+	nonce, _ := scram_nonce()
+	return &scram_client{user: user, password: password, cbind_flag: "n", nonce: nonce}
+}
+
+func (c *scram_client) gs2_header() string {
+	return c.cbind_flag + ",,"
+}
+
+func (c *scram_client) Start() (string, []byte, error) {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	c.client_first = "n=" + name + ",r=" + c.nonce
+	return "SCRAM-SHA-256", []byte(c.gs2_header() + c.client_first), nil
+}
+
+func (c *scram_client) Next(challenge []byte) ([]byte, error) {
+	c.state++
+	switch c.state {
+	case 1:
+		server_first := string(challenge)
+		attrs := strings.Split(server_first, ",")
+		if len(attrs) != 3 || !strings.HasPrefix(attrs[0], "r="+c.nonce) {
+			return nil, fmt.Errorf("unexpected server-first-message %q", server_first)
+		}
+		salt, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[1], "s="))
+		if err != nil {
+			return nil, err
+		}
+		iterations, err := strconv.Atoi(strings.TrimPrefix(attrs[2], "i="))
+		if err != nil {
+			return nil, err
+		}
+		binding := []byte(c.gs2_header())
+		if strings.HasPrefix(c.cbind_flag, "p=") {
+			binding = append(binding, c.channel_binding...)
+		}
+		without_proof := "c=" + base64.StdEncoding.EncodeToString(binding) + "," + attrs[0]
+		auth_message := c.client_first + "," + server_first + "," + without_proof
+
+		salted := accounts.SaltPassword(c.password, salt, iterations)
+		client_key := hmac_sha256(salted, "Client Key")
+		stored_key := sha256.Sum256(client_key)
+		client_signature := hmac_sha256(stored_key[:], auth_message)
+		proof := make([]byte, len(client_key))
+		for i := range proof {
+			proof[i] = client_key[i] ^ client_signature[i]
+		}
+		c.server_signature = hmac_sha256(hmac_sha256(salted, "Server Key"), auth_message)
+		return []byte(without_proof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+	case 2:
+		want := "v=" + base64.StdEncoding.EncodeToString(c.server_signature)
+		if string(challenge) != want {
+			return nil, fmt.Errorf("server-final-message = %q; want %q", challenge, want)
+		}
+		return []byte{}, nil
+	}
+	return nil, sasl.ErrUnexpectedServerChallenge
+}
+
+// run_scram runs the exchange between client and server, as the dovecot
+// auth protocol would.
+func run_scram(server sasl.Server, client sasl.Client) error {
+	_, response, err := client.Start()
+	if err != nil {
+		return err
+	}
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil || done {
+			return err
+		}
+		if response, err = client.Next(challenge); err != nil {
+			return err
+		}
+	}
+}
+
+func TestScramServerRFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	var finished error = errors.New("finished wasn't called")
+	server := &scram_server{
+		keys: func(user string) (accounts.SCRAMKeys, error, error) {
+			if user != "user" {
+				t.Fatalf("keys(%q); want keys(%q)", user, "user")
+			}
+			return accounts.DeriveSCRAMKeys("pencil", salt, 4096), nil, nil
+		},
+		finished: func(user string, err error) { finished = err },
+		nonce:    func() (string, error) { return "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", nil },
+	}
+	exchange := []struct {
+		response  string
+		challenge string
+		done      bool
+	}{
+		{"n,,n=user,r=rOprNGfwEbeRWgbNEkqO", "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", false},
+		{"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", false},
+		{"", "", true},
+	}
+	for _, step := range exchange {
+		challenge, done, err := server.Next([]byte(step.response))
+		if err != nil || string(challenge) != step.challenge || done != step.done {
+			t.Fatalf("Next(%q) = %q, %t, %v; want %q, %t, nil", step.response, challenge, done, err, step.challenge, step.done)
+		}
+	}
+	if finished != nil {
+		t.Fatalf("finished() was told %v; want nil", finished)
+	}
+}
+
+func TestScramServerRejects(t *testing.T) {
+	keys := accounts.DeriveSCRAMKeys("pencil", []byte("salt"), 4096)
+	for _, response := range []string{
+		"",
+		"n,n=user,r=abc",
+		"x,,n=user,r=abc",
+		"p=tls-unique,,n=user,r=abc",
+		"n,,m=ext,n=user,r=abc",
+		"n,,r=abc,n=user",
+		"n,,n=us=er,r=abc",
+		"n,,n=user,r=a\x01c",
+		"n,a=other,n=user,r=abc",
+	} {
+		server := &scram_server{
+			keys:     func(string) (accounts.SCRAMKeys, error, error) { return keys, nil, nil },
+			finished: func(string, error) {},
+			nonce:    scram_nonce,
+		}
+		if _, done, err := server.Next([]byte(response)); err == nil || !done {
+			t.Errorf("Next(%q) = %t, %v; want true and an error", response, done, err)
+		}
+	}
+
+	// Escaped usernames are decoded, and may be given as the authzid too.
+	var got string
+	server := &scram_server{
+		keys: func(user string) (accounts.SCRAMKeys, error, error) {
+			got = user
+			return keys, nil, nil
+		},
+		nonce: scram_nonce,
+	}
+	if _, _, err := server.Next([]byte("n,a=a=2Cb=3Dc,n=a=2Cb=3Dc,r=abc")); err != nil || got != "a,b=c" {
+		t.Fatalf("Next() for an escaped username = %v, looked up %q; want nil, %q", err, got, "a,b=c")
+	}
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	keys := accounts.DeriveSCRAMKeys("pencil", []byte("salt"), 4096)
+	exporter := []byte("tls-exporter data of the connection")
+	tests := []struct {
+		name           string
+		server_binding []byte
+		cbind_flag     string
+		client_binding []byte
+		ok             bool
+	}{
+		{"no channel binding", nil, "n", nil, true},
+		{"client supports it", nil, "y", nil, true},
+		{"both support it", exporter, "p=tls-exporter", exporter, true},
+		{"server doesn't have it", nil, "p=tls-exporter", exporter, false},
+		{"different connections", exporter, "p=tls-exporter", []byte("another connection"), false},
+		{"downgraded", exporter, "y", nil, false},
+	}
+	for _, test := range tests {
+		server := &scram_server{
+			channel_binding: test.server_binding,
+			keys:            func(string) (accounts.SCRAMKeys, error, error) { return keys, nil, nil },
+			finished:        func(string, error) {},
+			nonce:           scram_nonce,
+		}
+		client := new_scram_client("user", "pencil")
+		client.cbind_flag = test.cbind_flag
+		client.channel_binding = test.client_binding
+		if err := run_scram(server, client); (err == nil) != test.ok {
+			t.Errorf("%s: SCRAM exchange = %v; want success %t", test.name, err, test.ok)
+		}
+	}
+}
+
+// scram_attempt runs a SCRAM exchange for user with a, and returns the
+// server-first-message and how many responses the server took before
+// saying how it went.
+func scram_attempt(t *testing.T, a *authenticator, user string, password string) (string, int, error) {
+	t.Helper()
+	server := a.scram(nil)
+	client := new_scram_client(user, password)
+	_, response, _ := client.Start()
+	server_first := ""
+	for steps := 1; ; steps++ {
+		challenge, done, err := server.Next(response)
+		if err != nil || done {
+			return server_first, steps, err
+		}
+		if server_first == "" {
+			server_first = string(challenge)
+		}
+		if response, err = client.Next(challenge); err != nil {
+			t.Fatalf("client.Next() = %v", err)
+		}
+	}
+}
+
+func TestScramHidesWhichAccountsExist(t *testing.T) {
+	a := make_authenticator(t)
+	// This fails a lot of logins from the same place.
+	a.config.LoginFailuresPerIP = 0
+	user, password := make_login()
+	if err := a.authenticate("", user, password); err != nil {
+		t.Fatal(err)
+	}
+	blocked, blocked_password := make_login()
+	if err := a.authenticate("", blocked, blocked_password); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.accounts.Block(blocked); err != nil {
+		t.Fatal(err)
+	}
+	unknown, _ := make_login()
+	salt_of := func(server_first string) string {
+		return strings.Split(server_first, ",")[1]
+	}
+
+	real_first, real_steps, err := scram_attempt(t, a, user, password+"x")
+	if !errors.Is(err, accounts.ErrBadPassword) {
+		t.Fatalf("SCRAM with the wrong password = %v; want %v", err, accounts.ErrBadPassword)
+	}
+	for _, attempt := range []struct {
+		name     string
+		user     string
+		password string
+	}{
+		{"unknown user", unknown, password},
+		{"blocked user", blocked, blocked_password},
+		{"other domain", "ac_1234@other.example", password},
+	} {
+		first, steps, err := scram_attempt(t, a, attempt.user, attempt.password)
+		if err == nil {
+			t.Fatalf("%s: SCRAM login succeeded", attempt.name)
+		}
+		if steps != real_steps {
+			t.Errorf("%s: SCRAM failed after %d responses; want %d, like a wrong password", attempt.name, steps, real_steps)
+		}
+		if salt, real_salt := salt_of(first), salt_of(real_first); len(salt) != len(real_salt) || !strings.HasSuffix(first, ",i=4096") {
+			t.Errorf("%s: server-first-message = %q; want it to look like %q", attempt.name, first, real_first)
+		}
+		again, _, _ := scram_attempt(t, a, attempt.user, attempt.password)
+		if salt_of(again) != salt_of(first) {
+			t.Errorf("%s: made-up salt changed from %s to %s", attempt.name, salt_of(first), salt_of(again))
+		}
+	}
+	other, _ := make_login()
+	first, _, _ := scram_attempt(t, a, unknown, password)
+	other_first, _, _ := scram_attempt(t, a, other, password)
+	if salt_of(first) == salt_of(other_first) {
+		t.Errorf("two unknown users got the same salt %s", salt_of(first))
+	}
+}
+
+func TestLoadScramSecret(t *testing.T) {
+	salt_file := filepath.Join(t.TempDir(), "log-salt")
+	if _, err := logging.LoadSalt(salt_file); err != nil {
+		t.Fatal(err)
+	}
+	first, err := load_scram_secret(salt_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := load_scram_secret(salt_file)
+	if !bytes.Equal(first, again) {
+		t.Fatal("load_scram_secret() changed for the same log salt")
+	}
+	missing, err := load_scram_secret(filepath.Join(t.TempDir(), "nothing"))
+	if err != nil || len(missing) != sha256.Size || bytes.Equal(missing, first) {
+		t.Fatalf("load_scram_secret() without a log salt = %x, %v; want a random secret", missing, err)
+	}
+}
+
+// sasl_login logs in through the SASL server at uri, on a new connection
+// each time like the MTA does.
+func sasl_login(t *testing.T, uri string, client sasl.Client) error {
+	t.Helper()
+	conn, err := dial_uri(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := dovecotsasl.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Do("smtp", client)
+}
+
+func TestSaslMechanisms(t *testing.T) {
+	auth := make_authenticator(t)
+	cfg := auth.config
+	cfg.SASLListenAddress = "unix://" + filepath.Join(t.TempDir(), "sasl.sock")
+	server, err := new_sasl_server(cfg.SASLListenAddress, new_live_config(cfg, nil), auth.accounts, auth.metrics, auth.guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve()
+	defer server.stop()
+	uri := cfg.SASLListenAddress
+
+	user, password := make_login()
+	if err := sasl_login(t, uri, new_scram_client(user, password)); err == nil {
+		t.Fatal("SCRAM-SHA-256 login created an account")
+	}
+	if err := sasl_login(t, uri, sasl.NewPlainClient("", user, password)); err != nil {
+		t.Fatalf("PLAIN login for a new account = %v; want nil", err)
+	}
+	if err := sasl_login(t, uri, sasl.NewLoginClient(user, password)); err != nil {
+		t.Fatalf("LOGIN login = %v; want nil", err)
+	}
+	if err := sasl_login(t, uri, sasl.NewLoginClient(user, password+"x")); err == nil {
+		t.Fatal("LOGIN login with the wrong password succeeded")
+	}
+	if err := sasl_login(t, uri, new_scram_client(user, password)); err != nil {
+		t.Fatalf("SCRAM-SHA-256 login = %v; want nil", err)
+	}
+	if err := sasl_login(t, uri, new_scram_client(user, password+"x")); err == nil {
+		t.Fatal("SCRAM-SHA-256 login with the wrong password succeeded")
+	}
+
+	// Accounts from before SCRAM keys were stored can use SCRAM after they
+	// log in with their password once.
+	if err := os.Remove(filepath.Join(cfg.MailboxesDirectory, user, "scram-sha-256")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sasl_login(t, uri, new_scram_client(user, password)); err == nil {
+		t.Fatal("SCRAM-SHA-256 login without SCRAM keys succeeded")
+	}
+	if err := sasl_login(t, uri, sasl.NewLoginClient(user, password)); err != nil {
+		t.Fatalf("LOGIN login = %v; want nil", err)
+	}
+	if err := sasl_login(t, uri, new_scram_client(user, password)); err != nil {
+		t.Fatalf("SCRAM-SHA-256 login after a LOGIN login = %v; want nil", err)
+	}
+
+	if err := auth.accounts.Block(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := sasl_login(t, uri, new_scram_client(user, password)); err == nil {
+		t.Fatal("SCRAM-SHA-256 login for a blocked account succeeded")
+	}
+	m := auth.metrics
+	if got := m.sasl_logins.With("success").Value(); got != 5 {
+		t.Fatalf("metrics counted %d successful logins; want 5", got)
+	}
+	if got := m.sasl_logins.With("failure").Value(); got != 5 {
+		t.Fatalf("metrics counted %d failed logins; want 5", got)
+	}
+}
+
+func TestSaslMechanismList(t *testing.T) {
+	auth := make_authenticator(t)
+	cfg := auth.config
+	cfg.SASLListenAddress = "unix://" + filepath.Join(t.TempDir(), "sasl.sock")
+	server, err := new_sasl_server(cfg.SASLListenAddress, new_live_config(cfg, nil), auth.accounts, auth.metrics, auth.guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve()
+	defer server.stop()
+
+	conn, err := dial_uri(cfg.SASLListenAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := dovecotsasl.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mechs := c.ConnInfo().Mechs
+	for _, mech := range []string{"PLAIN", "LOGIN", "SCRAM-SHA-256"} {
+		if _, found := mechs[mech]; !found {
+			t.Errorf("mechanisms = %v; want %s", mechs, mech)
+		}
+	}
+	if !mechs["PLAIN"].Plaintext || !mechs["LOGIN"].Plaintext || mechs["SCRAM-SHA-256"].Plaintext {
+		t.Errorf("mechanisms = %v; want PLAIN and LOGIN marked as plaintext, and not SCRAM-SHA-256", mechs)
+	}
+	if strings.Contains(fmt.Sprint(mechs), "PLUS") {
+		t.Errorf("mechanisms = %v; want no channel binding", mechs)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// seed_dir copies the files under src into dst, replacing any that differ.
+// Appliance images (like the gokrazy one that cmdeploy builds) can only ship
+// files on a read-only root filesystem, so chatmaild copies its configuration
+// and keys from there to the writable partition where everything expects
+// them. Files in dst that aren't in src are left alone.
+func seed_dir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		existing, err := os.ReadFile(target)
+		if err == nil && bytes.Equal(existing, data) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tmp := target + ".seed"
+		if err := os.WriteFile(tmp, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Rename(tmp, target)
+	})
+}
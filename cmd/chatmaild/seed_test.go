@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func write_test_file(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read_test_file(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSeedDir(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "perm")
+	write_test_file(t, filepath.Join(src, "chatmail.json"), "new config")
+	write_test_file(t, filepath.Join(src, "dkim", "rsa.key"), "key")
+	write_test_file(t, filepath.Join(dst, "chatmail.json"), "old config")
+	write_test_file(t, filepath.Join(dst, "invites.json"), "invites")
+
+	if err := seed_dir(src, dst); err != nil {
+		t.Fatalf("seed_dir() = %v; want nil", err)
+	}
+	for path, want := range map[string]string{
+		"chatmail.json": "new config",
+		"dkim/rsa.key":  "key",
+		"invites.json":  "invites",
+	} {
+		if got := read_test_file(t, filepath.Join(dst, path)); got != want {
+			t.Fatalf("after seed_dir(), %s = %q; want %q", path, got, want)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dst, "dkim", "rsa.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("seeded key has mode %v; want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	// Seeding again without changes is a no-op.
+	if err := seed_dir(src, dst); err != nil {
+		t.Fatalf("second seed_dir() = %v; want nil", err)
+	}
+}
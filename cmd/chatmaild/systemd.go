@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// sd_listen_fds_start is the first file descriptor that systemd passes to
+// socket-activated services (see sd_listen_fds(3)).
+const sd_listen_fds_start = 3
+
+// systemd_socket is a listening socket passed in by systemd. The name comes
+// from FileDescriptorName= in the socket unit.
+type systemd_socket struct {
+	name     string
+	listener net.Listener
+}
+
+// systemd_sockets_from reads the sockets described by the LISTEN_* variables
+// in getenv, which are meant for the process pid and start at start_fd.
+func systemd_sockets_from(getenv func(string) string, pid int, start_fd int) ([]systemd_socket, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS from systemd: %q", getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdnames := getenv("LISTEN_FDNAMES"); fdnames != "" {
+		names = strings.Split(fdnames, ":")
+	}
+	var sockets []systemd_socket
+	for i := 0; i < count; i++ {
+		fd := start_fd + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd socket")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d from systemd isn't a listening socket: %w", fd, err)
+		}
+		// Like sd_listen_fds_with_names(3), call sockets without a name
+		// "unknown".
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		sockets = append(sockets, systemd_socket{name, l})
+	}
+	return sockets, nil
+}
+
+// systemd_sockets returns the sockets that systemd passed to this process,
+// if it was socket-activated. They're only read once, since the file
+// descriptors belong to whoever takes them first.
+var systemd_sockets = sync.OnceValues(func() ([]systemd_socket, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	return systemd_sockets_from(os.Getenv, os.Getpid(), sd_listen_fds_start)
+})
+
+func same_listen_address(l net.Listener, network string, addr string) bool {
+	if l.Addr().Network() != network {
+		return false
+	}
+	if network != "tcp" {
+		return l.Addr().String() == addr
+	}
+	want, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return false
+	}
+	got, ok := l.Addr().(*net.TCPAddr)
+	return ok && got.Port == want.Port && got.IP.Equal(want.IP)
+}
+
+// find_socket_by_address picks the socket listening on network and addr out
+// of sockets, so that sockets systemd opened for a unix:// or tcp:// address
+// are used without having to change the configuration.
+func find_socket_by_address(sockets []systemd_socket, network string, addr string) net.Listener {
+	for _, s := range sockets {
+		if same_listen_address(s.listener, network, addr) {
+			return s.listener
+		}
+	}
+	return nil
+}
+
+func find_socket_by_name(sockets []systemd_socket, name string) net.Listener {
+	for _, s := range sockets {
+		if s.name == name {
+			return s.listener
+		}
+	}
+	return nil
+}
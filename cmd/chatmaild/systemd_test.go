@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// fake_listen_fds puts files at consecutive file descriptors starting at a
+// high number, the way systemd would put sockets at 3, 4, and so on.
+func fake_listen_fds(t *testing.T, files ...*os.File) int {
+	t.Helper()
+	const start_fd = 1000
+	for i, f := range files {
+		if err := syscall.Dup3(int(f.Fd()), start_fd+i, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	return start_fd
+}
+
+func socketpair_file(t *testing.T) *os.File {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fds[1])
+	return os.NewFile(uintptr(fds[0]), "socketpair")
+}
+
+func fake_env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestSystemdSocketsFromSocketpairs(t *testing.T) {
+	start := fake_listen_fds(t, socketpair_file(t), socketpair_file(t), socketpair_file(t))
+	pid := os.Getpid()
+	sockets, err := systemd_sockets_from(fake_env(map[string]string{
+		"LISTEN_PID":     strconv.Itoa(pid),
+		"LISTEN_FDS":     "3",
+		"LISTEN_FDNAMES": "milter:sasl",
+	}), pid, start)
+	if err != nil {
+		t.Fatalf("systemd_sockets_from() = %v; want nil", err)
+	}
+	defer func() {
+		for _, s := range sockets {
+			s.listener.Close()
+		}
+	}()
+	var names []string
+	for _, s := range sockets {
+		names = append(names, s.name)
+	}
+	if len(names) != 3 || names[0] != "milter" || names[1] != "sasl" || names[2] != "unknown" {
+		t.Fatalf("systemd socket names = %v; want [milter sasl unknown]", names)
+	}
+	if got := find_socket_by_name(sockets, "sasl"); got != sockets[1].listener {
+		t.Fatalf("find_socket_by_name(sasl) = %v; want the second socket", got)
+	}
+	if got := find_socket_by_name(sockets, "admin"); got != nil {
+		t.Fatalf("find_socket_by_name(admin) = %v; want nil", got)
+	}
+}
+
+func TestSystemdSocketsForOtherProcess(t *testing.T) {
+	sockets, err := systemd_sockets_from(fake_env(map[string]string{
+		"LISTEN_PID": "1",
+		"LISTEN_FDS": "2",
+	}), os.Getpid(), 1000)
+	if err != nil || sockets != nil {
+		t.Fatalf("systemd_sockets_from() for another process = %v, %v; want nil, nil", sockets, err)
+	}
+	pid := os.Getpid()
+	if _, err := systemd_sockets_from(fake_env(map[string]string{
+		"LISTEN_PID": strconv.Itoa(pid),
+		"LISTEN_FDS": "lots",
+	}), pid, 1000); err == nil {
+		t.Fatal("systemd_sockets_from() with a malformed LISTEN_FDS succeeded")
+	}
+}
+
+func TestSystemdSocketAccepts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "milter.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hand the socket over like systemd would, without removing it.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	f, err := l.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	start := fake_listen_fds(t, f)
+	pid := os.Getpid()
+	sockets, err := systemd_sockets_from(fake_env(map[string]string{
+		"LISTEN_PID":     strconv.Itoa(pid),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "milter",
+	}), pid, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited := find_socket_by_address(sockets, "unix", path)
+	if inherited == nil {
+		t.Fatalf("find_socket_by_address(unix, %s) = nil; want the inherited socket", path)
+	}
+	defer inherited.Close()
+
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := inherited.Accept()
+	if err != nil {
+		t.Fatalf("Accept() on the inherited socket = %v; want nil", err)
+	}
+	conn.Close()
+}
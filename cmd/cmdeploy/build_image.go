@@ -0,0 +1,415 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const chatmail_module = "github.com/s0ph0s-dog/gochatmail"
+
+const (
+	chatmaild_package        = chatmail_module + "/cmd/chatmaild"
+	chatmail_website_package = chatmail_module + "/cmd/chatmail-website"
+	maddy_package            = "github.com/foxcpp/maddy/cmd/maddy"
+)
+
+// On the device, everything that has to survive updates lives on the /perm
+// partition. The image carries a copy of it on the read-only root filesystem
+// at gokrazy_seed_dir, which chatmaild copies to gokrazy_perm_dir at startup.
+const (
+	gokrazy_perm_dir = "/perm/chatmail"
+	gokrazy_seed_dir = "/etc/chatmail/seed"
+)
+
+type image_target struct {
+	GOARCH          string
+	KernelPackage   string
+	FirmwarePackage string
+	EEPROMPackage   string
+	// CC is the C compiler that builds maddy for this target, unless the
+	// -cc flag says otherwise.
+	CC string
+}
+
+var image_targets = map[string]image_target{
+	"amd64": {"amd64", "github.com/rtr7/kernel", "", "", "x86_64-linux-gnu-gcc"},
+	"rpi":   {"arm64", "github.com/gokrazy/kernel.rpi", "github.com/gokrazy/firmware", "github.com/gokrazy/rpi-eeprom", "aarch64-linux-gnu-gcc"},
+}
+
+func image_target_names() []string {
+	var names []string
+	for name := range image_targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gokrazy_package_config and gokrazy_instance_config are the parts of gok's
+// instance config.json that chatmail uses.
+type gokrazy_package_config struct {
+	GoBuildEnvironment []string          `json:",omitempty"`
+	GoBuildFlags       []string          `json:",omitempty"`
+	GoBuildTags        []string          `json:",omitempty"`
+	CommandLineFlags   []string          `json:",omitempty"`
+	Environment        []string          `json:",omitempty"`
+	ExtraFilePaths     map[string]string `json:",omitempty"`
+	WaitForClock       bool              `json:",omitempty"`
+}
+
+type gokrazy_update struct {
+	HTTPPort string `json:",omitempty"`
+}
+
+type gokrazy_instance_config struct {
+	Hostname        string
+	Packages        []string
+	PackageConfig   map[string]gokrazy_package_config
+	Environment     []string
+	Update          gokrazy_update
+	SerialConsole   string
+	KernelPackage   *string
+	FirmwarePackage *string
+	EEPROMPackage   *string
+}
+
+// gokrazy_chatmail_config moves everything that chatmail writes to the
+// /perm partition, and its sockets to /tmp.
+func gokrazy_chatmail_config(cm_config config.ChatmailConfig) config.ChatmailConfig {
+	cm_config.MailboxesDirectory = gokrazy_perm_dir + "/mail"
+	cm_config.InviteTokensFile = gokrazy_perm_dir + "/invites.json"
+	cm_config.MilterListenAddress = "unix:///tmp/chatmail-milter.sock"
+	cm_config.SASLListenAddress = "unix:///tmp/chatmail-sasl.sock"
+	cm_config.AdminListenAddress = "unix:///tmp/chatmail-admin.sock?mode=0600"
+	cm_config.TLSCertificateFile = gokrazy_perm_dir + "/tls/fullchain.pem"
+	cm_config.TLSKeyFile = gokrazy_perm_dir + "/tls/privkey.pem"
+	cm_config.DKIMKeyDirectory = gokrazy_perm_dir + "/" + dkim.DefaultDirectory
+	cm_config.LogSaltFile = gokrazy_perm_dir + "/log-salt"
+	if cm_config.AccountDatabaseFile != "" {
+		cm_config.AccountDatabaseFile = gokrazy_perm_dir + "/accounts.sqlite"
+	}
+	if strings.HasPrefix(cm_config.MetricsListenAddress, "unix://") {
+		cm_config.MetricsListenAddress = "unix:///tmp/chatmail-metrics.sock"
+	}
+	return cm_config
+}
+
+// maddy_build_config builds maddy with cgo, which its SQLite mail storage
+// needs, using cc. gokrazy has no C library to link against at run time, so
+// the result is linked statically, and the tags keep the Go standard library
+// and SQLite from looking for one.
+func maddy_build_config(cc string) gokrazy_package_config {
+	return gokrazy_package_config{
+		GoBuildEnvironment: []string{"CGO_ENABLED=1", "CC=" + cc},
+		GoBuildFlags:       []string{"-ldflags=-linkmode=external -extldflags=-static"},
+		GoBuildTags:        []string{"netgo", "osusergo", "sqlite_omit_load_extension"},
+	}
+}
+
+func make_gokrazy_instance_config(cm_config config.ChatmailConfig, target image_target, seed_dir string) gokrazy_instance_config {
+	perm_config_file := gokrazy_perm_dir + "/" + config_file_name
+	optional := func(pkg string) *string {
+		return &pkg
+	}
+	maddy := maddy_build_config(target.CC)
+	maddy.CommandLineFlags = []string{"-config", gokrazy_perm_dir + "/maddy.conf", "run"}
+	maddy.WaitForClock = true
+	return gokrazy_instance_config{
+		Hostname: strings.SplitN(cm_config.MailFullyQualifiedDomainName, ".", 2)[0],
+		Packages: []string{chatmaild_package, chatmail_website_package, maddy_package},
+		PackageConfig: map[string]gokrazy_package_config{
+			chatmaild_package: {
+				CommandLineFlags: []string{"-config", perm_config_file, "-seed", gokrazy_seed_dir},
+				ExtraFilePaths:   map[string]string{gokrazy_seed_dir: seed_dir},
+			},
+			chatmail_website_package: {
+				Environment: []string{
+					"CM_WEB_CONFIG=" + perm_config_file,
+					"CM_WEB_ROOT=" + gokrazy_perm_dir + "/www",
+				},
+			},
+			maddy_package: maddy,
+		},
+		Environment: []string{"GOOS=linux", "GOARCH=" + target.GOARCH},
+		// The chatmail website needs port 80.
+		Update:          gokrazy_update{HTTPPort: "8080"},
+		SerialConsole:   "disabled",
+		KernelPackage:   optional(target.KernelPackage),
+		FirmwarePackage: optional(target.FirmwarePackage),
+		EEPROMPackage:   optional(target.EEPROMPackage),
+	}
+}
+
+type image_options struct {
+	target       string
+	work_dir     string
+	www_dir      string
+	dkim_dir     string
+	template_dir string
+	tls_cert     string
+	tls_key      string
+	cc           string
+	source_dir   string
+	image_file   string
+	size_bytes   int64
+	mod_cache    string
+	gok          string
+}
+
+func (o image_options) instance_dir(cm_config config.ChatmailConfig) string {
+	return filepath.Join(o.work_dir, cm_config.MailFullyQualifiedDomainName)
+}
+
+func (o image_options) seed_dir() string {
+	return filepath.Join(o.work_dir, "perm", "chatmail")
+}
+
+// check_tls_certificate makes sure that cert_file and key_file belong
+// together and are good for fqdn, and returns when the certificate expires.
+// The image can't get certificates itself, so a bad one would only show up
+// once the device is running.
+func check_tls_certificate(cert_file string, key_file string, fqdn string, now time.Time) (time.Time, error) {
+	pair, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the image needs a TLS certificate for %s (get one with, for example, certbot's DNS challenge, and pass it with -tls-cert and -tls-key): %w", fqdn, err)
+	}
+	cert := pair.Leaf
+	if cert == nil {
+		if cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if err := cert.VerifyHostname(fqdn); err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", cert_file, err)
+	}
+	if now.After(cert.NotAfter) {
+		return time.Time{}, fmt.Errorf("%s expired on %s", cert_file, cert.NotAfter.Format(time.DateOnly))
+	}
+	return cert.NotAfter, nil
+}
+
+func write_json_file(path string, v any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), perm)
+}
+
+// stage_image writes the gok instance and the /perm files that go into the
+// image to opts.work_dir.
+func stage_image(cm_config config.ChatmailConfig, opts image_options) error {
+	target, ok := image_targets[opts.target]
+	if !ok {
+		return fmt.Errorf("unknown image target %q (expected one of %s)", opts.target, strings.Join(image_target_names(), ", "))
+	}
+	if _, err := os.Stat(filepath.Join(opts.www_dir, "page-layout.html")); err != nil {
+		return fmt.Errorf("no website sources in %s: %w", opts.www_dir, err)
+	}
+	keys, err := dkim.Load(opts.dkim_dir)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no DKIM keys in %s; run 'cmdeploy init' first", opts.dkim_dir)
+	}
+	if _, err := check_tls_certificate(opts.tls_cert, opts.tls_key, cm_config.MailFullyQualifiedDomainName, time.Now()); err != nil {
+		return err
+	}
+
+	seed := opts.seed_dir()
+	if err := os.RemoveAll(seed); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(seed, dkim.DefaultDirectory), 0700); err != nil {
+		return err
+	}
+	device_config := gokrazy_chatmail_config(cm_config)
+	if err := device_config.Save(filepath.Join(seed, config_file_name)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, err := os.ReadFile(dkim.KeyPath(opts.dkim_dir, key.Selector))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dkim.KeyPath(filepath.Join(seed, dkim.DefaultDirectory), key.Selector), data, 0600); err != nil {
+			return err
+		}
+	}
+	// The certificate goes where gokrazy_chatmail_config says, under the
+	// names that certbot uses.
+	tls_dir := filepath.Join(seed, "tls")
+	if err := os.MkdirAll(tls_dir, 0700); err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		src  string
+		name string
+		mode os.FileMode
+	}{
+		{opts.tls_cert, "fullchain.pem", 0644},
+		{opts.tls_key, "privkey.pem", 0600},
+	} {
+		data, err := os.ReadFile(file.src)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tls_dir, file.name), data, file.mode); err != nil {
+			return err
+		}
+	}
+	maddy := new_maddy_vars(device_config)
+	maddy.StateDir = "/perm/maddy"
+	maddy.RuntimeDir = "/tmp/maddy"
+	var maddy_conf bytes.Buffer
+	if err := render_maddy(&maddy_conf, maddy, opts.template_dir); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(seed, "maddy.conf"), maddy_conf.Bytes(), 0644); err != nil {
+		return err
+	}
+	www := filepath.Join(seed, "www")
+	if err := os.MkdirAll(www, 0755); err != nil {
+		return err
+	}
+	build_website(device_config, opts.www_dir, www)
+
+	abs_seed, err := filepath.Abs(seed)
+	if err != nil {
+		return err
+	}
+	instance := opts.instance_dir(cm_config)
+	if err := os.MkdirAll(instance, 0755); err != nil {
+		return err
+	}
+	if opts.cc != "" {
+		target.CC = opts.cc
+	}
+	instance_config := make_gokrazy_instance_config(cm_config, target, abs_seed)
+	if err := write_json_file(filepath.Join(instance, "config.json"), instance_config, 0644); err != nil {
+		return err
+	}
+	if opts.source_dir != "" {
+		return write_local_builddirs(instance, opts.source_dir)
+	}
+	return nil
+}
+
+// write_local_builddirs makes gok build the chatmail packages from a local
+// checkout instead of the published module.
+func write_local_builddirs(instance_dir string, source_dir string) error {
+	abs_source, err := filepath.Abs(source_dir)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range []string{chatmaild_package, chatmail_website_package} {
+		dir := filepath.Join(instance_dir, "builddir", filepath.FromSlash(pkg))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		go_mod := fmt.Sprintf("module gokrazy/build/%s\n\nrequire %s v0.0.0\n\nreplace %s => %s\n", pkg, chatmail_module, chatmail_module, abs_source)
+		if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(go_mod), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offline_build_env makes the go tool take every module from mod_cache
+// (a GOMODCACHE-style directory) instead of the network.
+func offline_build_env(mod_cache string) ([]string, error) {
+	abs_cache, err := filepath.Abs(mod_cache)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"GOPROXY=file://" + filepath.ToSlash(filepath.Join(abs_cache, "cache", "download")),
+		"GOFLAGS=-mod=mod",
+		"GOSUMDB=off",
+		"GOTOOLCHAIN=local",
+	}, nil
+}
+
+func gok_command(cm_config config.ChatmailConfig, opts image_options) (*exec.Cmd, error) {
+	cmd := exec.Command(opts.gok,
+		"--parent_dir", opts.work_dir,
+		"--instance", cm_config.MailFullyQualifiedDomainName,
+		"overwrite",
+		"--full", opts.image_file,
+		"--target_storage_bytes", fmt.Sprint(opts.size_bytes),
+	)
+	cmd.Env = os.Environ()
+	if opts.mod_cache != "" {
+		env, err := offline_build_env(opts.mod_cache)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// do_build_image stages the image and, unless stage_only is set, has gok
+// build it.
+func do_build_image(cm_config config.ChatmailConfig, opts image_options, stage_only bool) error {
+	if err := stage_image(cm_config, opts); err != nil {
+		return err
+	}
+	fmt.Printf("Prepared the gokrazy instance in %s.\n", opts.instance_dir(cm_config))
+	if stage_only {
+		return nil
+	}
+	cmd, err := gok_command(cm_config, opts)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gok failed: %w", err)
+	}
+	fmt.Printf("Image written to %s.\n", opts.image_file)
+	// stage_image has already checked the certificate.
+	expires, _ := check_tls_certificate(opts.tls_cert, opts.tls_key, cm_config.MailFullyQualifiedDomainName, time.Now())
+	fmt.Printf("Its TLS certificate expires on %s. Before then, renew it and build and update the image again (e.g. with 'gok update').\n", expires.Format(time.DateOnly))
+	return nil
+}
+
+func build_image_main(args []string) {
+	buildCmd := flag.NewFlagSet("build-image", flag.ExitOnError)
+	var opts image_options
+	buildCmd.StringVar(&opts.target, "target", "amd64", "hardware to build for: "+strings.Join(image_target_names(), ", "))
+	buildCmd.StringVar(&opts.work_dir, "workdir", "gokrazy", "directory for the gokrazy instance and staged files")
+	buildCmd.StringVar(&opts.www_dir, "www", filepath.Join(".", "www", "src"), "website sources")
+	buildCmd.StringVar(&opts.template_dir, "templates", default_template_dir, "directory with template overrides")
+	buildCmd.StringVar(&opts.tls_cert, "tls-cert", "tls/fullchain.pem", "TLS certificate chain for the mail domain, in PEM format")
+	buildCmd.StringVar(&opts.tls_key, "tls-key", "tls/privkey.pem", "private key of the TLS certificate, in PEM format")
+	buildCmd.StringVar(&opts.cc, "cc", "", "C compiler that builds maddy for the target (default: the target's GNU cross compiler)")
+	buildCmd.StringVar(&opts.source_dir, "source", "", "build chatmail from this checkout instead of the published module")
+	buildCmd.StringVar(&opts.image_file, "o", "chatmail.img", "image file to write")
+	buildCmd.Int64Var(&opts.size_bytes, "size", 4<<30, "size of the image in bytes")
+	buildCmd.StringVar(&opts.mod_cache, "modcache", "", "build offline from this Go module cache (a GOMODCACHE directory)")
+	buildCmd.StringVar(&opts.gok, "gok", "gok", "gok program to build the image with")
+	stageOnly := buildCmd.Bool("stage-only", false, "only prepare the gokrazy instance, without building the image")
+	buildCmd.Parse(args)
+	opts.dkim_dir = dkim.DefaultDirectory
+
+	if err := do_build_image(load_local_config(), opts, *stageOnly); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
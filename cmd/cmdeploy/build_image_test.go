@@ -0,0 +1,227 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write_test_certificate writes a self-signed certificate for hostname and
+// its key to dir.
+func write_test_certificate(t *testing.T, dir string, hostname string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert_file := filepath.Join(dir, "fullchain.pem")
+	key_file := filepath.Join(dir, "privkey.pem")
+	if err := os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key_der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert_file, key_file
+}
+
+func make_image_options(t *testing.T) image_options {
+	t.Helper()
+	dir := t.TempDir()
+	dkim_dir := filepath.Join(dir, "dkim")
+	if _, err := dkim.Generate(dkim_dir); err != nil {
+		t.Fatal(err)
+	}
+	tls_cert, tls_key := write_test_certificate(t, dir, "chat.example")
+	return image_options{
+		target:     "amd64",
+		work_dir:   filepath.Join(dir, "gokrazy"),
+		www_dir:    filepath.Join("..", "..", "www", "src"),
+		dkim_dir:   dkim_dir,
+		tls_cert:   tls_cert,
+		tls_key:    tls_key,
+		image_file: filepath.Join(dir, "chatmail.img"),
+		size_bytes: 1 << 30,
+		gok:        "gok",
+	}
+}
+
+func TestStageImage(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := make_image_options(t)
+	opts.target = "rpi"
+	opts.source_dir = filepath.Join("..", "..")
+	if err := stage_image(cfg, opts); err != nil {
+		t.Fatalf("stage_image() = %v; want nil", err)
+	}
+
+	seed := opts.seed_dir()
+	for _, name := range []string{"chatmail.json", "dkim/rsa.key", "dkim/ed25519.key", "tls/fullchain.pem", "tls/privkey.pem", "maddy.conf", "www/index.html"} {
+		if _, err := os.Stat(filepath.Join(seed, name)); err != nil {
+			t.Fatalf("stage_image() didn't stage %s: %v", name, err)
+		}
+	}
+	var device_config config.ChatmailConfig
+	if err := config.LoadChatmailConfigFromFile(filepath.Join(seed, "chatmail.json"), &device_config); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{device_config.MailboxesDirectory, device_config.InviteTokensFile, device_config.DKIMKeyDirectory, device_config.TLSKeyFile} {
+		if !strings.HasPrefix(path, gokrazy_perm_dir+"/") {
+			t.Fatalf("device config has %q outside of %s", path, gokrazy_perm_dir)
+		}
+	}
+	maddy_conf, err := os.ReadFile(filepath.Join(seed, "maddy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(maddy_conf), "key_path /perm/chatmail/dkim/rsa.key") {
+		t.Fatalf("staged maddy.conf doesn't use the keys on /perm:\n%s", maddy_conf)
+	}
+	if !strings.Contains(string(maddy_conf), "tls file /perm/chatmail/tls/fullchain.pem /perm/chatmail/tls/privkey.pem") {
+		t.Fatalf("staged maddy.conf doesn't use the certificate on /perm:\n%s", maddy_conf)
+	}
+
+	data, err := os.ReadFile(filepath.Join(opts.instance_dir(cfg), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var instance gokrazy_instance_config
+	if err := json.Unmarshal(data, &instance); err != nil {
+		t.Fatal(err)
+	}
+	if len(instance.Packages) != 3 {
+		t.Fatalf("instance packages = %v; want chatmaild, chatmail-website, and maddy", instance.Packages)
+	}
+	if got := instance.Environment; len(got) != 2 || got[1] != "GOARCH=arm64" {
+		t.Fatalf("instance environment = %v; want GOARCH=arm64 for rpi", got)
+	}
+	// maddy's SQLite storage needs cgo; chatmail's own programs don't.
+	maddy := instance.PackageConfig[maddy_package]
+	if !slices.Contains(maddy.GoBuildEnvironment, "CGO_ENABLED=1") || !slices.Contains(maddy.GoBuildEnvironment, "CC=aarch64-linux-gnu-gcc") {
+		t.Fatalf("maddy build environment = %v; want cgo with the arm64 cross compiler", maddy.GoBuildEnvironment)
+	}
+	if got := instance.PackageConfig[chatmaild_package].GoBuildEnvironment; len(got) != 0 {
+		t.Fatalf("chatmaild build environment = %v; want none", got)
+	}
+	abs_seed, _ := filepath.Abs(seed)
+	if got := instance.PackageConfig[chatmaild_package].ExtraFilePaths[gokrazy_seed_dir]; got != abs_seed {
+		t.Fatalf("chatmaild seed directory = %q; want %q", got, abs_seed)
+	}
+	go_mod, err := os.ReadFile(filepath.Join(opts.instance_dir(cfg), "builddir", chatmaild_package, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(go_mod), "replace "+chatmail_module+" => ") {
+		t.Fatalf("builddir go.mod doesn't use the local checkout:\n%s", go_mod)
+	}
+}
+
+func TestGokrazyChatmailConfigPaths(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.AccountDatabaseFile = "/var/lib/chatmail/accounts.sqlite"
+	cfg.MetricsListenAddress = "unix:///run/chatmail/metrics.sock"
+	device_config := reflect.ValueOf(gokrazy_chatmail_config(cfg))
+	// Everything else on gokrazy is read-only.
+	for i := range device_config.NumField() {
+		name := device_config.Type().Field(i).Name
+		path, ok := device_config.Field(i).Interface().(string)
+		if !ok || path == "" {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, "File"), strings.HasSuffix(name, "Directory"):
+			if !strings.HasPrefix(path, gokrazy_perm_dir+"/") {
+				t.Errorf("gokrazy_chatmail_config() has %s %q; want it under %s", name, path, gokrazy_perm_dir)
+			}
+		case strings.HasSuffix(name, "ListenAddress") && strings.HasPrefix(path, "unix://"):
+			if !strings.HasPrefix(path, "unix:///tmp/") {
+				t.Errorf("gokrazy_chatmail_config() has %s %q; want it under /tmp", name, path)
+			}
+		}
+	}
+}
+
+func TestStageImageErrors(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := make_image_options(t)
+	opts.target = "sparc"
+	if err := stage_image(cfg, opts); err == nil {
+		t.Fatal("stage_image() with an unknown target succeeded")
+	}
+	opts = make_image_options(t)
+	opts.dkim_dir = filepath.Join(t.TempDir(), "nothing")
+	if err := stage_image(cfg, opts); err == nil {
+		t.Fatal("stage_image() without DKIM keys succeeded")
+	}
+	opts = make_image_options(t)
+	opts.tls_cert = filepath.Join(t.TempDir(), "nothing.pem")
+	if err := stage_image(cfg, opts); err == nil || !strings.Contains(err.Error(), "-tls-cert") {
+		t.Fatalf("stage_image() without a TLS certificate = %v; want an error that says how to give one", err)
+	}
+	opts = make_image_options(t)
+	opts.tls_cert, opts.tls_key = write_test_certificate(t, t.TempDir(), "other.example")
+	if err := stage_image(cfg, opts); err == nil || !strings.Contains(err.Error(), "chat.example") {
+		t.Fatalf("stage_image() with a certificate for another domain = %v; want an error", err)
+	}
+}
+
+// TestBuildImageOffline only checks how gok is run. No image is actually
+// built: gok is a shell script stand-in, so neither building the packages
+// (maddy needs a C cross compiler) nor booting the result is tested.
+func TestBuildImageOffline(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := make_image_options(t)
+	opts.mod_cache = filepath.Join(t.TempDir(), "modcache")
+	// Stand in for gok, recording how it was run.
+	record := filepath.Join(t.TempDir(), "gok-run")
+	opts.gok = filepath.Join(t.TempDir(), "gok")
+	script := "#!/bin/sh\necho \"$@\" > " + record + "\necho \"$GOPROXY $GOFLAGS $GOSUMDB\" >> " + record + "\n"
+	if err := os.WriteFile(opts.gok, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := do_build_image(cfg, opts, false); err != nil {
+		t.Fatalf("do_build_image() = %v; want nil", err)
+	}
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want_args := "--parent_dir " + opts.work_dir + " --instance chat.example overwrite --full " + opts.image_file + " --target_storage_bytes 1073741824"
+	if lines[0] != want_args {
+		t.Fatalf("gok was run with %q; want %q", lines[0], want_args)
+	}
+	abs_cache, _ := filepath.Abs(opts.mod_cache)
+	want_env := "file://" + abs_cache + "/cache/download -mod=mod off"
+	if lines[1] != want_env {
+		t.Fatalf("gok environment = %q; want %q", lines[1], want_env)
+	}
+}
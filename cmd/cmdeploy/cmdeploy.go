@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
 
 	"bytes"
 	"crypto/sha1"
@@ -25,14 +26,25 @@ import (
 	"github.com/yuin/goldmark/renderer/html"
 )
 
+// cmdeploy runs in the directory that holds chatmail.json, and reads and
+// writes everything else it uses there too, with relative paths.
+const config_file_name = "chatmail.json"
+
 func do_init(fqdn string) {
 	config := config.NewChatmailConfig(fqdn)
-	err := config.Save("./chatmail.json")
+	err := config.Save(config_file_name)
+	if err != nil {
+		panic(err)
+	}
+
+	dkim_dir := dkim.DefaultDirectory
+	_, err = dkim.Generate(dkim_dir)
 	if err != nil {
 		panic(err)
 	}
 
 	fmt.Println("Chatmail server configuration generated! Edit ./chatmail.json in your favorite text editor to change any of the default settings, if you would like.")
+	fmt.Printf("DKIM signing keys are in %s; keep them private. Run 'cmdeploy dns zone' to see the DNS records to publish.\n", dkim_dir)
 }
 
 func copy_file(src string, dst string) error {
@@ -79,9 +91,14 @@ func make_markdown_renderer() goldmark.Markdown {
 //go:embed delta-chat-bw.svg.tmpl
 var dc_logo_tmpl string
 
-func generate_qr_code(fqdn string) string {
-	// Generate DCACCOUNT: URL to go in code
-	new_acct_url := fmt.Sprintf("DCACCOUNT:https://%s/new", fqdn)
+func new_account_url(fqdn string, token string) string {
+	if token == "" {
+		return fmt.Sprintf("DCACCOUNT:https://%s/new", fqdn)
+	}
+	return fmt.Sprintf("DCACCOUNT:https://%s/new?token=%s", fqdn, token)
+}
+
+func generate_qr_code(new_acct_url string) string {
 	// Set up QR code generator tool
 	qr, err := go_qr.EncodeText(new_acct_url, go_qr.High)
 	if err != nil {
@@ -123,7 +140,7 @@ func build_website(cm_config config.ChatmailConfig, input_dir string, output_dir
 		panic(err)
 	}
 	qr_invite_file := filepath.Join(output_dir, "qr-chatmail-invite-"+cm_config.MailFullyQualifiedDomainName+".svg")
-	qr_invite_data := generate_qr_code(cm_config.MailFullyQualifiedDomainName)
+	qr_invite_data := generate_qr_code(new_account_url(cm_config.MailFullyQualifiedDomainName, ""))
 	err = os.WriteFile(qr_invite_file, []byte(qr_invite_data), 0644)
 	if err != nil {
 		panic(err)
@@ -233,13 +250,24 @@ func watch_for_changes(cm_config config.ChatmailConfig, input_dir string, output
 	}
 }
 
+func load_local_config() config.ChatmailConfig {
+	config_file := config_file_name
+	cm_config, _, err := config.Loader{File: config_file, Environ: os.Environ()}.Load()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return cm_config
+}
+
 func main() {
 	initCmd := flag.NewFlagSet("init", flag.ExitOnError)
+	answersFile := initCmd.String("answers", "", "read the setup wizard's answers from this JSON file instead of asking")
 
 	webdevCmd := flag.NewFlagSet("webdev", flag.ExitOnError)
 
 	if len(os.Args) < 2 {
-		fmt.Println("expected 'init' or 'webdev' subcommands")
+		fmt.Println("expected 'init', 'webdev', 'invite', 'dns', 'render', 'build-image', 'install', 'uninstall', 'validate', 'config', 'import-ini', or 'export-ini' subcommands")
 		os.Exit(1)
 	}
 
@@ -248,19 +276,13 @@ func main() {
 		initCmd.Parse(os.Args[2:])
 		tail := initCmd.Args()
 		if len(tail) < 1 {
-			fmt.Println("you have to provide the fully qualified domain name of your new chat server")
-			os.Exit(1)
+			do_init_wizard(*answersFile)
+		} else {
+			do_init(tail[0])
 		}
-		fqdn := tail[0]
-		do_init(fqdn)
 	case "webdev":
 		webdevCmd.Parse(os.Args[2:])
-		var cm_config config.ChatmailConfig
-		config_file := filepath.Join(".", "chatmail.json")
-		cl_err := config.LoadChatmailConfigFromFile(config_file, &cm_config)
-		if cl_err != nil {
-			panic(cl_err)
-		}
+		cm_config := load_local_config()
 		input_dir := filepath.Join(".", "www", "src")
 		output_dir := filepath.Join(".", "www", "build")
 		os.RemoveAll(output_dir)
@@ -272,8 +294,28 @@ func main() {
 		}
 		open.Run("file://" + index_html)
 		watch_for_changes(cm_config, input_dir, output_dir)
+	case "invite":
+		invite_main(os.Args[2:])
+	case "dns":
+		dns_main(os.Args[2:])
+	case "render":
+		render_main(os.Args[2:])
+	case "build-image":
+		build_image_main(os.Args[2:])
+	case "install":
+		install_main(os.Args[2:])
+	case "uninstall":
+		uninstall_main(os.Args[2:])
+	case "validate":
+		validate_main(os.Args[2:])
+	case "config":
+		config_main(os.Args[2:])
+	case "import-ini":
+		import_ini_main(os.Args[2:])
+	case "export-ini":
+		export_ini_main(os.Args[2:])
 	default:
-		fmt.Println("expected 'init' or 'webdev' subcommands")
+		fmt.Println("expected 'init', 'webdev', 'invite', 'dns', 'render', 'build-image', 'install', 'uninstall', 'validate', 'config', 'import-ini', or 'export-ini' subcommands")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// line_diff compares a and b line by line, marking lines that are only in a
+// with "-", lines only in b with "+", and common lines with " ".
+func line_diff(a []string, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]. Configuration files are small enough for this to be fine.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+func split_lines(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// do_config_migrate shows how config_file would change when it's migrated
+// to the current version, and migrates it unless dry_run is set.
+func do_config_migrate(w io.Writer, config_file string, dry_run bool) error {
+	data, err := os.ReadFile(config_file)
+	if err != nil {
+		return err
+	}
+	migrated, version, err := config.Migrate(data)
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", config_file, err)
+	}
+	if version == config.CurrentVersion {
+		fmt.Fprintf(w, "%s is already at the current version (%d).\n", config_file, version)
+		return nil
+	}
+	fmt.Fprintf(w, "Changes to %s from version %d to %d:\n", config_file, version, config.CurrentVersion)
+	for _, line := range line_diff(split_lines(data), split_lines(migrated)) {
+		fmt.Fprintln(w, line)
+	}
+	if dry_run {
+		fmt.Fprintln(w, "Run again without -dry-run to make these changes.")
+		return nil
+	}
+	if _, _, err := config.MigrateFile(config_file); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Migrated %s; the original is in %s.\n", config_file, config.BackupPath(config_file, version))
+	return nil
+}
+
+// dump_config shows the value of every field, and where it came from.
+func dump_config(w io.Writer, cm_config config.ChatmailConfig, sources config.Sources) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tSOURCE")
+	v := reflect.ValueOf(cm_config)
+	for _, field := range config.FieldNames() {
+		value, err := json.Marshal(v.FieldByName(field).Interface())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", field, value, sources[field])
+	}
+	return tw.Flush()
+}
+
+func config_main(args []string) {
+	migrateCmd := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	dryRun := migrateCmd.Bool("dry-run", false, "only show what would change")
+
+	dumpCmd := flag.NewFlagSet("config dump", flag.ExitOnError)
+	dumpFile := dumpCmd.String("config", config_file_name, "configuration file to start from, or \"\" for none")
+	dumpOverrides := config.RegisterFlags(dumpCmd)
+
+	if len(args) < 1 {
+		fmt.Println("expected 'migrate' or 'dump' subcommands")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "migrate":
+		migrateCmd.Parse(args[1:])
+		config_file := config_file_name
+		if migrateCmd.NArg() > 0 {
+			config_file = migrateCmd.Arg(0)
+		}
+		if err := do_config_migrate(os.Stdout, config_file, *dryRun); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "dump":
+		dumpCmd.Parse(args[1:])
+		cm_config, sources, err := config.DefaultLoader(*dumpFile, dumpOverrides).Load()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := dump_config(os.Stdout, cm_config, sources); err != nil {
+			panic(err)
+		}
+	default:
+		fmt.Println("expected 'migrate' or 'dump' subcommands")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	a := []string{"{", "  a", "  b", "}"}
+	b := []string{"{", "  v", "  a", "  c", "}"}
+	want := []string{"  {", "+   v", "    a", "-   b", "+   c", "  }"}
+	if got := line_diff(a, b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("line_diff() = %q; want %q", got, want)
+	}
+}
+
+func TestDoConfigMigrate(t *testing.T) {
+	config_file := filepath.Join(t.TempDir(), config_file_name)
+	original, err := os.ReadFile(filepath.Join("..", "..", "internal", "config", "testdata", "v2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config_file, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := do_config_migrate(&out, config_file, true); err != nil {
+		t.Fatalf("do_config_migrate(dry run) = %v; want nil", err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf(`+   "ConfigVersion": %d,`, config.CurrentVersion),
+		`+   "MilterListenAddress": "unix:///run/chatmail/milter.sock",`,
+		`    "InviteOnly": true,`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("do_config_migrate() output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if data, _ := os.ReadFile(config_file); !bytes.Equal(data, original) {
+		t.Fatalf("do_config_migrate(dry run) changed %s", config_file)
+	}
+
+	out.Reset()
+	if err := do_config_migrate(&out, config_file, false); err != nil {
+		t.Fatalf("do_config_migrate() = %v; want nil", err)
+	}
+	if data, _ := os.ReadFile(config.BackupPath(config_file, 1)); !bytes.Equal(data, original) {
+		t.Fatalf("do_config_migrate() didn't keep the original")
+	}
+
+	out.Reset()
+	if err := do_config_migrate(&out, config_file, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("already at the current version (%d)", config.CurrentVersion)) {
+		t.Fatalf("do_config_migrate() of a migrated file = %q; want already current", out.String())
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	loader := config.Loader{Environ: []string{
+		"CHATMAIL_MAIL_FULLY_QUALIFIED_DOMAIN_NAME=chat.example",
+		"CHATMAIL_INVITE_ONLY=1",
+	}}
+	cm_config, sources, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := dump_config(&out, cm_config, sources); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(config.FieldNames())+1 {
+		t.Fatalf("dump_config() printed %d lines; want a header and one per field:\n%s", len(lines), out.String())
+	}
+	for _, want := range []string{
+		`(?m)^MailFullyQualifiedDomainName +"chat.example" +env CHATMAIL_MAIL_FULLY_QUALIFIED_DOMAIN_NAME$`,
+		`(?m)^InviteOnly +true +env CHATMAIL_INVITE_ONLY$`,
+		`(?m)^PassthroughRecipientsList +\["xstore@testrun.org"\] +default$`,
+	} {
+		if !regexp.MustCompile(want).MatchString(out.String()) {
+			t.Errorf("dump_config() doesn't match %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnsprovider"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ip_list collects a repeatable (or comma-separated) IP address flag.
+type ip_list []string
+
+func (l *ip_list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *ip_list) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("%q is not an IP address", s)
+		}
+		*l = append(*l, s)
+	}
+	return nil
+}
+
+type zone_flags struct {
+	ipv4 ip_list
+	ipv6 ip_list
+}
+
+func add_zone_flags(fs *flag.FlagSet) *zone_flags {
+	zf := &zone_flags{}
+	fs.Var(&zf.ipv4, "ipv4", "IPv4 address of the server (may be repeated)")
+	fs.Var(&zf.ipv6, "ipv6", "IPv6 address of the server (may be repeated)")
+	return zf
+}
+
+func (zf *zone_flags) options() dnszone.Options {
+	keys, err := dkim.Load(dkim.DefaultDirectory)
+	if err != nil {
+		panic(err)
+	}
+	return dnszone.Options{IPv4: zf.ipv4, IPv6: zf.ipv6, DKIMKeys: keys}
+}
+
+func do_dns_zone(cm_config config.ChatmailConfig, opts dnszone.Options, format string) {
+	records, err := dnszone.Zone(cm_config, opts)
+	if err != nil {
+		panic(err)
+	}
+	switch format {
+	case "bind":
+		if len(opts.IPv4) == 0 && len(opts.IPv6) == 0 {
+			fmt.Println("; Pass -ipv4 and/or -ipv6 to include address records for the server.")
+		}
+		if len(opts.DKIMKeys) == 0 {
+			fmt.Println("; No DKIM keys found; run 'cmdeploy init' to generate them.")
+		}
+		if err := dnszone.WriteBIND(os.Stdout, cm_config, records); err != nil {
+			panic(err)
+		}
+	case "json":
+		out, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(out))
+	default:
+		fmt.Printf("unknown zone format %q (expected 'bind' or 'json')\n", format)
+		os.Exit(1)
+	}
+}
+
+func do_dns_apply(cm_config config.ChatmailConfig, opts dnszone.Options, provider_name string, zone string, dry_run bool, timeout time.Duration) {
+	provider, err := dnsprovider.FromEnv(provider_name, os.Getenv)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	records, err := dnszone.Zone(cm_config, opts)
+	if err != nil {
+		panic(err)
+	}
+	if dry_run {
+		fmt.Printf("Changes that would be made to %s at %s:\n", zone, provider_name)
+	} else {
+		fmt.Printf("Applying changes to %s at %s:\n", zone, provider_name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	changes, err := dnsprovider.Reconcile(ctx, provider, zone, records, dry_run, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Println("Nothing to do; all records are up to date.")
+	} else if dry_run {
+		fmt.Println("Run again without -dry-run to make these changes.")
+	}
+}
+
+func dns_main(args []string) {
+	checkCmd := flag.NewFlagSet("dns check", flag.ExitOnError)
+	resolverAddr := checkCmd.String("resolver", default_resolver_address(), "DNS resolver to query, as host:port")
+	timeout := checkCmd.Duration("timeout", 30*time.Second, "how long to wait for all DNS queries to finish")
+	checkZone := add_zone_flags(checkCmd)
+
+	zoneCmd := flag.NewFlagSet("dns zone", flag.ExitOnError)
+	format := zoneCmd.String("format", "bind", "output format: 'bind' or 'json'")
+	zoneZone := add_zone_flags(zoneCmd)
+
+	applyCmd := flag.NewFlagSet("dns apply", flag.ExitOnError)
+	provider := applyCmd.String("provider", "", "DNS provider to configure: "+strings.Join(dnsprovider.Names(), ", "))
+	zone := applyCmd.String("zone", "", "zone at the provider that the chatmail domain is in (default: the chatmail domain itself)")
+	dryRun := applyCmd.Bool("dry-run", false, "only show what would change")
+	applyTimeout := applyCmd.Duration("timeout", 2*time.Minute, "how long to wait for the provider")
+	applyZone := add_zone_flags(applyCmd)
+
+	if len(args) < 1 {
+		fmt.Println("expected 'check', 'zone', or 'apply' subcommands")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "check":
+		checkCmd.Parse(args[1:])
+		cm_config := load_local_config()
+		resolver := dns_server_resolver{*resolverAddr}
+		if !do_dns_check(cm_config, checkZone.options(), resolver, *timeout, os.Stdout) {
+			os.Exit(1)
+		}
+	case "zone":
+		zoneCmd.Parse(args[1:])
+		do_dns_zone(load_local_config(), zoneZone.options(), *format)
+	case "apply":
+		applyCmd.Parse(args[1:])
+		if *provider == "" {
+			fmt.Println("you have to choose a DNS provider with -provider")
+			os.Exit(1)
+		}
+		cm_config := load_local_config()
+		if *zone == "" {
+			*zone = cm_config.MailFullyQualifiedDomainName
+		}
+		do_dns_apply(cm_config, applyZone.options(), *provider, *zone, *dryRun, *applyTimeout)
+	default:
+		fmt.Println("expected 'check', 'zone', or 'apply' subcommands")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dns_resolver answers DNS queries for the checker. It's an interface so that
+// tests can point the checker at an in-process DNS server.
+type dns_resolver interface {
+	Lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error)
+}
+
+// dns_server_resolver sends queries to a single recursive resolver.
+type dns_server_resolver struct {
+	server string
+}
+
+func default_resolver_address() string {
+	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(cc.Servers) == 0 {
+		return "1.1.1.1:53"
+	}
+	return net.JoinHostPort(cc.Servers[0], cc.Port)
+}
+
+func (r dns_server_resolver) Lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, false)
+	client := &dns.Client{}
+	resp, _, err := client.ExchangeContext(ctx, msg, r.server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, r.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("resolver returned %s for %s %s", dns.RcodeToString[resp.Rcode], name, dns.TypeToString[qtype])
+	}
+	// Skip over any CNAMEs the resolver followed on the way to the answer.
+	answers := make([]dns.RR, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, nil
+}
+
+func parse_record(record dnszone.Record) dns.RR {
+	rr, err := record.RR()
+	if err != nil {
+		panic(fmt.Errorf("chatmail generated an unparseable DNS record %q: %w", record, err))
+	}
+	return rr
+}
+
+type dns_matcher func(got []dns.RR) bool
+
+func match_any() dns_matcher {
+	return func(got []dns.RR) bool {
+		return len(got) > 0
+	}
+}
+
+func match_exact(record dnszone.Record) dns_matcher {
+	want := dnszone.RData(parse_record(record))
+	return func(got []dns.RR) bool {
+		for _, rr := range got {
+			// Domain names are case-insensitive, but TXT contents (like DKIM
+			// keys) aren't.
+			if _, is_txt := rr.(*dns.TXT); is_txt && dnszone.RData(rr) == want {
+				return true
+			} else if !is_txt && strings.EqualFold(dnszone.RData(rr), want) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func match_txt_prefix(prefix string) dns_matcher {
+	return func(got []dns.RR) bool {
+		for _, rr := range got {
+			if strings.HasPrefix(dnszone.RData(rr), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// match_caa accepts any CAA record set that lets Let's Encrypt issue
+// certificates, whatever extra parameters (like accounturi) it has.
+func match_caa() dns_matcher {
+	return func(got []dns.RR) bool {
+		for _, rr := range got {
+			caa, ok := rr.(*dns.CAA)
+			if ok && caa.Tag == "issue" && strings.HasPrefix(caa.Value, "letsencrypt.org") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type dns_expectation struct {
+	name     string
+	rtype    uint16
+	optional bool
+	matches  dns_matcher
+	// Records to suggest when the check fails.
+	fix []dnszone.Record
+}
+
+func dns_expectations(cm_config config.ChatmailConfig, opts dnszone.Options) ([]dns_expectation, error) {
+	zone, err := dnszone.Zone(cm_config, opts)
+	if err != nil {
+		return nil, err
+	}
+	domain := dns.Fqdn(cm_config.MailFullyQualifiedDomainName)
+	placeholder := func(name string, rtype string, value string) []dnszone.Record {
+		return []dnszone.Record{{Name: name, Type: rtype, TTL: dnszone.DefaultTTL, Value: value}}
+	}
+	var expectations []dns_expectation
+	// Without being told the server's addresses, the best we can do is check
+	// that there are some.
+	if len(opts.IPv4) == 0 {
+		expectations = append(expectations, dns_expectation{
+			domain, dns.TypeA, false, match_any(), placeholder(domain, "A", "<IPv4 address of your server>"),
+		})
+	}
+	if len(opts.IPv6) == 0 {
+		expectations = append(expectations, dns_expectation{
+			domain, dns.TypeAAAA, true, match_any(), placeholder(domain, "AAAA", "<IPv6 address of your server>"),
+		})
+	}
+	for _, record := range zone {
+		matches := match_exact(record)
+		if record.Type == "CAA" {
+			matches = match_caa()
+		} else if strings.HasPrefix(record.Name, "_mta-sts.") {
+			// The policy ID only has to change when the policy does, so
+			// operators may have their own.
+			matches = match_txt_prefix("v=STSv1;")
+		}
+		expectations = append(expectations, dns_expectation{
+			record.Name,
+			dns.StringToType[record.Type],
+			false,
+			matches,
+			[]dnszone.Record{record},
+		})
+	}
+	if len(opts.DKIMKeys) == 0 {
+		dkim_name := dnszone.DKIMRecordName(cm_config, dkim.SelectorRSA)
+		expectations = append(expectations, dns_expectation{
+			dkim_name,
+			dns.TypeTXT,
+			false,
+			match_txt_prefix("v=DKIM1;"),
+			placeholder(dkim_name, "TXT", `"v=DKIM1; k=rsa; p=<your DKIM public key>"`),
+		})
+	}
+	return expectations, nil
+}
+
+type dns_check_status int
+
+const (
+	dns_check_pass dns_check_status = iota
+	dns_check_warn
+	dns_check_fail
+)
+
+func (s dns_check_status) String() string {
+	switch s {
+	case dns_check_pass:
+		return "PASS"
+	case dns_check_warn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+type dns_check_result struct {
+	Name   string
+	Type   string
+	Status dns_check_status
+	Found  []string
+	Err    error
+	Fix    []dnszone.Record
+}
+
+func check_dns(ctx context.Context, resolver dns_resolver, expectations []dns_expectation) []dns_check_result {
+	results := make([]dns_check_result, 0, len(expectations))
+	for _, e := range expectations {
+		result := dns_check_result{Name: e.name, Type: dns.TypeToString[e.rtype], Fix: e.fix}
+		got, err := resolver.Lookup(ctx, e.name, e.rtype)
+		for _, rr := range got {
+			result.Found = append(result.Found, dnszone.RData(rr))
+		}
+		if err != nil {
+			result.Err = err
+			result.Status = dns_check_fail
+		} else if e.matches(got) {
+			result.Status = dns_check_pass
+		} else if e.optional {
+			result.Status = dns_check_warn
+		} else {
+			result.Status = dns_check_fail
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func print_dns_check_results(w io.Writer, results []dns_check_result) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tTYPE\tNAME\tFOUND")
+	for _, r := range results {
+		found := strings.Join(r.Found, " | ")
+		if r.Err != nil {
+			found = "error: " + r.Err.Error()
+		} else if len(r.Found) == 0 {
+			found = "(nothing)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Status, r.Type, r.Name, found)
+	}
+	tw.Flush()
+
+	needs_fix := false
+	for _, r := range results {
+		if r.Status == dns_check_pass {
+			continue
+		}
+		if !needs_fix {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "Suggested fixes (add these records at your DNS provider):")
+			needs_fix = true
+		}
+		for _, fix := range r.Fix {
+			fmt.Fprintf(w, "  %s\n", fix)
+		}
+	}
+}
+
+func dns_check_failed(results []dns_check_result) bool {
+	for _, r := range results {
+		if r.Status == dns_check_fail {
+			return true
+		}
+	}
+	return false
+}
+
+func do_dns_check(cm_config config.ChatmailConfig, opts dnszone.Options, resolver dns_resolver, timeout time.Duration, w io.Writer) bool {
+	expectations, err := dns_expectations(cm_config, opts)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := check_dns(ctx, resolver, expectations)
+	print_dns_check_results(w, results)
+	return !dns_check_failed(results)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// start_test_dns_server answers queries from records, and returns the address
+// it's listening on.
+func start_test_dns_server(t *testing.T, records []dns.RR) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		name_exists := false
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Header().Name, q.Name) {
+				continue
+			}
+			name_exists = true
+			if rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		if !name_exists {
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp)
+	})
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func test_zone_options(t *testing.T) dnszone.Options {
+	t.Helper()
+	keys, err := dkim.Generate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dnszone.Options{IPv4: []string{"192.0.2.1"}, DKIMKeys: keys}
+}
+
+func good_zone(t *testing.T, cm_config config.ChatmailConfig, opts dnszone.Options) []dns.RR {
+	t.Helper()
+	zone, err := dnszone.Zone(cm_config, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []dns.RR
+	for _, record := range zone {
+		records = append(records, parse_record(record))
+	}
+	return records
+}
+
+func expectations(t *testing.T, cm_config config.ChatmailConfig, opts dnszone.Options) []dns_expectation {
+	t.Helper()
+	e, err := dns_expectations(cm_config, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func results_by_name_type(results []dns_check_result) map[string]dns_check_status {
+	statuses := make(map[string]dns_check_status)
+	for _, r := range results {
+		statuses[r.Type+" "+r.Name] = r.Status
+	}
+	return statuses
+}
+
+func TestDnsCheckAllRecordsPresent(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := test_zone_options(t)
+	addr := start_test_dns_server(t, good_zone(t, cfg, opts))
+
+	var out bytes.Buffer
+	ok := do_dns_check(cfg, opts, dns_server_resolver{addr}, 5*time.Second, &out)
+	if !ok {
+		t.Fatalf("do_dns_check() with complete zone = false; want true\n%s", out.String())
+	}
+	statuses := results_by_name_type(check_dns(context.Background(), dns_server_resolver{addr}, expectations(t, cfg, opts)))
+	if statuses["AAAA chat.example."] != dns_check_warn {
+		t.Fatalf("missing AAAA status = %s; want %s", statuses["AAAA chat.example."], dns_check_warn)
+	}
+	if statuses["TXT ed25519._domainkey.chat.example."] != dns_check_pass {
+		t.Fatalf("Ed25519 DKIM status = %s; want %s", statuses["TXT ed25519._domainkey.chat.example."], dns_check_pass)
+	}
+
+	// Without knowing the addresses or keys, the checker only asks for some.
+	ok = do_dns_check(cfg, dnszone.Options{}, dns_server_resolver{addr}, 5*time.Second, &out)
+	if !ok {
+		t.Fatalf("do_dns_check() without zone options = false; want true\n%s", out.String())
+	}
+}
+
+func TestDnsCheckReportsMissingAndWrongRecords(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := test_zone_options(t)
+	other_keys, err := dkim.Generate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []dns.RR
+	for _, rr := range good_zone(t, cfg, dnszone.Options{IPv4: []string{"192.0.2.99"}, DKIMKeys: other_keys}) {
+		switch rr.Header().Name {
+		case "_dmarc.chat.example.":
+			continue
+		case "chat.example.":
+			if mx, ok := rr.(*dns.MX); ok {
+				mx.Mx = "mail.elsewhere.example."
+			}
+			if caa, ok := rr.(*dns.CAA); ok {
+				caa.Value = "letsencrypt.org;accounturi=https://acme.example/acct/1"
+			}
+		}
+		records = append(records, rr)
+	}
+	addr := start_test_dns_server(t, records)
+
+	results := check_dns(context.Background(), dns_server_resolver{addr}, expectations(t, cfg, opts))
+	statuses := results_by_name_type(results)
+	want := map[string]dns_check_status{
+		"A chat.example.":                  dns_check_fail,
+		"TXT rsa._domainkey.chat.example.": dns_check_fail,
+		"TXT _dmarc.chat.example.":         dns_check_fail,
+		"MX chat.example.":                 dns_check_fail,
+		"CAA chat.example.":                dns_check_pass,
+		"TXT chat.example.":                dns_check_pass,
+	}
+	for key, status := range want {
+		if statuses[key] != status {
+			t.Fatalf("status of %s = %s; want %s", key, statuses[key], status)
+		}
+	}
+	if !dns_check_failed(results) {
+		t.Fatal("dns_check_failed() = false; want true")
+	}
+
+	var out bytes.Buffer
+	print_dns_check_results(&out, results)
+	if !strings.Contains(out.String(), "_dmarc.chat.example.\t3600\tIN\tTXT\t\"v=DMARC1;p=reject;adkim=s;aspf=s\"") {
+		t.Fatalf("output does not suggest the DMARC record:\n%s", out.String())
+	}
+}
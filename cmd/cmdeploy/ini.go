@@ -0,0 +1,354 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chatmail.ini from the upstream Python chatmail project keeps its settings
+// in this section.
+const ini_section = "params"
+
+// ini_file is the parts of an ini file that matter for importing: the
+// settings in each section, and the order they appeared in.
+type ini_file struct {
+	values map[string]map[string]string
+	keys   map[string][]string
+}
+
+func parse_ini(r io.Reader) (ini_file, error) {
+	ini := ini_file{make(map[string]map[string]string), make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	section := ""
+	for line_no := 1; scanner.Scan(); line_no++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return ini, fmt.Errorf("line %d: unterminated section header %q", line_no, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return ini, fmt.Errorf("line %d: expected 'key = value', not %q", line_no, line)
+		}
+		if section == "" {
+			return ini, fmt.Errorf("line %d: %q is outside of any section", line_no, line)
+		}
+		key = strings.TrimSpace(key)
+		if ini.values[section] == nil {
+			ini.values[section] = make(map[string]string)
+		}
+		if _, seen := ini.values[section][key]; !seen {
+			ini.keys[section] = append(ini.keys[section], key)
+		}
+		ini.values[section][key] = strings.TrimSpace(value)
+	}
+	return ini, scanner.Err()
+}
+
+// parse_data_size is the inverse of data_size: it reads a number of bytes
+// with an optional K, M, G or T suffix, as Dovecot quotas are written.
+func parse_data_size(s string) (int, error) {
+	units := map[byte]int{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	number := strings.TrimSuffix(strings.ToUpper(s), "B")
+	multiplier := 1
+	if len(number) > 0 && units[number[len(number)-1]] != 0 {
+		multiplier = units[number[len(number)-1]]
+		number = number[:len(number)-1]
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n * multiplier, nil
+}
+
+// ini_setting maps one chatmail.ini key to and from a ChatmailConfig field.
+type ini_setting struct {
+	key     string
+	comment string
+	get     func(c *config.ChatmailConfig) string
+	set     func(c *config.ChatmailConfig, value string) error
+}
+
+func ini_int(key string, comment string, field func(*config.ChatmailConfig) *int) ini_setting {
+	return ini_setting{
+		key:     key,
+		comment: comment,
+		get:     func(c *config.ChatmailConfig) string { return strconv.Itoa(*field(c)) },
+		set: func(c *config.ChatmailConfig, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a whole number", value)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func ini_string(key string, comment string, field func(*config.ChatmailConfig) *string) ini_setting {
+	return ini_setting{
+		key:     key,
+		comment: comment,
+		get:     func(c *config.ChatmailConfig) string { return *field(c) },
+		set: func(c *config.ChatmailConfig, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+// ini_list handles upstream's space-separated address lists. Upstream also
+// allows "@domain" entries, which chatmail doesn't support; those are left
+// out, and reported as warnings.
+func ini_list(key string, comment string, field func(*config.ChatmailConfig) *[]string) ini_setting {
+	return ini_setting{
+		key:     key,
+		comment: comment,
+		get:     func(c *config.ChatmailConfig) string { return strings.Join(*field(c), " ") },
+		set: func(c *config.ChatmailConfig, value string) error {
+			list := []string{}
+			var skipped []string
+			for _, address := range strings.Fields(value) {
+				if strings.HasPrefix(address, "@") {
+					skipped = append(skipped, address)
+				} else {
+					list = append(list, address)
+				}
+			}
+			*field(c) = list
+			if len(skipped) > 0 {
+				return ini_warning{fmt.Sprintf("whole-domain entries aren't supported, so these were left out: %s", strings.Join(skipped, " "))}
+			}
+			return nil
+		},
+	}
+}
+
+// ini_warning is returned by a setter that managed to import the value, but
+// not all of it.
+type ini_warning struct {
+	message string
+}
+
+func (w ini_warning) Error() string {
+	return w.message
+}
+
+// ini_settings are in the order that upstream's chatmail.ini has them.
+var ini_settings = []ini_setting{
+	ini_int("max_user_send_per_minute", "how many mails a user can send out per minute", func(c *config.ChatmailConfig) *int { return &c.MaxEmailsPerMinutePerUser }),
+	{
+		key:     "max_mailbox_size",
+		comment: "maximum mailbox size of a chatmail address",
+		get:     func(c *config.ChatmailConfig) string { return data_size(c.MaxMailboxSizeMB * 1024 * 1024) },
+		set: func(c *config.ChatmailConfig, value string) error {
+			size, err := parse_data_size(value)
+			if err != nil {
+				return err
+			}
+			if size%(1024*1024) != 0 {
+				return fmt.Errorf("%s isn't a whole number of megabytes", value)
+			}
+			c.MaxMailboxSizeMB = size / (1024 * 1024)
+			return nil
+		},
+	},
+	{
+		key:     "max_message_size",
+		comment: "maximum message size for an e-mail in bytes",
+		get:     func(c *config.ChatmailConfig) string { return strconv.Itoa(c.MaxMessageSizeB) },
+		set: func(c *config.ChatmailConfig, value string) error {
+			size, err := parse_data_size(value)
+			c.MaxMessageSizeB = size
+			return err
+		},
+	},
+	ini_int("delete_mails_after", "days after which mails are unconditionally deleted", func(c *config.ChatmailConfig) *int { return &c.DeleteMailsAfterDays }),
+	ini_int("delete_inactive_users_after", "days after which users without a successful login are deleted (database and mails)", func(c *config.ChatmailConfig) *int { return &c.DeleteInactiveUsersAfterDays }),
+	ini_int("username_min_length", "minimum length a username must have", func(c *config.ChatmailConfig) *int { return &c.UsernameMinLength }),
+	ini_int("username_max_length", "maximum length a username can have", func(c *config.ChatmailConfig) *int { return &c.UsernameMaxLength }),
+	ini_int("password_min_length", "minimum length a password must have", func(c *config.ChatmailConfig) *int { return &c.PasswordMinLength }),
+	ini_list("passthrough_senders", "list of chatmail addresses which can send outbound un-encrypted mail", func(c *config.ChatmailConfig) *[]string { return &c.PassthroughSendersList }),
+	ini_list("passthrough_recipients", "list of e-mail recipients for which to accept outbound un-encrypted mails", func(c *config.ChatmailConfig) *[]string { return &c.PassthroughRecipientsList }),
+	ini_string("mailboxes_dir", "Directory where user mailboxes are stored", func(c *config.ChatmailConfig) *string { return &c.MailboxesDirectory }),
+	ini_string("privacy_postal", "postal address of privacy contact", func(c *config.ChatmailConfig) *string { return &c.PrivacyContactPostalAddress }),
+	ini_string("privacy_mail", "email address of privacy contact", func(c *config.ChatmailConfig) *string { return &c.PrivacyContactEmailAddress }),
+	ini_string("privacy_pdo", "postal address of the privacy data officer", func(c *config.ChatmailConfig) *string { return &c.PrivacyDataOfficerPostalAddress }),
+	ini_string("privacy_supervisor", "postal address of the privacy supervisor", func(c *config.ChatmailConfig) *string { return &c.PrivacySupervisorPostalAddress }),
+}
+
+// ini_unsupported explains the upstream options that chatmail has no
+// equivalent for.
+var ini_unsupported = map[string]string{
+	"filtermail_smtp_port":  "use 'cmdeploy render postfix-dovecot -content-filter' for the content filter setup",
+	"postfix_reinject_port": "use 'cmdeploy render postfix-dovecot -content-filter' for the content filter setup",
+	"disable_ipv6":          "pass only -ipv4 to the 'cmdeploy dns' commands instead",
+	"acme_email":            "certificates are set up outside of chatmail.json",
+	"imap_rawlog":           "there's no equivalent debugging option",
+	"iroh_relay":            "chatmail doesn't run an iroh relay",
+	"mtail_address":         "chatmail doesn't run mtail",
+	"www_folder":            "'cmdeploy webdev' and 'cmdeploy install -www' choose the website sources",
+}
+
+// import_ini converts an upstream chatmail.ini into a configuration,
+// starting from the defaults. Options that couldn't be imported, or only
+// partly, are described in the returned warnings.
+func import_ini(r io.Reader) (config.ChatmailConfig, []string, error) {
+	ini, err := parse_ini(r)
+	if err != nil {
+		return config.ChatmailConfig{}, nil, err
+	}
+	params, found := ini.values[ini_section]
+	if !found {
+		return config.ChatmailConfig{}, nil, fmt.Errorf("there's no [%s] section", ini_section)
+	}
+	fqdn := strings.ToLower(params["mail_domain"])
+	if fqdn == "" {
+		return config.ChatmailConfig{}, nil, errors.New("mail_domain isn't set")
+	}
+
+	var warnings []string
+	for section := range ini.values {
+		if section != ini_section {
+			warnings = append(warnings, fmt.Sprintf("[%s]: only the [%s] section is imported", section, ini_section))
+		}
+	}
+	cm_config := config.NewChatmailConfig(fqdn)
+	var problems []error
+	for _, key := range ini.keys[ini_section] {
+		if key == "mail_domain" {
+			continue
+		}
+		value := params[key]
+		index := -1
+		for i, setting := range ini_settings {
+			if setting.key == key {
+				index = i
+			}
+		}
+		if index < 0 {
+			reason, known := ini_unsupported[key]
+			if !known {
+				reason = "chatmail doesn't know this option"
+			}
+			warnings = append(warnings, fmt.Sprintf("%s: not imported; %s", key, reason))
+			continue
+		}
+		err := ini_settings[index].set(&cm_config, value)
+		var warning ini_warning
+		if errors.As(err, &warning) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", key, warning.message))
+		} else if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	return cm_config, warnings, errors.Join(problems...)
+}
+
+// export_ini writes the configuration in the format of upstream's
+// chatmail.ini. Settings that upstream doesn't have are written as comments
+// so that the files can still be compared.
+func export_ini(w io.Writer, cm_config config.ChatmailConfig) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "[%s]\n\n", ini_section)
+	fmt.Fprintf(b, "# mail domain (MUST be set to fully qualified chat mail domain)\n")
+	fmt.Fprintf(b, "mail_domain = %s\n", cm_config.MailFullyQualifiedDomainName)
+	for _, setting := range ini_settings {
+		fmt.Fprintf(b, "\n# %s\n%s = %s\n", setting.comment, setting.key, setting.get(&cm_config))
+	}
+	fmt.Fprintf(b, "\n# These settings have no equivalent in chatmail.ini:\n")
+	fmt.Fprintf(b, "# InviteOnly = %v\n", cm_config.InviteOnly)
+	fmt.Fprintf(b, "# InviteTokensFile = %s\n", cm_config.InviteTokensFile)
+	fmt.Fprintf(b, "# MilterListenAddress = %s\n", cm_config.MilterListenAddress)
+	fmt.Fprintf(b, "# SASLListenAddress = %s\n", cm_config.SASLListenAddress)
+	fmt.Fprintf(b, "# TLSCertificateFile = %s\n", cm_config.TLSCertificateFile)
+	fmt.Fprintf(b, "# TLSKeyFile = %s\n", cm_config.TLSKeyFile)
+	fmt.Fprintf(b, "# DKIMKeyDirectory = %s\n", cm_config.DKIMKeyDirectory)
+	fmt.Fprintf(b, "# MetricsListenAddress = %s\n", cm_config.MetricsListenAddress)
+	fmt.Fprintf(b, "# LogLevel = %s\n", cm_config.LogLevel)
+	fmt.Fprintf(b, "# LogFormat = %s\n", cm_config.LogFormat)
+	fmt.Fprintf(b, "# LogSaltFile = %s\n", cm_config.LogSaltFile)
+	fmt.Fprintf(b, "# MilterMonitorOnly = %v\n", cm_config.MilterMonitorOnly)
+	fmt.Fprintf(b, "# MilterMonitorOnlyDomains = %s\n", strings.Join(cm_config.MilterMonitorOnlyDomains, ","))
+	fmt.Fprintf(b, "# AdminListenAddress = %s\n", cm_config.AdminListenAddress)
+	fmt.Fprintf(b, "# ReservedUsernames = %s\n", strings.Join(cm_config.ReservedUsernames, ","))
+	fmt.Fprintf(b, "# OperatorMailbox = %s\n", cm_config.OperatorMailbox)
+	fmt.Fprintf(b, "# AllowUnicodeUsernames = %v\n", cm_config.AllowUnicodeUsernames)
+	fmt.Fprintf(b, "# LoginFailuresPerIP = %d\n", cm_config.LoginFailuresPerIP)
+	fmt.Fprintf(b, "# LoginFailuresPerAccount = %d\n", cm_config.LoginFailuresPerAccount)
+	fmt.Fprintf(b, "# LoginLockoutSeconds = %d\n", cm_config.LoginLockoutSeconds)
+	fmt.Fprintf(b, "# LoginMaxLockoutSeconds = %d\n", cm_config.LoginMaxLockoutSeconds)
+	fmt.Fprintf(b, "# AccountDatabaseFile = %s\n", cm_config.AccountDatabaseFile)
+	return b.Flush()
+}
+
+func do_import_ini(w io.Writer, ini_path string, config_file string, force bool) error {
+	if _, err := os.Stat(config_file); !force && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s already exists; pass -force to replace it", config_file)
+	}
+	f, err := os.Open(ini_path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cm_config, warnings, err := import_ini(f)
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to import %s:\n%w", ini_path, err)
+	}
+	if err := cm_config.Validate(); err != nil {
+		return fmt.Errorf("the configuration imported from %s isn't valid:\n%w", ini_path, err)
+	}
+	if err := cm_config.Save(config_file); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Imported %s into %s.\n", ini_path, config_file)
+	return nil
+}
+
+func import_ini_main(args []string) {
+	importCmd := flag.NewFlagSet("import-ini", flag.ExitOnError)
+	output := importCmd.String("o", config_file_name, "configuration file to write")
+	force := importCmd.Bool("force", false, "replace the configuration file if it exists")
+	importCmd.Parse(args)
+	if importCmd.NArg() != 1 {
+		fmt.Println("usage: cmdeploy import-ini [-o chatmail.json] [-force] chatmail.ini")
+		os.Exit(1)
+	}
+	if err := do_import_ini(os.Stdout, importCmd.Arg(0), *output, *force); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func export_ini_main(args []string) {
+	exportCmd := flag.NewFlagSet("export-ini", flag.ExitOnError)
+	output := exportCmd.String("o", "", "file to write chatmail.ini to (default: standard output)")
+	exportCmd.Parse(args)
+	cm_config := load_local_config()
+	var buf strings.Builder
+	if err := export_ini(&buf, cm_config); err != nil {
+		panic(err)
+	}
+	if err := write_output(*output, []byte(buf.String())); err != nil {
+		panic(err)
+	}
+}
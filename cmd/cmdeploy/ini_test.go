@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportIni(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "chatmail.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, warnings, err := import_ini(f)
+	if err != nil {
+		t.Fatalf("import_ini() = %v; want no error", err)
+	}
+
+	want := config.NewChatmailConfig("chat.example")
+	want.MaxEmailsPerMinutePerUser = 60
+	want.MaxMailboxSizeMB = 1024
+	want.MaxMessageSizeB = 20 * 1024 * 1024
+	want.DeleteMailsAfterDays = 40
+	want.DeleteInactiveUsersAfterDays = 100
+	want.UsernameMaxLength = 12
+	want.PasswordMinLength = 12
+	want.PassthroughRecipientsList = []string{"xstore@testrun.org", "echo@chat.example"}
+	want.PrivacyContactPostalAddress = "Example Ltd., 1 Example Street, Exampletown"
+	want.PrivacyContactEmailAddress = "privacy@chat.example"
+	want.PrivacySupervisorPostalAddress = "Data Protection Authority, 2 Example Street, Exampletown"
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("import_ini() = %+v; want %+v", got, want)
+	}
+
+	want_warnings := []string{
+		"passthrough_recipients: whole-domain entries aren't supported, so these were left out: @nine.testrun.org",
+		"filtermail_smtp_port: not imported;",
+		"postfix_reinject_port: not imported;",
+		"disable_ipv6: not imported;",
+		"acme_email: not imported;",
+		"imap_rawlog: not imported;",
+	}
+	if len(warnings) != len(want_warnings) {
+		t.Fatalf("import_ini() warnings = %q; want %d", warnings, len(want_warnings))
+	}
+	for i, want := range want_warnings {
+		if !strings.HasPrefix(warnings[i], want) {
+			t.Errorf("import_ini() warning %d = %q; want %q", i, warnings[i], want)
+		}
+	}
+}
+
+func TestImportIniErrors(t *testing.T) {
+	tests := map[string]string{
+		"mail_domain = chat.example\n":                                  "outside of any section",
+		"[other]\nmail_domain = chat.example\n":                         "there's no [params] section",
+		"[params]\nmax_user_send_per_minute = 10\n":                     "mail_domain isn't set",
+		"[params]\nmail_domain = chat.example\nmax_mailbox_size = 1.5G": `max_mailbox_size: "1.5G" is not a size`,
+		"[params]\nmail_domain = chat.example\nmax_mailbox_size = 100K": "isn't a whole number of megabytes",
+		"[params]\nmail_domain = chat.example\ndelete_mails_after = x":  `delete_mails_after: "x" is not a whole number`,
+		"[params\nmail_domain = chat.example\n":                         "unterminated section header",
+		"[params]\nmail_domain\n":                                       "expected 'key = value'",
+	}
+	for ini, want := range tests {
+		_, _, err := import_ini(strings.NewReader(ini))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("import_ini(%q) = %v; want error containing %q", ini, err, want)
+		}
+	}
+}
+
+func TestIniRoundTrip(t *testing.T) {
+	// Only the settings that chatmail.ini has survive the trip, so the rest
+	// are left at their defaults.
+	cm_config := config.NewChatmailConfig("chat.example")
+	cm_config.MaxMailboxSizeMB = 250
+	cm_config.MaxMessageSizeB = 12345678
+	cm_config.PassthroughSendersList = []string{"bot@chat.example", "echo@chat.example"}
+	cm_config.PassthroughRecipientsList = []string{}
+	cm_config.MailboxesDirectory = "/srv/mail"
+	cm_config.PrivacyDataOfficerPostalAddress = "3 Example Street"
+
+	var buf bytes.Buffer
+	if err := export_ini(&buf, cm_config); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\nmax_mailbox_size = 250M\n") {
+		t.Errorf("export_ini() doesn't contain the mailbox size:\n%s", buf.String())
+	}
+	got, warnings, err := import_ini(&buf)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("import_ini(export_ini()) = %v, %q; want no errors or warnings", err, warnings)
+	}
+	if !reflect.DeepEqual(got, cm_config) {
+		t.Fatalf("import_ini(export_ini()) = %+v; want %+v", got, cm_config)
+	}
+}
+
+func TestDoImportIni(t *testing.T) {
+	config_file := filepath.Join(t.TempDir(), config_file_name)
+	ini_path := filepath.Join("testdata", "chatmail.ini")
+	var out bytes.Buffer
+	if err := do_import_ini(&out, ini_path, config_file, false); err != nil {
+		t.Fatalf("do_import_ini() = %v; want nil", err)
+	}
+	var saved config.ChatmailConfig
+	if err := config.LoadChatmailConfigFromFile(config_file, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.MailFullyQualifiedDomainName != "chat.example" {
+		t.Fatalf("imported config is for %q; want chat.example", saved.MailFullyQualifiedDomainName)
+	}
+	if err := do_import_ini(&out, ini_path, config_file, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("do_import_ini() over an existing file = %v; want error", err)
+	}
+	if err := do_import_ini(&out, ini_path, config_file, true); err != nil {
+		t.Fatalf("do_import_ini(force) = %v; want nil", err)
+	}
+}
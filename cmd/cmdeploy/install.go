@@ -0,0 +1,455 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Where 'cmdeploy install' puts things on the target system.
+const (
+	install_bin_dir    = "/usr/local/bin"
+	install_config_dir = "/etc/chatmail"
+	install_share_dir  = "/usr/local/share/chatmail"
+	install_unit_dir   = "/etc/systemd/system"
+	install_sysusers   = "/etc/sysusers.d/chatmail.conf"
+	install_tmpfiles   = "/etc/tmpfiles.d/chatmail.conf"
+	install_user       = "vmail"
+)
+
+// install_manifest lists every file that the last install wrote, so that
+// reinstalling can clean up files that are no longer needed and uninstalling
+// knows what to remove.
+const install_manifest = install_share_dir + "/install-manifest"
+
+var installed_binaries = []string{"chatmaild", "chatmailctl", "chatmail-website"}
+
+type chatmaild_socket struct {
+	name string
+	uri  string
+}
+
+// chatmaild_sockets lists the listeners that chatmaild gets from systemd.
+func chatmaild_sockets(cm_config config.ChatmailConfig) []chatmaild_socket {
+	sockets := []chatmaild_socket{
+		{"milter", cm_config.MilterListenAddress},
+		{"sasl", cm_config.SASLListenAddress},
+	}
+	if cm_config.AdminListenAddress != "" {
+		sockets = append(sockets, chatmaild_socket{"admin", cm_config.AdminListenAddress})
+	}
+	return sockets
+}
+
+func socket_activated_units(cm_config config.ChatmailConfig) []string {
+	var units []string
+	for _, s := range chatmaild_sockets(cm_config) {
+		units = append(units, "chatmaild-"+s.name+".socket")
+	}
+	return units
+}
+
+type unit_vars struct {
+	Config     config.ChatmailConfig
+	BinDir     string
+	ConfigFile string
+	WebRoot    string
+	User       string
+	// Only set for socket units.
+	Name         string
+	ListenStream string
+	SocketMode   string
+	SocketGroup  string
+}
+
+func new_unit_vars(cm_config config.ChatmailConfig) unit_vars {
+	return unit_vars{
+		Config:     cm_config,
+		BinDir:     install_bin_dir,
+		ConfigFile: install_config_dir + "/" + config_file_name,
+		WebRoot:    install_share_dir + "/www",
+		User:       install_user,
+	}
+}
+
+// socket_permissions returns the SocketMode= and SocketGroup= values for the
+// mode and group options of a unix:// listen address. The sockets can create
+// accounts and send mail, so ones without a mode are only open to
+// install_user's group (or the group option), not to everyone.
+func socket_permissions(uri string) (string, string, error) {
+	_, rest, _ := strings.Cut(uri, "://")
+	_, raw_query, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(raw_query)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid options in %s: %w", uri, err)
+	}
+	mode, group := query.Get("mode"), query.Get("group")
+	if mode == "" {
+		mode = "0660"
+		if group == "" {
+			group = install_user
+		}
+	}
+	return mode, group, nil
+}
+
+// listen_stream converts a chatmaild listen address into a systemd
+// ListenStream= value.
+func listen_stream(uri string) (string, error) {
+	network, addr := split_listen_uri(uri)
+	switch network {
+	case "unix", "tcp", "tls":
+		return addr, nil
+	case "systemd":
+		return "", fmt.Errorf("%s names a socket unit, but cmdeploy writes its own; use the address the socket should listen on instead", uri)
+	default:
+		return "", fmt.Errorf("systemd can't listen on %q for chatmaild", uri)
+	}
+}
+
+type install_options struct {
+	root         string
+	bin_dir      string
+	www_dir      string
+	dkim_dir     string
+	template_dir string
+}
+
+// installer writes files under root, only touching the ones whose contents
+// or permissions have changed, and keeps track of what it has written.
+type installer struct {
+	root      string
+	installed []string
+	changed   []string
+}
+
+func (i *installer) path(path string) string {
+	return filepath.Join(i.root, filepath.FromSlash(path))
+}
+
+func (i *installer) install_file(path string, data []byte, mode fs.FileMode) error {
+	i.installed = append(i.installed, path)
+	target := i.path(path)
+	if existing, err := os.ReadFile(target); err == nil && bytes.Equal(existing, data) {
+		info, err := os.Stat(target)
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm() == mode {
+			return nil
+		}
+		i.changed = append(i.changed, path)
+		return os.Chmod(target, mode)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp := target + ".cmdeploy-new"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	// WriteFile doesn't change the mode of existing files, or apply it
+	// through the umask exactly.
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	i.changed = append(i.changed, path)
+	return os.Rename(tmp, target)
+}
+
+func (i *installer) install_template(path string, name string, override_dir string, vars any) error {
+	var buf bytes.Buffer
+	if err := render_template(&buf, name, override_dir, vars); err != nil {
+		return err
+	}
+	return i.install_file(path, buf.Bytes(), 0644)
+}
+
+// install_tree installs every file under src into dst.
+func (i *installer) install_tree(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return i.install_file(dst+"/"+filepath.ToSlash(rel), data, 0644)
+	})
+}
+
+func read_install_manifest(root string) ([]string, error) {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(install_manifest)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// remove_files removes paths under root, and then any directories that
+// removing them left empty.
+func remove_files(root string, paths []string) error {
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		target := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for dir := filepath.Dir(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	// Deepest first, so that parents are empty by the time we get to them.
+	sort.Slice(sorted, func(a, b int) bool {
+		return len(sorted[a]) > len(sorted[b])
+	})
+	for _, dir := range sorted {
+		target := filepath.Join(root, filepath.FromSlash(dir))
+		entries, err := os.ReadDir(target)
+		if err == nil && len(entries) == 0 {
+			os.Remove(target)
+		}
+	}
+	return nil
+}
+
+// do_install lays out chatmail under opts.root. It can be run again to
+// update an installation; it returns the files that it changed.
+func do_install(cm_config config.ChatmailConfig, opts install_options) ([]string, error) {
+	inst := &installer{root: opts.root}
+	previous, err := read_install_manifest(opts.root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range installed_binaries {
+		data, err := os.ReadFile(filepath.Join(opts.bin_dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s program (build it with 'make build'): %w", name, err)
+		}
+		if err := inst.install_file(install_bin_dir+"/"+name, data, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	vars := new_unit_vars(cm_config)
+	// The same format as Save, so that the installed copy can be compared
+	// against chatmail.json.
+	config_data, err := json.MarshalIndent(cm_config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := inst.install_file(vars.ConfigFile, config_data, 0644); err != nil {
+		return nil, err
+	}
+	keys, err := dkim.Load(opts.dkim_dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no DKIM keys in %s; run 'cmdeploy init' first", opts.dkim_dir)
+	}
+	for _, key := range keys {
+		data, err := os.ReadFile(dkim.KeyPath(opts.dkim_dir, key.Selector))
+		if err != nil {
+			return nil, err
+		}
+		if err := inst.install_file(dkim.KeyPath(cm_config.DKIMKeyDirectory, key.Selector), data, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := inst.install_template(install_unit_dir+"/chatmaild.service", "chatmaild.service", opts.template_dir, vars); err != nil {
+		return nil, err
+	}
+	for _, s := range chatmaild_sockets(cm_config) {
+		socket_vars := vars
+		socket_vars.Name = s.name
+		socket_vars.ListenStream, err = listen_stream(s.uri)
+		if err != nil {
+			return nil, err
+		}
+		socket_vars.SocketMode, socket_vars.SocketGroup, err = socket_permissions(s.uri)
+		if err != nil {
+			return nil, err
+		}
+		if err := inst.install_template(install_unit_dir+"/chatmaild-"+s.name+".socket", "chatmaild.socket", opts.template_dir, socket_vars); err != nil {
+			return nil, err
+		}
+	}
+	if err := inst.install_template(install_unit_dir+"/chatmail-website.service", "chatmail-website.service", opts.template_dir, vars); err != nil {
+		return nil, err
+	}
+
+	site, err := os.MkdirTemp("", "chatmail-www")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(site)
+	build_website(cm_config, opts.www_dir, site)
+	if err := inst.install_tree(site, vars.WebRoot); err != nil {
+		return nil, err
+	}
+
+	// The units run as install_user, which has to exist and own the
+	// mailboxes; chatmaild's sandbox only allows writing there, so they have
+	// to exist too. systemd sets both up at boot, and setup_system_users does
+	// it right away.
+	if err := inst.install_template(install_sysusers, "chatmail.sysusers", opts.template_dir, vars); err != nil {
+		return nil, err
+	}
+	if err := inst.install_template(install_tmpfiles, "chatmail.tmpfiles", opts.template_dir, vars); err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool)
+	for _, path := range inst.installed {
+		current[path] = true
+	}
+	var stale []string
+	for _, path := range previous {
+		if !current[path] {
+			stale = append(stale, path)
+		}
+	}
+	if err := remove_files(opts.root, stale); err != nil {
+		return nil, err
+	}
+	manifest := strings.Join(inst.installed, "\n") + "\n"
+	if err := os.WriteFile(inst.path(install_manifest), []byte(manifest), 0644); err != nil {
+		return nil, err
+	}
+	return append(inst.changed, stale...), nil
+}
+
+// do_uninstall removes what do_install installed. The configuration and
+// DKIM keys are kept unless purge is set; mailboxes are always kept.
+func do_uninstall(root string, purge bool) error {
+	installed, err := read_install_manifest(root)
+	if err != nil {
+		return err
+	}
+	if installed == nil {
+		return fmt.Errorf("chatmail isn't installed in %s", root)
+	}
+	var remove []string
+	for _, path := range installed {
+		if !purge && strings.HasPrefix(path, install_config_dir+"/") {
+			continue
+		}
+		remove = append(remove, path)
+	}
+	return remove_files(root, append(remove, install_manifest))
+}
+
+// setup_system_users creates the user and the directories that do_install
+// described, on the running system.
+func setup_system_users() error {
+	for _, args := range [][]string{
+		{"systemd-sysusers", install_sysusers},
+		{"systemd-tmpfiles", "--create", install_tmpfiles},
+	} {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+func default_bin_dir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	return filepath.Dir(exe)
+}
+
+func install_main(args []string) {
+	installCmd := flag.NewFlagSet("install", flag.ExitOnError)
+	var opts install_options
+	installCmd.StringVar(&opts.root, "root", "/", "directory to install into, as if it were the root of the target system")
+	installCmd.StringVar(&opts.bin_dir, "bin", default_bin_dir(), "directory with the chatmaild, chatmailctl, and chatmail-website programs")
+	installCmd.StringVar(&opts.www_dir, "www", filepath.Join(".", "www", "src"), "website sources")
+	installCmd.StringVar(&opts.template_dir, "templates", default_template_dir, "directory with template overrides")
+	installCmd.Parse(args)
+	opts.dkim_dir = dkim.DefaultDirectory
+
+	cm_config := load_local_config()
+	changed, err := do_install(cm_config, opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if opts.root == "/" {
+		if err := setup_system_users(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if len(changed) == 0 {
+		fmt.Println("Nothing to do; the installation is up to date.")
+		return
+	}
+	for _, path := range changed {
+		fmt.Printf("updated %s\n", path)
+	}
+	fmt.Println("To (re)start chatmail, run:")
+	fmt.Println("  systemctl daemon-reload")
+	fmt.Printf("  systemctl enable --now %s chatmail-website.service\n", strings.Join(socket_activated_units(cm_config), " "))
+	fmt.Println("  systemctl restart chatmaild.service chatmail-website.service")
+	fmt.Printf("Unless their addresses say otherwise, chatmaild's sockets are only open to the %s group; add the mail server's user to it, e.g.:\n", install_user)
+	fmt.Printf("  usermod -aG %s postfix\n", install_user)
+}
+
+func uninstall_main(args []string) {
+	uninstallCmd := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	root := uninstallCmd.String("root", "/", "directory that chatmail was installed into")
+	purge := uninstallCmd.Bool("purge", false, "also remove the configuration and DKIM keys")
+	uninstallCmd.Parse(args)
+	if *root == "/" {
+		// Every socket that install might have set up.
+		all_sockets := socket_activated_units(config.NewChatmailConfig(""))
+		fmt.Printf("Stop chatmail first, with: systemctl disable --now chatmaild.service %s chatmail-website.service\n", strings.Join(all_sockets, " "))
+	}
+	if err := do_uninstall(*root, *purge); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("chatmail has been uninstalled. Mailboxes were left in place.")
+}
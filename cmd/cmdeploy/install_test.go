@@ -0,0 +1,238 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func copy_dir(t *testing.T, src string, dst string) {
+	t.Helper()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := copy_file(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func make_install_options(t *testing.T) install_options {
+	t.Helper()
+	dir := t.TempDir()
+	opts := install_options{
+		root:     filepath.Join(dir, "root"),
+		bin_dir:  filepath.Join(dir, "bin"),
+		www_dir:  filepath.Join(dir, "www"),
+		dkim_dir: filepath.Join(dir, "dkim"),
+	}
+	if err := os.MkdirAll(opts.bin_dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range installed_binaries {
+		if err := os.WriteFile(filepath.Join(opts.bin_dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copy_dir(t, filepath.Join("..", "..", "www", "src"), opts.www_dir)
+	if _, err := dkim.Generate(opts.dkim_dir); err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func check_mode(t *testing.T, root string, path string, want os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(root, path))
+	if err != nil {
+		t.Fatalf("%s wasn't installed: %v", path, err)
+	}
+	if info.Mode().Perm() != want {
+		t.Fatalf("%s has mode %v; want %v", path, info.Mode().Perm(), want)
+	}
+}
+
+func check_missing(t *testing.T, root string, path string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(root, path)); !os.IsNotExist(err) {
+		t.Fatalf("%s still exists (err = %v)", path, err)
+	}
+}
+
+func TestInstallTree(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := make_install_options(t)
+	changed, err := do_install(cfg, opts)
+	if err != nil {
+		t.Fatalf("do_install() = %v; want nil", err)
+	}
+	if len(changed) == 0 {
+		t.Fatal("do_install() into an empty root changed nothing")
+	}
+
+	check_mode(t, opts.root, "usr/local/bin/chatmaild", 0755)
+	check_mode(t, opts.root, "usr/local/bin/chatmailctl", 0755)
+	check_mode(t, opts.root, "usr/local/bin/chatmail-website", 0755)
+	check_mode(t, opts.root, "etc/chatmail/chatmail.json", 0644)
+	check_mode(t, opts.root, "etc/chatmail/dkim/rsa.key", 0600)
+	check_mode(t, opts.root, "etc/chatmail/dkim/ed25519.key", 0600)
+	check_mode(t, opts.root, "usr/local/share/chatmail/www/index.html", 0644)
+	check_mode(t, opts.root, "etc/sysusers.d/chatmail.conf", 0644)
+	check_mode(t, opts.root, "etc/tmpfiles.d/chatmail.conf", 0644)
+	for _, unit := range []string{"chatmaild.service", "chatmaild-milter.socket", "chatmaild-sasl.socket", "chatmaild-admin.socket", "chatmail-website.service"} {
+		data, err := os.ReadFile(filepath.Join(opts.root, "etc/systemd/system", unit))
+		if err != nil {
+			t.Fatalf("%s wasn't installed: %v", unit, err)
+		}
+		check_golden(t, filepath.Join("units", unit), data)
+	}
+
+	// The units run as vmail, so it has to own the mailboxes.
+	tmpfiles, err := os.ReadFile(filepath.Join(opts.root, "etc/tmpfiles.d/chatmail.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d /home/vmail/mail/chat.example 0700 vmail vmail -\n"; !strings.Contains(string(tmpfiles), want) {
+		t.Fatalf("tmpfiles.d/chatmail.conf = %q; want it to contain %q", tmpfiles, want)
+	}
+	sysusers, err := os.ReadFile(filepath.Join(opts.root, "etc/sysusers.d/chatmail.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "u vmail - "; !strings.Contains(string(sysusers), want) {
+		t.Fatalf("sysusers.d/chatmail.conf = %q; want it to contain %q", sysusers, want)
+	}
+
+	var installed config.ChatmailConfig
+	if err := config.LoadChatmailConfigFromFile(filepath.Join(opts.root, "etc/chatmail/chatmail.json"), &installed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(installed, cfg) {
+		t.Fatalf("installed config = %+v; want %+v", installed, cfg)
+	}
+}
+
+func TestInstallIsIdempotent(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := make_install_options(t)
+	if _, err := do_install(cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := do_install(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("reinstalling changed %v; want nothing", changed)
+	}
+
+	if err := os.WriteFile(filepath.Join(opts.bin_dir, "chatmaild"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(opts.www_dir, "info.md")); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = do_install(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/usr/local/bin/chatmaild", "/usr/local/share/chatmail/www/info.html"}
+	if !slices.Equal(changed, want) {
+		t.Fatalf("reinstalling after changes changed %v; want %v", changed, want)
+	}
+	check_missing(t, opts.root, "usr/local/share/chatmail/www/info.html")
+}
+
+func TestInstallSocketAddresses(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.MilterListenAddress = "tcp://127.0.0.1:10026"
+	opts := make_install_options(t)
+	if _, err := do_install(cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(opts.root, "etc/systemd/system/chatmaild-milter.socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "ListenStream=127.0.0.1:10026\n") {
+		t.Fatalf("milter socket unit doesn't listen on the configured address:\n%s", data)
+	}
+	// The SASL socket can create accounts, so it isn't open to everyone.
+	data, err = os.ReadFile(filepath.Join(opts.root, "etc/systemd/system/chatmaild-sasl.socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "SocketMode=0660\nSocketGroup=vmail\n") {
+		t.Fatalf("sasl socket unit without a mode in its address isn't limited to the vmail group:\n%s", data)
+	}
+
+	cfg.AdminListenAddress = "unix:///run/chatmail/admin.sock?mode=0660&group=chatmail-admin"
+	if _, err := do_install(cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(filepath.Join(opts.root, "etc/systemd/system/chatmaild-admin.socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "SocketMode=0660\nSocketGroup=chatmail-admin\n") {
+		t.Fatalf("admin socket unit doesn't have the configured permissions:\n%s", data)
+	}
+
+	// Without an admin socket, chatmaild doesn't need one from systemd.
+	cfg.AdminListenAddress = ""
+	if _, err := do_install(cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+	check_missing(t, opts.root, "etc/systemd/system/chatmaild-admin.socket")
+	data, err = os.ReadFile(filepath.Join(opts.root, "etc/systemd/system/chatmaild.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "chatmaild-admin.socket") {
+		t.Fatalf("chatmaild.service needs the admin socket that wasn't installed:\n%s", data)
+	}
+
+	cfg.SASLListenAddress = "udp://127.0.0.1:1"
+	if _, err := do_install(cfg, opts); err == nil {
+		t.Fatal("do_install() with a udp listen address succeeded")
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	opts := make_install_options(t)
+	if err := do_uninstall(opts.root, false); err == nil {
+		t.Fatal("do_uninstall() without an installation succeeded")
+	}
+	if _, err := do_install(cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := do_uninstall(opts.root, false); err != nil {
+		t.Fatalf("do_uninstall() = %v; want nil", err)
+	}
+	check_missing(t, opts.root, "usr/local/bin/chatmaild")
+	check_missing(t, opts.root, "etc/systemd/system/chatmaild.service")
+	check_missing(t, opts.root, "usr/local/share/chatmail")
+	check_mode(t, opts.root, "etc/chatmail/chatmail.json", 0644)
+	check_missing(t, opts.root, "etc/tmpfiles.d/chatmail.conf")
+
+	if _, err := do_install(cfg, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := do_uninstall(opts.root, true); err != nil {
+		t.Fatalf("do_uninstall() with purge = %v; want nil", err)
+	}
+	check_missing(t, opts.root, "etc/chatmail")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/invite"
+
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+func invite_qr_file_name(token string) string {
+	return "qr-invite-" + token + ".svg"
+}
+
+func do_invite_create(cm_config config.ChatmailConfig, store *invite.Store, ttl time.Duration, max_uses int, note string, output_dir string) {
+	tok, err := store.Create(ttl, max_uses, note)
+	if err != nil {
+		panic(err)
+	}
+	url := new_account_url(cm_config.MailFullyQualifiedDomainName, tok.Token)
+	qr_file := filepath.Join(output_dir, invite_qr_file_name(tok.Token))
+	err = os.WriteFile(qr_file, []byte(generate_qr_code(url)), 0644)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Created invite token %s\n", tok.Token)
+	fmt.Printf("Invite link: %s\n", url)
+	fmt.Printf("QR code written to %s\n", qr_file)
+	if !cm_config.InviteOnly {
+		fmt.Println("Note: InviteOnly is not enabled in chatmail.json, so anyone can still create an account without a token.")
+	}
+}
+
+func format_expiry(t invite.Token) string {
+	if t.Expires.IsZero() {
+		return "never"
+	}
+	return t.Expires.Local().Format(time.DateTime)
+}
+
+func do_invite_list(store *invite.Store) {
+	tokens, err := store.List()
+	if err != nil {
+		panic(err)
+	}
+	if len(tokens) == 0 {
+		fmt.Println("There are no invite tokens.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tUSES\tEXPIRES\tNOTE")
+	for _, t := range tokens {
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%s\n", t.Token, t.Uses, t.MaxUses, format_expiry(t), t.Note)
+	}
+	tw.Flush()
+}
+
+func do_invite_revoke(store *invite.Store, token string) {
+	if err := store.Revoke(token); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Revoked invite token %s\n", token)
+}
+
+func invite_main(args []string) {
+	createCmd := flag.NewFlagSet("invite create", flag.ExitOnError)
+	maxUses := createCmd.Int("uses", 1, "number of accounts that can be created with this invite")
+	ttl := createCmd.Duration("expires", 7*24*time.Hour, "how long until the invite expires (0 for never)")
+	note := createCmd.String("note", "", "reminder of who the invite is for")
+	outputDir := createCmd.String("out", ".", "directory to write the invite QR code to")
+
+	listCmd := flag.NewFlagSet("invite list", flag.ExitOnError)
+
+	revokeCmd := flag.NewFlagSet("invite revoke", flag.ExitOnError)
+
+	if len(args) < 1 {
+		fmt.Println("expected 'create', 'list', or 'revoke' subcommands")
+		os.Exit(1)
+	}
+
+	cm_config := load_local_config()
+	store := invite.NewStore(cm_config.InviteTokensFile)
+	switch args[0] {
+	case "create":
+		createCmd.Parse(args[1:])
+		if *maxUses < 1 {
+			fmt.Println("an invite has to allow at least one use")
+			os.Exit(1)
+		}
+		do_invite_create(cm_config, store, *ttl, *maxUses, *note, *outputDir)
+	case "list":
+		listCmd.Parse(args[1:])
+		do_invite_list(store)
+	case "revoke":
+		revokeCmd.Parse(args[1:])
+		tail := revokeCmd.Args()
+		if len(tail) < 1 {
+			fmt.Println("you have to provide the invite token to revoke")
+			os.Exit(1)
+		}
+		do_invite_revoke(store, tail[0])
+	default:
+		fmt.Println("expected 'create', 'list', or 'revoke' subcommands")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"bytes"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates
+var builtin_templates embed.FS
+
+// default_template_dir is where operators can put their own versions of the
+// templates in cmd/cmdeploy/templates, next to chatmail.json.
+const default_template_dir = "templates"
+
+// data_size formats a byte count the way maddy and postfix-style configs
+// expect sizes, using a unit suffix when it divides evenly.
+func data_size(bytes int) string {
+	switch {
+	case bytes > 0 && bytes%(1024*1024*1024) == 0:
+		return fmt.Sprintf("%dG", bytes/(1024*1024*1024))
+	case bytes > 0 && bytes%(1024*1024) == 0:
+		return fmt.Sprintf("%dM", bytes/(1024*1024))
+	case bytes > 0 && bytes%1024 == 0:
+		return fmt.Sprintf("%dK", bytes/1024)
+	default:
+		return fmt.Sprint(bytes)
+	}
+}
+
+// split_listen_uri splits a chatmaild listen address like
+// "unix:///run/chatmail/sasl.sock?mode=0660" into its network and address,
+// dropping any options.
+func split_listen_uri(uri string) (string, string) {
+	network, addr, found := strings.Cut(uri, "://")
+	if !found {
+		return "unix", uri
+	}
+	addr, _, _ = strings.Cut(addr, "?")
+	return network, addr
+}
+
+// mta_socket returns the network and address that a mail server has to
+// connect to for a chatmaild listen address. Mail servers can't connect to
+// systemd:// addresses, since only the socket unit knows where they are, and
+// they don't speak TLS to milters or SASL servers.
+func mta_socket(uri string) (string, string, error) {
+	network, addr := split_listen_uri(uri)
+	switch network {
+	case "unix", "tcp":
+		return network, addr, nil
+	default:
+		return "", "", fmt.Errorf("mail servers can't connect to chatmaild at %s; use a unix:// or tcp:// address", uri)
+	}
+}
+
+// maddy_endpoint formats a listen address for maddy.
+func maddy_endpoint(uri string) (string, error) {
+	network, addr, err := mta_socket(uri)
+	if err != nil {
+		return "", err
+	}
+	return network + "://" + addr, nil
+}
+
+// postfix_endpoint formats a listen address the way postfix's milter
+// settings want it.
+func postfix_endpoint(uri string) (string, error) {
+	network, addr, err := mta_socket(uri)
+	if err != nil {
+		return "", err
+	}
+	if network == "unix" {
+		return "unix:" + addr, nil
+	}
+	return "inet:" + addr, nil
+}
+
+// postfix_sasl_path formats a listen address for smtpd_sasl_path, which
+// takes unix sockets as plain paths.
+func postfix_sasl_path(uri string) (string, error) {
+	network, addr, err := mta_socket(uri)
+	if err != nil {
+		return "", err
+	}
+	if network == "unix" {
+		return addr, nil
+	}
+	return "inet:" + addr, nil
+}
+
+var template_funcs = template.FuncMap{
+	"data_size":         data_size,
+	"maddy_endpoint":    maddy_endpoint,
+	"postfix_endpoint":  postfix_endpoint,
+	"postfix_sasl_path": postfix_sasl_path,
+	"role_accounts":     func() []string { return config.RoleAccounts },
+}
+
+// load_template parses the built-in template called name, then the
+// operator's template of the same name in override_dir, if there is one.
+// Sections that the operator's file redefines replace the built-in ones.
+func load_template(name string, override_dir string) (*template.Template, error) {
+	builtin, err := builtin_templates.ReadFile("templates/" + name + ".tmpl")
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Funcs(template_funcs).Parse(string(builtin))
+	if err != nil {
+		return nil, err
+	}
+	if override_dir == "" {
+		return tmpl, nil
+	}
+	override_file := filepath.Join(override_dir, name+".tmpl")
+	override, err := os.ReadFile(override_file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tmpl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmpl.Parse(string(override)); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", override_file, err)
+	}
+	return tmpl, nil
+}
+
+func render_template(w io.Writer, name string, override_dir string, vars any) error {
+	tmpl, err := load_template(name, override_dir)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, vars)
+}
+
+type dkim_key_file struct {
+	Selector string
+	Path     string
+}
+
+// dkim_key_files lists the DKIM keys as they'll be found on the server.
+func dkim_key_files(cm_config config.ChatmailConfig) []dkim_key_file {
+	var keys []dkim_key_file
+	for _, selector := range []string{dkim.SelectorRSA, dkim.SelectorEd25519} {
+		keys = append(keys, dkim_key_file{selector, dkim.KeyPath(cm_config.DKIMKeyDirectory, selector)})
+	}
+	return keys
+}
+
+type maddy_vars struct {
+	Config     config.ChatmailConfig
+	StateDir   string
+	RuntimeDir string
+	DKIMKeys   []dkim_key_file
+}
+
+func new_maddy_vars(cm_config config.ChatmailConfig) maddy_vars {
+	return maddy_vars{
+		Config:     cm_config,
+		StateDir:   "/var/lib/maddy",
+		RuntimeDir: "/run/maddy",
+		DKIMKeys:   dkim_key_files(cm_config),
+	}
+}
+
+// render_maddy renders maddy.conf. maddy only delivers the role addresses to
+// local mailboxes, so unlike postfix it can't send them to an
+// OperatorMailbox on another domain.
+func render_maddy(w io.Writer, vars maddy_vars, override_dir string) error {
+	fqdn := vars.Config.MailFullyQualifiedDomainName
+	if _, domain, _ := strings.Cut(vars.Config.OperatorMailbox, "@"); domain != "" && !strings.EqualFold(domain, fqdn) {
+		return fmt.Errorf("OperatorMailbox %s has to be an account on %s for maddy to deliver the role addresses to it", vars.Config.OperatorMailbox, fqdn)
+	}
+	return render_template(w, "maddy.conf", override_dir, vars)
+}
+
+type postfix_dovecot_vars struct {
+	Config          config.ChatmailConfig
+	ChatmaildBinary string
+	ConfigFile      string
+	// ContentFilter routes submissions through an SMTP content filter on
+	// port 10080 (re-injecting on port 10025) instead of the milter.
+	ContentFilter bool
+}
+
+func new_postfix_dovecot_vars(cm_config config.ChatmailConfig) postfix_dovecot_vars {
+	return postfix_dovecot_vars{
+		Config:          cm_config,
+		ChatmaildBinary: install_bin_dir + "/chatmaild",
+		ConfigFile:      install_config_dir + "/" + config_file_name,
+	}
+}
+
+var postfix_dovecot_files = []string{"main.cf", "master.cf", "login_map", "dovecot.conf"}
+
+// render_postfix_dovecot renders each of postfix_dovecot_files.
+func render_postfix_dovecot(vars postfix_dovecot_vars, override_dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, name := range postfix_dovecot_files {
+		var buf bytes.Buffer
+		if err := render_template(&buf, name, override_dir, vars); err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", name, err)
+		}
+		files[name] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// write_output writes data to stdout for "" or "-", and otherwise to a file.
+func write_output(path string, data []byte) error {
+	if path == "" || path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func render_main(args []string) {
+	maddyCmd := flag.NewFlagSet("render maddy", flag.ExitOnError)
+	maddyOut := maddyCmd.String("o", "", "file to write the configuration to (default: standard output)")
+	maddyTemplates := maddyCmd.String("templates", default_template_dir, "directory with template overrides")
+
+	pdCmd := flag.NewFlagSet("render postfix-dovecot", flag.ExitOnError)
+	pdOut := pdCmd.String("o", "postfix-dovecot", "directory to write the postfix and dovecot configuration files to")
+	pdTemplates := pdCmd.String("templates", default_template_dir, "directory with template overrides")
+	pdContentFilter := pdCmd.Bool("content-filter", false, "check submissions with an SMTP content filter on port 10080 instead of the chatmaild milter")
+
+	if len(args) < 1 {
+		fmt.Println("expected 'maddy' or 'postfix-dovecot' subcommands")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "maddy":
+		maddyCmd.Parse(args[1:])
+		cm_config := load_local_config()
+		var buf bytes.Buffer
+		if err := render_maddy(&buf, new_maddy_vars(cm_config), *maddyTemplates); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := write_output(*maddyOut, buf.Bytes()); err != nil {
+			panic(err)
+		}
+	case "postfix-dovecot":
+		pdCmd.Parse(args[1:])
+		vars := new_postfix_dovecot_vars(load_local_config())
+		vars.ContentFilter = *pdContentFilter
+		files, err := render_postfix_dovecot(vars, *pdTemplates)
+		if err != nil {
+			panic(err)
+		}
+		if err := os.MkdirAll(*pdOut, 0755); err != nil {
+			panic(err)
+		}
+		for _, name := range postfix_dovecot_files {
+			if err := os.WriteFile(filepath.Join(*pdOut, name), files[name], 0644); err != nil {
+				panic(err)
+			}
+		}
+		fmt.Printf("Wrote %s to %s.\n", strings.Join(postfix_dovecot_files, ", "), *pdOut)
+	default:
+		fmt.Println("expected 'maddy' or 'postfix-dovecot' subcommands")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update_golden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func check_golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update_golden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("output for %s does not match golden file:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestDataSize(t *testing.T) {
+	cases := map[int]string{
+		0:               "0",
+		1000:            "1000",
+		2048:            "2K",
+		31457280:        "30M",
+		2 << 30:         "2G",
+		31457280 + 1:    "31457281",
+		31457280 + 1024: "30721K",
+	}
+	for in, want := range cases {
+		if got := data_size(in); got != want {
+			t.Fatalf("data_size(%d) = %q; want %q", in, got, want)
+		}
+	}
+}
+
+func TestRenderMaddyGolden(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	var buf bytes.Buffer
+	if err := render_maddy(&buf, new_maddy_vars(cfg), ""); err != nil {
+		t.Fatal(err)
+	}
+	check_golden(t, "maddy.conf", buf.Bytes())
+}
+
+func TestRenderMaddyUsesConfig(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.MaxMessageSizeB = 10 * 1024 * 1024
+	cfg.MilterListenAddress = "unix:///srv/milter.sock"
+	cfg.SASLListenAddress = "unix:///srv/sasl.sock"
+	cfg.TLSCertificateFile = "/srv/cert.pem"
+	cfg.TLSKeyFile = "/srv/key.pem"
+	cfg.DKIMKeyDirectory = "/srv/dkim"
+	var buf bytes.Buffer
+	if err := render_maddy(&buf, new_maddy_vars(cfg), ""); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"max_message_size 10M",
+		"milter unix:///srv/milter.sock",
+		"auth.dovecot_sasl chatmaild_auth unix:///srv/sasl.sock",
+		"tls file /srv/cert.pem /srv/key.pem",
+		"key_path /srv/dkim/rsa.key",
+		"key_path /srv/dkim/ed25519.key",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("render_maddy() output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRenderMaddyOverride(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	dir := t.TempDir()
+	override := "{{define \"imap\"}}\nimap tls://0.0.0.0:993 {\n    auth &chatmaild_auth\n    storage &local_mailboxes\n}\n{{end}}\n"
+	if err := os.WriteFile(filepath.Join(dir, "maddy.conf.tmpl"), []byte(override), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := render_maddy(&buf, new_maddy_vars(cfg), dir); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "tcp://0.0.0.0:143") {
+		t.Fatalf("render_maddy() ignored the overridden imap section:\n%s", out)
+	}
+	if !strings.Contains(out, "imap tls://0.0.0.0:993 {") || !strings.Contains(out, "submission tls://0.0.0.0:465") {
+		t.Fatalf("render_maddy() with an override = \n%s\nwant the new imap section and the other sections unchanged", out)
+	}
+
+	// A template without any sections replaces the built-in one.
+	if err := os.WriteFile(filepath.Join(dir, "maddy.conf.tmpl"), []byte("hostname {{.Config.MailFullyQualifiedDomainName}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := render_maddy(&buf, new_maddy_vars(cfg), dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "hostname chat.example\n" {
+		t.Fatalf("render_maddy() with a replacement template = %q; want %q", got, "hostname chat.example\n")
+	}
+}
+
+func TestRenderMaddyMissingOverrideDir(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	var want, got bytes.Buffer
+	if err := render_maddy(&want, new_maddy_vars(cfg), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := render_maddy(&got, new_maddy_vars(cfg), filepath.Join(t.TempDir(), "nonexistent")); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("render_maddy() with a missing template directory differs from the built-in output")
+	}
+}
+
+func TestListenURIFormats(t *testing.T) {
+	cases := []struct {
+		uri      string
+		maddy    string
+		endpoint string
+		sasl     string
+	}{
+		{"unix:///run/chatmail/milter.sock", "unix:///run/chatmail/milter.sock", "unix:/run/chatmail/milter.sock", "/run/chatmail/milter.sock"},
+		{"unix:///run/chatmail/milter.sock?mode=0660&group=mail", "unix:///run/chatmail/milter.sock", "unix:/run/chatmail/milter.sock", "/run/chatmail/milter.sock"},
+		{"tcp://127.0.0.1:10026", "tcp://127.0.0.1:10026", "inet:127.0.0.1:10026", "inet:127.0.0.1:10026"},
+	}
+	for _, c := range cases {
+		if got, err := maddy_endpoint(c.uri); err != nil || got != c.maddy {
+			t.Fatalf("maddy_endpoint(%q) = %q, %v; want %q, nil", c.uri, got, err, c.maddy)
+		}
+		if got, err := postfix_endpoint(c.uri); err != nil || got != c.endpoint {
+			t.Fatalf("postfix_endpoint(%q) = %q, %v; want %q, nil", c.uri, got, err, c.endpoint)
+		}
+		if got, err := postfix_sasl_path(c.uri); err != nil || got != c.sasl {
+			t.Fatalf("postfix_sasl_path(%q) = %q, %v; want %q, nil", c.uri, got, err, c.sasl)
+		}
+	}
+	for _, uri := range []string{"systemd://milter", "tls://0.0.0.0:10026?cert=a&key=b"} {
+		if _, err := postfix_endpoint(uri); err == nil {
+			t.Fatalf("postfix_endpoint(%q) succeeded; want an error", uri)
+		}
+	}
+}
+
+func TestRenderMaddySystemdSocket(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.MilterListenAddress = "systemd://milter"
+	var buf bytes.Buffer
+	if err := render_maddy(&buf, new_maddy_vars(cfg), ""); err == nil {
+		t.Fatal("render_maddy() with a systemd:// milter address succeeded")
+	}
+}
+
+func TestRenderPostfixDovecotGolden(t *testing.T) {
+	for _, content_filter := range []bool{false, true} {
+		vars := new_postfix_dovecot_vars(config.NewChatmailConfig("chat.example"))
+		vars.ContentFilter = content_filter
+		files, err := render_postfix_dovecot(vars, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := "postfix-dovecot"
+		if content_filter {
+			dir = "postfix-dovecot-content-filter"
+		}
+		for _, name := range postfix_dovecot_files {
+			check_golden(t, filepath.Join(dir, name), files[name])
+		}
+		// Rendering has to be deterministic, so that re-running it doesn't
+		// show up as a configuration change.
+		again, err := render_postfix_dovecot(vars, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range postfix_dovecot_files {
+			if !bytes.Equal(files[name], again[name]) {
+				t.Fatalf("rendering %s twice gave different output", name)
+			}
+		}
+	}
+}
+
+func TestRenderPostfixDovecotUsesConfig(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.MaxMailboxSizeMB = 250
+	cfg.MailboxesDirectory = "/srv/mail"
+	cfg.MilterListenAddress = "tcp://127.0.0.1:10026"
+	files, err := render_postfix_dovecot(new_postfix_dovecot_vars(cfg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"dovecot.conf": "quota_rule = *:storage=250M",
+		"master.cf":    "-o smtpd_milters=inet:127.0.0.1:10026",
+		"main.cf":      "smtpd_sasl_path = /run/chatmail/sasl.sock",
+	} {
+		if !strings.Contains(string(files[name]), want) {
+			t.Fatalf("rendered %s is missing %q:\n%s", name, want, files[name])
+		}
+	}
+	if !strings.Contains(string(files["dovecot.conf"]), "mail_location = maildir:/srv/mail/%u") {
+		t.Fatalf("rendered dovecot.conf doesn't use MailboxesDirectory:\n%s", files["dovecot.conf"])
+	}
+}
+
+func TestRenderRoleAliases(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.OperatorMailbox = "ops@chat.example"
+	files, err := render_postfix_dovecot(new_postfix_dovecot_vars(cfg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "virtual_alias_maps = inline:{ abuse@chat.example=ops@chat.example, ftp@chat.example=ops@chat.example,"
+	if !strings.Contains(string(files["main.cf"]), want) || !strings.Contains(string(files["main.cf"]), "www@chat.example=ops@chat.example }") {
+		t.Fatalf("rendered main.cf doesn't send the role addresses to OperatorMailbox:\n%s", files["main.cf"])
+	}
+	var buf bytes.Buffer
+	if err := render_maddy(&buf, new_maddy_vars(cfg), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "entry abuse@$(primary_domain) ops@chat.example") {
+		t.Fatalf("rendered maddy.conf doesn't send the role addresses to OperatorMailbox:\n%s", buf.String())
+	}
+
+	// postfix forwards mail for the role addresses elsewhere; maddy can't.
+	cfg.OperatorMailbox = "ops@elsewhere.example"
+	files, err = render_postfix_dovecot(new_postfix_dovecot_vars(cfg), "")
+	if err != nil || !strings.Contains(string(files["main.cf"]), "abuse@chat.example=ops@elsewhere.example") {
+		t.Fatalf("render_postfix_dovecot() with an OperatorMailbox on another domain = %v; want it to forward there", err)
+	}
+	if err := render_maddy(&buf, new_maddy_vars(cfg), ""); err == nil || !strings.Contains(err.Error(), "OperatorMailbox") {
+		t.Fatalf("render_maddy() with an OperatorMailbox on another domain = %v; want an error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// config_problems splits the error from Validate back into its parts.
+func config_problems(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// do_validate reports what's wrong with the configuration in config_file,
+// and whether it's good enough to use.
+func do_validate(w io.Writer, config_file string) bool {
+	var cm_config config.ChatmailConfig
+	if err := config.LoadChatmailConfigFromFile(config_file, &cm_config); err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return false
+	}
+	err := cm_config.Validate()
+	if err != nil {
+		for _, problem := range config_problems(err) {
+			fmt.Fprintf(w, "error: %v\n", problem)
+		}
+	}
+	for _, warning := range cm_config.Warnings() {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	if err == nil {
+		fmt.Fprintf(w, "%s is valid.\n", config_file)
+	}
+	return err == nil
+}
+
+func validate_main(args []string) {
+	validateCmd := flag.NewFlagSet("validate", flag.ExitOnError)
+	validateCmd.Parse(args)
+	config_file := config_file_name
+	if validateCmd.NArg() > 0 {
+		config_file = validateCmd.Arg(0)
+	}
+	if !do_validate(os.Stdout, config_file) {
+		os.Exit(1)
+	}
+}
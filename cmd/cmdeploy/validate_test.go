@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoValidate(t *testing.T) {
+	config_file := filepath.Join(t.TempDir(), config_file_name)
+	cm_config := config.NewChatmailConfig("chat.example")
+	if err := cm_config.Save(config_file); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if !do_validate(&out, config_file) {
+		t.Fatalf("do_validate() of the defaults = false; want true\n%s", out.String())
+	}
+	if got := strings.Count(out.String(), "warning: Privacy"); got != 4 {
+		t.Fatalf("do_validate() printed %d privacy warnings; want 4\n%s", got, out.String())
+	}
+
+	cm_config.UsernameMinLength = 0
+	cm_config.DeleteMailsAfterDays = -5
+	if err := cm_config.Save(config_file); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if do_validate(&out, config_file) {
+		t.Fatalf("do_validate() of an invalid config = true; want false")
+	}
+	if got := strings.Count(out.String(), "error: "); got != 2 {
+		t.Fatalf("do_validate() printed %d errors; want 2\n%s", got, out.String())
+	}
+}
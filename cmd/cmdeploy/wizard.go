@@ -0,0 +1,408 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnsprovider"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// wizard_result is everything the setup wizard asks about. Only the config
+// is saved; the rest decides which commands to suggest afterwards.
+type wizard_result struct {
+	config       config.ChatmailConfig
+	dns_provider string
+	target       string
+	ipv4         []string
+	ipv6         []string
+	confirmed    bool
+}
+
+var deployment_targets = []string{"gokrazy-amd64", "gokrazy-rpi", "systemd"}
+
+type wizard_question struct {
+	// key names the question in answers files.
+	key    string
+	prompt string
+	// default_value is what an empty answer means.
+	default_value func(r *wizard_result) string
+	required      bool
+	// apply validates the answer and records it in r.
+	apply func(r *wizard_result, answer string) error
+}
+
+func fixed(value string) func(*wizard_result) string {
+	return func(*wizard_result) string {
+		return value
+	}
+}
+
+func parse_positive_int(answer string) (int, error) {
+	n, err := strconv.Atoi(answer)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%q is not a whole number greater than zero", answer)
+	}
+	return n, nil
+}
+
+func int_question(key string, prompt string, field func(*config.ChatmailConfig) *int) wizard_question {
+	return wizard_question{
+		key:    key,
+		prompt: prompt,
+		default_value: func(r *wizard_result) string {
+			return strconv.Itoa(*field(&r.config))
+		},
+		apply: func(r *wizard_result, answer string) error {
+			n, err := parse_positive_int(answer)
+			if err != nil {
+				return err
+			}
+			*field(&r.config) = n
+			return nil
+		},
+	}
+}
+
+func text_question(key string, prompt string, field func(*config.ChatmailConfig) *string) wizard_question {
+	return wizard_question{
+		key:           key,
+		prompt:        prompt,
+		default_value: func(r *wizard_result) string { return *field(&r.config) },
+		apply: func(r *wizard_result, answer string) error {
+			*field(&r.config) = answer
+			return nil
+		},
+	}
+}
+
+func choice_question(key string, prompt string, choices []string, default_choice string, apply func(r *wizard_result, choice string)) wizard_question {
+	return wizard_question{
+		key:           key,
+		prompt:        prompt + " (" + strings.Join(choices, ", ") + ")",
+		default_value: fixed(default_choice),
+		apply: func(r *wizard_result, answer string) error {
+			answer = strings.ToLower(answer)
+			if !slices.Contains(choices, answer) {
+				return fmt.Errorf("please answer one of: %s", strings.Join(choices, ", "))
+			}
+			apply(r, answer)
+			return nil
+		},
+	}
+}
+
+func yes_no_question(key string, prompt string, default_value func(*wizard_result) string, apply func(r *wizard_result, yes bool)) wizard_question {
+	return wizard_question{
+		key:           key,
+		prompt:        prompt + " (yes/no)",
+		default_value: default_value,
+		apply: func(r *wizard_result, answer string) error {
+			switch strings.ToLower(answer) {
+			case "y", "yes":
+				apply(r, true)
+			case "n", "no":
+				apply(r, false)
+			default:
+				return fmt.Errorf("please answer yes or no")
+			}
+			return nil
+		},
+	}
+}
+
+func ip_question(key string, prompt string, want_ipv4 bool, field func(*wizard_result) *[]string) wizard_question {
+	return wizard_question{
+		key:           key,
+		prompt:        prompt,
+		default_value: fixed(""),
+		apply: func(r *wizard_result, answer string) error {
+			*field(r) = nil
+			for _, s := range strings.FieldsFunc(answer, func(c rune) bool { return c == ',' || c == ' ' }) {
+				ip := net.ParseIP(s)
+				if ip == nil || (ip.To4() != nil) != want_ipv4 {
+					return fmt.Errorf("%q is not an IPv%s address", s, map[bool]string{true: "4", false: "6"}[want_ipv4])
+				}
+				*field(r) = append(*field(r), s)
+			}
+			return nil
+		},
+	}
+}
+
+func wizard_questions() []wizard_question {
+	dns_choices := append([]string{"none"}, dnsprovider.Names()...)
+	return []wizard_question{
+		{
+			key:           "domain",
+			prompt:        "Domain name of your chatmail server (like chat.example.org)",
+			default_value: fixed(""),
+			required:      true,
+			apply: func(r *wizard_result, answer string) error {
+				fqdn := strings.TrimSuffix(strings.ToLower(answer), ".")
+				if !config.IsDomainName(fqdn) {
+					return fmt.Errorf("%q is not a domain name", answer)
+				}
+				r.config = config.NewChatmailConfig(fqdn)
+				return nil
+			},
+		},
+		int_question("max_emails_per_minute", "How many emails may each user send per minute?", func(c *config.ChatmailConfig) *int { return &c.MaxEmailsPerMinutePerUser }),
+		int_question("max_mailbox_size_mb", "How big may each mailbox get, in megabytes?", func(c *config.ChatmailConfig) *int { return &c.MaxMailboxSizeMB }),
+		{
+			key:    "max_message_size_mb",
+			prompt: "How big may a single message be, in megabytes?",
+			default_value: func(r *wizard_result) string {
+				return strconv.Itoa(r.config.MaxMessageSizeB / (1024 * 1024))
+			},
+			apply: func(r *wizard_result, answer string) error {
+				n, err := parse_positive_int(answer)
+				if err != nil {
+					return err
+				}
+				if n > r.config.MaxMailboxSizeMB {
+					return fmt.Errorf("messages can't be bigger than a whole mailbox (%d MB)", r.config.MaxMailboxSizeMB)
+				}
+				r.config.MaxMessageSizeB = n * 1024 * 1024
+				return nil
+			},
+		},
+		int_question("delete_mails_after_days", "After how many days should messages be deleted from the server?", func(c *config.ChatmailConfig) *int { return &c.DeleteMailsAfterDays }),
+		int_question("delete_inactive_users_after_days", "After how many days without logging in should accounts be deleted?", func(c *config.ChatmailConfig) *int { return &c.DeleteInactiveUsersAfterDays }),
+		yes_no_question("invite_only", "Should new accounts need an invite?", fixed("no"), func(r *wizard_result, yes bool) {
+			r.config.InviteOnly = yes
+		}),
+		text_question("privacy_contact_postal_address", "Postal address of the server operator, for the privacy policy", func(c *config.ChatmailConfig) *string { return &c.PrivacyContactPostalAddress }),
+		{
+			key:           "privacy_contact_email_address",
+			prompt:        "Email address of the server operator, for the privacy policy",
+			default_value: fixed(""),
+			apply: func(r *wizard_result, answer string) error {
+				if answer != "" {
+					if _, err := mail.ParseAddress(answer); err != nil {
+						return fmt.Errorf("%q is not an email address", answer)
+					}
+				}
+				r.config.PrivacyContactEmailAddress = answer
+				return nil
+			},
+		},
+		text_question("privacy_data_officer_postal_address", "Postal address of the data protection officer, if there is one", func(c *config.ChatmailConfig) *string { return &c.PrivacyDataOfficerPostalAddress }),
+		text_question("privacy_supervisor_postal_address", "Postal address of the data protection supervisory authority", func(c *config.ChatmailConfig) *string { return &c.PrivacySupervisorPostalAddress }),
+		ip_question("ipv4", "IPv4 address(es) of the server, if you know them", true, func(r *wizard_result) *[]string { return &r.ipv4 }),
+		ip_question("ipv6", "IPv6 address(es) of the server, if you know them", false, func(r *wizard_result) *[]string { return &r.ipv6 }),
+		choice_question("dns_provider", "Where is the domain's DNS hosted? Choose none to set up the records by hand", dns_choices, "none", func(r *wizard_result, choice string) {
+			r.dns_provider = choice
+		}),
+		choice_question("deployment_target", "Where will the server run?", deployment_targets, "gokrazy-amd64", func(r *wizard_result, choice string) {
+			r.target = choice
+		}),
+	}
+}
+
+var confirm_question = yes_no_question("write", "Write this configuration and generate DKIM keys?", fixed("yes"), func(r *wizard_result, yes bool) {
+	r.confirmed = yes
+})
+
+// wizard asks questions on out and reads answers from in, one per line. If
+// answers is set, it's used instead, and questions that it doesn't answer
+// get their default.
+type wizard struct {
+	in      *bufio.Scanner
+	out     io.Writer
+	answers map[string]string
+	getenv  func(string) string
+}
+
+func (w *wizard) ask(r *wizard_result, q wizard_question) error {
+	default_value := q.default_value(r)
+	for {
+		prompt := q.prompt
+		if default_value != "" {
+			prompt += " [" + default_value + "]"
+		}
+		fmt.Fprintf(w.out, "%s: ", prompt)
+
+		var answer string
+		if w.answers != nil {
+			answer = w.answers[q.key]
+			fmt.Fprintln(w.out, answer)
+		} else {
+			if !w.in.Scan() {
+				if err := w.in.Err(); err != nil {
+					return err
+				}
+				return errors.New("setup cancelled")
+			}
+			answer = w.in.Text()
+		}
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			answer = default_value
+		}
+		var err error
+		if answer == "" && q.required {
+			err = errors.New("this question needs an answer")
+		} else {
+			err = q.apply(r, answer)
+		}
+		if err == nil {
+			return nil
+		}
+		if w.answers != nil {
+			return fmt.Errorf("answer for %s: %w", q.key, err)
+		}
+		fmt.Fprintf(w.out, "  %v\n", err)
+	}
+}
+
+func check_answer_keys(answers map[string]string) error {
+	known := []string{confirm_question.key}
+	for _, q := range wizard_questions() {
+		known = append(known, q.key)
+	}
+	for key := range answers {
+		if !slices.Contains(known, key) {
+			return fmt.Errorf("unknown question %q in answers file", key)
+		}
+	}
+	return nil
+}
+
+// preview_setup shows the configuration and DNS records that the answers
+// so far would produce.
+func preview_setup(out io.Writer, r *wizard_result) error {
+	config_json, err := json.MarshalIndent(r.config, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nThis is the chatmail.json that will be written:\n\n%s\n", config_json)
+	records, err := dnszone.Zone(r.config, dnszone.Options{IPv4: r.ipv4, IPv6: r.ipv6})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "\nThese are the DNS records the server needs; the DKIM records will be added once the keys have been generated:")
+	fmt.Fprintln(out)
+	if err := dnszone.WriteBIND(out, r.config, records); err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+func run_wizard(w *wizard) (wizard_result, error) {
+	var r wizard_result
+	if w.answers != nil {
+		if err := check_answer_keys(w.answers); err != nil {
+			return r, err
+		}
+	}
+	fmt.Fprintln(w.out, "Let's set up your chatmail server. Press Enter to accept the [default] answer.")
+	for _, q := range wizard_questions() {
+		if err := w.ask(&r, q); err != nil {
+			return r, err
+		}
+		// Credentials only have to be there once DNS is set up, so missing
+		// ones are worth a warning but shouldn't stop the setup.
+		if q.key == "dns_provider" && r.dns_provider != "none" {
+			if _, err := dnsprovider.FromEnv(r.dns_provider, w.getenv); err != nil {
+				fmt.Fprintf(w.out, "  Warning: %v\n", err)
+			}
+		}
+	}
+	if err := r.config.Validate(); err != nil {
+		return r, err
+	}
+	if err := preview_setup(w.out, &r); err != nil {
+		return r, err
+	}
+	if err := w.ask(&r, confirm_question); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// write_wizard_result saves the configuration and DKIM keys in dir, and
+// explains what to do next.
+func write_wizard_result(out io.Writer, r wizard_result, dir string) error {
+	if !r.confirmed {
+		fmt.Fprintln(out, "Nothing was written.")
+		return nil
+	}
+	config_file := filepath.Join(dir, config_file_name)
+	if err := r.config.Save(config_file); err != nil {
+		return err
+	}
+	dkim_dir := filepath.Join(dir, dkim.DefaultDirectory)
+	if _, err := dkim.Generate(dkim_dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Wrote %s and generated DKIM keys in %s. Next steps:\n", config_file, dkim_dir)
+
+	zone_flags := ""
+	for _, ip := range r.ipv4 {
+		zone_flags += " -ipv4 " + ip
+	}
+	for _, ip := range r.ipv6 {
+		zone_flags += " -ipv6 " + ip
+	}
+	if r.dns_provider == "none" {
+		fmt.Fprintf(out, "  - Publish the records from 'cmdeploy dns zone%s' at your DNS provider.\n", zone_flags)
+	} else {
+		fmt.Fprintf(out, "  - Set up DNS with 'cmdeploy dns apply -provider %s%s'.\n", r.dns_provider, zone_flags)
+	}
+	switch r.target {
+	case "gokrazy-amd64":
+		fmt.Fprintln(out, "  - Build the server image with 'cmdeploy build-image -target amd64'.")
+	case "gokrazy-rpi":
+		fmt.Fprintln(out, "  - Build the server image with 'cmdeploy build-image -target rpi'.")
+	case "systemd":
+		fmt.Fprintln(out, "  - Install chatmail on the server with 'cmdeploy install'.")
+	}
+	fmt.Fprintf(out, "  - Check the DNS records with 'cmdeploy dns check%s'.\n", zone_flags)
+	return nil
+}
+
+func read_answers_file(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	answers := make(map[string]string)
+	if err := json.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("failed to read answers from %s: %w", path, err)
+	}
+	return answers, nil
+}
+
+func do_init_wizard(answers_file string) {
+	w := &wizard{in: bufio.NewScanner(os.Stdin), out: os.Stdout, getenv: os.Getenv}
+	if answers_file != "" {
+		answers, err := read_answers_file(answers_file)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		w.answers = answers
+	}
+	result, err := run_wizard(w)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := write_wizard_result(os.Stdout, result, "."); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func no_env(string) string {
+	return ""
+}
+
+func answers_wizard(t *testing.T, answers map[string]string) (*wizard, *bytes.Buffer) {
+	t.Helper()
+	var out bytes.Buffer
+	return &wizard{out: &out, answers: answers, getenv: no_env}, &out
+}
+
+func TestWizardAnswersFile(t *testing.T) {
+	answers, err := read_answers_file(filepath.Join("testdata", "wizard-answers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, out := answers_wizard(t, answers)
+	r, err := run_wizard(w)
+	if err != nil {
+		t.Fatalf("run_wizard() = %v; want no error", err)
+	}
+
+	want := config.NewChatmailConfig("chat.example")
+	want.MaxEmailsPerMinutePerUser = 60
+	want.MaxMessageSizeB = 20 * 1024 * 1024
+	want.InviteOnly = true
+	want.PrivacyContactEmailAddress = "operator@example.org"
+	want.PrivacyContactPostalAddress = "1 Example Street, Exampletown"
+	if !reflect.DeepEqual(r.config, want) {
+		t.Fatalf("run_wizard().config = %+v; want %+v", r.config, want)
+	}
+	if r.dns_provider != "cloudflare" || r.target != "systemd" || !r.confirmed {
+		t.Fatalf("run_wizard() = provider %q, target %q, confirmed %v; want cloudflare, systemd, true", r.dns_provider, r.target, r.confirmed)
+	}
+	if !reflect.DeepEqual(r.ipv4, []string{"192.0.2.1"}) || r.ipv6 != nil {
+		t.Fatalf("run_wizard() = IPv4 %v, IPv6 %v; want [192.0.2.1], none", r.ipv4, r.ipv6)
+	}
+
+	for _, want := range []string{
+		`"MailFullyQualifiedDomainName": "chat.example"`,
+		"chat.example.\t3600\tIN\tA\t192.0.2.1",
+		"_dmarc.chat.example.",
+		"Warning: the cloudflare DNS provider needs these environment variables set: CLOUDFLARE_API_TOKEN",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("wizard output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWizardAnswersFileErrors(t *testing.T) {
+	tests := []struct {
+		answers map[string]string
+		want    string
+	}{
+		{map[string]string{}, "answer for domain: this question needs an answer"},
+		{map[string]string{"domain": "not a domain"}, `answer for domain: "not a domain" is not a domain name`},
+		{map[string]string{"domain": "chat.example", "max_mailbox_size_mb": "0"}, "answer for max_mailbox_size_mb"},
+		{map[string]string{"domain": "chat.example", "max_message_size_mb": "500"}, "bigger than a whole mailbox"},
+		{map[string]string{"domain": "chat.example", "privacy_contact_email_address": "nobody"}, "is not an email address"},
+		{map[string]string{"domain": "chat.example", "ipv4": "2001:db8::1"}, "is not an IPv4 address"},
+		{map[string]string{"domain": "chat.example", "dns_provider": "gandi"}, "please answer one of: none, "},
+		{map[string]string{"domain": "chat.example", "write": "maybe"}, "please answer yes or no"},
+		{map[string]string{"domain": "chat.example", "colour": "blue"}, `unknown question "colour"`},
+	}
+	for _, test := range tests {
+		w, _ := answers_wizard(t, test.answers)
+		_, err := run_wizard(w)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("run_wizard(%v) = %v; want error containing %q", test.answers, err, test.want)
+		}
+	}
+}
+
+func TestWizardInteractive(t *testing.T) {
+	// Every invalid answer is followed by a valid one for the same question;
+	// empty lines take the default.
+	input := strings.Join([]string{
+		"", "chat..example", "chat.example",
+		"lots", "10",
+		"", "", "", "",
+		"", "",
+		"", "",
+		"", "",
+		"", "",
+		"gokrazy-rpi",
+		"n",
+	}, "\n") + "\n"
+	var out bytes.Buffer
+	w := &wizard{in: bufio.NewScanner(strings.NewReader(input)), out: &out, getenv: no_env}
+	r, err := run_wizard(w)
+	if err != nil {
+		t.Fatalf("run_wizard() = %v; want no error\n%s", err, out.String())
+	}
+	want := config.NewChatmailConfig("chat.example")
+	want.MaxEmailsPerMinutePerUser = 10
+	if !reflect.DeepEqual(r.config, want) {
+		t.Fatalf("run_wizard().config = %+v; want %+v", r.config, want)
+	}
+	if r.dns_provider != "none" || r.target != "gokrazy-rpi" || r.confirmed {
+		t.Fatalf("run_wizard() = provider %q, target %q, confirmed %v; want none, gokrazy-rpi, false", r.dns_provider, r.target, r.confirmed)
+	}
+	for _, want := range []string{
+		"this question needs an answer",
+		`"chat..example" is not a domain name`,
+		`"lots" is not a whole number`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("wizard output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+
+	// Running out of input part way through is a cancellation.
+	w = &wizard{in: bufio.NewScanner(strings.NewReader("chat.example\n")), out: &out, getenv: no_env}
+	if _, err := run_wizard(w); err == nil {
+		t.Fatalf("run_wizard() with truncated input = nil; want error")
+	}
+}
+
+func TestWriteWizardResult(t *testing.T) {
+	dir := t.TempDir()
+	r := wizard_result{
+		config:       config.NewChatmailConfig("chat.example"),
+		dns_provider: "porkbun",
+		target:       "gokrazy-amd64",
+		ipv4:         []string{"192.0.2.1"},
+	}
+
+	var out bytes.Buffer
+	if err := write_wizard_result(&out, r, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, config_file_name)); err == nil {
+		t.Fatalf("write_wizard_result() wrote %s without confirmation", config_file_name)
+	}
+
+	r.confirmed = true
+	out.Reset()
+	if err := write_wizard_result(&out, r, dir); err != nil {
+		t.Fatal(err)
+	}
+	var saved config.ChatmailConfig
+	if err := config.LoadChatmailConfigFromFile(filepath.Join(dir, config_file_name), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, r.config) {
+		t.Fatalf("saved config = %+v; want %+v", saved, r.config)
+	}
+	keys, err := dkim.Load(filepath.Join(dir, dkim.DefaultDirectory))
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("dkim.Load() = %d keys, %v; want 2 keys", len(keys), err)
+	}
+	for _, want := range []string{
+		"cmdeploy dns apply -provider porkbun -ipv4 192.0.2.1",
+		"cmdeploy build-image -target amd64",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("write_wizard_result() output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package accounts
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrExists       = errors.New("account already exists")
+	ErrNotFound     = errors.New("account does not exist")
+	ErrBadPassword  = errors.New("incorrect password")
+	ErrInvalidAddr  = errors.New("invalid account address")
+	ErrUnknownCrypt = errors.New("unsupported password hash scheme")
+	ErrBlocked      = errors.New("account is blocked")
+)
+
+const password_scheme = "{SHA512-CRYPT}"
+
+// Info describes an account for administrators. Times that aren't known are
+// zero, and so is MailboxBytes for stores that don't keep the mail.
+type Info struct {
+	Address      string
+	Created      time.Time
+	LastLogin    time.Time
+	MailboxBytes int64
+	Blocked      bool
+}
+
+// FileStore keeps one directory per account underneath dir, using the same
+// layout as the upstream Python chatmail: <dir>/<address>/password holds the
+// password hash, and the rest of the directory is the account's Maildir.
+// Like upstream, the modification time of the password file is when the
+// account last logged in. An empty created file marks when the account was
+// made (accounts from before it existed don't have one), an empty blocked
+// file stops the address from logging in or being created, and
+// scram-sha-256 holds the account's SCRAMKeys (accounts from before those
+// existed get them on their next login with a password).
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir}
+}
+
+// check_address returns ErrInvalidAddr if addr can't be an account, because
+// it couldn't be the name of its Maildir.
+func check_address(addr string) error {
+	if addr == "" || addr == "." || addr == ".." || strings.ContainsAny(addr, "/\\\x00") {
+		return ErrInvalidAddr
+	}
+	return nil
+}
+
+func (s *FileStore) account_dir(addr string) (string, error) {
+	if err := check_address(addr); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, addr), nil
+}
+
+func (s *FileStore) password_path(addr string) (string, error) {
+	dir, err := s.account_dir(addr)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "password"), nil
+}
+
+func (s *FileStore) marker_path(addr string, name string) (string, error) {
+	dir, err := s.account_dir(addr)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func (s *FileStore) Exists(addr string) (bool, error) {
+	path, err := s.password_path(addr)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Create makes a new account with the given password, or returns ErrExists if
+// there already is one.
+func (s *FileStore) Create(addr string, password string) error {
+	dir, err := s.account_dir(addr)
+	if err != nil {
+		return err
+	}
+	hash, err := hash_password(password)
+	if err != nil {
+		return err
+	}
+	keys, err := NewSCRAMKeys(password)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write the hash to a temporary file and then hard-link it into place, so
+	// that a concurrent login never sees a half-written password file and only
+	// one of two racing creations can win.
+	tmp, err := os.CreateTemp(dir, ".password-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(hash + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Link(tmp.Name(), filepath.Join(dir, "password"))
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := write_file(filepath.Join(dir, "scram-sha-256"), keys.String()+"\n"); err != nil {
+		return err
+	}
+	return touch(filepath.Join(dir, "created"))
+}
+
+// write_file replaces the contents of path by renaming a temporary file
+// over it, so that readers see either the old contents or the new ones.
+func write_file(path string, contents string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func touch(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// RecordLogin notes that addr logged in at now.
+func (s *FileStore) RecordLogin(addr string, now time.Time) error {
+	path, err := s.password_path(addr)
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(path, now, now)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// IsBlocked reports whether addr has been blocked, whether or not there's
+// an account for it.
+func (s *FileStore) IsBlocked(addr string) (bool, error) {
+	path, err := s.marker_path(addr, "blocked")
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Block stops addr from logging in, and from being created if there's no
+// account for it yet.
+func (s *FileStore) Block(addr string) error {
+	dir, err := s.account_dir(addr)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return touch(filepath.Join(dir, "blocked"))
+}
+
+// Unblock undoes Block. Unblocking an address that isn't blocked does
+// nothing.
+func (s *FileStore) Unblock(addr string) error {
+	path, err := s.marker_path(addr, "blocked")
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Blocking an address that had no account left an empty directory.
+	if exists, err := s.Exists(addr); err != nil || exists {
+		return err
+	}
+	dir, _ := s.account_dir(addr)
+	err = os.Remove(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Delete removes the account for addr along with all of its mail. A blocked
+// address stays blocked, so that it can't simply be created again.
+func (s *FileStore) Delete(addr string) error {
+	exists, err := s.Exists(addr)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	blocked, err := s.IsBlocked(addr)
+	if err != nil {
+		return err
+	}
+	dir, _ := s.account_dir(addr)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if blocked {
+		return s.Block(addr)
+	}
+	return nil
+}
+
+// is_message reports whether path is a message in a Maildir folder.
+func is_message(path string) bool {
+	parent := filepath.Base(filepath.Dir(path))
+	return parent == "cur" || parent == "new"
+}
+
+// ExpireMail removes the messages of addr that arrived before cutoff, and
+// returns how many there were.
+func (s *FileStore) ExpireMail(addr string, cutoff time.Time) (int, error) {
+	dir, err := s.account_dir(addr)
+	if err != nil {
+		return 0, err
+	}
+	return expire_maildir(dir, cutoff)
+}
+
+// expire_maildir removes the messages in the Maildir dir that arrived
+// before cutoff, and returns how many there were.
+func expire_maildir(dir string, cutoff time.Time) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !is_message(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// mod_time returns the modification time of path, or the zero time if it
+// doesn't exist.
+func mod_time(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func dir_size(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted while walking, or there's nothing here yet.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// List describes every account, and every blocked address, sorted by
+// address.
+func (s *FileStore) List() ([]Info, error) {
+	var list []Info
+	err := s.Each(func(info Info) error {
+		list = append(list, info)
+		return nil
+	})
+	return list, err
+}
+
+// Each calls fn for every account, and every blocked address, sorted by
+// address, until it returns an error.
+func (s *FileStore) Each(fn func(Info) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := s.Info(e.Name())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Info describes the account for addr, which has to exist or be blocked.
+func (s *FileStore) Info(addr string) (Info, error) {
+	dir, err := s.account_dir(addr)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Address: addr}
+	if info.LastLogin, err = mod_time(filepath.Join(dir, "password")); err != nil {
+		return Info{}, err
+	}
+	if info.Created, err = mod_time(filepath.Join(dir, "created")); err != nil {
+		return Info{}, err
+	}
+	if info.Blocked, err = s.IsBlocked(addr); err != nil {
+		return Info{}, err
+	}
+	if info.LastLogin.IsZero() && !info.Blocked {
+		return Info{}, ErrNotFound
+	}
+	if info.MailboxBytes, err = dir_size(dir); err != nil {
+		return Info{}, err
+	}
+	return info, nil
+}
+
+// Verify checks password against the stored hash for addr.
+func (s *FileStore) Verify(addr string, password string) error {
+	path, err := s.password_path(addr)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return check_password(strings.TrimSpace(string(data)), password)
+}
+
+// SCRAMKeys returns the stored SCRAM-SHA-256 keys of addr, or ErrNoSCRAMKeys
+// if the account was made before they were stored.
+func (s *FileStore) SCRAMKeys(addr string) (SCRAMKeys, error) {
+	exists, err := s.Exists(addr)
+	if err != nil {
+		return SCRAMKeys{}, err
+	}
+	if !exists {
+		return SCRAMKeys{}, ErrNotFound
+	}
+	path, _ := s.marker_path(addr, "scram-sha-256")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return SCRAMKeys{}, ErrNoSCRAMKeys
+	}
+	if err != nil {
+		return SCRAMKeys{}, err
+	}
+	return parse_scram_keys(strings.TrimSpace(string(data)))
+}
+
+// SetSCRAMKeys stores new SCRAM-SHA-256 keys for password, which should have
+// just been checked with Verify.
+func (s *FileStore) SetSCRAMKeys(addr string, password string) error {
+	exists, err := s.Exists(addr)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	keys, err := NewSCRAMKeys(password)
+	if err != nil {
+		return err
+	}
+	path, _ := s.marker_path(addr, "scram-sha-256")
+	return write_file(path, keys.String()+"\n")
+}
+
+// Count returns how many accounts there are. A missing directory means
+// that there are none yet.
+func (s *FileStore) Count() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, e.Name(), "password")); err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// DiskUsage adds up the sizes of all of the files that belong to accounts.
+func (s *FileStore) DiskUsage() (int64, error) {
+	return dir_size(s.dir)
+}
+
+func hash_password(password string) (string, error) {
+	salt_bytes := make([]byte, 12)
+	if _, err := rand.Read(salt_bytes); err != nil {
+		return "", err
+	}
+	var salt strings.Builder
+	for _, b := range salt_bytes {
+		salt.WriteByte(crypt_alphabet[b&0x3f])
+	}
+	hash, err := sha512_crypt([]byte(password), sha512_crypt_prefix+salt.String())
+	if err != nil {
+		return "", err
+	}
+	return password_scheme + hash, nil
+}
+
+func check_password(stored string, password string) error {
+	hash, found := strings.CutPrefix(stored, password_scheme)
+	if !found {
+		return fmt.Errorf("%w: %.20q", ErrUnknownCrypt, stored)
+	}
+	computed, err := sha512_crypt([]byte(password), hash)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return ErrBadPassword
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package accounts
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSha512CryptVectors(t *testing.T) {
+	// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+	vectors := []struct {
+		setting  string
+		password string
+		want     string
+	}{
+		{
+			"$6$saltstring",
+			"Hello world!",
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			"$6$rounds=10000$saltstringsaltstring",
+			"Hello world!",
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			"$6$rounds=5000$toolongsaltstring",
+			"This is just a test",
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+		},
+		{
+			"$6$rounds=10$roundstoolow",
+			"the minimum number is still observed",
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+		},
+	}
+	for _, v := range vectors {
+		got, err := sha512_crypt([]byte(v.password), v.setting)
+		if err != nil || got != v.want {
+			t.Fatalf("sha512_crypt(%q, %q) = %q, %v; want %q, nil", v.password, v.setting, got, err, v.want)
+		}
+	}
+}
+
+func TestFileStorePasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	addr := "ac_1234@chat.example"
+	if err := store.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, addr, "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:len(password_scheme)]) != password_scheme {
+		t.Fatalf("password file = %q; want %s prefix", data, password_scheme)
+	}
+}
+
+func TestFileStoreCountAndDiskUsage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	store := NewFileStore(dir)
+	usage, err := store.DiskUsage()
+	if err != nil || usage != 0 {
+		t.Fatalf("DiskUsage() before any accounts = %d, %v; want 0, nil", usage, err)
+	}
+
+	for _, addr := range []string{"ac_1@chat.example", "ac_2@chat.example"} {
+		if err := store.Create(addr, "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Directories without a password file aren't accounts.
+	if err := os.MkdirAll(filepath.Join(dir, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write_message(t, filepath.Join(dir, "ac_1@chat.example", "cur", "1.eml"), 1000, time.Now())
+
+	count, err := store.Count()
+	if err != nil || count != 2 {
+		t.Fatalf("Count() = %d, %v; want 2, nil", count, err)
+	}
+	usage, err = store.DiskUsage()
+	if err != nil || usage <= 1000 {
+		t.Fatalf("DiskUsage() = %d, %v; want more than 1000, nil", usage, err)
+	}
+	info, err := store.Info("ac_1@chat.example")
+	if err != nil || info.MailboxBytes <= 1000 {
+		t.Fatalf("Info() = %+v, %v; want more than 1000 mailbox bytes", info, err)
+	}
+}
+
+func write_message(t *testing.T, path string, size int, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreDirectories(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	addr := "ac_1@chat.example"
+	if err := store.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, addr)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Delete() left the account's directory: %v", err)
+	}
+
+	// Blocked addresses without an account only have a directory while
+	// they're blocked.
+	if err := store.Block(addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Unblock(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, addr)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Unblock() left the directory of an address without an account: %v", err)
+	}
+}
+
+func TestFileStoreExpireMail(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	addr := "ac_1@chat.example"
+	if err := store.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	old := cutoff.Add(-time.Hour)
+	// Only messages in cur and new count; tmp holds deliveries in progress.
+	messages := map[string]struct {
+		mtime   time.Time
+		expired bool
+	}{
+		"cur/1.eml":          {old, true},
+		"new/2.eml":          {old, true},
+		".Archive/cur/3.eml": {old, true},
+		"tmp/4.eml":          {old, false},
+		"dovecot-uidlist":    {old, false},
+		"cur/5.eml":          {cutoff, false},
+		".Archive/new/6.eml": {cutoff, false},
+	}
+	for name, m := range messages {
+		write_message(t, filepath.Join(dir, addr, name), 10, m.mtime)
+	}
+
+	removed, err := store.ExpireMail(addr, cutoff)
+	if err != nil || removed != 3 {
+		t.Fatalf("ExpireMail() = %d, %v; want 3, nil", removed, err)
+	}
+	for name, m := range messages {
+		_, err := os.Stat(filepath.Join(dir, addr, name))
+		if m.expired != errors.Is(err, os.ErrNotExist) {
+			t.Errorf("after ExpireMail(), %s exists = %t; want %t", name, err == nil, !m.expired)
+		}
+	}
+	if exists, err := store.Exists(addr); err != nil || !exists {
+		t.Fatalf("ExpireMail() removed the account: %t, %v", exists, err)
+	}
+}
+
+func TestDeriveSCRAMKeys(t *testing.T) {
+	// From the example exchange in RFC 7677 section 3.
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	keys := DeriveSCRAMKeys("pencil", salt, 4096)
+	want := "{SCRAM-SHA-256}4096,W22ZaJ0SNY7soEsUEjb6gQ==,WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=,wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU="
+	if got := keys.String(); got != want {
+		t.Fatalf("DeriveSCRAMKeys().String() = %q; want %q", got, want)
+	}
+	parsed, err := parse_scram_keys(want)
+	if err != nil || parsed.String() != want {
+		t.Fatalf("parse_scram_keys(%q) = %q, %v; want the same, nil", want, parsed, err)
+	}
+	for _, bad := range []string{"", "{SHA512-CRYPT}$6$x", "{SCRAM-SHA-256}0,,,", "{SCRAM-SHA-256}4096,W22Z,AAAA,AAAA"} {
+		if _, err := parse_scram_keys(bad); err == nil {
+			t.Fatalf("parse_scram_keys(%q) = nil error; want an error", bad)
+		}
+	}
+}
+
+// Accounts from before SCRAM keys were stored get them later.
+func TestFileStoreAddsSCRAMKeys(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	addr := "ac_1234@chat.example"
+	if err := store.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, addr, "scram-sha-256")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SCRAMKeys(addr); !errors.Is(err, ErrNoSCRAMKeys) {
+		t.Fatalf("SCRAMKeys() without keys = %v; want %v", err, ErrNoSCRAMKeys)
+	}
+	if err := store.SetSCRAMKeys(addr, "correct horse"); err != nil {
+		t.Fatalf("SetSCRAMKeys() = %v; want nil", err)
+	}
+	keys, err := store.SCRAMKeys(addr)
+	if err != nil {
+		t.Fatalf("SCRAMKeys() after SetSCRAMKeys() = %v; want nil", err)
+	}
+	if want := DeriveSCRAMKeys("correct horse", keys.Salt, keys.Iterations); keys.String() != want.String() {
+		t.Fatalf("SCRAMKeys() after SetSCRAMKeys() = %s; want %s", keys, want)
+	}
+}
@@ -0,0 +1,257 @@
+package accounts
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memory_account is an account, or a blocked address, in a MemoryStore. An
+// address that's only blocked has no password.
+type memory_account struct {
+	password   string
+	scram_keys string
+	created    time.Time
+	last_login time.Time
+	blocked    bool
+}
+
+// MemoryStore keeps accounts in memory, for tests. Its accounts have no
+// mail.
+type MemoryStore struct {
+	mu       sync.Mutex
+	accounts map[string]*memory_account
+	// now is when accounts are created.
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{accounts: make(map[string]*memory_account), now: time.Now}
+}
+
+// account returns the account for addr, or nil if there's none. It's
+// called with mu held.
+func (s *MemoryStore) account(addr string) (*memory_account, error) {
+	if err := check_address(addr); err != nil {
+		return nil, err
+	}
+	a := s.accounts[addr]
+	if a == nil || a.password == "" {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func (s *MemoryStore) Exists(addr string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.account(addr)
+	return a != nil, err
+}
+
+func (s *MemoryStore) Create(addr string, password string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	hash, err := hash_password(password)
+	if err != nil {
+		return err
+	}
+	keys, err := NewSCRAMKeys(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[addr]
+	if a == nil {
+		a = &memory_account{}
+		s.accounts[addr] = a
+	}
+	if a.password != "" {
+		return ErrExists
+	}
+	now := s.now()
+	a.password, a.scram_keys, a.created, a.last_login = hash, keys.String(), now, now
+	return nil
+}
+
+func (s *MemoryStore) Verify(addr string, password string) error {
+	s.mu.Lock()
+	a, err := s.account(addr)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if a == nil {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	hash := a.password
+	// Checking the password is slow on purpose; don't hold up other
+	// accounts meanwhile.
+	s.mu.Unlock()
+	return check_password(hash, password)
+}
+
+func (s *MemoryStore) RecordLogin(addr string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.account(addr)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return ErrNotFound
+	}
+	a.last_login = now
+	return nil
+}
+
+func (s *MemoryStore) Delete(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.account(addr)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return ErrNotFound
+	}
+	if a.blocked {
+		s.accounts[addr] = &memory_account{blocked: true}
+	} else {
+		delete(s.accounts, addr)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Info(addr string) (Info, error) {
+	if err := check_address(addr); err != nil {
+		return Info{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[addr]
+	if a == nil {
+		return Info{}, ErrNotFound
+	}
+	return a.info(addr), nil
+}
+
+func (a *memory_account) info(addr string) Info {
+	return Info{Address: addr, Created: a.created, LastLogin: a.last_login, Blocked: a.blocked}
+}
+
+func (s *MemoryStore) Each(fn func(Info) error) error {
+	s.mu.Lock()
+	list := make([]Info, 0, len(s.accounts))
+	for addr, a := range s.accounts {
+		list = append(list, a.info(addr))
+	}
+	s.mu.Unlock()
+	slices.SortFunc(list, func(a, b Info) int { return strings.Compare(a.Address, b.Address) })
+	for _, info := range list {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, a := range s.accounts {
+		if a.password != "" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) IsBlocked(addr string) (bool, error) {
+	if err := check_address(addr); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[addr]
+	return a != nil && a.blocked, nil
+}
+
+func (s *MemoryStore) Block(addr string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[addr]
+	if a == nil {
+		a = &memory_account{}
+		s.accounts[addr] = a
+	}
+	a.blocked = true
+	return nil
+}
+
+func (s *MemoryStore) Unblock(addr string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[addr]
+	if a == nil {
+		return nil
+	}
+	a.blocked = false
+	if a.password == "" {
+		delete(s.accounts, addr)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SCRAMKeys(addr string) (SCRAMKeys, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.account(addr)
+	if err != nil {
+		return SCRAMKeys{}, err
+	}
+	if a == nil {
+		return SCRAMKeys{}, ErrNotFound
+	}
+	if a.scram_keys == "" {
+		return SCRAMKeys{}, ErrNoSCRAMKeys
+	}
+	return parse_scram_keys(a.scram_keys)
+}
+
+func (s *MemoryStore) SetSCRAMKeys(addr string, password string) error {
+	keys, err := NewSCRAMKeys(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.account(addr)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return ErrNotFound
+	}
+	a.scram_keys = keys.String()
+	return nil
+}
+
+func (s *MemoryStore) ExpireMail(addr string, cutoff time.Time) (int, error) {
+	return 0, check_address(addr)
+}
+
+func (s *MemoryStore) DiskUsage() (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,116 @@
+package accounts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SCRAM-SHA-256 (RFC 7677) keys are stored the way Dovecot writes them for
+// its {SCRAM-SHA-256} scheme: the iteration count, then the salt, StoredKey
+// and ServerKey in base64, separated by commas. Passwords aren't put
+// through SASLprep, which only changes non-ASCII passwords.
+
+const scram_scheme = "{SCRAM-SHA-256}"
+
+// SCRAMIterations is how many rounds of PBKDF2 new SCRAM keys use; 4096 is
+// what RFC 7677 asks for at least.
+const SCRAMIterations = 4096
+
+var ErrNoSCRAMKeys = errors.New("account has no SCRAM keys")
+
+// SCRAMKeys are what the server needs to check a SCRAM-SHA-256 login,
+// without being able to log in itself.
+type SCRAMKeys struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMKeys derives keys for password with a new random salt.
+func NewSCRAMKeys(password string) (SCRAMKeys, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return SCRAMKeys{}, err
+	}
+	return DeriveSCRAMKeys(password, salt, SCRAMIterations), nil
+}
+
+// SaltPassword is the SaltedPassword of RFC 5802 section 3, which SCRAM
+// clients and DeriveSCRAMKeys work out the rest from.
+func SaltPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2_sha256([]byte(password), salt, iterations)
+}
+
+// DeriveSCRAMKeys works out the keys for password with salt, as in RFC 5802
+// section 3.
+func DeriveSCRAMKeys(password string, salt []byte, iterations int) SCRAMKeys {
+	salted := SaltPassword(password, salt, iterations)
+	client_key := hmac_sha256(salted, []byte("Client Key"))
+	stored_key := sha256.Sum256(client_key)
+	return SCRAMKeys{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  stored_key[:],
+		ServerKey:  hmac_sha256(salted, []byte("Server Key")),
+	}
+}
+
+func hmac_sha256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2_sha256 is PBKDF2 (RFC 8018) with HMAC-SHA-256, for one block of
+// output, which is all that SCRAM-SHA-256 needs.
+func pbkdf2_sha256(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func (k SCRAMKeys) String() string {
+	enc := base64.StdEncoding
+	return fmt.Sprintf("%s%d,%s,%s,%s", scram_scheme, k.Iterations, enc.EncodeToString(k.Salt), enc.EncodeToString(k.StoredKey), enc.EncodeToString(k.ServerKey))
+}
+
+func parse_scram_keys(stored string) (SCRAMKeys, error) {
+	fields, found := strings.CutPrefix(stored, scram_scheme)
+	parts := strings.Split(fields, ",")
+	if !found || len(parts) != 4 {
+		return SCRAMKeys{}, fmt.Errorf("%w: %.20q", ErrUnknownCrypt, stored)
+	}
+	var keys SCRAMKeys
+	var err error
+	if keys.Iterations, err = strconv.Atoi(parts[0]); err != nil || keys.Iterations < 1 {
+		return SCRAMKeys{}, fmt.Errorf("invalid SCRAM iteration count %q", parts[0])
+	}
+	for i, field := range []*[]byte{&keys.Salt, &keys.StoredKey, &keys.ServerKey} {
+		if *field, err = base64.StdEncoding.DecodeString(parts[i+1]); err != nil {
+			return SCRAMKeys{}, fmt.Errorf("invalid SCRAM keys: %w", err)
+		}
+	}
+	if len(keys.StoredKey) != sha256.Size || len(keys.ServerKey) != sha256.Size {
+		return SCRAMKeys{}, errors.New("invalid SCRAM keys: wrong length")
+	}
+	return keys, nil
+}
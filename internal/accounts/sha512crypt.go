@@ -0,0 +1,144 @@
+package accounts
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Implementation of the SHA-512 variant of crypt(3) as described in
+// https://www.akkadia.org/drepper/SHA-crypt.txt. This is the scheme the
+// upstream Python chatmail uses for its password files, and one that Dovecot
+// understands as {SHA512-CRYPT}.
+
+const crypt_alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	sha512_crypt_prefix         = "$6$"
+	sha512_crypt_rounds_prefix  = "rounds="
+	sha512_crypt_default_rounds = 5000
+	sha512_crypt_min_rounds     = 1000
+	sha512_crypt_max_rounds     = 999999999
+	sha512_crypt_max_salt_len   = 16
+)
+
+// Order in which the bytes of the final digest are shuffled into the output.
+var sha512_crypt_permutation = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+func crypt_b64(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(crypt_alphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+func repeat_to_len(digest []byte, n int) []byte {
+	result := make([]byte, 0, n)
+	for len(result)+len(digest) < n {
+		result = append(result, digest...)
+	}
+	return append(result, digest[:n-len(result)]...)
+}
+
+// sha512_crypt hashes password with the given settings string, which is
+// either a complete hash (to verify against it) or just "$6$[rounds=N$]salt".
+func sha512_crypt(password []byte, setting string) (string, error) {
+	if !strings.HasPrefix(setting, sha512_crypt_prefix) {
+		return "", fmt.Errorf("not a SHA512-CRYPT setting: %q", setting)
+	}
+	rest := setting[len(sha512_crypt_prefix):]
+	rounds := sha512_crypt_default_rounds
+	custom_rounds := false
+	if strings.HasPrefix(rest, sha512_crypt_rounds_prefix) {
+		rounds_str, after, found := strings.Cut(rest[len(sha512_crypt_rounds_prefix):], "$")
+		if !found {
+			return "", fmt.Errorf("malformed rounds in SHA512-CRYPT setting: %q", setting)
+		}
+		n, err := strconv.Atoi(rounds_str)
+		if err != nil {
+			return "", fmt.Errorf("malformed rounds in SHA512-CRYPT setting: %q", setting)
+		}
+		rounds = min(max(n, sha512_crypt_min_rounds), sha512_crypt_max_rounds)
+		custom_rounds = true
+		rest = after
+	}
+	salt_str, _, _ := strings.Cut(rest, "$")
+	if len(salt_str) > sha512_crypt_max_salt_len {
+		salt_str = salt_str[:sha512_crypt_max_salt_len]
+	}
+	salt := []byte(salt_str)
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	digest_b := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(salt)
+	a.Write(repeat_to_len(digest_b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(digest_b)
+		} else {
+			a.Write(password)
+		}
+	}
+	digest_a := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(password) {
+		dp.Write(password)
+	}
+	p_seq := repeat_to_len(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for range 16 + int(digest_a[0]) {
+		ds.Write(salt)
+	}
+	s_seq := repeat_to_len(ds.Sum(nil), len(salt))
+
+	prev := digest_a
+	for i := range rounds {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p_seq)
+		} else {
+			c.Write(prev)
+		}
+		if i%3 != 0 {
+			c.Write(s_seq)
+		}
+		if i%7 != 0 {
+			c.Write(p_seq)
+		}
+		if i&1 != 0 {
+			c.Write(prev)
+		} else {
+			c.Write(p_seq)
+		}
+		prev = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512_crypt_prefix)
+	if custom_rounds {
+		fmt.Fprintf(&out, "%s%d$", sha512_crypt_rounds_prefix, rounds)
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+	for _, p := range sha512_crypt_permutation {
+		crypt_b64(&out, prev[p[0]], prev[p[1]], prev[p[2]], 4)
+	}
+	crypt_b64(&out, 0, 0, prev[63], 2)
+	return out.String(), nil
+}
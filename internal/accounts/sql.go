@@ -0,0 +1,337 @@
+package accounts
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sql_schema = `
+CREATE TABLE IF NOT EXISTS accounts (
+	address TEXT PRIMARY KEY,
+	-- NULL for addresses that are only blocked.
+	password TEXT,
+	scram_sha_256 TEXT,
+	-- Unix times in nanoseconds.
+	created INTEGER,
+	last_login INTEGER,
+	blocked INTEGER NOT NULL DEFAULT 0
+)`
+
+// SQLStore keeps accounts in an SQLite database, with the same password
+// hashes as FileStore. The mail of its accounts is still kept in Maildirs,
+// in the same place as FileStore keeps it.
+type SQLStore struct {
+	db *sql.DB
+	// mail_dir has one Maildir per account.
+	mail_dir string
+	// now is when accounts are created.
+	now func() time.Time
+}
+
+// OpenSQLStore opens the SQLite database at path, and creates it if there
+// isn't one. The accounts' Maildirs are in mail_dir.
+func OpenSQLStore(path string, mail_dir string) (*SQLStore, error) {
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Opaque:   url.PathEscape(path),
+		RawQuery: "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+	}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has one writer at a time anyway; sharing one connection
+	// keeps transactions from failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sql_schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up account database %s: %w", path, err)
+	}
+	return &SQLStore{db, mail_dir, time.Now}, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func from_unix_nano(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64)
+}
+
+// password returns the password hash of addr, or ErrNotFound.
+func (s *SQLStore) password(addr string) (string, error) {
+	if err := check_address(addr); err != nil {
+		return "", err
+	}
+	var hash sql.NullString
+	err := s.db.QueryRow("SELECT password FROM accounts WHERE address = ?", addr).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !hash.Valid) {
+		return "", ErrNotFound
+	}
+	return hash.String, err
+}
+
+func (s *SQLStore) Exists(addr string) (bool, error) {
+	_, err := s.password(addr)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLStore) Create(addr string, password string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	hash, err := hash_password(password)
+	if err != nil {
+		return err
+	}
+	keys, err := NewSCRAMKeys(password)
+	if err != nil {
+		return err
+	}
+	now := s.now().UnixNano()
+	// Blocked addresses already have a row, which gets the account unless it
+	// already has one.
+	result, err := s.db.Exec(`INSERT INTO accounts (address, password, scram_sha_256, created, last_login)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (address) DO UPDATE SET
+			password = excluded.password, scram_sha_256 = excluded.scram_sha_256,
+			created = excluded.created, last_login = excluded.last_login
+		WHERE password IS NULL`, addr, hash, keys.String(), now, now)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) Verify(addr string, password string) error {
+	hash, err := s.password(addr)
+	if err != nil {
+		return err
+	}
+	return check_password(hash, password)
+}
+
+// update runs query, which changes the account for addr, and returns
+// ErrNotFound if there isn't one.
+func (s *SQLStore) update(addr string, query string, args ...any) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	result, err := s.db.Exec(query, append(args, addr)...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+func (s *SQLStore) RecordLogin(addr string, now time.Time) error {
+	return s.update(addr, "UPDATE accounts SET last_login = ? WHERE address = ? AND password IS NOT NULL", now.UnixNano())
+}
+
+func (s *SQLStore) Delete(addr string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	deleted, err := tx.Exec("DELETE FROM accounts WHERE address = ? AND password IS NOT NULL AND NOT blocked", addr)
+	if err != nil {
+		return err
+	}
+	// Blocked addresses keep their row, without the account.
+	emptied, err := tx.Exec(`UPDATE accounts SET password = NULL, scram_sha_256 = NULL, created = NULL, last_login = NULL
+		WHERE address = ? AND password IS NOT NULL`, addr)
+	if err != nil {
+		return err
+	}
+	n, err := deleted.RowsAffected()
+	if err != nil {
+		return err
+	}
+	m, err := emptied.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n+m == 0 {
+		return ErrNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.mail_dir, addr))
+}
+
+type sql_row interface {
+	Scan(dest ...any) error
+}
+
+func scan_info(row sql_row) (Info, error) {
+	var info Info
+	var created, last_login sql.NullInt64
+	if err := row.Scan(&info.Address, &created, &last_login, &info.Blocked); err != nil {
+		return Info{}, err
+	}
+	info.Created = from_unix_nano(created)
+	info.LastLogin = from_unix_nano(last_login)
+	return info, nil
+}
+
+// with_mailbox adds the size of the account's Maildir to info.
+func (s *SQLStore) with_mailbox(info Info, err error) (Info, error) {
+	if err != nil {
+		return Info{}, err
+	}
+	info.MailboxBytes, err = dir_size(filepath.Join(s.mail_dir, info.Address))
+	return info, err
+}
+
+func (s *SQLStore) Info(addr string) (Info, error) {
+	if err := check_address(addr); err != nil {
+		return Info{}, err
+	}
+	info, err := s.with_mailbox(scan_info(s.db.QueryRow("SELECT address, created, last_login, blocked FROM accounts WHERE address = ?", addr)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Info{}, ErrNotFound
+	}
+	return info, err
+}
+
+func (s *SQLStore) Each(fn func(Info) error) error {
+	// Read everything first, so that fn can use the store too.
+	rows, err := s.db.Query("SELECT address, created, last_login, blocked FROM accounts ORDER BY address")
+	if err != nil {
+		return err
+	}
+	var list []Info
+	for rows.Next() {
+		info, err := scan_info(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, info)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, info := range list {
+		info, err := s.with_mailbox(info, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) Count() (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT count(*) FROM accounts WHERE password IS NOT NULL").Scan(&count)
+	return count, err
+}
+
+func (s *SQLStore) IsBlocked(addr string) (bool, error) {
+	if err := check_address(addr); err != nil {
+		return false, err
+	}
+	var blocked bool
+	err := s.db.QueryRow("SELECT blocked FROM accounts WHERE address = ?", addr).Scan(&blocked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return blocked, err
+}
+
+func (s *SQLStore) Block(addr string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("INSERT INTO accounts (address, blocked) VALUES (?, 1) ON CONFLICT (address) DO UPDATE SET blocked = 1", addr)
+	return err
+}
+
+func (s *SQLStore) Unblock(addr string) error {
+	if err := check_address(addr); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE accounts SET blocked = 0 WHERE address = ?", addr); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM accounts WHERE address = ? AND password IS NULL", addr); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) SCRAMKeys(addr string) (SCRAMKeys, error) {
+	if err := check_address(addr); err != nil {
+		return SCRAMKeys{}, err
+	}
+	var hash, keys sql.NullString
+	err := s.db.QueryRow("SELECT password, scram_sha_256 FROM accounts WHERE address = ?", addr).Scan(&hash, &keys)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !hash.Valid) {
+		return SCRAMKeys{}, ErrNotFound
+	}
+	if err != nil {
+		return SCRAMKeys{}, err
+	}
+	if !keys.Valid {
+		return SCRAMKeys{}, ErrNoSCRAMKeys
+	}
+	return parse_scram_keys(keys.String)
+}
+
+func (s *SQLStore) SetSCRAMKeys(addr string, password string) error {
+	keys, err := NewSCRAMKeys(password)
+	if err != nil {
+		return err
+	}
+	return s.update(addr, "UPDATE accounts SET scram_sha_256 = ? WHERE address = ? AND password IS NOT NULL", keys.String())
+}
+
+func (s *SQLStore) ExpireMail(addr string, cutoff time.Time) (int, error) {
+	if err := check_address(addr); err != nil {
+		return 0, err
+	}
+	return expire_maildir(filepath.Join(s.mail_dir, addr), cutoff)
+}
+
+func (s *SQLStore) DiskUsage() (int64, error) {
+	return dir_size(s.mail_dir)
+}
@@ -0,0 +1,74 @@
+package accounts
+
+import (
+	"strings"
+	"time"
+)
+
+// Store keeps the accounts of a chatmail server: their passwords, whether
+// they're blocked, when they were made and last logged in, and their mail.
+// Addresses are compared exactly, so callers pass them through
+// CanonicalAddress first.
+//
+// FileStore keeps them in the upstream chatmail layout, SQLStore in an
+// SQLite database next to the Maildirs, and MemoryStore nowhere, for tests.
+type Store interface {
+	Exists(addr string) (bool, error)
+	// Create makes a new account with the given password, or returns
+	// ErrExists if there already is one. Only one of several concurrent
+	// Creates for the same address succeeds.
+	Create(addr string, password string) error
+	// Verify checks password, and returns ErrNotFound or ErrBadPassword if
+	// it's not right.
+	Verify(addr string, password string) error
+	// RecordLogin notes that addr logged in at now.
+	RecordLogin(addr string, now time.Time) error
+	// Delete removes the account for addr along with all of its mail. A
+	// blocked address stays blocked, so that it can't simply be created
+	// again.
+	Delete(addr string) error
+	// Info describes the account for addr, which has to exist or be
+	// blocked.
+	Info(addr string) (Info, error)
+	// Each calls fn for every account, and every blocked address, sorted by
+	// address, until it returns an error.
+	Each(fn func(Info) error) error
+	// Count returns how many accounts there are, not counting addresses
+	// that are only blocked.
+	Count() (int, error)
+
+	// IsBlocked reports whether addr has been blocked, whether or not
+	// there's an account for it.
+	IsBlocked(addr string) (bool, error)
+	// Block stops addr from logging in, and from being created if there's
+	// no account for it yet.
+	Block(addr string) error
+	// Unblock undoes Block. Unblocking an address that isn't blocked does
+	// nothing.
+	Unblock(addr string) error
+
+	// SCRAMKeys returns the stored SCRAM-SHA-256 keys of addr, or
+	// ErrNoSCRAMKeys if the account was made before they were stored.
+	SCRAMKeys(addr string) (SCRAMKeys, error)
+	// SetSCRAMKeys stores new SCRAM-SHA-256 keys for password, which should
+	// have just been checked with Verify.
+	SetSCRAMKeys(addr string, password string) error
+
+	// ExpireMail removes the messages of addr that arrived before cutoff,
+	// and returns how many there were.
+	ExpireMail(addr string, cutoff time.Time) (int, error)
+	// DiskUsage adds up the sizes of all of the mailboxes.
+	DiskUsage() (int64, error)
+}
+
+var (
+	_ Store = (*FileStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*SQLStore)(nil)
+)
+
+// CanonicalAddress is the spelling of addr that accounts are stored under,
+// so that Alice@ and alice@ are the same account.
+func CanonicalAddress(addr string) string {
+	return strings.ToLower(addr)
+}
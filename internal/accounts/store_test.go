@@ -0,0 +1,392 @@
+package accounts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// store_backends are the Store implementations that every test in
+// test_store runs against.
+var store_backends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+	{"file", func(t *testing.T) Store { return NewFileStore(filepath.Join(t.TempDir(), "mail")) }},
+	{"sql", func(t *testing.T) Store {
+		dir := t.TempDir()
+		s, err := OpenSQLStore(filepath.Join(dir, "accounts.sqlite"), filepath.Join(dir, "mail"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"CreateAndVerify", test_store_create_and_verify},
+		{"InvalidAddresses", test_store_invalid_addresses},
+		{"RecordLogin", test_store_record_login},
+		{"BlockAndDelete", test_store_block_and_delete},
+		{"EachAndCount", test_store_each_and_count},
+		{"SCRAMKeys", test_store_scram_keys},
+		{"ConcurrentCreate", test_store_concurrent_create},
+		{"ConcurrentUse", test_store_concurrent_use},
+	}
+	for _, backend := range store_backends {
+		for _, test := range tests {
+			t.Run(backend.name+"/"+test.name, func(t *testing.T) {
+				test.test(t, backend.open(t))
+			})
+		}
+	}
+}
+
+func test_store_create_and_verify(t *testing.T, s Store) {
+	addr := "ac_1234@chat.example"
+	if exists, err := s.Exists(addr); err != nil || exists {
+		t.Fatalf("Exists() before creation = %t, %v; want false, nil", exists, err)
+	}
+	if err := s.Verify(addr, "correct horse"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Verify() before creation = %v; want %v", err, ErrNotFound)
+	}
+	if _, err := s.Info(addr); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Info() before creation = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.Create(addr, "correct horse"); err != nil {
+		t.Fatalf("Create() = %v; want nil", err)
+	}
+	if err := s.Create(addr, "battery staple"); !errors.Is(err, ErrExists) {
+		t.Fatalf("second Create() = %v; want %v", err, ErrExists)
+	}
+	if exists, err := s.Exists(addr); err != nil || !exists {
+		t.Fatalf("Exists() after creation = %t, %v; want true, nil", exists, err)
+	}
+	if err := s.Verify(addr, "correct horse"); err != nil {
+		t.Fatalf("Verify() with right password = %v; want nil", err)
+	}
+	if err := s.Verify(addr, "battery staple"); !errors.Is(err, ErrBadPassword) {
+		t.Fatalf("Verify() with wrong password = %v; want %v", err, ErrBadPassword)
+	}
+	info, err := s.Info(addr)
+	if err != nil || info.Address != addr || info.Created.IsZero() || info.Blocked {
+		t.Fatalf("Info() = %+v, %v; want a new, unblocked account", info, err)
+	}
+}
+
+func test_store_invalid_addresses(t *testing.T, s Store) {
+	for _, addr := range []string{"", ".", "..", "../etc@chat.example", "a/b@chat.example"} {
+		if err := s.Create(addr, "password"); !errors.Is(err, ErrInvalidAddr) {
+			t.Errorf("Create(%q) = %v; want %v", addr, err, ErrInvalidAddr)
+		}
+		if err := s.Block(addr); !errors.Is(err, ErrInvalidAddr) {
+			t.Errorf("Block(%q) = %v; want %v", addr, err, ErrInvalidAddr)
+		}
+	}
+}
+
+func test_store_record_login(t *testing.T, s Store) {
+	addr := "ac_1234@chat.example"
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.RecordLogin(addr, now); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RecordLogin() before creation = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordLogin(addr, now); err != nil {
+		t.Fatalf("RecordLogin() = %v; want nil", err)
+	}
+	if info, err := s.Info(addr); err != nil || !info.LastLogin.Equal(now) {
+		t.Fatalf("last login = %v, %v; want %v", info.LastLogin, err, now)
+	}
+	// Logging in doesn't change the password.
+	if err := s.Verify(addr, "correct horse"); err != nil {
+		t.Fatalf("Verify() after RecordLogin() = %v; want nil", err)
+	}
+}
+
+func test_store_block_and_delete(t *testing.T, s Store) {
+	addr := "ac_1234@chat.example"
+	if err := s.Delete(addr); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Delete() before creation = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Block(addr); err != nil {
+		t.Fatalf("Block() = %v; want nil", err)
+	}
+	if blocked, err := s.IsBlocked(addr); err != nil || !blocked {
+		t.Fatalf("IsBlocked() after Block() = %t, %v; want true, nil", blocked, err)
+	}
+	if err := s.Delete(addr); err != nil {
+		t.Fatalf("Delete() = %v; want nil", err)
+	}
+	if exists, err := s.Exists(addr); err != nil || exists {
+		t.Fatalf("Exists() after Delete() = %t, %v; want false, nil", exists, err)
+	}
+	// A deleted account that was blocked stays blocked.
+	if blocked, err := s.IsBlocked(addr); err != nil || !blocked {
+		t.Fatalf("IsBlocked() after Delete() = %t, %v; want true, nil", blocked, err)
+	}
+	if info, err := s.Info(addr); err != nil || !info.Blocked || !info.Created.IsZero() {
+		t.Fatalf("Info() of a blocked address = %+v, %v; want only blocked", info, err)
+	}
+	if err := s.Delete(addr); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Delete() of a blocked address = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.Unblock(addr); err != nil {
+		t.Fatalf("Unblock() = %v; want nil", err)
+	}
+	if _, err := s.Info(addr); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Info() after Unblock() = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.Unblock(addr); err != nil {
+		t.Fatalf("Unblock() of an address that isn't blocked = %v; want nil", err)
+	}
+
+	// Blocking an address that has no account yet doesn't make one, and
+	// it can still be created, for whoever is allowed to decide.
+	other := "ac_5678@chat.example"
+	if err := s.Block(other); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := s.Exists(other); err != nil || exists {
+		t.Fatalf("Exists() of a blocked address = %t, %v; want false, nil", exists, err)
+	}
+	if err := s.Create(other, "correct horse"); err != nil {
+		t.Fatalf("Create() of a blocked address = %v; want nil", err)
+	}
+	if blocked, err := s.IsBlocked(other); err != nil || !blocked {
+		t.Fatalf("IsBlocked() after Create() = %t, %v; want true, nil", blocked, err)
+	}
+	if err := s.Unblock(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(other, "correct horse"); err != nil {
+		t.Fatalf("Verify() after Unblock() = %v; want nil", err)
+	}
+}
+
+func test_store_each_and_count(t *testing.T, s Store) {
+	if count, err := s.Count(); err != nil || count != 0 {
+		t.Fatalf("Count() of an empty store = %d, %v; want 0, nil", count, err)
+	}
+	for _, addr := range []string{"ac_3@chat.example", "ac_1@chat.example"} {
+		if err := s.Create(addr, "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Block("ac_2@chat.example"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := s.Count(); err != nil || count != 2 {
+		t.Fatalf("Count() = %d, %v; want 2, nil", count, err)
+	}
+	var got []string
+	err := s.Each(func(info Info) error {
+		got = append(got, fmt.Sprintf("%s %t", info.Address, info.Blocked))
+		// The store can be used while iterating.
+		_, err := s.Exists(info.Address)
+		return err
+	})
+	want := []string{"ac_1@chat.example false", "ac_2@chat.example true", "ac_3@chat.example false"}
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Each() visited %q, %v; want %q, nil", got, err, want)
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err = s.Each(func(Info) error {
+		visited++
+		return stop
+	})
+	if !errors.Is(err, stop) || visited != 1 {
+		t.Fatalf("Each() stopping early = %v after %d; want %v after 1", err, visited, stop)
+	}
+}
+
+func test_store_scram_keys(t *testing.T, s Store) {
+	addr := "ac_1234@chat.example"
+	if _, err := s.SCRAMKeys(addr); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SCRAMKeys() before creation = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.SetSCRAMKeys(addr, "correct horse"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetSCRAMKeys() before creation = %v; want %v", err, ErrNotFound)
+	}
+	if err := s.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.SCRAMKeys(addr)
+	if err != nil {
+		t.Fatalf("SCRAMKeys() = %v; want nil", err)
+	}
+	if want := DeriveSCRAMKeys("correct horse", keys.Salt, keys.Iterations); keys.String() != want.String() {
+		t.Fatalf("SCRAMKeys() = %s; want %s", keys, want)
+	}
+	if err := s.SetSCRAMKeys(addr, "correct horse"); err != nil {
+		t.Fatalf("SetSCRAMKeys() = %v; want nil", err)
+	}
+	new_keys, err := s.SCRAMKeys(addr)
+	if err != nil || string(new_keys.Salt) == string(keys.Salt) {
+		t.Fatalf("SCRAMKeys() after SetSCRAMKeys() = %s, %v; want keys with a new salt", new_keys, err)
+	}
+}
+
+// test_store_concurrent_create checks that only one of several racing
+// creations of the same account wins, and that the winner's password is
+// the one that counts.
+func test_store_concurrent_create(t *testing.T, s Store) {
+	const racers = 8
+	addr := "ac_1234@chat.example"
+	errs := make([]error, racers)
+	var wg sync.WaitGroup
+	for i := range racers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Create(addr, fmt.Sprintf("password %d", i))
+		}()
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner < 0:
+			winner = i
+		case err == nil:
+			t.Fatalf("Create() succeeded for racers %d and %d", winner, i)
+		case !errors.Is(err, ErrExists):
+			t.Fatalf("Create() for racer %d = %v; want nil or %v", i, err, ErrExists)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no racer created the account")
+	}
+	for i := range racers {
+		err := s.Verify(addr, fmt.Sprintf("password %d", i))
+		if (i == winner) != (err == nil) {
+			t.Fatalf("Verify() with racer %d's password = %v; racer %d won", i, err, winner)
+		}
+	}
+	if count, err := s.Count(); err != nil || count != 1 {
+		t.Fatalf("Count() after racing = %d, %v; want 1, nil", count, err)
+	}
+}
+
+// test_store_concurrent_use creates, logs in to and deletes different
+// accounts at the same time.
+func test_store_concurrent_use(t *testing.T, s Store) {
+	const workers = 8
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr := fmt.Sprintf("ac_%d@chat.example", i)
+			for _, step := range []func() error{
+				func() error { return s.Create(addr, "correct horse") },
+				func() error { return s.Verify(addr, "correct horse") },
+				func() error { return s.RecordLogin(addr, time.Now()) },
+				func() error { return s.SetSCRAMKeys(addr, "correct horse") },
+				func() error { _, err := s.Count(); return err },
+				func() error { return s.Each(func(Info) error { return nil }) },
+				func() error {
+					if i%2 == 0 {
+						return s.Delete(addr)
+					}
+					return nil
+				},
+			} {
+				if err := step(); err != nil {
+					errs <- fmt.Errorf("%s: %w", addr, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if count, err := s.Count(); err != nil || count != workers/2 {
+		t.Fatalf("Count() = %d, %v; want %d, nil", count, err, workers/2)
+	}
+}
+
+func TestSQLStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "accounts.sqlite")
+	s, err := OpenSQLStore(path, filepath.Join(dir, "mail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create("ac_1234@chat.example", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSQLStore(path, filepath.Join(dir, "mail"))
+	if err != nil {
+		t.Fatalf("OpenSQLStore() of an existing database = %v; want nil", err)
+	}
+	defer s.Close()
+	if err := s.Verify("ac_1234@chat.example", "correct horse"); err != nil {
+		t.Fatalf("Verify() after reopening = %v; want nil", err)
+	}
+}
+
+func TestSQLStoreMail(t *testing.T) {
+	dir := t.TempDir()
+	mail_dir := filepath.Join(dir, "mail")
+	s, err := OpenSQLStore(filepath.Join(dir, "accounts.sqlite"), mail_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := "ac_1@chat.example"
+	if err := s.Create(addr, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	write_message(t, filepath.Join(mail_dir, addr, "cur/1.eml"), 100, cutoff.Add(-time.Hour))
+	write_message(t, filepath.Join(mail_dir, addr, "new/2.eml"), 50, cutoff)
+
+	if info, err := s.Info(addr); err != nil || info.MailboxBytes != 150 {
+		t.Fatalf("Info().MailboxBytes = %d, %v; want 150, nil", info.MailboxBytes, err)
+	}
+	var each int64
+	if err := s.Each(func(info Info) error { each += info.MailboxBytes; return nil }); err != nil || each != 150 {
+		t.Fatalf("Each() mailbox sizes add up to %d, %v; want 150, nil", each, err)
+	}
+	if usage, err := s.DiskUsage(); err != nil || usage != 150 {
+		t.Fatalf("DiskUsage() = %d, %v; want 150, nil", usage, err)
+	}
+	if removed, err := s.ExpireMail(addr, cutoff); err != nil || removed != 1 {
+		t.Fatalf("ExpireMail() = %d, %v; want 1, nil", removed, err)
+	}
+	if usage, err := s.DiskUsage(); err != nil || usage != 50 {
+		t.Fatalf("DiskUsage() after expiring = %d, %v; want 50, nil", usage, err)
+	}
+	if err := s.Delete(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(mail_dir, addr)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Delete() left the Maildir behind (err = %v)", err)
+	}
+}
@@ -1,11 +1,14 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
 )
 
 type ChatmailConfig struct {
+	ConfigVersion                   int
 	MailFullyQualifiedDomainName    string
 	MaxEmailsPerMinutePerUser       int
 	MaxMailboxSizeMB                int
@@ -21,30 +24,77 @@ type ChatmailConfig struct {
 	PrivacyContactEmailAddress      string
 	PrivacyDataOfficerPostalAddress string
 	PrivacySupervisorPostalAddress  string
+	MailboxesDirectory              string
+	InviteOnly                      bool
+	InviteTokensFile                string
+	MilterListenAddress             string
+	SASLListenAddress               string
+	TLSCertificateFile              string
+	TLSKeyFile                      string
+	DKIMKeyDirectory                string
+	MetricsListenAddress            string
+	LogLevel                        string
+	LogFormat                       string
+	LogSaltFile                     string
+	MilterMonitorOnly               bool
+	MilterMonitorOnlyDomains        []string
+	AdminListenAddress              string
+	ReservedUsernames               []string
+	OperatorMailbox                 string
+	AllowUnicodeUsernames           bool
+	LoginFailuresPerIP              int
+	LoginFailuresPerAccount         int
+	LoginLockoutSeconds             int
+	LoginMaxLockoutSeconds          int
+	AccountDatabaseFile             string
 }
 
 func NewChatmailConfig(fqdn string) ChatmailConfig {
 	return ChatmailConfig{
-		fqdn,
-		30,
-		100,
-		31457280,
-		20,
-		90,
-		9,
-		9,
-		9,
-		[]string{},
-		[]string{"xstore@testrun.org"},
-		"",
-		"",
-		"",
-		"",
+		ConfigVersion:                   CurrentVersion,
+		MailFullyQualifiedDomainName:    fqdn,
+		MaxEmailsPerMinutePerUser:       30,
+		MaxMailboxSizeMB:                100,
+		MaxMessageSizeB:                 31457280,
+		DeleteMailsAfterDays:            20,
+		DeleteInactiveUsersAfterDays:    90,
+		UsernameMinLength:               9,
+		UsernameMaxLength:               9,
+		PasswordMinLength:               9,
+		PassthroughSendersList:          []string{},
+		PassthroughRecipientsList:       []string{"xstore@testrun.org"},
+		PrivacyContactPostalAddress:     "",
+		PrivacyContactEmailAddress:      "",
+		PrivacyDataOfficerPostalAddress: "",
+		PrivacySupervisorPostalAddress:  "",
+		MailboxesDirectory:              "/home/vmail/mail/" + fqdn,
+		InviteOnly:                      false,
+		InviteTokensFile:                "/var/lib/chatmail/invites.json",
+		MilterListenAddress:             "unix:///run/chatmail/milter.sock",
+		SASLListenAddress:               "unix:///run/chatmail/sasl.sock",
+		TLSCertificateFile:              "/var/lib/chatmail/tls/fullchain.pem",
+		TLSKeyFile:                      "/var/lib/chatmail/tls/privkey.pem",
+		DKIMKeyDirectory:                "/etc/chatmail/dkim",
+		MetricsListenAddress:            "",
+		LogLevel:                        "info",
+		LogFormat:                       "text",
+		LogSaltFile:                     "/var/lib/chatmail/log-salt",
+		MilterMonitorOnly:               false,
+		MilterMonitorOnlyDomains:        []string{},
+		AdminListenAddress:              "unix:///run/chatmail/admin.sock?mode=0600",
+		ReservedUsernames:               []string{"admin*", "root", "mailer-daemon", "nobody", "no-reply", "noreply"},
+		OperatorMailbox:                 "",
+		AllowUnicodeUsernames:           false,
+		LoginFailuresPerIP:              10,
+		LoginFailuresPerAccount:         50,
+		LoginLockoutSeconds:             60,
+		LoginMaxLockoutSeconds:          3600,
+		AccountDatabaseFile:             "",
 	}
 }
 
 func (config ChatmailConfig) Save(filename string) error {
-	output_txt, m_err := json.MarshalIndent(config, "", "  ")
+	output_txt, m_err := marshal_config(config)
 	if m_err != nil {
 		return m_err
 	}
@@ -58,14 +108,28 @@ func (config ChatmailConfig) Save(filename string) error {
 	return err
 }
 
+func decode_config(data []byte, config *ChatmailConfig) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+// LoadChatmailConfigFromFile reads filename into config, migrating it to the
+// current version in memory if it's older; the file itself is only changed
+// by MigrateFile. Keys that config doesn't have are an error, since they're
+// most likely typos.
 func LoadChatmailConfigFromFile(filename string, config *ChatmailConfig) error {
-	data, r_err := os.ReadFile(filename)
+	original, r_err := os.ReadFile(filename)
 	if r_err != nil {
 		return r_err
 	}
-	j_err := json.Unmarshal(data, config)
+	data, _, m_err := Migrate(original)
+	if m_err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", filename, m_err)
+	}
+	j_err := decode_config(data, config)
 	if j_err != nil {
-		return j_err
+		return fmt.Errorf("failed to load %s: %w", filename, j_err)
 	}
 	return nil
 }
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDefaults(t *testing.T) {
+	if err := NewChatmailConfig("chat.example").Validate(); err != nil {
+		t.Fatalf("Validate() of the defaults = %v; want nil", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := NewChatmailConfig("Not A Domain")
+	config.MaxMessageSizeB = -1
+	config.UsernameMinLength = 12
+	config.UsernameMaxLength = 10
+	config.MaxMailboxSizeMB = 1
+	config.PassthroughSendersList = []string{"Someone <someone@example.org>"}
+	config.PrivacyContactEmailAddress = "nobody"
+	config.MailboxesDirectory = "mail"
+	config.InviteOnly = true
+	config.InviteTokensFile = ""
+	config.MilterListenAddress = "udp://127.0.0.1:1234"
+	config.TLSKeyFile = ""
+	config.MilterMonitorOnlyDomains = []string{"@example.org"}
+	config.AdminListenAddress = "tcp://127.0.0.1:9742"
+	config.ReservedUsernames = []string{"staff-[", "admin@example.org"}
+	config.OperatorMailbox = "operator"
+	config.LoginFailuresPerAccount = -1
+	config.LoginMaxLockoutSeconds = 30
+	config.AccountDatabaseFile = "accounts.sqlite"
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("Validate() = nil; want errors")
+	}
+	for _, want := range []string{
+		`MailFullyQualifiedDomainName: "Not A Domain"`,
+		"MaxMessageSizeB: must be at least 1, not -1",
+		"UsernameMinLength: 12 is more than UsernameMaxLength (10)",
+		`PassthroughSendersList: "Someone <someone@example.org>" is not an email address`,
+		`PrivacyContactEmailAddress: "nobody"`,
+		`MailboxesDirectory: "mail" is not an absolute path`,
+		"InviteTokensFile: must be set when InviteOnly is true",
+		`MilterListenAddress: "udp://127.0.0.1:1234" has unsupported scheme "udp"`,
+		"TLSKeyFile: must be set",
+		`MilterMonitorOnlyDomains: "@example.org" is not a domain name`,
+		`AdminListenAddress: "tcp://127.0.0.1:9742" has to be a unix:// or systemd:// socket`,
+		`ReservedUsernames: "staff-[" is not a pattern`,
+		`ReservedUsernames: "admin@example.org" is not a pattern`,
+		`OperatorMailbox: "operator" is not an email address`,
+		"LoginFailuresPerAccount: can't be negative",
+		"LoginMaxLockoutSeconds: 30 is less than LoginLockoutSeconds (60)",
+		`AccountDatabaseFile: "accounts.sqlite" is not an absolute path`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v; want it to mention %q", err, want)
+		}
+	}
+
+	config = NewChatmailConfig("chat.example")
+	config.MaxMailboxSizeMB = 10
+	config.MaxMessageSizeB = 11 * 1024 * 1024
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "bigger than the whole mailbox") {
+		t.Fatalf("Validate() with a message bigger than the mailbox = %v; want error", err)
+	}
+
+	config = NewChatmailConfig("chat.example")
+	config.OperatorMailbox = "Abuse@chat.example"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "role addresses") {
+		t.Fatalf("Validate() with a role address as OperatorMailbox = %v; want error", err)
+	}
+}
+
+func TestIsDomainName(t *testing.T) {
+	tests := map[string]bool{
+		"chat.example":                   true,
+		"c-1.chat.example":               true,
+		"chat":                           false,
+		"chat.example.":                  false,
+		"Chat.example":                   false,
+		"-chat.example":                  false,
+		"chat..example":                  false,
+		"chat_example.org":               false,
+		strings.Repeat("a", 64) + ".org": false,
+	}
+	for name, want := range tests {
+		if got := IsDomainName(name); got != want {
+			t.Errorf("IsDomainName(%q) = %v; want %v", name, got, want)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	config := NewChatmailConfig("chat.example")
+	if got := len(config.Warnings()); got != 4 {
+		t.Fatalf("len(Warnings()) without privacy contacts = %d; want 4", got)
+	}
+	config.PrivacyContactPostalAddress = "1 Example Street"
+	config.PrivacyContactEmailAddress = "operator@example.org"
+	config.PrivacyDataOfficerPostalAddress = "2 Example Street"
+	config.PrivacySupervisorPostalAddress = "3 Example Street"
+	if got := config.Warnings(); len(got) != 0 {
+		t.Fatalf("Warnings() with privacy contacts = %v; want none", got)
+	}
+	config.LoginFailuresPerAccount = config.LoginFailuresPerIP - 1
+	if got := config.Warnings(); len(got) != 1 || !strings.Contains(got[0], "LoginFailuresPerAccount") {
+		t.Fatalf("Warnings() with a stricter per-account login limit = %v; want a warning about it", got)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "chatmail.json")
+	if err := NewChatmailConfig("chat.example").Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	var config ChatmailConfig
+	if err := LoadChatmailConfigFromFile(filename, &config); err != nil {
+		t.Fatalf("LoadChatmailConfigFromFile() of a saved config = %v; want nil", err)
+	}
+
+	typo := `{"MailFullyQualifiedDomainName": "chat.example", "MaxMailboxSizeMiB": 50}`
+	if err := os.WriteFile(filename, []byte(typo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := LoadChatmailConfigFromFile(filename, &config)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "MaxMailboxSizeMiB"`) {
+		t.Fatalf("LoadChatmailConfigFromFile() with a typo = %v; want unknown field error", err)
+	}
+}
@@ -0,0 +1,270 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix starts the names of the environment variables that override
+// configuration fields.
+const EnvPrefix = "CHATMAIL_"
+
+// Layer says where a configuration value came from. Later layers win.
+type Layer int
+
+const (
+	LayerDefault Layer = iota
+	LayerFile
+	LayerEnv
+	LayerFlag
+)
+
+func (l Layer) String() string {
+	switch l {
+	case LayerDefault:
+		return "default"
+	case LayerFile:
+		return "file"
+	case LayerEnv:
+		return "env"
+	default:
+		return "flag"
+	}
+}
+
+// Source is where one field's value came from: the layer, and the file,
+// variable or flag within it.
+type Source struct {
+	Layer Layer
+	Name  string
+}
+
+func (s Source) String() string {
+	if s.Name == "" {
+		return s.Layer.String()
+	}
+	return s.Layer.String() + " " + s.Name
+}
+
+// Sources maps field names to where their values came from.
+type Sources map[string]Source
+
+// FieldNames lists the fields that can be overridden, in the order they're
+// declared. ConfigVersion isn't one of them, since it describes the file.
+func FieldNames() []string {
+	t := reflect.TypeOf(ChatmailConfig{})
+	names := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		if name := t.Field(i).Name; name != "ConfigVersion" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// field_words splits a field name like "SASLListenAddress" into its words,
+// keeping acronyms together.
+func field_words(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		prev_lower := !unicode.IsUpper(runes[i-1])
+		next_lower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if prev_lower || next_lower {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+// EnvName is the environment variable that overrides field, like
+// CHATMAIL_MAX_MAILBOX_SIZE_MB for MaxMailboxSizeMB.
+func EnvName(field string) string {
+	return EnvPrefix + strings.ToUpper(strings.Join(field_words(field), "_"))
+}
+
+// FlagName is the command-line flag that overrides field, like
+// max-mailbox-size-mb for MaxMailboxSizeMB.
+func FlagName(field string) string {
+	return strings.ToLower(strings.Join(field_words(field), "-"))
+}
+
+// set_field parses value into the named field of config. Lists are
+// comma-separated.
+func set_field(config *ChatmailConfig, field string, value string) error {
+	v := reflect.ValueOf(config).Elem().FieldByName(field)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("%s can't be overridden", field)
+	}
+	return nil
+}
+
+// FlagOverrides collects the command-line flags that override fields.
+type FlagOverrides struct {
+	values map[string]string
+}
+
+// RegisterFlags adds a flag for every field to fs.
+func RegisterFlags(fs *flag.FlagSet) *FlagOverrides {
+	overrides := &FlagOverrides{make(map[string]string)}
+	t := reflect.TypeOf(ChatmailConfig{})
+	for _, field := range FieldNames() {
+		set := func(value string) error {
+			// Check the value now so that mistakes are reported like any
+			// other bad flag.
+			var scratch ChatmailConfig
+			if err := set_field(&scratch, field, value); err != nil {
+				return err
+			}
+			overrides.values[field] = value
+			return nil
+		}
+		usage := "override " + field + " in the configuration file"
+		if f, _ := t.FieldByName(field); f.Type.Kind() == reflect.Bool {
+			fs.BoolFunc(FlagName(field), usage, set)
+		} else {
+			fs.Func(FlagName(field), usage, set)
+		}
+	}
+	return overrides
+}
+
+// Loader builds the configuration out of its layers: the defaults from
+// NewChatmailConfig, then File (if set), then environment variables from
+// Environ (in os.Environ's format), then Flags (if set).
+type Loader struct {
+	File    string
+	Environ []string
+	Flags   *FlagOverrides
+}
+
+// DefaultLoader reads filename, the process environment, and flags.
+func DefaultLoader(filename string, flags *FlagOverrides) Loader {
+	return Loader{filename, os.Environ(), flags}
+}
+
+func (l Loader) env_overrides() (map[string]string, error) {
+	by_env_name := make(map[string]string)
+	for _, field := range FieldNames() {
+		by_env_name[EnvName(field)] = field
+	}
+	overrides := make(map[string]string)
+	var unknown []string
+	for _, kv := range l.Environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		field, found := by_env_name[name]
+		if !found {
+			unknown = append(unknown, name)
+			continue
+		}
+		overrides[field] = value
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return nil, fmt.Errorf("unknown configuration variables in the environment: %s", strings.Join(unknown, ", "))
+	}
+	return overrides, nil
+}
+
+// Load returns the effective configuration and where each field came from.
+// The result has been validated.
+func (l Loader) Load() (ChatmailConfig, Sources, error) {
+	var file_config ChatmailConfig
+	if l.File != "" {
+		if err := LoadChatmailConfigFromFile(l.File, &file_config); err != nil {
+			return ChatmailConfig{}, nil, err
+		}
+	}
+	env, err := l.env_overrides()
+	if err != nil {
+		return ChatmailConfig{}, nil, err
+	}
+	var flags map[string]string
+	if l.Flags != nil {
+		flags = l.Flags.values
+	}
+
+	// Some defaults depend on the domain name, so that has to be worked
+	// out first.
+	fqdn := file_config.MailFullyQualifiedDomainName
+	if value, found := env["MailFullyQualifiedDomainName"]; found {
+		fqdn = value
+	}
+	if value, found := flags["MailFullyQualifiedDomainName"]; found {
+		fqdn = value
+	}
+
+	config := NewChatmailConfig(fqdn)
+	sources := make(Sources)
+	for _, field := range FieldNames() {
+		sources[field] = Source{Layer: LayerDefault}
+	}
+	if l.File != "" {
+		// Loading migrates the file, so it always has every field.
+		config = file_config
+		for _, field := range FieldNames() {
+			sources[field] = Source{LayerFile, l.File}
+		}
+	}
+	var problems []error
+	apply := func(overrides map[string]string, source func(field string) Source) {
+		for _, field := range FieldNames() {
+			value, found := overrides[field]
+			if !found {
+				continue
+			}
+			if err := set_field(&config, field, value); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", source(field), err))
+				continue
+			}
+			sources[field] = source(field)
+		}
+	}
+	apply(env, func(field string) Source { return Source{LayerEnv, EnvName(field)} })
+	apply(flags, func(field string) Source { return Source{LayerFlag, "-" + FlagName(field)} })
+	if err := errors.Join(problems...); err != nil {
+		return ChatmailConfig{}, nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return ChatmailConfig{}, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return config, sources, nil
+}
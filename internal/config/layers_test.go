@@ -0,0 +1,132 @@
+package config
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverrideNames(t *testing.T) {
+	tests := []struct {
+		field string
+		env   string
+		flag  string
+	}{
+		{"MailFullyQualifiedDomainName", "CHATMAIL_MAIL_FULLY_QUALIFIED_DOMAIN_NAME", "mail-fully-qualified-domain-name"},
+		{"MaxMailboxSizeMB", "CHATMAIL_MAX_MAILBOX_SIZE_MB", "max-mailbox-size-mb"},
+		{"MaxMessageSizeB", "CHATMAIL_MAX_MESSAGE_SIZE_B", "max-message-size-b"},
+		{"SASLListenAddress", "CHATMAIL_SASL_LISTEN_ADDRESS", "sasl-listen-address"},
+		{"TLSKeyFile", "CHATMAIL_TLS_KEY_FILE", "tls-key-file"},
+		{"DKIMKeyDirectory", "CHATMAIL_DKIM_KEY_DIRECTORY", "dkim-key-directory"},
+	}
+	for _, test := range tests {
+		if got := EnvName(test.field); got != test.env {
+			t.Errorf("EnvName(%q) = %q; want %q", test.field, got, test.env)
+		}
+		if got := FlagName(test.field); got != test.flag {
+			t.Errorf("FlagName(%q) = %q; want %q", test.field, got, test.flag)
+		}
+	}
+	if names := FieldNames(); names[0] != "MailFullyQualifiedDomainName" || len(names) != reflect.TypeOf(ChatmailConfig{}).NumField()-1 {
+		t.Fatalf("FieldNames() = %v; want every field but ConfigVersion", names)
+	}
+}
+
+func parse_override_flags(t *testing.T, args ...string) *FlagOverrides {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return overrides
+}
+
+func TestLoaderLayers(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "chatmail.json")
+	file_config := NewChatmailConfig("chat.example")
+	file_config.MaxEmailsPerMinutePerUser = 10
+	file_config.MaxMailboxSizeMB = 200
+	if err := file_config.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	loader := Loader{
+		File: filename,
+		Environ: []string{
+			"PATH=/bin",
+			"CHATMAIL_MAX_MAILBOX_SIZE_MB=300",
+			"CHATMAIL_PASSWORD_MIN_LENGTH=12",
+			"CHATMAIL_PASSTHROUGH_SENDERS_LIST=bot@chat.example, echo@chat.example",
+		},
+		Flags: parse_override_flags(t, "-password-min-length", "14", "-invite-only"),
+	}
+	got, sources, err := loader.Load()
+	if err != nil {
+		t.Fatalf("Load() = %v; want no error", err)
+	}
+
+	want := file_config
+	want.MaxMailboxSizeMB = 300
+	want.PasswordMinLength = 14
+	want.PassthroughSendersList = []string{"bot@chat.example", "echo@chat.example"}
+	want.InviteOnly = true
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %+v; want %+v", got, want)
+	}
+	want_sources := map[string]string{
+		"MaxEmailsPerMinutePerUser": "file " + filename,
+		"MaxMailboxSizeMB":          "env CHATMAIL_MAX_MAILBOX_SIZE_MB",
+		"PassthroughSendersList":    "env CHATMAIL_PASSTHROUGH_SENDERS_LIST",
+		"PasswordMinLength":         "flag -password-min-length",
+		"InviteOnly":                "flag -invite-only",
+	}
+	for field, want := range want_sources {
+		if got := sources[field].String(); got != want {
+			t.Errorf("Load() source of %s = %q; want %q", field, got, want)
+		}
+	}
+}
+
+func TestLoaderWithoutFile(t *testing.T) {
+	loader := Loader{Environ: []string{"CHATMAIL_MAIL_FULLY_QUALIFIED_DOMAIN_NAME=chat.example"}}
+	got, sources, err := loader.Load()
+	if err != nil {
+		t.Fatalf("Load() = %v; want no error", err)
+	}
+	// Defaults that depend on the domain name use the overridden one.
+	if want := NewChatmailConfig("chat.example"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %+v; want %+v", got, want)
+	}
+	if got := sources["MailboxesDirectory"].String(); got != "default" {
+		t.Fatalf("Load() source of MailboxesDirectory = %q; want default", got)
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	tests := []struct {
+		loader Loader
+		want   string
+	}{
+		{Loader{File: filepath.Join(t.TempDir(), "missing.json")}, "no such file"},
+		{Loader{}, "MailFullyQualifiedDomainName"},
+		{Loader{Environ: []string{"CHATMAIL_MAX_MAILBOX_SIZE=1", "CHATMAIL_COLOUR=blue"}}, "unknown configuration variables in the environment: CHATMAIL_COLOUR, CHATMAIL_MAX_MAILBOX_SIZE"},
+		{Loader{Environ: []string{"CHATMAIL_MAIL_FULLY_QUALIFIED_DOMAIN_NAME=chat.example", "CHATMAIL_INVITE_ONLY=maybe"}}, `env CHATMAIL_INVITE_ONLY: "maybe" is not true or false`},
+		{Loader{Environ: []string{"CHATMAIL_MAIL_FULLY_QUALIFIED_DOMAIN_NAME=chat.example", "CHATMAIL_USERNAME_MIN_LENGTH=20"}}, "invalid configuration"},
+	}
+	for _, test := range tests {
+		_, _, err := test.loader.Load()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Load() with %+v = %v; want error containing %q", test.loader, err, test.want)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-max-mailbox-size-mb", "lots"}); err == nil {
+		t.Fatalf("parsing a bad override flag = nil; want error")
+	}
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// CurrentVersion is the ConfigVersion that this code writes. Bump it, and
+// add a migration, whenever a field is added to ChatmailConfig or the
+// meaning of one changes.
+const CurrentVersion = 10
+
+// Files written before ConfigVersion existed don't have one. They're treated
+// as the oldest version; since migrations never overwrite fields that are
+// already there, that's harmless for files that are actually newer.
+const unversioned = 1
+
+type migration struct {
+	// to is the version that this migration produces.
+	to int
+	// added fields get their default value unless they're already set.
+	added []string
+	// update makes any other changes to the fields.
+	update func(fields map[string]json.RawMessage) error
+}
+
+var migrations = []migration{
+	{
+		to:    2,
+		added: []string{"MailboxesDirectory", "InviteOnly", "InviteTokensFile"},
+	},
+	{
+		to:    3,
+		added: []string{"MilterListenAddress", "SASLListenAddress", "TLSCertificateFile", "TLSKeyFile", "DKIMKeyDirectory"},
+	},
+	{
+		to:    4,
+		added: []string{"MetricsListenAddress"},
+	},
+	{
+		to:    5,
+		added: []string{"LogLevel", "LogFormat", "LogSaltFile"},
+	},
+	{
+		to:    6,
+		added: []string{"MilterMonitorOnly", "MilterMonitorOnlyDomains"},
+	},
+	{
+		to:    7,
+		added: []string{"AdminListenAddress"},
+	},
+	{
+		to:    8,
+		added: []string{"ReservedUsernames", "OperatorMailbox", "AllowUnicodeUsernames"},
+	},
+	{
+		to:    9,
+		added: []string{"LoginFailuresPerIP", "LoginFailuresPerAccount", "LoginLockoutSeconds", "LoginMaxLockoutSeconds"},
+	},
+	{
+		to:    10,
+		added: []string{"AccountDatabaseFile"},
+	},
+}
+
+func marshal_config(config ChatmailConfig) ([]byte, error) {
+	return json.MarshalIndent(config, "", "  ")
+}
+
+func config_version(fields map[string]json.RawMessage) (int, error) {
+	raw, found := fields["ConfigVersion"]
+	if !found {
+		return unversioned, nil
+	}
+	var version int
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, fmt.Errorf("ConfigVersion: %w", err)
+	}
+	return version, nil
+}
+
+// Migrate upgrades the JSON of a configuration file to CurrentVersion, and
+// also returns the version it was at. Data that's already current is
+// returned unchanged.
+func Migrate(data []byte) ([]byte, int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, err
+	}
+	version, err := config_version(fields)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > CurrentVersion {
+		return nil, version, fmt.Errorf("configuration version %d is newer than this version of chatmail understands (%d)", version, CurrentVersion)
+	}
+	if version < unversioned {
+		return nil, version, fmt.Errorf("configuration version %d doesn't exist", version)
+	}
+	if version == CurrentVersion {
+		return data, version, nil
+	}
+
+	var fqdn string
+	if raw, found := fields["MailFullyQualifiedDomainName"]; found {
+		if err := json.Unmarshal(raw, &fqdn); err != nil {
+			return nil, version, fmt.Errorf("MailFullyQualifiedDomainName: %w", err)
+		}
+	}
+	default_data, err := json.Marshal(NewChatmailConfig(fqdn))
+	if err != nil {
+		return nil, version, err
+	}
+	var defaults map[string]json.RawMessage
+	if err := json.Unmarshal(default_data, &defaults); err != nil {
+		return nil, version, err
+	}
+
+	for _, m := range migrations {
+		if m.to <= version {
+			continue
+		}
+		for _, name := range m.added {
+			if _, found := fields[name]; !found {
+				fields[name] = defaults[name]
+			}
+		}
+		if m.update != nil {
+			if err := m.update(fields); err != nil {
+				return nil, version, fmt.Errorf("failed to migrate to version %d: %w", m.to, err)
+			}
+		}
+	}
+	fields["ConfigVersion"] = defaults["ConfigVersion"]
+
+	// Going through ChatmailConfig checks for unknown fields and puts the
+	// rest in the same order that Save does.
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return nil, version, err
+	}
+	var config ChatmailConfig
+	if err := decode_config(migrated, &config); err != nil {
+		return nil, version, err
+	}
+	migrated, err = marshal_config(config)
+	return migrated, version, err
+}
+
+// BackupPath is where the original of filename is kept when it's migrated
+// from version.
+func BackupPath(filename string, version int) string {
+	return fmt.Sprintf("%s.v%d.bak", filename, version)
+}
+
+// MigrateFile upgrades filename in place, keeping a copy of the original at
+// BackupPath. It returns the migrated data, and the version that the file
+// was at.
+func MigrateFile(filename string) ([]byte, int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	migrated, version, err := Migrate(data)
+	if err != nil {
+		return nil, version, fmt.Errorf("failed to migrate %s: %w", filename, err)
+	}
+	if version == CurrentVersion {
+		return migrated, version, nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, version, err
+	}
+	// If a backup from this version already exists, it's from an earlier
+	// attempt and is at least as original as this file.
+	backup := BackupPath(filename, version)
+	if _, err := os.Stat(backup); errors.Is(err, fs.ErrNotExist) {
+		if err := os.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+			return nil, version, err
+		}
+	}
+	if err := os.WriteFile(filename, migrated, info.Mode().Perm()); err != nil {
+		return nil, version, err
+	}
+	return migrated, version, nil
+}
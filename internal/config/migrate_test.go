@@ -0,0 +1,183 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fixture_config is what each of the files in testdata holds, as far as the
+// fields that existed in its version go.
+func fixture_config(version int) ChatmailConfig {
+	want := NewChatmailConfig("chat.example")
+	want.MaxEmailsPerMinutePerUser = 60
+	want.MaxMailboxSizeMB = 500
+	want.DeleteMailsAfterDays = 40
+	want.UsernameMaxLength = 12
+	want.PasswordMinLength = 10
+	want.PrivacyContactPostalAddress = "1 Example Street"
+	want.PrivacyContactEmailAddress = "operator@chat.example"
+	if version >= 2 {
+		want.MailboxesDirectory = "/srv/mail/chat.example"
+		want.InviteOnly = true
+		want.InviteTokensFile = "/srv/chatmail/invites.json"
+	}
+	if version >= 3 {
+		want.MilterListenAddress = "tcp://127.0.0.1:10026"
+		want.TLSCertificateFile = "/etc/letsencrypt/live/chat.example/fullchain.pem"
+		want.TLSKeyFile = "/etc/letsencrypt/live/chat.example/privkey.pem"
+	}
+	if version >= 4 {
+		want.MetricsListenAddress = "tcp://127.0.0.1:9741"
+	}
+	if version >= 5 {
+		want.LogLevel = "debug"
+		want.LogFormat = "json"
+	}
+	if version >= 6 {
+		want.MilterMonitorOnlyDomains = []string{"new.chat.example"}
+	}
+	if version >= 7 {
+		want.AdminListenAddress = "unix:///run/chatmail/admin.sock?mode=0600&group=chatmail-admin"
+	}
+	if version >= 8 {
+		want.ReservedUsernames = []string{"admin*", "staff-*"}
+		want.OperatorMailbox = "operator@chat.example"
+		want.AllowUnicodeUsernames = true
+	}
+	if version >= 9 {
+		want.LoginFailuresPerIP = 5
+		want.LoginFailuresPerAccount = 0
+		want.LoginMaxLockoutSeconds = 86400
+	}
+	if version >= 10 {
+		want.AccountDatabaseFile = "/srv/chatmail/accounts.sqlite"
+	}
+	return want
+}
+
+func read_fixture(t *testing.T, version int) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("v%d.json", version)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMigrateFixtures(t *testing.T) {
+	// Versions 1 and 2 were written before ConfigVersion existed, so both
+	// are loaded as version 1.
+	from := map[int]int{1: 1, 2: 1, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 10: 10}
+	for version := 1; version <= CurrentVersion; version++ {
+		data := read_fixture(t, version)
+		migrated, got_from, err := Migrate(data)
+		if err != nil {
+			t.Fatalf("Migrate(v%d) = %v; want no error", version, err)
+		}
+		if got_from != from[version] {
+			t.Errorf("Migrate(v%d) from version %d; want %d", version, got_from, from[version])
+		}
+		var got ChatmailConfig
+		if err := decode_config(migrated, &got); err != nil {
+			t.Fatalf("Migrate(v%d) produced an unloadable config: %v\n%s", version, err, migrated)
+		}
+		if want := fixture_config(version); !reflect.DeepEqual(got, want) {
+			t.Errorf("Migrate(v%d) = %+v; want %+v", version, got, want)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("Migrate(v%d) produced an invalid config: %v", version, err)
+		}
+
+		again, _, err := Migrate(migrated)
+		if err != nil || !bytes.Equal(again, migrated) {
+			t.Errorf("Migrate(Migrate(v%d)) = %s, %v; want it unchanged", version, again, err)
+		}
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"ConfigVersion": 99, "MailFullyQualifiedDomainName": "chat.example"}`: "newer than this version of chatmail understands",
+		`{"ConfigVersion": 0}`:   "configuration version 0 doesn't exist",
+		`{"ConfigVersion": "3"}`: "ConfigVersion",
+		`{"MailFullyQualifiedDomainName": "chat.example", "Colour": "blue"}`: `unknown field "Colour"`,
+		`[]`: "cannot unmarshal",
+	}
+	for data, want := range tests {
+		_, _, err := Migrate([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Migrate(%s) = %v; want error containing %q", data, err, want)
+		}
+	}
+}
+
+func TestLoadMigratesInMemory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "chatmail.json")
+	original := read_fixture(t, 1)
+	if err := os.WriteFile(filename, original, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	var config ChatmailConfig
+	if err := LoadChatmailConfigFromFile(filename, &config); err != nil {
+		t.Fatalf("LoadChatmailConfigFromFile() = %v; want nil", err)
+	}
+	if want := fixture_config(1); !reflect.DeepEqual(config, want) {
+		t.Fatalf("LoadChatmailConfigFromFile() = %+v; want %+v", config, want)
+	}
+	// The file may well be read-only to the service that loads it.
+	if data, err := os.ReadFile(filename); err != nil || !bytes.Equal(data, original) {
+		t.Fatalf("loading an old file changed it")
+	}
+	if _, err := os.Stat(BackupPath(filename, 1)); !os.IsNotExist(err) {
+		t.Fatalf("loading an old file made a backup (err = %v)", err)
+	}
+}
+
+func TestMigrateFileWithBackup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "chatmail.json")
+	original := read_fixture(t, 1)
+	if err := os.WriteFile(filename, original, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, version, err := MigrateFile(filename); err != nil || version != 1 {
+		t.Fatalf("MigrateFile() = %d, %v; want 1, nil", version, err)
+	}
+	backup, err := os.ReadFile(BackupPath(filename, 1))
+	if err != nil || !bytes.Equal(backup, original) {
+		t.Fatalf("backup = %q, %v; want the original file", backup, err)
+	}
+	migrated, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(migrated, []byte(fmt.Sprintf(`"ConfigVersion": %d`, CurrentVersion))) {
+		t.Fatalf("%s wasn't migrated in place:\n%s", filename, migrated)
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("migrated file mode = %v, %v; want 0640", info.Mode().Perm(), err)
+	}
+	var config ChatmailConfig
+	if err := LoadChatmailConfigFromFile(filename, &config); err != nil {
+		t.Fatal(err)
+	}
+	if want := fixture_config(1); !reflect.DeepEqual(config, want) {
+		t.Fatalf("LoadChatmailConfigFromFile() after migrating = %+v; want %+v", config, want)
+	}
+
+	// Migrating a current file again leaves it alone.
+	if _, _, err := MigrateFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	again, err := os.ReadFile(filename)
+	if err != nil || !bytes.Equal(again, migrated) {
+		t.Fatalf("migrating a current file changed it")
+	}
+}
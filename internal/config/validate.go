@@ -0,0 +1,233 @@
+package config
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/logging"
+
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Local parts of email addresses can't be longer than this (RFC 5321 section
+// 4.5.3.1.1).
+const max_local_part_length = 64
+
+var listen_schemes = []string{"unix", "tcp", "tls", "systemd"}
+
+// RoleAccounts are the mailbox names that RFC 2142 expects every domain to
+// have. Nobody can register them; mail to them goes to OperatorMailbox.
+var RoleAccounts = []string{
+	"abuse", "ftp", "hostmaster", "info", "marketing", "news", "noc",
+	"postmaster", "sales", "security", "support", "usenet", "uucp",
+	"webmaster", "www",
+}
+
+// IsDomainName reports whether name is a fully qualified host name in
+// lowercase, without a trailing dot.
+func IsDomainName(name string) bool {
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) < 1 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func is_bare_address(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+func check_listen_address(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(listen_schemes, u.Scheme) {
+		return fmt.Errorf("%q has unsupported scheme %q (expected one of %v)", uri, u.Scheme, listen_schemes)
+	}
+	if u.Host == "" && u.Path == "" {
+		return fmt.Errorf("%q has no address", uri)
+	}
+	return nil
+}
+
+// Validate checks that config makes sense, and returns every problem it
+// finds joined into one error, or nil if there are none.
+func (config ChatmailConfig) Validate() error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if !IsDomainName(config.MailFullyQualifiedDomainName) {
+		problem("MailFullyQualifiedDomainName: %q is not a lowercase fully qualified domain name", config.MailFullyQualifiedDomainName)
+	}
+	positive := []struct {
+		name  string
+		value int
+	}{
+		{"MaxEmailsPerMinutePerUser", config.MaxEmailsPerMinutePerUser},
+		{"MaxMailboxSizeMB", config.MaxMailboxSizeMB},
+		{"MaxMessageSizeB", config.MaxMessageSizeB},
+		{"DeleteMailsAfterDays", config.DeleteMailsAfterDays},
+		{"DeleteInactiveUsersAfterDays", config.DeleteInactiveUsersAfterDays},
+		{"UsernameMinLength", config.UsernameMinLength},
+		{"UsernameMaxLength", config.UsernameMaxLength},
+		{"PasswordMinLength", config.PasswordMinLength},
+	}
+	for _, field := range positive {
+		if field.value < 1 {
+			problem("%s: must be at least 1, not %d", field.name, field.value)
+		}
+	}
+	if config.MaxMailboxSizeMB > 0 && config.MaxMessageSizeB > config.MaxMailboxSizeMB*1024*1024 {
+		problem("MaxMessageSizeB: %d bytes is bigger than the whole mailbox (MaxMailboxSizeMB is %d)", config.MaxMessageSizeB, config.MaxMailboxSizeMB)
+	}
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"LoginFailuresPerIP", config.LoginFailuresPerIP},
+		{"LoginFailuresPerAccount", config.LoginFailuresPerAccount},
+	} {
+		if field.value < 0 {
+			problem("%s: can't be negative (0 turns the limit off), not %d", field.name, field.value)
+		}
+	}
+	if config.LoginLockoutSeconds < 1 {
+		problem("LoginLockoutSeconds: must be at least 1, not %d", config.LoginLockoutSeconds)
+	}
+	if config.LoginMaxLockoutSeconds < config.LoginLockoutSeconds {
+		problem("LoginMaxLockoutSeconds: %d is less than LoginLockoutSeconds (%d)", config.LoginMaxLockoutSeconds, config.LoginLockoutSeconds)
+	}
+	if config.UsernameMinLength > config.UsernameMaxLength {
+		problem("UsernameMinLength: %d is more than UsernameMaxLength (%d)", config.UsernameMinLength, config.UsernameMaxLength)
+	}
+	if config.UsernameMaxLength > max_local_part_length {
+		problem("UsernameMaxLength: %d is longer than email addresses allow (%d)", config.UsernameMaxLength, max_local_part_length)
+	}
+	for _, list := range []struct {
+		name      string
+		addresses []string
+	}{
+		{"PassthroughSendersList", config.PassthroughSendersList},
+		{"PassthroughRecipientsList", config.PassthroughRecipientsList},
+	} {
+		for _, address := range list.addresses {
+			if !is_bare_address(address) {
+				problem("%s: %q is not an email address", list.name, address)
+			}
+		}
+	}
+	if config.PrivacyContactEmailAddress != "" && !is_bare_address(config.PrivacyContactEmailAddress) {
+		problem("PrivacyContactEmailAddress: %q is not an email address", config.PrivacyContactEmailAddress)
+	}
+	if config.OperatorMailbox != "" {
+		local, domain, _ := strings.Cut(config.OperatorMailbox, "@")
+		if !is_bare_address(config.OperatorMailbox) {
+			problem("OperatorMailbox: %q is not an email address", config.OperatorMailbox)
+		} else if strings.EqualFold(domain, config.MailFullyQualifiedDomainName) && slices.Contains(RoleAccounts, strings.ToLower(local)) {
+			problem("OperatorMailbox: %q is itself one of the role addresses that are sent to it", config.OperatorMailbox)
+		}
+	}
+	for _, pattern := range config.ReservedUsernames {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" || strings.Contains(pattern, "@") {
+			problem("ReservedUsernames: %q is not a pattern for usernames", pattern)
+		}
+	}
+	if !filepath.IsAbs(config.MailboxesDirectory) {
+		problem("MailboxesDirectory: %q is not an absolute path", config.MailboxesDirectory)
+	}
+	if config.AccountDatabaseFile != "" && !filepath.IsAbs(config.AccountDatabaseFile) {
+		problem("AccountDatabaseFile: %q is not an absolute path", config.AccountDatabaseFile)
+	}
+	if config.InviteOnly && config.InviteTokensFile == "" {
+		problem("InviteTokensFile: must be set when InviteOnly is true")
+	}
+	for _, listen := range []struct {
+		name string
+		uri  string
+	}{
+		{"MilterListenAddress", config.MilterListenAddress},
+		{"SASLListenAddress", config.SASLListenAddress},
+	} {
+		if err := check_listen_address(listen.uri); err != nil {
+			problem("%s: %v", listen.name, err)
+		}
+	}
+	if config.MetricsListenAddress != "" {
+		if err := check_listen_address(config.MetricsListenAddress); err != nil {
+			problem("MetricsListenAddress: %v", err)
+		}
+	}
+	if config.AdminListenAddress != "" {
+		if err := check_listen_address(config.AdminListenAddress); err != nil {
+			problem("AdminListenAddress: %v", err)
+		} else if scheme, _, _ := strings.Cut(config.AdminListenAddress, "://"); scheme != "unix" && scheme != "systemd" {
+			problem("AdminListenAddress: %q has to be a unix:// or systemd:// socket, so that only local users can manage accounts", config.AdminListenAddress)
+		}
+	}
+	for _, domain := range config.MilterMonitorOnlyDomains {
+		if !IsDomainName(domain) {
+			problem("MilterMonitorOnlyDomains: %q is not a domain name", domain)
+		}
+	}
+	if !slices.Contains(logging.Levels, config.LogLevel) {
+		problem("LogLevel: %q is not one of %s", config.LogLevel, strings.Join(logging.Levels, ", "))
+	}
+	if !slices.Contains(logging.Formats, config.LogFormat) {
+		problem("LogFormat: %q is not one of %s", config.LogFormat, strings.Join(logging.Formats, ", "))
+	}
+	for _, file := range []struct {
+		name string
+		path string
+	}{
+		{"TLSCertificateFile", config.TLSCertificateFile},
+		{"TLSKeyFile", config.TLSKeyFile},
+		{"DKIMKeyDirectory", config.DKIMKeyDirectory},
+		{"LogSaltFile", config.LogSaltFile},
+	} {
+		if file.path == "" {
+			problem("%s: must be set", file.name)
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// Warnings lists settings that are allowed but probably unintended, like
+// leaving out the contact details that the privacy policy shows.
+func (config ChatmailConfig) Warnings() []string {
+	var warnings []string
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"PrivacyContactPostalAddress", config.PrivacyContactPostalAddress},
+		{"PrivacyContactEmailAddress", config.PrivacyContactEmailAddress},
+		{"PrivacyDataOfficerPostalAddress", config.PrivacyDataOfficerPostalAddress},
+		{"PrivacySupervisorPostalAddress", config.PrivacySupervisorPostalAddress},
+	} {
+		if field.value == "" {
+			warnings = append(warnings, field.name+" is empty, so the privacy policy on the website will have a gap where it should be")
+		}
+	}
+	if config.LoginFailuresPerAccount > 0 && config.LoginFailuresPerAccount < config.LoginFailuresPerIP {
+		warnings = append(warnings, "LoginFailuresPerAccount is less than LoginFailuresPerIP, so it's easier for someone else to lock an account out than to lock themselves out")
+	}
+	return warnings
+}
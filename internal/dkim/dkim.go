@@ -0,0 +1,142 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// chatmail signs with both an RSA and an Ed25519 key (RFC 8463), since not
+// every receiving server understands Ed25519 yet.
+const (
+	SelectorRSA     = "rsa"
+	SelectorEd25519 = "ed25519"
+)
+
+// DefaultDirectory is where the keys live, relative to chatmail.json.
+const DefaultDirectory = "dkim"
+
+const rsa_key_bits = 2048
+
+type Key struct {
+	Selector  string
+	Algorithm string
+	Signer    crypto.Signer
+}
+
+// KeyPath is the PEM file that holds the private key for selector.
+func KeyPath(dir string, selector string) string {
+	return filepath.Join(dir, selector+".key")
+}
+
+// TXTValue is the content of the key's DNS record (RFC 6376 section 3.6.1),
+// before it is split into strings.
+func (k Key) TXTValue() (string, error) {
+	var pub []byte
+	switch key := k.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		pub = der
+	case ed25519.PublicKey:
+		pub = key
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", k.Algorithm, base64.StdEncoding.EncodeToString(pub)), nil
+}
+
+func write_key(path string, signer crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Generate creates any keys that are missing in dir. Existing keys are never
+// overwritten, since that would break DKIM until DNS is updated.
+func Generate(dir string) ([]Key, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	generators := []struct {
+		selector string
+		generate func() (crypto.Signer, error)
+	}{
+		{SelectorRSA, func() (crypto.Signer, error) {
+			return rsa.GenerateKey(rand.Reader, rsa_key_bits)
+		}},
+		{SelectorEd25519, func() (crypto.Signer, error) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			return key, err
+		}},
+	}
+	for _, g := range generators {
+		path := KeyPath(dir, g.selector)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		signer, err := g.generate()
+		if err != nil {
+			return nil, err
+		}
+		if err := write_key(path, signer); err != nil {
+			return nil, fmt.Errorf("failed to write DKIM key %s: %w", path, err)
+		}
+	}
+	return Load(dir)
+}
+
+// Load reads all of the keys in dir. A missing directory means that no keys
+// have been generated yet, which isn't an error.
+func Load(dir string) ([]Key, error) {
+	var keys []Key
+	for _, selector := range []string{SelectorRSA, SelectorEd25519} {
+		path := KeyPath(dir, selector)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("%s does not contain a PEM-encoded PKCS #8 private key", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		key := Key{Selector: selector}
+		switch signer := parsed.(type) {
+		case *rsa.PrivateKey:
+			key.Algorithm = "rsa"
+			key.Signer = signer
+		case ed25519.PrivateKey:
+			key.Algorithm = "ed25519"
+			key.Signer = signer
+		default:
+			return nil, fmt.Errorf("%s contains an unsupported key type %T", path, parsed)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
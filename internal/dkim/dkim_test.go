@@ -0,0 +1,47 @@
+package dkim
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGenerateKeys(t *testing.T) {
+	dir := t.TempDir() + "/dkim"
+	keys, err := Generate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Algorithm != "rsa" || keys[1].Algorithm != "ed25519" {
+		t.Fatalf("Generate() = %v; want an RSA and an Ed25519 key", keys)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("key directory mode = %v, %v; want 0700", info.Mode().Perm(), err)
+	}
+	for _, selector := range []string{SelectorRSA, SelectorEd25519} {
+		info, err := os.Stat(KeyPath(dir, selector))
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Fatalf("%s key mode = %v, %v; want 0600", selector, info.Mode().Perm(), err)
+		}
+	}
+
+	value, err := keys[1].TXTValue()
+	if err != nil || !strings.HasPrefix(value, "v=DKIM1; k=ed25519; p=") {
+		t.Fatalf("Ed25519 TXTValue() = %q, %v; want v=DKIM1; k=ed25519; p=...", value, err)
+	}
+
+	// Generating again must keep the existing keys.
+	again, err := Generate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		before, _ := keys[i].TXTValue()
+		after, _ := again[i].TXTValue()
+		if before != after {
+			t.Fatalf("Generate() replaced the existing %s key", keys[i].Selector)
+		}
+	}
+}
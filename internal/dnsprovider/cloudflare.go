@@ -0,0 +1,245 @@
+package dnsprovider
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const cloudflare_base_url = "https://api.cloudflare.com/client/v4"
+
+// Cloudflare talks to the Cloudflare v4 API with an API token that has
+// Zone:DNS:Edit permission.
+type Cloudflare struct {
+	Token    string
+	BaseURL  string
+	Client   *http.Client
+	zone_ids map[string]string
+}
+
+func NewCloudflare(token string) *Cloudflare {
+	return &Cloudflare{Token: token, BaseURL: cloudflare_base_url, Client: http.DefaultClient}
+}
+
+type cf_error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type cf_result_info struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+}
+
+type cf_response[T any] struct {
+	Success    bool           `json:"success"`
+	Errors     []cf_error     `json:"errors"`
+	Result     T              `json:"result"`
+	ResultInfo cf_result_info `json:"result_info"`
+}
+
+// api_err returns the errors that Cloudflare sent, if it sent any.
+func (r cf_response[T]) api_err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, e := range r.Errors {
+		msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+	}
+	return errors.New("cloudflare: " + strings.Join(msgs, "; "))
+}
+
+func (r cf_response[T]) err() error {
+	if r.Success {
+		return nil
+	}
+	if err := r.api_err(); err != nil {
+		return err
+	}
+	return errors.New("cloudflare: the request failed without an error message")
+}
+
+type cf_zone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cf_record struct {
+	ID       string         `json:"id,omitempty"`
+	Type     string         `json:"type"`
+	Name     string         `json:"name"`
+	Content  string         `json:"content,omitempty"`
+	TTL      uint32         `json:"ttl"`
+	Priority *uint16        `json:"priority,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+type cf_reply interface {
+	err() error
+	api_err() error
+}
+
+func (p *Cloudflare) call(ctx context.Context, method string, path string, body any, out cf_reply) error {
+	header := http.Header{"Authorization": {"Bearer " + p.Token}}
+	if err := do_json(ctx, p.Client, method, p.BaseURL+path, header, body, out); err != nil {
+		// Cloudflare's own error messages are more helpful than the HTTP
+		// status, but a failed request may not have a response to take
+		// them from.
+		if api_err := out.api_err(); api_err != nil {
+			return api_err
+		}
+		return err
+	}
+	return out.err()
+}
+
+func (p *Cloudflare) zone_id(ctx context.Context, zone string) (string, error) {
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	if id, found := p.zone_ids[zone]; found {
+		return id, nil
+	}
+	var resp cf_response[[]cf_zone]
+	if err := p.call(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(zone), nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Result) != 1 {
+		return "", fmt.Errorf("cloudflare: no zone named %s in this account", zone)
+	}
+	if p.zone_ids == nil {
+		p.zone_ids = make(map[string]string)
+	}
+	p.zone_ids[zone] = resp.Result[0].ID
+	return resp.Result[0].ID, nil
+}
+
+func to_cloudflare(record dnszone.Record) (cf_record, error) {
+	rr, err := record.RR()
+	if err != nil {
+		return cf_record{}, err
+	}
+	r := cf_record{Type: record.Type, Name: strings.TrimSuffix(record.Name, "."), TTL: record.TTL}
+	switch v := rr.(type) {
+	case *dns.MX:
+		r.Content = strings.TrimSuffix(v.Mx, ".")
+		r.Priority = &v.Preference
+	case *dns.TXT:
+		r.Content = strings.Join(v.Txt, "")
+	case *dns.CNAME:
+		r.Content = strings.TrimSuffix(v.Target, ".")
+	case *dns.SRV:
+		r.Data = map[string]any{
+			"priority": v.Priority,
+			"weight":   v.Weight,
+			"port":     v.Port,
+			"target":   strings.TrimSuffix(v.Target, "."),
+		}
+	case *dns.CAA:
+		r.Data = map[string]any{"flags": v.Flag, "tag": v.Tag, "value": v.Value}
+	default:
+		r.Content = dnszone.RData(rr)
+	}
+	return r, nil
+}
+
+func data_int(data map[string]any, key string) int {
+	n, _ := data[key].(float64)
+	return int(n)
+}
+
+func from_cloudflare(r cf_record) Record {
+	value := r.Content
+	switch r.Type {
+	case "MX":
+		prio := uint16(0)
+		if r.Priority != nil {
+			prio = *r.Priority
+		}
+		value = fmt.Sprintf("%d %s", prio, dns.Fqdn(r.Content))
+	case "TXT":
+		// Depending on the zone's settings, Cloudflare hands TXT content
+		// back either as plain text or in quoted presentation format.
+		text := r.Content
+		if strings.HasPrefix(text, `"`) {
+			if rr, err := dns.NewRR(". TXT " + text); err == nil {
+				text = dnszone.RData(rr)
+			}
+		}
+		value = dnszone.QuoteTXT(text)
+	case "CNAME":
+		value = dns.Fqdn(r.Content)
+	case "SRV":
+		target, _ := r.Data["target"].(string)
+		value = fmt.Sprintf("%d %d %d %s", data_int(r.Data, "priority"), data_int(r.Data, "weight"), data_int(r.Data, "port"), dns.Fqdn(target))
+	case "CAA":
+		tag, _ := r.Data["tag"].(string)
+		caa_value, _ := r.Data["value"].(string)
+		value = fmt.Sprintf("%d %s %q", data_int(r.Data, "flags"), tag, caa_value)
+	}
+	return Record{r.ID, dnszone.Record{Name: dns.Fqdn(r.Name), Type: r.Type, TTL: r.TTL, Value: value}}
+}
+
+func (p *Cloudflare) List(ctx context.Context, zone string) ([]Record, error) {
+	id, err := p.zone_id(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for page := 1; ; page++ {
+		var resp cf_response[[]cf_record]
+		path := fmt.Sprintf("/zones/%s/dns_records?per_page=100&page=%d", id, page)
+		if err := p.call(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Result {
+			records = append(records, from_cloudflare(r))
+		}
+		if page >= resp.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+func (p *Cloudflare) Create(ctx context.Context, zone string, record dnszone.Record) error {
+	id, err := p.zone_id(ctx, zone)
+	if err != nil {
+		return err
+	}
+	body, err := to_cloudflare(record)
+	if err != nil {
+		return err
+	}
+	var resp cf_response[cf_record]
+	return p.call(ctx, http.MethodPost, "/zones/"+id+"/dns_records", body, &resp)
+}
+
+func (p *Cloudflare) Update(ctx context.Context, zone string, old Record, record dnszone.Record) error {
+	id, err := p.zone_id(ctx, zone)
+	if err != nil {
+		return err
+	}
+	body, err := to_cloudflare(record)
+	if err != nil {
+		return err
+	}
+	var resp cf_response[cf_record]
+	return p.call(ctx, http.MethodPut, "/zones/"+id+"/dns_records/"+old.ID, body, &resp)
+}
+
+func (p *Cloudflare) Delete(ctx context.Context, zone string, record Record) error {
+	id, err := p.zone_id(ctx, zone)
+	if err != nil {
+		return err
+	}
+	var resp cf_response[struct {
+		ID string `json:"id"`
+	}]
+	return p.call(ctx, http.MethodDelete, "/zones/"+id+"/dns_records/"+record.ID, nil, &resp)
+}
@@ -0,0 +1,171 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fake_cloudflare is a stand-in for the parts of the Cloudflare API that the
+// provider uses. It returns records in pages of 5 to exercise pagination.
+type fake_cloudflare struct {
+	mu      sync.Mutex
+	next_id int
+	records map[string]cf_record
+}
+
+func (f *fake_cloudflare) add(r cf_record) cf_record {
+	f.next_id += 1
+	r.ID = strconv.Itoa(f.next_id)
+	f.records[r.ID] = r
+	return r
+}
+
+func (f *fake_cloudflare) handler(t *testing.T) http.Handler {
+	reply := func(w http.ResponseWriter, status int, result any, info cf_result_info) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{
+			"success":     status == http.StatusOK,
+			"errors":      []cf_error{},
+			"result":      result,
+			"result_info": info,
+		})
+	}
+	decode := func(r *http.Request) cf_record {
+		var rec cf_record
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			t.Errorf("fake cloudflare got an invalid record: %v", err)
+		}
+		return rec
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != test_zone {
+			reply(w, http.StatusOK, []cf_zone{}, cf_result_info{})
+			return
+		}
+		reply(w, http.StatusOK, []cf_zone{{"zone1", test_zone}}, cf_result_info{})
+	})
+	mux.HandleFunc("GET /zones/zone1/dns_records", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]int, 0, len(f.records))
+		for id := range f.records {
+			n, _ := strconv.Atoi(id)
+			ids = append(ids, n)
+		}
+		sort.Ints(ids)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		const page_size = 5
+		var result []cf_record
+		for i := (page - 1) * page_size; i < len(ids) && i < page*page_size; i++ {
+			result = append(result, f.records[strconv.Itoa(ids[i])])
+		}
+		total := (len(ids) + page_size - 1) / page_size
+		reply(w, http.StatusOK, result, cf_result_info{page, total})
+	})
+	mux.HandleFunc("POST /zones/zone1/dns_records", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, f.add(decode(r)), cf_result_info{})
+	})
+	mux.HandleFunc("PUT /zones/zone1/dns_records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rec := decode(r)
+		rec.ID = r.PathValue("id")
+		f.records[rec.ID] = rec
+		reply(w, http.StatusOK, rec, cf_result_info{})
+	})
+	mux.HandleFunc("DELETE /zones/zone1/dns_records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		delete(f.records, r.PathValue("id"))
+		reply(w, http.StatusOK, map[string]string{"id": r.PathValue("id")}, cf_result_info{})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": false,
+				"errors":  []cf_error{{10000, "Authentication error"}},
+			})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func new_fake_cloudflare(t *testing.T) (*fake_cloudflare, *Cloudflare) {
+	fake := &fake_cloudflare{records: make(map[string]cf_record)}
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+	p := NewCloudflare("test-token")
+	p.BaseURL = server.URL
+	p.Client = server.Client()
+	return fake, p
+}
+
+func TestCloudflareReconcile(t *testing.T) {
+	fake, p := new_fake_cloudflare(t)
+	mx_prio := uint16(5)
+	unrelated := fake.add(cf_record{Type: "TXT", Name: "chat.example.org", Content: "google-site-verification=abc", TTL: 1})
+	fake.add(cf_record{Type: "MX", Name: "chat.example.org", Content: "mx.elsewhere.example", TTL: 1, Priority: &mx_prio})
+	fake.add(cf_record{Type: "TXT", Name: "chat.example.org", Content: `"v=spf1 a ~all"`, TTL: 1})
+
+	changes := check_reconcile(t, p)
+	counts := count_actions(changes)
+	// 12 records in the zone, minus the SPF record that's already right and
+	// the MX record that gets updated.
+	if counts[ActionUpdate] != 1 || counts[ActionCreate] != 10 || counts[ActionDelete] != 0 {
+		t.Fatalf("Reconcile() changes = %v; want 1 update and 10 creations", counts)
+	}
+	if got := fake.records[unrelated.ID]; got.Content != unrelated.Content || got.Type != unrelated.Type {
+		t.Fatalf("Reconcile() changed an unrelated record: %v", fake.records[unrelated.ID])
+	}
+	for _, r := range fake.records {
+		if r.Type == "SRV" && r.Name == "_submission._tcp.chat.example.org" {
+			if fmt.Sprint(r.Data["port"]) != "587" || r.Data["target"] != "chat.example.org" {
+				t.Fatalf("SRV record data = %v; want port 587 and target chat.example.org", r.Data)
+			}
+		}
+	}
+}
+
+func TestCloudflareReportsAPIErrors(t *testing.T) {
+	_, p := new_fake_cloudflare(t)
+	p.Token = "wrong"
+	_, err := p.List(context.Background(), test_zone)
+	if err == nil || err.Error() != "cloudflare: 10000: Authentication error" {
+		t.Fatalf("List() with bad token = %v; want the Cloudflare error message", err)
+	}
+}
+
+type failing_transport struct{}
+
+func (failing_transport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestCloudflareReportsTransportErrors(t *testing.T) {
+	p := NewCloudflare("test-token")
+	p.Client = &http.Client{Transport: failing_transport{}}
+	_, err := p.List(context.Background(), test_zone)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("List() over a failing connection = %v; want the connection error", err)
+	}
+
+	// A proxy in front of the API answers with something that isn't JSON.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>Bad Gateway</html>", http.StatusBadGateway)
+	}))
+	defer server.Close()
+	p.BaseURL = server.URL
+	p.Client = server.Client()
+	_, err = p.List(context.Background(), test_zone)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("List() through a failing proxy = %v; want the HTTP status", err)
+	}
+}
@@ -0,0 +1,221 @@
+package dnsprovider
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Record is a record as it exists at a provider. ID is whatever the provider
+// needs to refer to the record later, and may be empty.
+type Record struct {
+	ID string
+	dnszone.Record
+}
+
+// Provider manages the records of one zone at a DNS host. Record names are
+// always fully qualified, with a trailing dot, whatever the provider's API
+// uses; converting is the implementation's job.
+type Provider interface {
+	List(ctx context.Context, zone string) ([]Record, error)
+	Create(ctx context.Context, zone string, record dnszone.Record) error
+	Update(ctx context.Context, zone string, old Record, record dnszone.Record) error
+	Delete(ctx context.Context, zone string, record Record) error
+}
+
+type Action int
+
+const (
+	ActionCreate Action = iota
+	ActionUpdate
+	ActionDelete
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionCreate:
+		return "create"
+	case ActionUpdate:
+		return "update"
+	default:
+		return "delete"
+	}
+}
+
+// Change is one step towards the desired zone. Old is set for updates and
+// deletions, New for creations and updates.
+type Change struct {
+	Action Action
+	Old    Record
+	New    dnszone.Record
+}
+
+func (c Change) String() string {
+	switch c.Action {
+	case ActionCreate:
+		return "+ " + c.New.String()
+	case ActionUpdate:
+		return "- " + c.Old.Record.String() + "\n+ " + c.New.String()
+	default:
+		return "- " + c.Old.Record.String()
+	}
+}
+
+// canonical_value normalises a record value so that equivalent values from
+// different providers compare equal.
+func canonical_value(r dnszone.Record) string {
+	rr, err := r.RR()
+	if err != nil {
+		return r.Value
+	}
+	if r.Type == "TXT" {
+		return dnszone.RData(rr)
+	}
+	return strings.ToLower(dnszone.RData(rr))
+}
+
+// txt_kind identifies what a TXT record is for by its version tag (like
+// "v=spf1"), so that unrelated TXT records at the same name are left alone.
+func txt_kind(r dnszone.Record) string {
+	text := canonical_value(r)
+	end := strings.IndexAny(text, "; ")
+	if end < 0 {
+		end = len(text)
+	}
+	return strings.ToLower(text[:end])
+}
+
+type rrset_key struct {
+	name  string
+	rtype string
+	kind  string
+}
+
+func key_of(r dnszone.Record) rrset_key {
+	key := rrset_key{strings.ToLower(dns.Fqdn(r.Name)), strings.ToUpper(r.Type), ""}
+	if key.rtype == "TXT" {
+		key.kind = txt_kind(r)
+	}
+	return key
+}
+
+// Plan works out the changes that turn existing into desired. Only record
+// sets that chatmail manages are touched: existing records whose name and
+// type (and, for TXT, version tag) don't appear in desired are ignored.
+// Differences in TTL alone are ignored too, since many providers clamp TTLs.
+func Plan(existing []Record, desired []dnszone.Record) []Change {
+	have := make(map[rrset_key][]Record)
+	for _, r := range existing {
+		key := key_of(r.Record)
+		have[key] = append(have[key], r)
+	}
+	want := make(map[rrset_key][]dnszone.Record)
+	var order []rrset_key
+	for _, r := range desired {
+		key := key_of(r)
+		if _, seen := want[key]; !seen {
+			order = append(order, key)
+		}
+		want[key] = append(want[key], r)
+	}
+
+	var changes []Change
+	for _, key := range order {
+		var stale []Record
+		for _, h := range have[key] {
+			matched := false
+			for _, w := range want[key] {
+				if canonical_value(h.Record) == canonical_value(w) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				stale = append(stale, h)
+			}
+		}
+		var missing []dnszone.Record
+		for _, w := range want[key] {
+			matched := false
+			for _, h := range have[key] {
+				if canonical_value(h.Record) == canonical_value(w) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				missing = append(missing, w)
+			}
+		}
+		// Prefer editing stale records in place over deleting and recreating
+		// them, so that there's no moment where the record is missing.
+		for len(stale) > 0 && len(missing) > 0 {
+			changes = append(changes, Change{ActionUpdate, stale[0], missing[0]})
+			stale, missing = stale[1:], missing[1:]
+		}
+		for _, m := range missing {
+			changes = append(changes, Change{Action: ActionCreate, New: m})
+		}
+		for _, s := range stale {
+			changes = append(changes, Change{Action: ActionDelete, Old: s})
+		}
+	}
+	return changes
+}
+
+// InZone keeps only the records that belong to zone.
+func InZone(zone string, records []dnszone.Record) []dnszone.Record {
+	var result []dnszone.Record
+	for _, r := range records {
+		if dns.IsSubDomain(dns.Fqdn(zone), dns.Fqdn(r.Name)) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// Reconcile compares the zone at the provider against desired, describes
+// the differences to w, and applies them unless dry_run is set.
+func Reconcile(ctx context.Context, p Provider, zone string, desired []dnszone.Record, dry_run bool, w io.Writer) ([]Change, error) {
+	existing, err := p.List(ctx, zone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records in %s: %w", zone, err)
+	}
+	changes := Plan(existing, InZone(zone, desired))
+	for _, c := range changes {
+		fmt.Fprintln(w, c)
+	}
+	if dry_run {
+		return changes, nil
+	}
+	for _, c := range changes {
+		switch c.Action {
+		case ActionCreate:
+			err = p.Create(ctx, zone, c.New)
+		case ActionUpdate:
+			err = p.Update(ctx, zone, c.Old, c.New)
+		case ActionDelete:
+			err = p.Delete(ctx, zone, c.Old)
+		}
+		if err != nil {
+			return changes, fmt.Errorf("failed to apply change:\n%s\n%w", c, err)
+		}
+	}
+	return changes, nil
+}
+
+// relative_name strips zone from name, returning "" for the zone apex. It's
+// used by providers whose APIs take names relative to the zone.
+func relative_name(name string, zone string) string {
+	name = strings.TrimSuffix(strings.ToLower(dns.Fqdn(name)), ".")
+	zone = strings.TrimSuffix(strings.ToLower(dns.Fqdn(zone)), ".")
+	if name == zone {
+		return ""
+	}
+	return strings.TrimSuffix(name, "."+zone)
+}
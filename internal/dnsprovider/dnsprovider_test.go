@@ -0,0 +1,109 @@
+package dnsprovider
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"bytes"
+	"context"
+	"testing"
+)
+
+const test_zone = "example.org"
+
+func desired_zone(t *testing.T) []dnszone.Record {
+	t.Helper()
+	cfg := config.NewChatmailConfig("chat.example.org")
+	records, err := dnszone.Zone(cfg, dnszone.Options{IPv4: []string{"192.0.2.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func rec(name string, rtype string, value string) dnszone.Record {
+	return dnszone.Record{Name: name, Type: rtype, TTL: dnszone.DefaultTTL, Value: value}
+}
+
+// check_reconcile applies the desired zone to p, then checks that a second
+// run has nothing left to do.
+func check_reconcile(t *testing.T, p Provider) []Change {
+	t.Helper()
+	ctx := context.Background()
+	var out bytes.Buffer
+	changes, err := Reconcile(ctx, p, test_zone, desired_zone(t), false, &out)
+	if err != nil {
+		t.Fatalf("Reconcile() = %v; want nil\n%s", err, out.String())
+	}
+	again, err := Reconcile(ctx, p, test_zone, desired_zone(t), true, &out)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("second Reconcile() = %v, %v; want no changes", again, err)
+	}
+	return changes
+}
+
+func count_actions(changes []Change) map[Action]int {
+	counts := make(map[Action]int)
+	for _, c := range changes {
+		counts[c.Action] += 1
+	}
+	return counts
+}
+
+func TestPlanOnlyTouchesManagedRecords(t *testing.T) {
+	existing := []Record{
+		{"1", rec("chat.example.org.", "MX", "20 mail.elsewhere.example.")},
+		{"2", rec("chat.example.org.", "MX", "30 backup.elsewhere.example.")},
+		{"3", rec("chat.example.org.", "TXT", `"google-site-verification=abc"`)},
+		{"4", rec("chat.example.org.", "TXT", `"v=spf1 " "a ~all"`)},
+		{"5", rec("www.example.org.", "A", "198.51.100.7")},
+		{"6", rec("CHAT.example.org.", "A", "192.0.2.1")},
+	}
+	desired := []dnszone.Record{
+		rec("chat.example.org.", "A", "192.0.2.1"),
+		rec("chat.example.org.", "MX", "10 chat.example.org."),
+		rec("chat.example.org.", "TXT", `"v=spf1 a ~all"`),
+		rec("_dmarc.chat.example.org.", "TXT", `"v=DMARC1;p=reject;adkim=s;aspf=s"`),
+	}
+	changes := Plan(existing, desired)
+	want := []Change{
+		{ActionUpdate, existing[0], desired[1]},
+		{Action: ActionDelete, Old: existing[1]},
+		{Action: ActionCreate, New: desired[3]},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Plan() = %v; want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("Plan()[%d] = %v; want %v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestInZone(t *testing.T) {
+	records := []dnszone.Record{
+		rec("chat.example.org.", "A", "192.0.2.1"),
+		rec("chat.example.net.", "A", "192.0.2.1"),
+	}
+	got := InZone("example.org", records)
+	if len(got) != 1 || got[0] != records[0] {
+		t.Fatalf("InZone() = %v; want only the example.org record", got)
+	}
+}
+
+func TestFromEnvReportsMissingCredentials(t *testing.T) {
+	env := map[string]string{"PORKBUN_API_KEY": "pk1_x"}
+	_, err := FromEnv("porkbun", func(key string) string { return env[key] })
+	if err == nil {
+		t.Fatal("FromEnv() without PORKBUN_SECRET_API_KEY succeeded")
+	}
+	if _, err := FromEnv("carrier-pigeon", func(string) string { return "" }); err == nil {
+		t.Fatal("FromEnv() with an unknown provider succeeded")
+	}
+	env["PORKBUN_SECRET_API_KEY"] = "sk1_x"
+	p, err := FromEnv("Porkbun", func(key string) string { return env[key] })
+	if _, ok := p.(*Porkbun); err != nil || !ok {
+		t.Fatalf("FromEnv(\"Porkbun\") = %T, %v; want *Porkbun, nil", p, err)
+	}
+}
@@ -0,0 +1,66 @@
+package dnsprovider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type provider_constructor struct {
+	env []string
+	new func(env map[string]string) Provider
+}
+
+// Credentials are read from the environment rather than from chatmail.json,
+// so that they don't end up in backups or on the server.
+var providers = map[string]provider_constructor{
+	"cloudflare": {
+		[]string{"CLOUDFLARE_API_TOKEN"},
+		func(env map[string]string) Provider {
+			return NewCloudflare(env["CLOUDFLARE_API_TOKEN"])
+		},
+	},
+	"porkbun": {
+		[]string{"PORKBUN_API_KEY", "PORKBUN_SECRET_API_KEY"},
+		func(env map[string]string) Provider {
+			return NewPorkbun(env["PORKBUN_API_KEY"], env["PORKBUN_SECRET_API_KEY"])
+		},
+	},
+	"rfc2136": {
+		[]string{"RFC2136_SERVER", "RFC2136_TSIG_KEY", "RFC2136_TSIG_SECRET"},
+		func(env map[string]string) Provider {
+			return NewRFC2136(env["RFC2136_SERVER"], env["RFC2136_TSIG_KEY"], env["RFC2136_TSIG_SECRET"], env["RFC2136_TSIG_ALGORITHM"])
+		},
+	},
+}
+
+// Names lists the providers that FromEnv knows about.
+func Names() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FromEnv sets up the named provider with credentials from getenv.
+func FromEnv(name string, getenv func(string) string) (Provider, error) {
+	c, found := providers[strings.ToLower(name)]
+	if !found {
+		return nil, fmt.Errorf("unknown DNS provider %q (expected one of %s)", name, strings.Join(Names(), ", "))
+	}
+	env := make(map[string]string)
+	var missing []string
+	for _, key := range c.env {
+		env[key] = getenv(key)
+		if env[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the %s DNS provider needs these environment variables set: %s", name, strings.Join(missing, ", "))
+	}
+	env["RFC2136_TSIG_ALGORITHM"] = getenv("RFC2136_TSIG_ALGORITHM")
+	return c.new(env), nil
+}
@@ -0,0 +1,51 @@
+package dnsprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// do_json sends body (if any) as JSON and decodes the JSON response into out.
+// Non-2xx responses are errors, but their bodies are still decoded so that
+// callers can report the provider's own error messages.
+func do_json(ctx context.Context, client *http.Client, method string, url string, header http.Header, body any, out any) error {
+	var req_body io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		req_body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, req_body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+	if err != nil {
+		return err
+	}
+	decode_err := json.Unmarshal(data, out)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: HTTP %s", method, req.URL.Path, resp.Status)
+	}
+	if decode_err != nil {
+		return fmt.Errorf("%s %s: failed to decode response: %w", method, req.URL.Path, decode_err)
+	}
+	return nil
+}
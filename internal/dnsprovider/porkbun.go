@@ -0,0 +1,151 @@
+package dnsprovider
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const porkbun_base_url = "https://api.porkbun.com/api/json/v3"
+
+// Porkbun doesn't accept TTLs below 600 seconds.
+const porkbun_min_ttl = 600
+
+// Porkbun talks to the Porkbun v3 JSON API. API access has to be enabled
+// for the domain in Porkbun's control panel.
+type Porkbun struct {
+	APIKey       string
+	SecretAPIKey string
+	BaseURL      string
+	Client       *http.Client
+}
+
+func NewPorkbun(api_key string, secret_api_key string) *Porkbun {
+	return &Porkbun{api_key, secret_api_key, porkbun_base_url, http.DefaultClient}
+}
+
+type pb_record struct {
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     string `json:"ttl"`
+	Prio    string `json:"prio,omitempty"`
+}
+
+type pb_request struct {
+	APIKey       string `json:"apikey"`
+	SecretAPIKey string `json:"secretapikey"`
+	*pb_record
+}
+
+type pb_response struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Records []pb_record `json:"records"`
+}
+
+func (p *Porkbun) call(ctx context.Context, path string, record *pb_record) (pb_response, error) {
+	body := pb_request{p.APIKey, p.SecretAPIKey, record}
+	var resp pb_response
+	err := do_json(ctx, p.Client, http.MethodPost, p.BaseURL+path, nil, body, &resp)
+	if resp.Status != "" && resp.Status != "SUCCESS" {
+		return resp, errors.New("porkbun: " + resp.Message)
+	}
+	return resp, err
+}
+
+func domain_path(zone string) string {
+	return strings.TrimSuffix(strings.ToLower(zone), ".")
+}
+
+// to_porkbun converts a record for creating or editing, where Porkbun wants
+// the name relative to the zone.
+func to_porkbun(zone string, record dnszone.Record) (*pb_record, error) {
+	rr, err := record.RR()
+	if err != nil {
+		return nil, err
+	}
+	r := &pb_record{
+		Name: relative_name(record.Name, zone),
+		Type: record.Type,
+		TTL:  strconv.Itoa(int(max(record.TTL, porkbun_min_ttl))),
+	}
+	switch v := rr.(type) {
+	case *dns.MX:
+		r.Content = strings.TrimSuffix(v.Mx, ".")
+		r.Prio = strconv.Itoa(int(v.Preference))
+	case *dns.TXT:
+		r.Content = strings.Join(v.Txt, "")
+	case *dns.CNAME:
+		r.Content = strings.TrimSuffix(v.Target, ".")
+	case *dns.SRV:
+		r.Content = fmt.Sprintf("%d %d %s", v.Weight, v.Port, strings.TrimSuffix(v.Target, "."))
+		r.Prio = strconv.Itoa(int(v.Priority))
+	default:
+		r.Content = dnszone.RData(rr)
+	}
+	return r, nil
+}
+
+// from_porkbun converts a listed record, which Porkbun names in full.
+func from_porkbun(r pb_record) Record {
+	ttl, _ := strconv.Atoi(r.TTL)
+	value := r.Content
+	switch r.Type {
+	case "MX":
+		value = r.Prio + " " + dns.Fqdn(r.Content)
+	case "TXT":
+		value = dnszone.QuoteTXT(r.Content)
+	case "CNAME":
+		value = dns.Fqdn(r.Content)
+	case "SRV":
+		fields := strings.Fields(r.Content)
+		if len(fields) == 3 {
+			value = fmt.Sprintf("%s %s %s %s", r.Prio, fields[0], fields[1], dns.Fqdn(fields[2]))
+		}
+	}
+	return Record{r.ID, dnszone.Record{Name: dns.Fqdn(r.Name), Type: r.Type, TTL: uint32(ttl), Value: value}}
+}
+
+func (p *Porkbun) List(ctx context.Context, zone string) ([]Record, error) {
+	resp, err := p.call(ctx, "/dns/retrieve/"+domain_path(zone), nil)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(resp.Records))
+	for _, r := range resp.Records {
+		records = append(records, from_porkbun(r))
+	}
+	return records, nil
+}
+
+func (p *Porkbun) Create(ctx context.Context, zone string, record dnszone.Record) error {
+	body, err := to_porkbun(zone, record)
+	if err != nil {
+		return err
+	}
+	_, err = p.call(ctx, "/dns/create/"+domain_path(zone), body)
+	return err
+}
+
+func (p *Porkbun) Update(ctx context.Context, zone string, old Record, record dnszone.Record) error {
+	body, err := to_porkbun(zone, record)
+	if err != nil {
+		return err
+	}
+	_, err = p.call(ctx, "/dns/edit/"+domain_path(zone)+"/"+old.ID, body)
+	return err
+}
+
+func (p *Porkbun) Delete(ctx context.Context, zone string, record Record) error {
+	_, err := p.call(ctx, "/dns/delete/"+domain_path(zone)+"/"+record.ID, nil)
+	return err
+}
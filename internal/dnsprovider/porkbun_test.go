@@ -0,0 +1,136 @@
+package dnsprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fake_porkbun is a stand-in for the DNS part of the Porkbun API. Like the
+// real thing, it takes relative names when creating records and returns full
+// names when listing them.
+type fake_porkbun struct {
+	mu      sync.Mutex
+	next_id int
+	records map[string]pb_record
+}
+
+func (f *fake_porkbun) add(r pb_record) pb_record {
+	f.next_id += 1
+	r.ID = strconv.Itoa(f.next_id)
+	if r.Name == "" {
+		r.Name = test_zone
+	} else {
+		r.Name += "." + test_zone
+	}
+	f.records[r.ID] = r
+	return r
+}
+
+func (f *fake_porkbun) handler(t *testing.T) http.Handler {
+	reply := func(w http.ResponseWriter, resp map[string]any) {
+		if resp["status"] == nil {
+			resp["status"] = "SUCCESS"
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /dns/retrieve/example.org", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]int, 0, len(f.records))
+		for id := range f.records {
+			n, _ := strconv.Atoi(id)
+			ids = append(ids, n)
+		}
+		sort.Ints(ids)
+		records := []pb_record{}
+		for _, id := range ids {
+			records = append(records, f.records[strconv.Itoa(id)])
+		}
+		reply(w, map[string]any{"records": records})
+	})
+	mux.HandleFunc("POST /dns/create/example.org", func(w http.ResponseWriter, r *http.Request) {
+		var rec pb_record
+		json.NewDecoder(r.Body).Decode(&rec)
+		ttl, _ := strconv.Atoi(rec.TTL)
+		if ttl < porkbun_min_ttl {
+			reply(w, map[string]any{"status": "ERROR", "message": "TTL too low"})
+			return
+		}
+		reply(w, map[string]any{"id": f.add(rec).ID})
+	})
+	mux.HandleFunc("POST /dns/edit/example.org/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var rec pb_record
+		json.NewDecoder(r.Body).Decode(&rec)
+		rec.ID = r.PathValue("id")
+		rec.Name += "." + test_zone
+		f.records[rec.ID] = rec
+		reply(w, map[string]any{})
+	})
+	mux.HandleFunc("POST /dns/delete/example.org/{id}", func(w http.ResponseWriter, r *http.Request) {
+		delete(f.records, r.PathValue("id"))
+		reply(w, map[string]any{})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		data, _ := io.ReadAll(r.Body)
+		var creds pb_request
+		json.Unmarshal(data, &creds)
+		if creds.APIKey != "pk1_test" || creds.SecretAPIKey != "sk1_test" {
+			reply(w, map[string]any{"status": "ERROR", "message": "Invalid API key."})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func new_fake_porkbun(t *testing.T) (*fake_porkbun, *Porkbun) {
+	fake := &fake_porkbun{records: make(map[string]pb_record)}
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+	p := NewPorkbun("pk1_test", "sk1_test")
+	p.BaseURL = server.URL
+	p.Client = server.Client()
+	return fake, p
+}
+
+func TestPorkbunReconcile(t *testing.T) {
+	fake, p := new_fake_porkbun(t)
+	unrelated := fake.add(pb_record{Name: "www", Type: "A", Content: "198.51.100.7", TTL: "600"})
+	fake.add(pb_record{Name: "_imaps._tcp.chat", Type: "SRV", Content: "1 993 chat.example.org", TTL: "600", Prio: "0"})
+	fake.add(pb_record{Name: "chat", Type: "MX", Content: "mx.elsewhere.example", TTL: "600", Prio: "10"})
+	fake.add(pb_record{Name: "chat", Type: "MX", Content: "mx2.elsewhere.example", TTL: "600", Prio: "20"})
+
+	changes := check_reconcile(t, p)
+	counts := count_actions(changes)
+	// 12 records in the zone, minus the SRV record that's already right and
+	// the MX record that gets updated.
+	if counts[ActionUpdate] != 1 || counts[ActionCreate] != 10 || counts[ActionDelete] != 1 {
+		t.Fatalf("Reconcile() changes = %v; want 1 update, 10 creations and 1 deletion", counts)
+	}
+	if fake.records[unrelated.ID] != unrelated {
+		t.Fatalf("Reconcile() changed an unrelated record: %v", fake.records[unrelated.ID])
+	}
+	for _, r := range fake.records {
+		if r.Type == "MX" && (r.Name != "chat.example.org" || r.Content != "chat.example.org" || r.Prio != "10") {
+			t.Fatalf("MX record = %v; want 10 chat.example.org", r)
+		}
+	}
+}
+
+func TestPorkbunReportsAPIErrors(t *testing.T) {
+	_, p := new_fake_porkbun(t)
+	p.SecretAPIKey = "wrong"
+	_, err := p.List(context.Background(), test_zone)
+	if err == nil || err.Error() != "porkbun: Invalid API key." {
+		t.Fatalf("List() with bad key = %v; want the Porkbun error message", err)
+	}
+}
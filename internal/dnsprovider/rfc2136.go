@@ -0,0 +1,113 @@
+package dnsprovider
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC2136 updates a zone on an authoritative server with dynamic updates
+// (RFC 2136) signed with TSIG (RFC 8945), and lists it with a zone transfer.
+type RFC2136 struct {
+	// Server is the host:port of the primary name server.
+	Server    string
+	KeyName   string
+	Secret    string
+	Algorithm string
+}
+
+func NewRFC2136(server string, key_name string, secret string, algorithm string) *RFC2136 {
+	if algorithm == "" {
+		algorithm = dns.HmacSHA256
+	}
+	return &RFC2136{server, dns.Fqdn(key_name), secret, dns.Fqdn(algorithm)}
+}
+
+func (p *RFC2136) tsig_secrets() map[string]string {
+	return map[string]string{p.KeyName: p.Secret}
+}
+
+func (p *RFC2136) sign(m *dns.Msg) {
+	m.SetTsig(p.KeyName, p.Algorithm, 300, time.Now().Unix())
+}
+
+func (p *RFC2136) List(ctx context.Context, zone string) ([]Record, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(zone))
+	p.sign(m)
+	t := &dns.Transfer{TsigSecret: p.tsig_secrets()}
+	envelopes, err := t.In(m, p.Server)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for env := range envelopes {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		for _, rr := range env.RR {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				continue
+			}
+			records = append(records, Record{Record: dnszone.FromRR(rr)})
+		}
+	}
+	return records, nil
+}
+
+func (p *RFC2136) send_update(ctx context.Context, m *dns.Msg) error {
+	p.sign(m)
+	client := &dns.Client{Net: "tcp", TsigSecret: p.tsig_secrets()}
+	resp, _, err := client.ExchangeContext(ctx, m, p.Server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server refused update: %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (p *RFC2136) Create(ctx context.Context, zone string, record dnszone.Record) error {
+	rr, err := record.RR()
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Insert([]dns.RR{rr})
+	return p.send_update(ctx, m)
+}
+
+// Update replaces the record in a single update message, so the change is
+// atomic on the server.
+func (p *RFC2136) Update(ctx context.Context, zone string, old Record, record dnszone.Record) error {
+	old_rr, err := old.RR()
+	if err != nil {
+		return err
+	}
+	rr, err := record.RR()
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Remove([]dns.RR{old_rr})
+	m.Insert([]dns.RR{rr})
+	return p.send_update(ctx, m)
+}
+
+func (p *RFC2136) Delete(ctx context.Context, zone string, record Record) error {
+	rr, err := record.RR()
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Remove([]dns.RR{rr})
+	return p.send_update(ctx, m)
+}
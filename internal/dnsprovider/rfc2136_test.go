@@ -0,0 +1,124 @@
+package dnsprovider
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/dnszone"
+
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	test_tsig_key    = "chatmail-test."
+	test_tsig_secret = "c2VjcmV0IGtleSBmb3IgdGVzdGluZyBvbmx5"
+)
+
+// fake_primary is an authoritative name server for the test zone that
+// accepts TSIG-signed zone transfers and dynamic updates.
+type fake_primary struct {
+	mu      sync.Mutex
+	records []dns.RR
+}
+
+func (f *fake_primary) soa() dns.RR {
+	rr, _ := dns.NewRR(test_zone + ". 3600 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 3600")
+	return rr
+}
+
+func (f *fake_primary) apply_update(req *dns.Msg) {
+	for _, rr := range req.Ns {
+		switch rr.Header().Class {
+		case dns.ClassINET:
+			f.records = append(f.records, rr)
+		case dns.ClassNONE:
+			kept := f.records[:0]
+			for _, have := range f.records {
+				same_name := dns.CanonicalName(have.Header().Name) == dns.CanonicalName(rr.Header().Name)
+				same_type := have.Header().Rrtype == rr.Header().Rrtype
+				if !(same_name && same_type && dnszone.RData(have) == dnszone.RData(rr)) {
+					kept = append(kept, have)
+				}
+			}
+			f.records = kept
+		}
+	}
+}
+
+func (f *fake_primary) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		resp.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(resp)
+		return
+	}
+	switch {
+	case req.Opcode == dns.OpcodeUpdate:
+		f.apply_update(req)
+	case req.Question[0].Qtype == dns.TypeAXFR:
+		resp.Answer = append([]dns.RR{f.soa()}, f.records...)
+		resp.Answer = append(resp.Answer, f.soa())
+	default:
+		resp.Rcode = dns.RcodeRefused
+	}
+	resp.SetTsig(test_tsig_key, dns.HmacSHA256, 300, int64(req.IsTsig().TimeSigned))
+	w.WriteMsg(resp)
+}
+
+func new_fake_primary(t *testing.T) (*fake_primary, string) {
+	t.Helper()
+	fake := &fake_primary{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          ln,
+		Handler:           fake,
+		TsigSecret:        map[string]string{test_tsig_key: test_tsig_secret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default filter turns away UPDATE messages.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return fake, ln.Addr().String()
+}
+
+func TestRFC2136Reconcile(t *testing.T) {
+	fake, addr := new_fake_primary(t)
+	for _, s := range []string{
+		"chat.example.org. 3600 IN MX 20 mx.elsewhere.example.",
+		"example.org. 3600 IN NS ns.example.org.",
+	} {
+		rr, _ := dns.NewRR(s)
+		fake.records = append(fake.records, rr)
+	}
+
+	p := NewRFC2136(addr, test_tsig_key, test_tsig_secret, "")
+	changes := check_reconcile(t, p)
+	counts := count_actions(changes)
+	if counts[ActionUpdate] != 1 || counts[ActionCreate] != 11 || counts[ActionDelete] != 0 {
+		t.Fatalf("Reconcile() changes = %v; want 1 update and 11 creations", counts)
+	}
+	// 12 chatmail records plus the NS record that was there before.
+	if len(fake.records) != 13 {
+		t.Fatalf("zone has %d records after Reconcile(); want 13", len(fake.records))
+	}
+}
+
+func TestRFC2136RequiresValidTSIG(t *testing.T) {
+	_, addr := new_fake_primary(t)
+	p := NewRFC2136(addr, test_tsig_key, "d3Jvbmcgc2VjcmV0", "")
+	err := p.Create(context.Background(), test_zone, rec("chat.example.org.", "A", "192.0.2.1"))
+	if err == nil {
+		t.Fatal("Create() with the wrong TSIG secret succeeded")
+	}
+}
@@ -0,0 +1,159 @@
+package dnszone
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTTL is used for every record chatmail asks for.
+const DefaultTTL = 3600
+
+// A single character-string in a TXT record can hold at most 255 bytes
+// (RFC 1035 section 3.3).
+const max_txt_string_len = 255
+
+// Record is a single DNS resource record in presentation format. Name is
+// always fully qualified with a trailing dot.
+type Record struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// String formats the record as a line of a BIND zone file.
+func (r Record) String() string {
+	return fmt.Sprintf("%s\t%d\tIN\t%s\t%s", r.Name, r.TTL, r.Type, r.Value)
+}
+
+// RR parses the record into its wire representation.
+func (r Record) RR() (dns.RR, error) {
+	return dns.NewRR(r.String())
+}
+
+// FromRR converts a parsed record back into presentation format.
+func FromRR(rr dns.RR) Record {
+	h := rr.Header()
+	return Record{
+		Name:  h.Name,
+		Type:  dns.TypeToString[h.Rrtype],
+		TTL:   h.Ttl,
+		Value: strings.TrimPrefix(rr.String(), h.String()),
+	}
+}
+
+// RData returns the presentation form of a record without its header, with
+// TXT strings joined back together the way they'll be interpreted.
+func RData(rr dns.RR) string {
+	if txt, ok := rr.(*dns.TXT); ok {
+		return strings.Join(txt.Txt, "")
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func fqdn_dot(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func quote_txt_string(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// QuoteTXT renders a TXT value in presentation format, split into as many
+// strings as it takes to fit the length limit.
+func QuoteTXT(value string) string {
+	var parts []string
+	for len(value) > max_txt_string_len {
+		parts = append(parts, quote_txt_string(value[:max_txt_string_len]))
+		value = value[max_txt_string_len:]
+	}
+	parts = append(parts, quote_txt_string(value))
+	return strings.Join(parts, " ")
+}
+
+// MTASTSPolicyID identifies the current MTA-STS policy. The policy only
+// depends on the domain name, so the ID does too.
+func MTASTSPolicyID(cm_config config.ChatmailConfig) string {
+	sum := sha256.Sum256([]byte(cm_config.MailFullyQualifiedDomainName))
+	return hex.EncodeToString(sum[:8])
+}
+
+// DKIMRecordName is where the public key for selector is published.
+func DKIMRecordName(cm_config config.ChatmailConfig, selector string) string {
+	return selector + "._domainkey." + fqdn_dot(cm_config.MailFullyQualifiedDomainName)
+}
+
+// Required lists the records that a chatmail server needs, apart from
+// address records (which depend on where it's deployed) and the DKIM keys
+// (which depend on what has been generated).
+func Required(cm_config config.ChatmailConfig) []Record {
+	fqdn := cm_config.MailFullyQualifiedDomainName
+	domain := fqdn_dot(fqdn)
+	rec := func(name string, rtype string, value string) Record {
+		return Record{name, rtype, DefaultTTL, value}
+	}
+	return []Record{
+		rec(domain, "MX", "10 "+domain),
+		rec(domain, "TXT", QuoteTXT("v=spf1 a ~all")),
+		rec("_dmarc."+domain, "TXT", QuoteTXT("v=DMARC1;p=reject;adkim=s;aspf=s")),
+		rec("_mta-sts."+domain, "TXT", QuoteTXT("v=STSv1; id="+MTASTSPolicyID(cm_config))),
+		rec("mta-sts."+domain, "CNAME", domain),
+		rec("_smtp._tls."+domain, "TXT", QuoteTXT("v=TLSRPTv1;rua=mailto:postmaster@"+fqdn)),
+		rec("_submission._tcp."+domain, "SRV", "0 1 587 "+domain),
+		rec("_submissions._tcp."+domain, "SRV", "0 1 465 "+domain),
+		rec("_imap._tcp."+domain, "SRV", "0 1 143 "+domain),
+		rec("_imaps._tcp."+domain, "SRV", "0 1 993 "+domain),
+		rec(domain, "CAA", `0 issue "letsencrypt.org"`),
+	}
+}
+
+// Options holds the deployment details that complete a zone.
+type Options struct {
+	IPv4     []string
+	IPv6     []string
+	DKIMKeys []dkim.Key
+}
+
+// Zone is the complete set of records for a chatmail server. This is the
+// source of truth for the DNS checker and for registrar automation.
+func Zone(cm_config config.ChatmailConfig, opts Options) ([]Record, error) {
+	domain := fqdn_dot(cm_config.MailFullyQualifiedDomainName)
+	var records []Record
+	for _, ip := range opts.IPv4 {
+		records = append(records, Record{domain, "A", DefaultTTL, ip})
+	}
+	for _, ip := range opts.IPv6 {
+		records = append(records, Record{domain, "AAAA", DefaultTTL, ip})
+	}
+	records = append(records, Required(cm_config)...)
+	for _, key := range opts.DKIMKeys {
+		value, err := key.TXTValue()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{DKIMRecordName(cm_config, key.Selector), "TXT", DefaultTTL, QuoteTXT(value)})
+	}
+	return records, nil
+}
+
+// WriteBIND writes records as a zone file snippet.
+func WriteBIND(w io.Writer, cm_config config.ChatmailConfig, records []Record) error {
+	_, err := fmt.Fprintf(w, "; DNS records for the chatmail server %s\n", cm_config.MailFullyQualifiedDomainName)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if _, err := fmt.Fprintln(w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package dnszone
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+	"github.com/s0ph0s-dog/gochatmail/internal/dkim"
+
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQuoteTXTSplitsLongValues(t *testing.T) {
+	if got := QuoteTXT(`say "hi"`); got != `"say \"hi\""` {
+		t.Fatalf("QuoteTXT() = %s; want %s", got, `"say \"hi\""`)
+	}
+	value := strings.Repeat("a", 255) + strings.Repeat("b", 255) + "c"
+	want := `"` + strings.Repeat("a", 255) + `" "` + strings.Repeat("b", 255) + `" "c"`
+	if got := QuoteTXT(value); got != want {
+		t.Fatalf("QuoteTXT() of 511 bytes = %s; want %s", got, want)
+	}
+}
+
+func TestZoneIncludesAddressesAndDKIM(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	keys, err := dkim.Generate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := Zone(cfg, Options{IPv4: []string{"192.0.2.1"}, IPv6: []string{"2001:db8::1"}, DKIMKeys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0] != (Record{"chat.example.", "A", DefaultTTL, "192.0.2.1"}) {
+		t.Fatalf("first record = %v; want the A record", records[0])
+	}
+	if records[1] != (Record{"chat.example.", "AAAA", DefaultTTL, "2001:db8::1"}) {
+		t.Fatalf("second record = %v; want the AAAA record", records[1])
+	}
+	rsa_dkim := records[len(records)-2]
+	if rsa_dkim.Name != "rsa._domainkey.chat.example." || rsa_dkim.Type != "TXT" {
+		t.Fatalf("RSA DKIM record = %v; want TXT at rsa._domainkey.chat.example.", rsa_dkim)
+	}
+	// A 2048-bit RSA key doesn't fit into one string.
+	if !strings.Contains(rsa_dkim.Value, `" "`) {
+		t.Fatalf("RSA DKIM record value = %s; want it split into several strings", rsa_dkim.Value)
+	}
+
+	var out bytes.Buffer
+	if err := WriteBIND(&out, cfg, records); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "chat.example.\t3600\tIN\tMX\t10 chat.example.\n") {
+		t.Fatalf("WriteBIND() output is missing the MX record:\n%s", out.String())
+	}
+}
@@ -0,0 +1,231 @@
+package invite
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownToken = errors.New("unknown invite token")
+	ErrExpired      = errors.New("invite token has expired")
+	ErrUsedUp       = errors.New("invite token has no uses left")
+)
+
+// TokenPasswordSeparator divides the invite token from the actual password
+// when someone sets up their first login by hand.
+const TokenPasswordSeparator = ":"
+
+var token_encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+type Token struct {
+	Token   string
+	Created time.Time
+	// Zero means the token never expires.
+	Expires time.Time
+	MaxUses int
+	Uses    int
+	Note    string
+}
+
+func (t Token) check(now time.Time) error {
+	if !t.Expires.IsZero() && !now.Before(t.Expires) {
+		return ErrExpired
+	}
+	if t.Uses >= t.MaxUses {
+		return ErrUsedUp
+	}
+	return nil
+}
+
+// Store keeps invite tokens in a JSON file. chatmaild redeems tokens while
+// cmdeploy and chatmail-website create and revoke them, so every operation
+// re-reads the file instead of caching it, and holds a lock on
+// <file>.lock while it does.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// locked runs fn while holding the Store's lock, both against other
+// goroutines and against other processes.
+func (s *Store) locked(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	// Readable by everyone, so that a lock file that root made doesn't keep
+	// chatmaild out; flock doesn't need write access.
+	f, err := os.OpenFile(s.path+".lock", os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lock_file(f); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+	return fn()
+}
+
+func (s *Store) load() ([]Token, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Token{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *Store) save(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".invites-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func find(tokens []Token, token string) int {
+	for i, t := range tokens {
+		if t.Token == token {
+			return i
+		}
+	}
+	return -1
+}
+
+// Create adds a new token that may be used max_uses times. A ttl of zero
+// makes a token that never expires.
+func (s *Store) Create(ttl time.Duration, max_uses int, note string) (Token, error) {
+	raw := make([]byte, 15)
+	if _, err := rand.Read(raw); err != nil {
+		return Token{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	t := Token{
+		Token:   token_encoding.EncodeToString(raw),
+		Created: now,
+		MaxUses: max_uses,
+		Note:    note,
+	}
+	if ttl > 0 {
+		t.Expires = now.Add(ttl)
+	}
+	err := s.locked(func() error {
+		tokens, err := s.load()
+		if err != nil {
+			return err
+		}
+		return s.save(append(tokens, t))
+	})
+	return t, err
+}
+
+func (s *Store) List() ([]Token, error) {
+	var tokens []Token
+	err := s.locked(func() error {
+		var err error
+		tokens, err = s.load()
+		return err
+	})
+	return tokens, err
+}
+
+// update runs fn on the token, and saves the tokens if it succeeds.
+func (s *Store) update(token string, fn func(tokens []Token, i int) ([]Token, error)) error {
+	return s.locked(func() error {
+		tokens, err := s.load()
+		if err != nil {
+			return err
+		}
+		i := find(tokens, token)
+		if i < 0 {
+			return ErrUnknownToken
+		}
+		if tokens, err = fn(tokens, i); err != nil {
+			return err
+		}
+		return s.save(tokens)
+	})
+}
+
+func (s *Store) Revoke(token string) error {
+	return s.update(token, func(tokens []Token, i int) ([]Token, error) {
+		return append(tokens[:i], tokens[i+1:]...), nil
+	})
+}
+
+// Check reports whether token could currently be redeemed, without using it.
+func (s *Store) Check(token string, now time.Time) error {
+	tokens, err := s.List()
+	if err != nil {
+		return err
+	}
+	i := find(tokens, token)
+	if i < 0 {
+		return ErrUnknownToken
+	}
+	return tokens[i].check(now)
+}
+
+// Redeem uses up one of the remaining uses of token.
+func (s *Store) Redeem(token string, now time.Time) error {
+	return s.update(token, func(tokens []Token, i int) ([]Token, error) {
+		if err := tokens[i].check(now); err != nil {
+			return nil, err
+		}
+		tokens[i].Uses += 1
+		return tokens, nil
+	})
+}
+
+// Unredeem gives back a use of token that Redeem took, when what it was
+// redeemed for didn't happen after all.
+func (s *Store) Unredeem(token string) error {
+	return s.update(token, func(tokens []Token, i int) ([]Token, error) {
+		if tokens[i].Uses > 0 {
+			tokens[i].Uses -= 1
+		}
+		return tokens, nil
+	})
+}
+
+// SplitPassword separates an invite token from a password of the form
+// "<token>:<password>". ok is false if there is no token prefix.
+func SplitPassword(password string) (token string, rest string, ok bool) {
+	token, rest, ok = strings.Cut(password, TokenPasswordSeparator)
+	if !ok || token == "" {
+		return "", password, false
+	}
+	return token, rest, true
+}
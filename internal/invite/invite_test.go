@@ -0,0 +1,134 @@
+package invite
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInviteTokenLifecycle(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "invites.json"))
+	tok, err := store.Create(time.Hour, 2, "for the book club")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if err := store.Check(tok.Token, now); err != nil {
+		t.Fatalf("Check() on fresh token = %v; want nil", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Redeem(tok.Token, now); err != nil {
+			t.Fatalf("Redeem() #%d = %v; want nil", i+1, err)
+		}
+	}
+	if err := store.Redeem(tok.Token, now); !errors.Is(err, ErrUsedUp) {
+		t.Fatalf("Redeem() past max uses = %v; want %v", err, ErrUsedUp)
+	}
+
+	tokens, err := store.List()
+	if err != nil || len(tokens) != 1 || tokens[0].Uses != 2 {
+		t.Fatalf("List() = %v, %v; want one token with 2 uses", tokens, err)
+	}
+
+	if err := store.Revoke(tok.Token); err != nil {
+		t.Fatalf("Revoke() = %v; want nil", err)
+	}
+	if err := store.Check(tok.Token, now); !errors.Is(err, ErrUnknownToken) {
+		t.Fatalf("Check() after revoke = %v; want %v", err, ErrUnknownToken)
+	}
+}
+
+func TestInviteTokenExpiry(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "invites.json"))
+	tok, err := store.Create(time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Redeem(tok.Token, tok.Expires.Add(time.Second)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Redeem() after expiry = %v; want %v", err, ErrExpired)
+	}
+
+	forever, err := store.Create(0, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Check(forever.Token, time.Now().AddDate(100, 0, 0)); err != nil {
+		t.Fatalf("Check() on non-expiring token = %v; want nil", err)
+	}
+}
+
+func TestSplitPassword(t *testing.T) {
+	token, rest, ok := SplitPassword("abcdef:hunter2:with:colons")
+	if !ok || token != "abcdef" || rest != "hunter2:with:colons" {
+		t.Fatalf("SplitPassword() = %q, %q, %t; want \"abcdef\", \"hunter2:with:colons\", true", token, rest, ok)
+	}
+	_, rest, ok = SplitPassword("no token here")
+	if ok || rest != "no token here" {
+		t.Fatalf("SplitPassword() without token = %q, %t; want original password, false", rest, ok)
+	}
+}
+
+func TestInviteTokenUnredeem(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "invites.json"))
+	tok, err := store.Create(0, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Redeem(tok.Token, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Unredeem(tok.Token); err != nil {
+		t.Fatalf("Unredeem() = %v; want nil", err)
+	}
+	if err := store.Redeem(tok.Token, time.Now()); err != nil {
+		t.Fatalf("Redeem() after Unredeem() = %v; want nil", err)
+	}
+	if err := store.Unredeem("bogus"); !errors.Is(err, ErrUnknownToken) {
+		t.Fatalf("Unredeem() of an unknown token = %v; want %v", err, ErrUnknownToken)
+	}
+}
+
+// Stores for the same file in different processes don't share a mutex, so
+// only the file lock keeps them from losing each other's changes.
+func TestInviteStoresShareFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invites.json")
+	const stores, redeems = 8, 25
+	tok, err := NewStore(path).Create(0, stores*redeems, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, stores)
+	for range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := NewStore(path)
+			if _, err := store.Create(0, 1, "another"); err != nil {
+				errs <- err
+				return
+			}
+			for range redeems {
+				if err := store.Redeem(tok.Token, time.Now()); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent Redeem() or Create() = %v; want nil", err)
+	}
+	tokens, err := NewStore(path).List()
+	if err != nil || len(tokens) != 1+stores {
+		t.Fatalf("List() = %d tokens, %v; want %d", len(tokens), err, 1+stores)
+	}
+	if err := NewStore(path).Redeem(tok.Token, time.Now()); !errors.Is(err, ErrUsedUp) {
+		t.Fatalf("Redeem() after %d concurrent ones = %v; want %v", stores*redeems, err, ErrUsedUp)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package invite
+
+import (
+	"os"
+)
+
+// lock_file is only implemented on Unix. Elsewhere, only the Store's own
+// mutex keeps changes from getting lost.
+func lock_file(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package invite
+
+import (
+	"os"
+	"syscall"
+)
+
+// lock_file takes an exclusive lock on f, waiting for other processes to
+// let go of it.
+func lock_file(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Levels are the names of the log levels, most verbose first.
+var Levels = []string{"debug", "info", "warn", "error"}
+
+// Formats are the names of the log output formats.
+var Formats = []string{"text", "json"}
+
+// salt_len is how many random bytes LoadSalt generates for a new salt.
+const salt_len = 32
+
+// ParseLevel turns one of Levels into a slog.Level.
+func ParseLevel(name string) (slog.Level, error) {
+	switch name {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (expected one of %s)", name, strings.Join(Levels, ", "))
+}
+
+// New makes a logger that writes to w in format, leaving out messages below
+// level, with every email address redacted.
+func New(w io.Writer, level string, format string, r *Redactor) (*slog.Logger, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected one of %s)", format, strings.Join(Formats, ", "))
+	}
+	return slog.New(NewRedactingHandler(h, r)), nil
+}
+
+// LoadSalt reads the salt for redacting addresses from path, and creates it
+// if it doesn't exist yet. The salt has to stay the same for the life of the
+// server, or the same address will look different in old and new logs.
+func LoadSalt(path string) ([]byte, error) {
+	salt, err := ReadSalt(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return salt, err
+	}
+	salt = make([]byte, salt_len)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		// Someone else just created it.
+		return ReadSalt(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(hex.EncodeToString(salt) + "\n")
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// ReadSalt reads a salt that LoadSalt created.
+func ReadSalt(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(salt) < salt_len/2 {
+		return nil, fmt.Errorf("%s: salt is too short", path)
+	}
+	return salt, nil
+}
+
+// address_pattern is deliberately loose: logging a few things that only look
+// like addresses in a less useful form is better than missing real ones.
+var address_pattern = regexp.MustCompile("[A-Za-z0-9.!#$%&'*+/=?^_`{|}~-]+@([A-Za-z0-9-]+(?:\\.[A-Za-z0-9-]+)*)")
+
+// Redactor replaces the local part of email addresses with a salted hash, so
+// that the log lines about one address can still be picked out without the
+// logs saying whose address it is. The domain is kept.
+type Redactor struct {
+	salt []byte
+}
+
+// NewRedactor makes a Redactor that hashes with salt. Without a salt, local
+// parts are removed altogether.
+func NewRedactor(salt []byte) *Redactor {
+	return &Redactor{salt: salt}
+}
+
+// Address redacts a single address.
+func (r *Redactor) Address(address string) string {
+	local, domain, found := strings.Cut(address, "@")
+	if !found {
+		return address
+	}
+	if r.salt == nil {
+		return "*@" + domain
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(strings.ToLower(local)))
+	return hex.EncodeToString(mac.Sum(nil)[:6]) + "@" + domain
+}
+
+// String redacts every address in s.
+func (r *Redactor) String(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return address_pattern.ReplaceAllStringFunc(s, r.Address)
+}
+
+func (r *Redactor) value(v slog.Value) slog.Value {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.StringValue(r.String(v.String()))
+	case slog.KindGroup:
+		attrs := slices.Clone(v.Group())
+		for i := range attrs {
+			attrs[i] = r.attr(attrs[i])
+		}
+		return slog.GroupValue(attrs...)
+	case slog.KindAny:
+		switch a := v.Any().(type) {
+		case error:
+			return slog.StringValue(r.String(a.Error()))
+		case []string:
+			redacted := make([]string, len(a))
+			for i, s := range a {
+				redacted[i] = r.String(s)
+			}
+			return slog.AnyValue(redacted)
+		default:
+			// There's no telling what's inside, so flatten it to the
+			// text form that can be checked.
+			return slog.StringValue(r.String(fmt.Sprintf("%+v", a)))
+		}
+	}
+	return v
+}
+
+func (r *Redactor) attr(a slog.Attr) slog.Attr {
+	return slog.Attr{Key: a.Key, Value: r.value(a.Value)}
+}
+
+type redacting_handler struct {
+	inner    slog.Handler
+	redactor *Redactor
+}
+
+// NewRedactingHandler redacts addresses in the message and attributes of
+// every record before passing it on to inner.
+func NewRedactingHandler(inner slog.Handler, r *Redactor) slog.Handler {
+	return redacting_handler{inner, r}
+}
+
+func (h redacting_handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h redacting_handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.String(record.Message), record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redactor.attr(a))
+		return true
+	})
+	return h.inner.Handle(ctx, redacted)
+}
+
+func (h redacting_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redactor.attr(a)
+	}
+	return redacting_handler{h.inner.WithAttrs(redacted), h.redactor}
+}
+
+func (h redacting_handler) WithGroup(name string) slog.Handler {
+	return redacting_handler{h.inner.WithGroup(name), h.redactor}
+}
@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactorAddress(t *testing.T) {
+	r := NewRedactor([]byte("0123456789abcdef"))
+	got := r.Address("alice@chat.example")
+	if strings.Contains(got, "alice") || !strings.HasSuffix(got, "@chat.example") {
+		t.Fatalf("Address() = %q; want the local part hashed and the domain kept", got)
+	}
+	if again := r.Address("Alice@chat.example"); again != got {
+		t.Fatalf("Address() of the same address in another case = %q; want %q", again, got)
+	}
+	if other := NewRedactor([]byte("fedcba9876543210")).Address("alice@chat.example"); other == got {
+		t.Fatalf("Address() with a different salt = %q; want something else", other)
+	}
+	if got := NewRedactor(nil).Address("alice@chat.example"); got != "*@chat.example" {
+		t.Fatalf("Address() without a salt = %q; want %q", got, "*@chat.example")
+	}
+}
+
+func TestRedactorString(t *testing.T) {
+	r := NewRedactor(nil)
+	tests := map[string]string{
+		"no addresses here": "no addresses here",
+		"rejecting login from bob.b+tag@chat.example: x":    "rejecting login from *@chat.example: x",
+		`"Bob" <bob@external.example>, carol@other.example`: `"Bob" <*@external.example>, *@other.example`,
+	}
+	for in, want := range tests {
+		if got := r.String(in); got != want {
+			t.Errorf("String(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
+
+type address_holder struct {
+	Address string
+}
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "json", NewRedactor([]byte("0123456789abcdef")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger = logger.With("account", "alice@chat.example").WithGroup("message")
+	logger.Debug("sending mail from alice@chat.example",
+		"to", []string{"bob@external.example"},
+		"err", errors.New("no thanks, carol@other.example"),
+		slog.Group("envelope", "from", "dave@chat.example"),
+		"holder", address_holder{"erin@chat.example"},
+		"size", 42,
+	)
+	out := buf.String()
+	for _, local := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if strings.Contains(out, local+"@") {
+			t.Errorf("log output contains %s's address: %s", local, out)
+		}
+	}
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log output isn't JSON: %v\n%s", err, out)
+	}
+	if size := record["message"].(map[string]any)["size"]; size != 42.0 {
+		t.Errorf("size = %v; want 42", size)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(os.Stderr, "loud", "text", NewRedactor(nil)); err == nil || !strings.Contains(err.Error(), "unknown log level") {
+		t.Errorf("New() with a bad level = %v; want an error", err)
+	}
+	if _, err := New(os.Stderr, "info", "xml", NewRedactor(nil)); err == nil || !strings.Contains(err.Error(), "unknown log format") {
+		t.Errorf("New() with a bad format = %v; want an error", err)
+	}
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "text", NewRedactor(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("quiet")
+	if buf.Len() != 0 {
+		t.Errorf("logger at warn level wrote an info message: %s", buf.String())
+	}
+}
+
+func TestLoadSalt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "log-salt")
+	salt, err := LoadSalt(path)
+	if err != nil || len(salt) != salt_len {
+		t.Fatalf("LoadSalt() of a new file = %x, %v; want %d bytes", salt, err, salt_len)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("salt file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+	again, err := LoadSalt(path)
+	if err != nil || !bytes.Equal(again, salt) {
+		t.Fatalf("LoadSalt() of an existing file = %x, %v; want %x", again, err, salt)
+	}
+
+	if err := os.WriteFile(path, []byte("abcd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSalt(path); err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Fatalf("ReadSalt() of a short salt = %v; want an error", err)
+	}
+}
@@ -0,0 +1,243 @@
+// Package metrics exposes counters and gauges in the Prometheus text
+// exposition format (version 0.0.4), which OpenMetrics scrapers read too.
+//
+// Label values have to be declared when a metric is registered, so there's
+// no way for anything that varies per user, like an address, to end up in
+// a label.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is what the exposition format is served as.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var name_pattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var label_pattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Counter only goes up.
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Set(n int64) {
+	g.value.Store(n)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+// CounterVec is a counter split by one label, which can only take the
+// values it was registered with.
+type CounterVec struct {
+	name     string
+	label    string
+	values   []string
+	counters []Counter
+}
+
+// With returns the counter for value. It panics if value wasn't declared,
+// since that's a programming mistake.
+func (v *CounterVec) With(value string) *Counter {
+	i := slices.Index(v.values, value)
+	if i < 0 {
+		panic(fmt.Sprintf("metrics: %q isn't a declared value of %s{%s}", value, v.name, v.label))
+	}
+	return &v.counters[i]
+}
+
+type sample struct {
+	label string
+	value string
+	n     float64
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples func() ([]sample, error)
+}
+
+// Registry holds the metrics that a program exposes.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	if !name_pattern.MatchString(m.name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", m.name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name == m.name {
+			panic(fmt.Sprintf("metrics: %s is registered twice", m.name))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Counter registers a counter. By convention, name ends in _total.
+func (r *Registry) Counter(name string, help string) *Counter {
+	c := &Counter{}
+	r.register(metric{name, help, "counter", func() ([]sample, error) {
+		return []sample{{n: float64(c.Value())}}, nil
+	}})
+	return c
+}
+
+// CounterVec registers a counter with one label that takes the given
+// values. Every value is exposed, even before it's been counted.
+func (r *Registry) CounterVec(name string, help string, label string, values ...string) *CounterVec {
+	if !label_pattern.MatchString(label) || strings.HasPrefix(label, "__") {
+		panic(fmt.Sprintf("metrics: invalid label name %q", label))
+	}
+	v := &CounterVec{name, label, values, make([]Counter, len(values))}
+	r.register(metric{name, help, "counter", func() ([]sample, error) {
+		samples := make([]sample, len(v.values))
+		for i, value := range v.values {
+			samples[i] = sample{v.label, value, float64(v.counters[i].Value())}
+		}
+		return samples, nil
+	}})
+	return v
+}
+
+// Gauge registers a gauge that the program sets.
+func (r *Registry) Gauge(name string, help string) *Gauge {
+	g := &Gauge{}
+	r.register(metric{name, help, "gauge", func() ([]sample, error) {
+		return []sample{{n: float64(g.Value())}}, nil
+	}})
+	return g
+}
+
+// GaugeFunc registers a gauge that's measured by calling f on every scrape.
+// If f fails, the gauge is left out of that scrape.
+func (r *Registry) GaugeFunc(name string, help string, f func() (float64, error)) {
+	r.register(metric{name, help, "gauge", func() ([]sample, error) {
+		n, err := f()
+		if err != nil {
+			return nil, err
+		}
+		return []sample{{n: n}}, nil
+	}})
+}
+
+func escape_help(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escape_label_value(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func format_value(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "+Inf"
+	case math.IsInf(n, -1):
+		return "-Inf"
+	case math.IsNaN(n):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(n, 'g', -1, 64)
+	}
+}
+
+// WriteText writes every metric in the text exposition format. Metrics whose
+// value can't be measured are skipped, and their errors returned once the
+// rest have been written.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	var errs []string
+	for _, m := range metrics {
+		samples, err := m.samples()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", m.name, err))
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, escape_help(m.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+		for _, s := range samples {
+			if s.label == "" {
+				fmt.Fprintf(&b, "%s %s\n", m.name, format_value(s.n))
+			} else {
+				fmt.Fprintf(&b, "%s{%s=\"%s\"} %s\n", m.name, s.label, escape_label_value(s.value), format_value(s.n))
+			}
+		}
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to measure %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Handler serves the registry's metrics to scrapers.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		var b strings.Builder
+		// A metric that can't be measured shouldn't hide all of the others,
+		// so the scrape still succeeds.
+		if err := r.WriteText(&b); err != nil {
+			log.Printf("metrics: %v", err)
+		}
+		io.WriteString(w, b.String())
+	})
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_requests_total", "Requests handled.")
+	v := r.CounterVec("test_results_total", "Results, by \"kind\".\nSecond line.", "kind", "good", "bad")
+	g := r.Gauge("test_open", "Open things.")
+	r.GaugeFunc("test_measured", "Something measured.", func() (float64, error) { return 2.5, nil })
+	r.GaugeFunc("test_broken", "Something that can't be measured.", func() (float64, error) { return 0, errors.New("broken") })
+
+	c.Add(3)
+	v.With("bad").Inc()
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	var b strings.Builder
+	err := r.WriteText(&b)
+	if err == nil || !strings.Contains(err.Error(), "test_broken: broken") {
+		t.Fatalf("WriteText() = %v; want error about test_broken", err)
+	}
+	want := `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total 3
+# HELP test_results_total Results, by "kind".\nSecond line.
+# TYPE test_results_total counter
+test_results_total{kind="good"} 0
+test_results_total{kind="bad"} 1
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 1
+# HELP test_measured Something measured.
+# TYPE test_measured gauge
+test_measured 2.5
+`
+	if b.String() != want {
+		t.Fatalf("WriteText() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func expect_panic(t *testing.T, what string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s didn't panic", what)
+		}
+	}()
+	f()
+}
+
+func TestUndeclaredValuesPanic(t *testing.T) {
+	r := NewRegistry()
+	v := r.CounterVec("test_total", "Test.", "result", "ok")
+	expect_panic(t, "With() with an undeclared value", func() { v.With("someone@chat.example") })
+	expect_panic(t, "registering a metric twice", func() { r.Counter("test_total", "Test.") })
+	expect_panic(t, "registering a bad metric name", func() { r.Counter("test-total", "Test.") })
+	expect_panic(t, "registering a bad label name", func() { r.CounterVec("test2_total", "Test.", "__name", "x") })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Test.").Inc()
+	server := httptest.NewServer(r.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != ContentType {
+		t.Fatalf("GET = %d, %q; want 200, %q", resp.StatusCode, resp.Header.Get("Content-Type"), ContentType)
+	}
+
+	resp, err = http.Post(server.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST = %d; want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
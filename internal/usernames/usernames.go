@@ -0,0 +1,166 @@
+// Package usernames decides which local parts may be registered as new
+// accounts, so that nobody can claim postmaster@, one of the operator's
+// own addresses, or something that only looks like them.
+package usernames
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrReserved   = errors.New("username is reserved")
+	ErrNotASCII   = errors.New("username has to be ASCII")
+	ErrConfusable = errors.New("username can be mistaken for another one")
+)
+
+// Check returns nil if localpart may be registered on the server that
+// cm_config describes. It checks the RFC 2142 role names, the local parts
+// of the server's own passthrough and operator addresses, and
+// ReservedUsernames. When AllowUnicodeUsernames is on, it also refuses names
+// that mix scripts, and names whose Skeleton is reserved or already taken
+// according to exists, which may be nil.
+func Check(cm_config config.ChatmailConfig, localpart string, exists func(localpart string) (bool, error)) error {
+	name := strings.ToLower(localpart)
+	if is_reserved(cm_config, name) {
+		return ErrReserved
+	}
+	if !cm_config.AllowUnicodeUsernames {
+		if !is_ascii(name) {
+			return ErrNotASCII
+		}
+		return nil
+	}
+	if mixes_scripts(name) {
+		return ErrConfusable
+	}
+	skeleton := Skeleton(name)
+	if skeleton == name {
+		return nil
+	}
+	if is_reserved(cm_config, skeleton) {
+		return ErrConfusable
+	}
+	if exists != nil {
+		taken, err := exists(skeleton)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConfusable
+		}
+	}
+	return nil
+}
+
+// is_reserved reports whether the lowercase name is a role account, the
+// local part of one of the server's own special addresses, or matches one of
+// the ReservedUsernames patterns.
+func is_reserved(cm_config config.ChatmailConfig, name string) bool {
+	if slices.Contains(config.RoleAccounts, name) {
+		return true
+	}
+	own := slices.Concat(cm_config.PassthroughSendersList, cm_config.PassthroughRecipientsList, []string{cm_config.OperatorMailbox})
+	for _, address := range own {
+		local, domain, found := strings.Cut(address, "@")
+		if found && strings.EqualFold(domain, cm_config.MailFullyQualifiedDomainName) && strings.ToLower(local) == name {
+			return true
+		}
+	}
+	for _, pattern := range cm_config.ReservedUsernames {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func is_ascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Scripts can be mixed in these combinations, because that's how Japanese,
+// Chinese and Korean are written (UTS #39's "highly restrictive" level).
+var script_combinations = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// mixes_scripts reports whether name has letters from scripts that aren't
+// normally written together, like a Cyrillic а among Latin letters.
+func mixes_scripts(name string) bool {
+	var scripts []string
+	for _, r := range name {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for script, table := range unicode.Scripts {
+			if script != "Common" && script != "Inherited" && unicode.Is(table, r) && !slices.Contains(scripts, script) {
+				scripts = append(scripts, script)
+			}
+		}
+	}
+	if len(scripts) <= 1 {
+		return false
+	}
+	for _, allowed := range script_combinations {
+		if !slices.ContainsFunc(scripts, func(s string) bool { return !slices.Contains(allowed, s) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// confusables maps characters to the ASCII letter that they look like. It's
+// the part of the Unicode confusables table that matters for lowercase
+// local parts, not all of it.
+var confusables = map[rune]rune{
+	// ASCII digits that look like letters.
+	'0': 'o', '1': 'l',
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i',
+	'ј': 'j', 'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'ԛ': 'q', 'г': 'r', 'ѕ': 's', 'ѵ': 'v', 'ԝ': 'w',
+	'х': 'x', 'у': 'y', 'с': 'c', 'ԁ': 'd',
+	// Greek.
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y', 'ω': 'w',
+	// Latin letters that look like other Latin letters.
+	'ı': 'i', 'ɩ': 'i', 'ȷ': 'j', 'ɑ': 'a', 'ɒ': 'a', 'ℓ': 'l', 'ʟ': 'l',
+	'ɪ': 'i', 'ʀ': 'r', 'ꜱ': 's', 'ᴠ': 'v', 'ᴡ': 'w', 'ᴢ': 'z', 'ᴏ': 'o',
+	'ɡ': 'g',
+}
+
+// Skeleton maps the lowercase name to the ASCII string that it looks like,
+// so that names that can be mistaken for each other have the same skeleton.
+// Combining marks are dropped, fullwidth letters are narrowed, and rn and vv
+// become m and w.
+func Skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case r >= 'ａ' && r <= 'ｚ':
+			r = 'a' + (r - 'ａ')
+		case r >= '０' && r <= '９':
+			r = '0' + (r - '０')
+		}
+		if c, found := confusables[r]; found {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return strings.NewReplacer("rn", "m", "vv", "w").Replace(b.String())
+}
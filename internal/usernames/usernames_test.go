@@ -0,0 +1,84 @@
+package usernames
+
+import (
+	"github.com/s0ph0s-dog/gochatmail/internal/config"
+
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.PassthroughSendersList = []string{"bot@chat.example", "relay@other.example"}
+	cfg.OperatorMailbox = "ops@chat.example"
+	cfg.ReservedUsernames = []string{"admin*", "Staff-?"}
+	for _, tc := range []struct {
+		localpart string
+		want      error
+	}{
+		{"x7k2m9q4a", nil},
+		{"Postmaster", ErrReserved},
+		{"abuse", ErrReserved},
+		{"bot", ErrReserved},
+		{"relay", nil},
+		{"ops", ErrReserved},
+		{"administrator", ErrReserved},
+		{"staff-1", ErrReserved},
+		{"staff-12", nil},
+		{"pоstmaster", ErrNotASCII},
+	} {
+		if err := Check(cfg, tc.localpart, nil); !errors.Is(err, tc.want) {
+			t.Errorf("Check(%q) = %v; want %v", tc.localpart, err, tc.want)
+		}
+	}
+}
+
+func TestCheckUnicode(t *testing.T) {
+	cfg := config.NewChatmailConfig("chat.example")
+	cfg.AllowUnicodeUsernames = true
+	exists := func(localpart string) (bool, error) {
+		return localpart == "alice", nil
+	}
+	for _, tc := range []struct {
+		localpart string
+		want      error
+	}{
+		{"zoë", nil},
+		{"наташа", nil},
+		{"たなか太郎", nil},
+		{"pоstmaster", ErrConfusable},
+		{"ｐｏｓｔｍａｓｔｅｒ", ErrConfusable},
+		{"p0stmaster", ErrConfusable},
+		{"аdmin", ErrConfusable},
+		{"ɑlice", ErrConfusable},
+		{"а1ісе", ErrConfusable},
+		{"bob", nil},
+	} {
+		if err := Check(cfg, tc.localpart, exists); !errors.Is(err, tc.want) {
+			t.Errorf("Check(%q) = %v; want %v", tc.localpart, err, tc.want)
+		}
+	}
+
+	broken := errors.New("disk on fire")
+	if err := Check(cfg, "ɑlice", func(string) (bool, error) { return false, broken }); !errors.Is(err, broken) {
+		t.Errorf("Check() when exists fails = %v; want %v", err, broken)
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"paypal", "paypal"},
+		{"раураl", "paypal"},
+		{"adrnin", "admin"},
+		{"éve", "eve"},
+		{"ｗｗｗ", "www"},
+		{"vvebmaster", "webmaster"},
+	} {
+		if got := Skeleton(tc.name); got != tc.want {
+			t.Errorf("Skeleton(%q) = %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}